@@ -13,12 +13,14 @@ import (
 	"mizuserver/pkg/api"
 	"mizuserver/pkg/middleware"
 	"mizuserver/pkg/models"
+	"mizuserver/pkg/protobuf"
 	"mizuserver/pkg/routes"
 	"mizuserver/pkg/sensitiveDataFiltering"
 	"mizuserver/pkg/utils"
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 )
 
 var shouldTap = flag.Bool("tap", false, "Run in tapper mode without API")
@@ -26,6 +28,8 @@ var aggregator = flag.Bool("aggregator", false, "Run in aggregator mode with API
 var standalone = flag.Bool("standalone", false, "Run in standalone tapper and API mode")
 var aggregatorAddress = flag.String("aggregator-address", "", "Address of mizu collector for tapping")
 
+const tapperStatsPeriod = 10 * time.Second
+
 func main() {
 	flag.Parse()
 	hostMode := os.Getenv(shared.HostModeEnvVar) == "1"
@@ -36,6 +40,8 @@ func main() {
 	}
 
 	if *standalone {
+		loadProtobufDescriptors()
+		loadTLSKeyLogs()
 		harOutputChannel, outboundLinkOutputChannel := tap.StartPassiveTapper(tapOpts)
 		filteredHarChannel := make(chan *tap.OutputChannelItem)
 
@@ -55,6 +61,7 @@ func main() {
 			rlog.Infof("Filtering for the following authorities: %v", tap.GetFilterIPs())
 		}
 
+		loadTLSKeyLogs()
 		harOutputChannel, outboundLinkOutputChannel := tap.StartPassiveTapper(tapOpts)
 
 		socketConnection, err := shared.ConnectToSocketServer(*aggregatorAddress, shared.DEFAULT_SOCKET_RETRIES, shared.DEFAULT_SOCKET_RETRY_SLEEP_TIME, false)
@@ -63,8 +70,10 @@ func main() {
 		}
 
 		go pipeChannelToSocket(socketConnection, harOutputChannel)
+		go readAggregatorMessages(socketConnection)
 		go api.StartReadingOutbound(outboundLinkOutputChannel)
 	} else if *aggregator {
+		loadProtobufDescriptors()
 		socketHarOutChannel := make(chan *tap.OutputChannelItem, 1000)
 		filteredHarChannel := make(chan *tap.OutputChannelItem)
 
@@ -102,6 +111,8 @@ func hostApi(socketHarOutputChannel chan<- *tap.OutputChannelItem) {
 	routes.WebSocketRoutes(app, &eventHandlers)
 	routes.EntriesRoutes(app)
 	routes.MetadataRoutes(app)
+	routes.ProtobufRoutes(app)
+	routes.TLSRoutes(app)
 	routes.NotFoundRoute(app)
 
 	utils.StartServer(app)
@@ -131,6 +142,20 @@ func getTrafficFilteringOptions() *shared.TrafficFilteringOptions {
 	return &filteringOptions
 }
 
+// loadProtobufDescriptors decodes gRPC messages with the descriptor sets in the directory in the env var, which are reloaded as they change
+func loadProtobufDescriptors() {
+	if descriptorsDir := os.Getenv(shared.ProtobufDescriptorsDirEnvVar); descriptorsDir != "" {
+		go protobuf.WatchDescriptorSetsDir(descriptorsDir)
+	}
+}
+
+// loadTLSKeyLogs decrypts TLS connections with the key logs mounted at the path in the env var, which may be a file or a directory
+func loadTLSKeyLogs() {
+	if keyLogPath := os.Getenv(shared.TLSKeyLogPathEnvVar); keyLogPath != "" {
+		go tap.WatchTLSKeyLogFiles(keyLogPath)
+	}
+}
+
 var userAgentsToFilter = []string{"kube-probe", "prometheus"}
 
 func filterHarItems(inChannel <-chan *tap.OutputChannelItem, outChannel chan *tap.OutputChannelItem, filterOptions *shared.TrafficFilteringOptions) {
@@ -138,12 +163,14 @@ func filterHarItems(inChannel <-chan *tap.OutputChannelItem, outChannel chan *ta
 		if message.ConnectionInfo.IsOutgoing && api.CheckIsServiceIP(message.ConnectionInfo.ServerIP) {
 			continue
 		}
-		// TODO: move this to tappers https://up9.atlassian.net/browse/TRA-3441
-		if filterOptions.HideHealthChecks && isHealthCheckByUserAgent(message) {
-			continue
-		}
+		if message.HarEntry != nil {
+			// TODO: move this to tappers https://up9.atlassian.net/browse/TRA-3441
+			if filterOptions.HideHealthChecks && isHealthCheckByUserAgent(message) {
+				continue
+			}
 
-		sensitiveDataFiltering.FilterSensitiveInfoFromHarRequest(message, filterOptions)
+			sensitiveDataFiltering.FilterSensitiveInfoFromHarRequest(message, filterOptions)
+		}
 
 		outChannel <- message
 	}
@@ -172,17 +199,82 @@ func pipeChannelToSocket(connection *websocket.Conn, messageDataChannel <-chan *
 		panic("Channel of captured messages is nil")
 	}
 
-	for messageData := range messageDataChannel {
-		marshaledData, err := models.CreateWebsocketTappedEntryMessage(messageData)
-		if err != nil {
-			rlog.Infof("error converting message to json %s, (%v,%+v)\n", err, err, err)
-			continue
+	tapperStatsTicker := time.NewTicker(tapperStatsPeriod)
+	defer tapperStatsTicker.Stop()
+
+	// The stats are sent by the goroutine that sends the entries, as a websocket connection can't have concurrent writers
+	for {
+		select {
+		case messageData, ok := <-messageDataChannel:
+			if !ok {
+				return
+			}
+			marshaledData, err := models.CreateWebsocketTappedEntryMessage(messageData)
+			if err != nil {
+				rlog.Infof("error converting message to json %s, (%v,%+v)\n", err, err, err)
+				continue
+			}
+
+			err = connection.WriteMessage(websocket.TextMessage, marshaledData)
+			if err != nil {
+				rlog.Infof("error sending message through socket server %s, (%v,%+v)\n", err, err, err)
+				continue
+			}
+		case <-tapperStatsTicker.C:
+			sendTapperStats(connection)
 		}
+	}
+}
 
-		err = connection.WriteMessage(websocket.TextMessage, marshaledData)
+// sendTapperStats reports the items that the capture pipeline of the tapper dropped to the aggregator.
+func sendTapperStats(connection *websocket.Conn) {
+	queues := make([]shared.QueueStats, 0)
+	for _, queueStats := range tap.GetQueueStats() {
+		queues = append(queues, shared.QueueStats{
+			Stage:   queueStats.Stage,
+			Dropped: queueStats.Dropped,
+			Blocked: queueStats.Blocked,
+		})
+	}
+	tapperStats := shared.TapperStats{NodeName: os.Getenv(shared.NodeNameEnvVar), Queues: queues}
+	marshaledData, err := json.Marshal(shared.CreateWebSocketTapperStatsMessage(tapperStats))
+	if err != nil {
+		rlog.Infof("error converting tapper stats to json %s, (%v,%+v)\n", err, err, err)
+		return
+	}
+	if err := connection.WriteMessage(websocket.TextMessage, marshaledData); err != nil {
+		rlog.Infof("error sending tapper stats through socket server %s, (%v,%+v)\n", err, err, err)
+	}
+}
+
+// readAggregatorMessages handles the messages that the aggregator sends to tappers, which are the key logs uploaded to it.
+func readAggregatorMessages(connection *websocket.Conn) {
+	for {
+		_, data, err := connection.ReadMessage()
 		if err != nil {
-			rlog.Infof("error sending message through socket server %s, (%v,%+v)\n", err, err, err)
+			rlog.Infof("error reading message from socket server %s, (%v,%+v)\n", err, err, err)
+			return
+		}
+
+		var socketMessageBase shared.WebSocketMessageMetadata
+		if err := json.Unmarshal(data, &socketMessageBase); err != nil {
+			rlog.Infof("Could not unmarshal websocket message %v\n", err)
 			continue
 		}
+		switch socketMessageBase.MessageType {
+		case shared.WebSocketMessageTypeTLSKeyLog:
+			var keyLogMessage shared.WebSocketTLSKeyLogMessage
+			if err := json.Unmarshal(data, &keyLogMessage); err != nil {
+				rlog.Infof("Could not unmarshal message of message type %s %v\n", socketMessageBase.MessageType, err)
+				continue
+			}
+			if count, err := tap.AddTLSKeyLog([]byte(keyLogMessage.KeyLog)); err != nil {
+				rlog.Infof("Could not add TLS key log %v\n", err)
+			} else {
+				rlog.Debugf("Added %d TLS secrets", count)
+			}
+		default:
+			rlog.Infof("Received socket message of type %s for which no handlers are defined", socketMessageBase.MessageType)
+		}
 	}
 }
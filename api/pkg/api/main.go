@@ -19,6 +19,7 @@ import (
 
 	"mizuserver/pkg/database"
 	"mizuserver/pkg/models"
+	"mizuserver/pkg/protobuf"
 	"mizuserver/pkg/resolver"
 	"mizuserver/pkg/utils"
 )
@@ -94,7 +95,7 @@ func startReadingFiles(workingDir string) {
 				ServerPort: "",
 				IsOutgoing: false,
 			}
-			saveHarToDb(entry, connectionInfo)
+			saveHarToDb(&tap.HarEntry{Entry: entry}, connectionInfo, "")
 		}
 		rmErr := os.Remove(inputFilePath)
 		utils.CheckErr(rmErr)
@@ -107,22 +108,85 @@ func startReadingChannel(outputItems <-chan *tap.OutputChannelItem) {
 	}
 
 	for item := range outputItems {
-		saveHarToDb(item.HarEntry, item.ConnectionInfo)
+		if item.HarEntry != nil {
+			saveHarToDb(item.HarEntry, item.ConnectionInfo, item.StreamID)
+		} else if item.Entry != nil {
+			saveEntryToDb(item.Entry, item.ConnectionInfo, item.StreamID)
+		}
 	}
 }
 
 func StartReadingOutbound(outboundLinkChannel <-chan *tap.OutboundLink) {
-	// tcpStreamFactory will block on write to channel. Empty channel to unblock.
-	// TODO: Make write to channel optional.
+	// tcpStreamFactory waits for room when the channel is full, or drops outbound links with a drop overflow policy. Empty channel to unblock.
 	for range outboundLinkChannel {
 	}
 }
 
 
-func saveHarToDb(entry *har.Entry, connectionInfo *tap.ConnectionInfo) {
+func saveHarToDb(entry *tap.HarEntry, connectionInfo *tap.ConnectionInfo, streamId string) {
+	protobuf.DecodeGrpcHarEntry(entry.Entry)
 	entryBytes, _ := json.Marshal(entry)
 	serviceName, urlPath := getServiceNameFromUrl(entry.Request.URL)
-	entryId := primitive.NewObjectID().Hex()
+	resolvedSource, resolvedDestination, ok := resolveConnection(connectionInfo)
+	if !ok {
+		return
+	}
+
+	mizuEntry := models.MizuEntry{
+		EntryId:             primitive.NewObjectID().Hex(),
+		Entry:               string(entryBytes), // simple way to store it and not convert to bytes
+		Protocol:            tap.HTTPProtocolName,
+		Service:             serviceName,
+		Url:                 entry.Request.URL,
+		Path:                urlPath,
+		Method:              entry.Request.Method,
+		Status:              entry.Response.Status,
+		RequestSenderIp:     connectionInfo.ClientIP,
+		Timestamp:           entry.StartedDateTime.UnixNano() / int64(time.Millisecond),
+		ResolvedSource:      resolvedSource,
+		ResolvedDestination: resolvedDestination,
+		IsOutgoing:          connectionInfo.IsOutgoing,
+		StreamId:            streamId,
+	}
+	if grpcStatus := protobuf.GetGrpcStatus(entry.Entry); grpcStatus != nil {
+		mizuEntry.GrpcStatus = &grpcStatus.Code
+		mizuEntry.GrpcMessage = grpcStatus.Message
+	}
+	saveMizuEntry(&mizuEntry)
+}
+
+// saveEntryToDb stores the protocol-neutral entries of dissectors other than HTTP
+func saveEntryToDb(entry *tap.Entry, connectionInfo *tap.ConnectionInfo, streamId string) {
+	if entry.Protocol == tap.GrpcProtocolName {
+		protobuf.DecodeGrpcMessageEntry(entry)
+	}
+	entryBytes, _ := json.Marshal(entry)
+	serviceName := fmt.Sprintf("%s://%s", entry.Protocol, connectionInfo.ServerAddress())
+	resolvedSource, resolvedDestination, ok := resolveConnection(connectionInfo)
+	if !ok {
+		return
+	}
+
+	mizuEntry := models.MizuEntry{
+		EntryId:             primitive.NewObjectID().Hex(),
+		Entry:               string(entryBytes),
+		Protocol:            entry.Protocol,
+		Service:             serviceName,
+		Url:                 serviceName + "/" + strings.TrimPrefix(entry.Path, "/"),
+		Path:                entry.Path,
+		Method:              entry.Method,
+		Status:              entry.Status,
+		RequestSenderIp:     connectionInfo.ClientIP,
+		Timestamp:           entry.StartedDateTime.UnixNano() / int64(time.Millisecond),
+		ResolvedSource:      resolvedSource,
+		ResolvedDestination: resolvedDestination,
+		IsOutgoing:          connectionInfo.IsOutgoing,
+		StreamId:            streamId,
+	}
+	saveMizuEntry(&mizuEntry)
+}
+
+func resolveConnection(connectionInfo *tap.ConnectionInfo) (string, string, bool) {
 	var (
 		resolvedSource      string
 		resolvedDestination string
@@ -133,38 +197,27 @@ func saveHarToDb(entry *har.Entry, connectionInfo *tap.ConnectionInfo) {
 		if resolvedSource == "" {
 			rlog.Debugf("Cannot find resolved name to source: %s\n", unresolvedSource)
 			if os.Getenv("SKIP_NOT_RESOLVED_SOURCE") == "1" {
-				return
+				return "", "", false
 			}
 		}
-		unresolvedDestination := fmt.Sprintf("%s:%s", connectionInfo.ServerIP, connectionInfo.ServerPort)
+		unresolvedDestination := connectionInfo.ServerAddress()
 		resolvedDestination = k8sResolver.Resolve(unresolvedDestination)
 		if resolvedDestination == "" {
 			rlog.Debugf("Cannot find resolved name to dest: %s\n", unresolvedDestination)
 			if os.Getenv("SKIP_NOT_RESOLVED_DEST") == "1" {
-				return
+				return "", "", false
 			}
 		}
 	}
+	return resolvedSource, resolvedDestination, true
+}
 
-	mizuEntry := models.MizuEntry{
-		EntryId:             entryId,
-		Entry:               string(entryBytes), // simple way to store it and not convert to bytes
-		Service:             serviceName,
-		Url:                 entry.Request.URL,
-		Path:                urlPath,
-		Method:              entry.Request.Method,
-		Status:              entry.Response.Status,
-		RequestSenderIp:     connectionInfo.ClientIP,
-		Timestamp:           entry.StartedDateTime.UnixNano() / int64(time.Millisecond),
-		ResolvedSource:      resolvedSource,
-		ResolvedDestination: resolvedDestination,
-		IsOutgoing:          connectionInfo.IsOutgoing,
-	}
-	mizuEntry.EstimatedSizeBytes = getEstimatedEntrySizeBytes(mizuEntry)
-	database.CreateEntry(&mizuEntry)
+func saveMizuEntry(mizuEntry *models.MizuEntry) {
+	mizuEntry.EstimatedSizeBytes = getEstimatedEntrySizeBytes(*mizuEntry)
+	database.CreateEntry(mizuEntry)
 
 	baseEntry := models.BaseEntryDetails{}
-	if err := models.GetEntry(&mizuEntry, &baseEntry); err != nil {
+	if err := models.GetEntry(mizuEntry, &baseEntry); err != nil {
 		return
 	}
 	baseEntryBytes, _ := models.CreateBaseEntryWebSocketMessage(&baseEntry)
@@ -185,13 +238,19 @@ func CheckIsServiceIP(address string) bool {
 func getEstimatedEntrySizeBytes(mizuEntry models.MizuEntry) int {
 	sizeBytes := len(mizuEntry.Entry)
 	sizeBytes += len(mizuEntry.EntryId)
+	sizeBytes += len(mizuEntry.Protocol)
 	sizeBytes += len(mizuEntry.Service)
 	sizeBytes += len(mizuEntry.Url)
 	sizeBytes += len(mizuEntry.Method)
 	sizeBytes += len(mizuEntry.RequestSenderIp)
 	sizeBytes += len(mizuEntry.ResolvedDestination)
 	sizeBytes += len(mizuEntry.ResolvedSource)
+	sizeBytes += len(mizuEntry.StreamId)
+	sizeBytes += len(mizuEntry.GrpcMessage)
 	sizeBytes += 8 // Status bytes (sqlite integer is always 8 bytes)
+	if mizuEntry.GrpcStatus != nil {
+		sizeBytes += 8 // GrpcStatus bytes
+	}
 	sizeBytes += 8 // Timestamp bytes
 	sizeBytes += 8 // SizeBytes bytes
 	sizeBytes += 1 // IsOutgoing bytes
@@ -9,10 +9,14 @@ import (
 	"mizuserver/pkg/controllers"
 	"mizuserver/pkg/models"
 	"mizuserver/pkg/routes"
+	"mizuserver/pkg/tlskeylog"
 	"mizuserver/pkg/up9"
+	"sync"
 )
 
 var browserClientSocketUUIDs = make([]string, 0)
+var tapperClientSocketUUIDs = make([]string, 0)
+var tapperClientSocketUUIDsMutex sync.Mutex
 
 type RoutesEventHandlers struct {
 	routes.EventHandlers
@@ -21,11 +25,21 @@ type RoutesEventHandlers struct {
 
 func init() {
 	go up9.UpdateAnalyzeStatus(broadcastToBrowserClients)
+	tlskeylog.SetListener(sendTLSKeyLogToTappers)
 }
 
 func (h *RoutesEventHandlers) WebSocketConnect(ep *ikisocket.EventPayload) {
 	if ep.Kws.GetAttribute("is_tapper") == true {
 		rlog.Infof("Websocket Connection event - Tapper connected: %s", ep.SocketUUID)
+		tapperClientSocketUUIDsMutex.Lock()
+		tapperClientSocketUUIDs = append(tapperClientSocketUUIDs, ep.SocketUUID)
+		tapperClientSocketUUIDsMutex.Unlock()
+		// Tappers that connect later decrypt with the key logs that were uploaded before
+		if keyLog := tlskeylog.Get(); len(keyLog) > 0 {
+			if message, err := json.Marshal(shared.CreateWebSocketTLSKeyLogMessage(keyLog)); err == nil {
+				ep.Kws.Emit(message)
+			}
+		}
 	} else {
 		rlog.Infof("Websocket Connection event - Browser socket connected: %s", ep.SocketUUID)
 		browserClientSocketUUIDs = append(browserClientSocketUUIDs, ep.SocketUUID)
@@ -35,6 +49,7 @@ func (h *RoutesEventHandlers) WebSocketConnect(ep *ikisocket.EventPayload) {
 func (h *RoutesEventHandlers) WebSocketDisconnect(ep *ikisocket.EventPayload) {
 	if ep.Kws.GetAttribute("is_tapper") == true {
 		rlog.Infof("Disconnection event - Tapper connected: %s", ep.SocketUUID)
+		removeSocketUUIDFromTapperSlice(ep.SocketUUID)
 	} else {
 		rlog.Infof("Disconnection event - Browser socket connected: %s", ep.SocketUUID)
 		removeSocketUUIDFromBrowserSlice(ep.SocketUUID)
@@ -45,9 +60,22 @@ func broadcastToBrowserClients(message []byte) {
 	ikisocket.EmitToList(browserClientSocketUUIDs, message)
 }
 
+func sendTLSKeyLogToTappers(keyLog []byte) {
+	message, err := json.Marshal(shared.CreateWebSocketTLSKeyLogMessage(keyLog))
+	if err != nil {
+		rlog.Infof("Could not marshal TLS key log message %v\n", err)
+		return
+	}
+	tapperClientSocketUUIDsMutex.Lock()
+	uuids := append([]string(nil), tapperClientSocketUUIDs...)
+	tapperClientSocketUUIDsMutex.Unlock()
+	ikisocket.EmitToList(uuids, message)
+}
+
 func (h *RoutesEventHandlers) WebSocketClose(ep *ikisocket.EventPayload) {
 	if ep.Kws.GetAttribute("is_tapper") == true {
 		rlog.Infof("Websocket Close event - Tapper connected: %s", ep.SocketUUID)
+		removeSocketUUIDFromTapperSlice(ep.SocketUUID)
 	} else {
 		rlog.Infof("Websocket  Close event - Browser socket connected: %s", ep.SocketUUID)
 		removeSocketUUIDFromBrowserSlice(ep.SocketUUID)
@@ -82,6 +110,14 @@ func (h *RoutesEventHandlers) WebSocketMessage(ep *ikisocket.EventPayload) {
 				controllers.TapStatus = statusMessage.TappingStatus
 				broadcastToBrowserClients(ep.Data)
 			}
+		case shared.WebSocketMessageTypeTapperStats:
+			var tapperStatsMessage shared.WebSocketTapperStatsMessage
+			err := json.Unmarshal(ep.Data, &tapperStatsMessage)
+			if err != nil {
+				rlog.Infof("Could not unmarshal message of message type %s %v\n", socketMessageBase.MessageType, err)
+			} else {
+				controllers.SetTapperStats(tapperStatsMessage.TapperStats)
+			}
 		default:
 			rlog.Infof("Received socket message of type %s for which no handlers are defined", socketMessageBase.MessageType)
 		}
@@ -97,3 +133,16 @@ func removeSocketUUIDFromBrowserSlice(uuidToRemove string) {
 	}
 	browserClientSocketUUIDs = newUUIDSlice
 }
+
+func removeSocketUUIDFromTapperSlice(uuidToRemove string) {
+	tapperClientSocketUUIDsMutex.Lock()
+	defer tapperClientSocketUUIDsMutex.Unlock()
+
+	newUUIDSlice := make([]string, 0, len(tapperClientSocketUUIDs))
+	for _, uuid := range tapperClientSocketUUIDs {
+		if uuid != uuidToRemove {
+			newUUIDSlice = append(newUUIDSlice, uuid)
+		}
+	}
+	tapperClientSocketUUIDs = newUUIDSlice
+}
@@ -29,7 +29,11 @@ func GetEntries(c *fiber.Ctx) error {
 	order := database.OperatorToOrderMapping[entriesFilter.Operator]
 	operatorSymbol := database.OperatorToSymbolMapping[entriesFilter.Operator]
 	var entries []models.MizuEntry
-	database.GetEntriesTable().
+	query := database.GetEntriesTable()
+	if entriesFilter.GrpcStatus != nil {
+		query = query.Where("grpcStatus = ?", *entriesFilter.GrpcStatus)
+	}
+	query.
 		Order(fmt.Sprintf("timestamp %s", order)).
 		Where(fmt.Sprintf("timestamp %s %v", operatorSymbol, entriesFilter.Timestamp)).
 		Omit("entry"). // remove the "big" entry field
@@ -53,6 +57,27 @@ func GetEntries(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(baseEntries)
 }
 
+// GetStreamEntries returns the entries that belong to one stream, such as a gRPC call and each of its messages
+func GetStreamEntries(c *fiber.Ctx) error {
+	var entries []models.MizuEntry
+	database.GetEntriesTable().
+		Where("streamId = ?", c.Params("streamId")).
+		Order(fmt.Sprintf("timestamp %s", database.OrderAsc)).
+		Omit("entry"). // remove the "big" entry field
+		Find(&entries)
+
+	baseEntries := make([]models.BaseEntryDetails, 0)
+	for _, data := range entries {
+		baseEntry := models.BaseEntryDetails{}
+		if err := models.GetEntry(&data, &baseEntry); err != nil {
+			continue
+		}
+		baseEntries = append(baseEntries, baseEntry)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(baseEntries)
+}
+
 func GetHARs(c *fiber.Ctx) error {
 	entriesFilter := &models.HarFetchRequestBody{}
 	order := database.OrderDesc
@@ -91,6 +116,9 @@ func GetHARs(c *fiber.Ctx) error {
 	harsObject := map[string]*models.ExtendedHAR{}
 
 	for _, entryData := range entries {
+		if !entryData.IsHTTP() {
+			continue
+		}
 		var harEntry har.Entry
 		_ = json.Unmarshal([]byte(entryData.Entry), &harEntry)
 		if entryData.ResolvedDestination != "" {
@@ -205,8 +233,13 @@ func GetEntry(c *fiber.Ctx) error {
 		Where(map[string]string{"entryId": c.Params("entryId")}).
 		First(&entryData)
 
-	fullEntry := models.FullEntryDetails{}
-	if err := models.GetEntry(&entryData, &fullEntry); err != nil {
+	var fullEntry models.DataUnmarshaler
+	if entryData.IsHTTP() {
+		fullEntry = &models.FullEntryDetails{}
+	} else {
+		fullEntry = &models.GenericEntryDetails{}
+	}
+	if err := models.GetEntry(&entryData, fullEntry); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": true,
 			"msg":   "Can't get entry details",
@@ -0,0 +1,18 @@
+package controllers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"mizuserver/pkg/protobuf"
+)
+
+// UploadProtobufDescriptors registers the gRPC methods of a FileDescriptorSet sent as the request body
+func UploadProtobufDescriptors(c *fiber.Ctx) error {
+	count, err := protobuf.AddDescriptorSet(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"msg":   err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"methods": count})
+}
@@ -4,14 +4,40 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/up9inc/mizu/shared"
 	"mizuserver/pkg/up9"
+	"sort"
+	"sync"
 )
 
 var TapStatus shared.TapStatus
 
+// The latest stats of each tapper, by the name of its node
+var tappersStats = make(map[string]shared.TapperStats)
+var tappersStatsMutex sync.Mutex
+
 func GetTappingStatus(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(TapStatus)
 }
 
+func SetTapperStats(tapperStats shared.TapperStats) {
+	tappersStatsMutex.Lock()
+	defer tappersStatsMutex.Unlock()
+	tappersStats[tapperStats.NodeName] = tapperStats
+}
+
+func GetTappersStats(c *fiber.Ctx) error {
+	tappersStatsMutex.Lock()
+	stats := make([]shared.TapperStats, 0, len(tappersStats))
+	for _, tapperStats := range tappersStats {
+		stats = append(stats, tapperStats)
+	}
+	tappersStatsMutex.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].NodeName < stats[j].NodeName
+	})
+	return c.Status(fiber.StatusOK).JSON(stats)
+}
+
 func AnalyzeInformation(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(up9.GetAnalyzeInfo())
 }
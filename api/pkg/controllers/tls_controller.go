@@ -0,0 +1,18 @@
+package controllers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"mizuserver/pkg/tlskeylog"
+)
+
+// UploadTLSKeyLog adds the TLS secrets of a key log in the NSS format, sent as the request body, to every tapper
+func UploadTLSKeyLog(c *fiber.Ctx) error {
+	count, err := tlskeylog.Add(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"msg":   err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"secrets": count})
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/google/martian/har"
 	"github.com/up9inc/mizu/shared"
 	"github.com/up9inc/mizu/tap"
@@ -23,6 +24,7 @@ type MizuEntry struct {
 	UpdatedAt           time.Time
 	Entry               string `json:"entry,omitempty" gorm:"column:entry"`
 	EntryId             string `json:"entryId" gorm:"column:entryId"`
+	Protocol            string `json:"protocol" gorm:"column:protocol"`
 	Url                 string `json:"url" gorm:"column:url"`
 	Method              string `json:"method" gorm:"column:method"`
 	Status              int    `json:"status" gorm:"column:status"`
@@ -33,11 +35,20 @@ type MizuEntry struct {
 	ResolvedSource      string `json:"resolvedSource,omitempty" gorm:"column:resolvedSource"`
 	ResolvedDestination string `json:"resolvedDestination,omitempty" gorm:"column:resolvedDestination"`
 	IsOutgoing          bool   `json:"isOutgoing,omitempty" gorm:"column:isOutgoing"`
+	StreamId            string `json:"streamId,omitempty" gorm:"column:streamId;index"`
+	GrpcStatus          *int   `json:"grpcStatus,omitempty" gorm:"column:grpcStatus;index"`
+	GrpcMessage         string `json:"grpcMessage,omitempty" gorm:"column:grpcMessage"`
 	EstimatedSizeBytes           int `json:"-" gorm:"column:estimatedSizeBytes"`
 }
 
+// IsHTTP reports whether the entry holds a HAR entry. Entries stored before protocols were recorded are all HTTP.
+func (entry *MizuEntry) IsHTTP() bool {
+	return entry.Protocol == "" || entry.Protocol == tap.HTTPProtocolName
+}
+
 type BaseEntryDetails struct {
 	Id              string `json:"id,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
 	Url             string `json:"url,omitempty"`
 	RequestSenderIp string `json:"requestSenderIp,omitempty"`
 	Service         string `json:"service,omitempty"`
@@ -46,6 +57,9 @@ type BaseEntryDetails struct {
 	Method          string `json:"method,omitempty"`
 	Timestamp       int64  `json:"timestamp,omitempty"`
 	IsOutgoing      bool   `json:"isOutgoing,omitempty"`
+	StreamId        string `json:"streamId,omitempty"`
+	GrpcStatus      *int   `json:"grpcStatus,omitempty"`
+	GrpcMessage     string `json:"grpcMessage,omitempty"`
 }
 
 type FullEntryDetails struct {
@@ -56,6 +70,12 @@ type FullEntryDetailsExtra struct {
 	har.Entry
 }
 
+type GenericEntryDetails struct {
+	tap.Entry
+}
+
+var ErrNotHTTPEntry = errors.New("entry is not an HTTP entry")
+
 func (bed *BaseEntryDetails) UnmarshalData(entry *MizuEntry) error {
 	entryUrl := entry.Url
 	service := entry.Service
@@ -64,6 +84,7 @@ func (bed *BaseEntryDetails) UnmarshalData(entry *MizuEntry) error {
 		service = utils.SetHostname(service, entry.ResolvedDestination)
 	}
 	bed.Id = entry.EntryId
+	bed.Protocol = entry.Protocol
 	bed.Url = entryUrl
 	bed.Service = service
 	bed.Path = entry.Path
@@ -72,10 +93,16 @@ func (bed *BaseEntryDetails) UnmarshalData(entry *MizuEntry) error {
 	bed.Timestamp = entry.Timestamp
 	bed.RequestSenderIp = entry.RequestSenderIp
 	bed.IsOutgoing = entry.IsOutgoing
+	bed.StreamId = entry.StreamId
+	bed.GrpcStatus = entry.GrpcStatus
+	bed.GrpcMessage = entry.GrpcMessage
 	return nil
 }
 
 func (fed *FullEntryDetails) UnmarshalData(entry *MizuEntry) error {
+	if !entry.IsHTTP() {
+		return ErrNotHTTPEntry
+	}
 	if err := json.Unmarshal([]byte(entry.Entry), &fed.Entry); err != nil {
 		return err
 	}
@@ -87,6 +114,9 @@ func (fed *FullEntryDetails) UnmarshalData(entry *MizuEntry) error {
 }
 
 func (fedex *FullEntryDetailsExtra) UnmarshalData(entry *MizuEntry) error {
+	if !entry.IsHTTP() {
+		return ErrNotHTTPEntry
+	}
 	if err := json.Unmarshal([]byte(entry.Entry), &fedex.Entry); err != nil {
 		return err
 	}
@@ -101,15 +131,20 @@ func (fedex *FullEntryDetailsExtra) UnmarshalData(entry *MizuEntry) error {
 	return nil
 }
 
+func (ged *GenericEntryDetails) UnmarshalData(entry *MizuEntry) error {
+	return json.Unmarshal([]byte(entry.Entry), &ged.Entry)
+}
+
 type EntryData struct {
 	Entry               string `json:"entry,omitempty"`
 	ResolvedDestination string `json:"resolvedDestination,omitempty" gorm:"column:resolvedDestination"`
 }
 
 type EntriesFilter struct {
-	Limit     int    `query:"limit" validate:"required,min=1,max=200"`
-	Operator  string `query:"operator" validate:"required,oneof='lt' 'gt'"`
-	Timestamp int64  `query:"timestamp" validate:"required,min=1"`
+	Limit      int    `query:"limit" validate:"required,min=1,max=200"`
+	Operator   string `query:"operator" validate:"required,oneof='lt' 'gt'"`
+	Timestamp  int64  `query:"timestamp" validate:"required,min=1"`
+	GrpcStatus *int   `query:"grpcStatus" validate:"omitempty,min=0,max=16"`
 }
 
 type UploadEntriesRequestBody struct {
@@ -0,0 +1,243 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const grpcMessageHeaderLen = 5
+
+// Decompressed messages are at most as long as gRPC servers accept by default, so that small bodies can't decompress into huge ones
+const maxGrpcMessageLen = 4 * 1024 * 1024
+
+// undecodedMessage stands for a message that could not be decompressed or decoded, with its payload as it was captured.
+type undecodedMessage struct {
+	Note   string `json:"_note"`
+	Base64 string `json:"_base64"`
+}
+
+// DecodeGrpcBody decodes the length-prefixed messages of a gRPC request or response body into JSON.
+// The messages are decoded with the descriptors of grpcPath when they are known, and by their wire format otherwise.
+// A body with a single message becomes a JSON object, and a body with several messages a JSON array of objects.
+// grpcEncoding is the value of the grpc-encoding header, which applies to messages flagged as compressed.
+// A message that can't be decoded, e.g. compressed with an unsupported encoding, is kept as base64 with a note,
+// so that it doesn't prevent the other messages of the body from being decoded.
+func DecodeGrpcBody(body []byte, grpcPath string, isRequest bool, grpcEncoding string) ([]byte, error) {
+	messageType := getMessageType(grpcPath, isRequest)
+	messages := make([]json.RawMessage, 0)
+	for len(body) >= grpcMessageHeaderLen {
+		isCompressed := body[0] == 1
+		length := binary.BigEndian.Uint32(body[1:grpcMessageHeaderLen])
+		if uint64(len(body)-grpcMessageHeaderLen) < uint64(length) {
+			// The body is truncated when it is longer than what the tapper keeps
+			break
+		}
+		payload := body[grpcMessageHeaderLen : grpcMessageHeaderLen+int(length)]
+		body = body[grpcMessageHeaderLen+int(length):]
+
+		message, err := decodeGrpcMessage(payload, isCompressed, grpcEncoding, messageType)
+		if err != nil {
+			if message, err = json.Marshal(&undecodedMessage{Note: err.Error(), Base64: base64.StdEncoding.EncodeToString(payload)}); err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, message)
+	}
+
+	switch len(messages) {
+	case 0:
+		return nil, errors.New("no complete gRPC message in body")
+	case 1:
+		return messages[0], nil
+	}
+	return json.Marshal(messages)
+}
+
+func getMessageType(grpcPath string, isRequest bool) protoreflect.MessageDescriptor {
+	method := getMethod(grpcPath)
+	if method == nil {
+		return nil
+	}
+	if isRequest {
+		return method.Input()
+	}
+	return method.Output()
+}
+
+func decodeGrpcMessage(payload []byte, isCompressed bool, grpcEncoding string, messageType protoreflect.MessageDescriptor) (json.RawMessage, error) {
+	if isCompressed {
+		var err error
+		if payload, err = decompress(payload, grpcEncoding); err != nil {
+			return nil, err
+		}
+	}
+	return decodeMessage(payload, messageType)
+}
+
+func decompress(payload []byte, grpcEncoding string) ([]byte, error) {
+	var reader io.Reader
+	switch grpcEncoding {
+	case "identity":
+		// Flagged as compressed, though the encoding leaves it as it is
+		return payload, nil
+	case "gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		// deflate is the zlib format, though some implementations send a raw deflate stream
+		zlibReader, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			flateReader := flate.NewReader(bytes.NewReader(payload))
+			defer flateReader.Close()
+			reader = flateReader
+		} else {
+			defer zlibReader.Close()
+			reader = zlibReader
+		}
+	default:
+		return nil, fmt.Errorf("unsupported grpc-encoding %q", grpcEncoding)
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxGrpcMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxGrpcMessageLen {
+		return nil, fmt.Errorf("decompressed gRPC message is larger than %d bytes", maxGrpcMessageLen)
+	}
+	return decompressed, nil
+}
+
+func decodeMessage(payload []byte, messageType protoreflect.MessageDescriptor) (json.RawMessage, error) {
+	if messageType != nil {
+		message := dynamicpb.NewMessage(messageType)
+		if err := proto.Unmarshal(payload, message); err == nil {
+			return protojson.Marshal(message)
+		}
+		// The descriptors may be outdated, fall back to the wire format
+	}
+	fields, err := decodeWireFormat(payload, 0)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+const maxWireFormatDepth = 32
+
+/* decodeWireFormat decodes a protobuf message without its schema.
+ * Fields are keyed by their number, and repeated fields become arrays.
+ * Since the wire format does not tell strings, bytes and nested messages apart,
+ * length-delimited values are decoded as text when printable, then as nested messages when possible, and base64 encoded otherwise.
+ */
+func decodeWireFormat(b []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxWireFormatDepth {
+		return nil, errors.New("protobuf message is nested too deeply")
+	}
+
+	fields := make(map[string]interface{})
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var value interface{}
+		switch wireType {
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			value = v
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			value = v
+		case protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			value = v
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				value = decodeLengthDelimited(v, depth)
+			}
+		case protowire.StartGroupType:
+			var v []byte
+			v, n = protowire.ConsumeGroup(number, b)
+			if n >= 0 {
+				var err error
+				if value, err = decodeWireFormat(v, depth+1); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unexpected protobuf wire type %d", wireType)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		key := strconv.Itoa(int(number))
+		switch existing := fields[key].(type) {
+		case nil:
+			fields[key] = value
+		case []interface{}:
+			fields[key] = append(existing, value)
+		default:
+			fields[key] = []interface{}{existing, value}
+		}
+	}
+	return fields, nil
+}
+
+func decodeLengthDelimited(v []byte, depth int) interface{} {
+	// Tags of the first fields of a nested message are control characters, which text rarely contains
+	if isPrintable(v, false) {
+		return string(v)
+	}
+	if len(v) > 0 {
+		if nested, err := decodeWireFormat(v, depth+1); err == nil {
+			return nested
+		}
+	}
+	if isPrintable(v, true) {
+		return string(v)
+	}
+	return base64.StdEncoding.EncodeToString(v)
+}
+
+func isPrintable(v []byte, allowSpaces bool) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	for _, r := range string(v) {
+		if !unicode.IsPrint(r) && !(allowSpaces && unicode.IsSpace(r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package protobuf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// How often a directory of FileDescriptorSets is read again, as a mounted ConfigMap is updated in place
+const descriptorSetsPollPeriod = 10 * time.Second
+
+var (
+	methodsMutex sync.RWMutex
+	methods      = make(map[string]protoreflect.MethodDescriptor) // by gRPC path, e.g. /package.Service/Method
+)
+
+// AddDescriptorSet registers the service methods of a serialized FileDescriptorSet, as produced by
+// protoc --descriptor_set_out --include_imports, and returns how many methods it contains.
+// Methods that are already known are replaced, so an updated set can be uploaded again.
+func AddDescriptorSet(data []byte) (int, error) {
+	descriptorSet := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, descriptorSet); err != nil {
+		return 0, fmt.Errorf("invalid FileDescriptorSet: %w", err)
+	}
+	files, err := protodesc.NewFiles(descriptorSet)
+	if err != nil {
+		return 0, fmt.Errorf("unresolvable FileDescriptorSet: %w", err)
+	}
+
+	added := make(map[string]protoreflect.MethodDescriptor)
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			serviceMethods := services.Get(i).Methods()
+			for j := 0; j < serviceMethods.Len(); j++ {
+				method := serviceMethods.Get(j)
+				added[fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())] = method
+			}
+		}
+		return true
+	})
+
+	methodsMutex.Lock()
+	defer methodsMutex.Unlock()
+	for grpcPath, method := range added {
+		methods[grpcPath] = method
+	}
+	return len(added), nil
+}
+
+/* WatchDescriptorSetsDir registers every FileDescriptorSet in dir, e.g. the keys of a mounted ConfigMap,
+ * and registers them again whenever they change, so that an updated ConfigMap needs no restart. It never returns.
+ */
+func WatchDescriptorSetsDir(dir string) {
+	loaded := make(map[string][]byte) // the content of every file when it was last loaded, by path
+	for {
+		loadDescriptorSetsFromDir(dir, loaded)
+		time.Sleep(descriptorSetsPollPeriod)
+	}
+}
+
+// loadDescriptorSetsFromDir registers the FileDescriptorSets of dir that are not in loaded yet with the same content.
+func loadDescriptorSetsFromDir(dir string, loaded map[string][]byte) {
+	dirEntries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		rlog.Infof("Failed to read protobuf descriptors directory %s: %v", dir, err)
+		return
+	}
+	for _, dirEntry := range dirEntries {
+		// Mounted ConfigMaps also contain hidden directories and links used for atomic updates
+		if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		filePath := path.Join(dir, dirEntry.Name())
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			rlog.Infof("Failed to read protobuf descriptors file %s: %v", filePath, err)
+			continue
+		}
+		if previous, ok := loaded[filePath]; ok && bytes.Equal(previous, data) {
+			continue
+		}
+		loaded[filePath] = data
+		count, err := AddDescriptorSet(data)
+		if err != nil {
+			rlog.Infof("Failed to load protobuf descriptors file %s: %v", filePath, err)
+			continue
+		}
+		rlog.Infof("Loaded %d gRPC methods from %s", count, filePath)
+	}
+}
+
+func getMethod(grpcPath string) protoreflect.MethodDescriptor {
+	methodsMutex.RLock()
+	defer methodsMutex.RUnlock()
+	return methods[grpcPath]
+}
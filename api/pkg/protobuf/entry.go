@@ -0,0 +1,44 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/romana/rlog"
+	"github.com/up9inc/mizu/tap"
+)
+
+// DecodeGrpcMessageEntry decodes the message of an entry emitted for a single message of a gRPC call.
+func DecodeGrpcMessageEntry(entry *tap.Entry) {
+	// Entries received from tappers hold the message as a generic JSON object
+	messageBytes, err := json.Marshal(entry.Request)
+	if err != nil {
+		return
+	}
+	message := &tap.GrpcMessage{}
+	if err := json.Unmarshal(messageBytes, message); err != nil {
+		return
+	}
+	entry.Request = message
+	if message.Truncated {
+		return
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(message.Data)
+	if err != nil {
+		return
+	}
+	if message.Compressed {
+		// The grpc-encoding header is only part of the entry of the whole call, gzip is the common one
+		if payload, err = decompress(payload, "gzip"); err != nil {
+			rlog.Debugf("Failed to decompress gRPC message of %s: %v", entry.Path, err)
+			return
+		}
+	}
+	decoded, err := decodeMessage(payload, getMessageType(entry.Path, message.Direction == tap.GrpcRequestMessage))
+	if err != nil {
+		rlog.Debugf("Failed to decode gRPC message of %s: %v", entry.Path, err)
+		return
+	}
+	message.Message = decoded
+}
@@ -0,0 +1,110 @@
+package protobuf
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/google/martian/har"
+	"github.com/romana/rlog"
+)
+
+const decodedMimeType = "application/json"
+
+// DecodeGrpcHarEntry replaces the bodies of a gRPC HAR entry with their messages decoded into JSON,
+// and adds the decoded error details of the call to the response headers.
+// Bodies that cannot be decoded are left as they are.
+func DecodeGrpcHarEntry(entry *har.Entry) {
+	decodeGrpcStatusDetails(entry.Response)
+
+	request := entry.Request
+	if request.PostData == nil {
+		return
+	}
+	isConnectUnary := isConnectUnaryCall(request)
+	if !isConnectUnary && !isGrpcMimeType(request.PostData.MimeType) {
+		return
+	}
+	grpcPath := getGrpcPath(request)
+
+	if decoded, ok := decodeGrpcHarBody([]byte(request.PostData.Text), grpcPath, true, getGrpcEncoding(request.Headers), isConnectUnary); ok {
+		request.PostData.Text = string(decoded)
+		request.PostData.MimeType = decodedMimeType
+	}
+
+	response := entry.Response
+	if response.Content == nil || len(response.Content.Text) == 0 {
+		return
+	}
+	if isConnectUnary && response.Status != 200 {
+		// The body is a JSON error
+		return
+	}
+	if decoded, ok := decodeGrpcHarBody(response.Content.Text, grpcPath, false, getGrpcEncoding(response.Headers), isConnectUnary); ok {
+		response.Content.Text = decoded
+		response.Content.Size = int64(len(decoded))
+		response.Content.MimeType = decodedMimeType
+	}
+}
+
+func decodeGrpcHarBody(body []byte, grpcPath string, isRequest bool, grpcEncoding string, isBareMessage bool) ([]byte, bool) {
+	var decoded []byte
+	var err error
+	if isBareMessage {
+		decoded, err = decodeMessage(body, getMessageType(grpcPath, isRequest))
+	} else {
+		decoded, err = DecodeGrpcBody(body, grpcPath, isRequest, grpcEncoding)
+	}
+	if err != nil {
+		rlog.Debugf("Failed to decode gRPC messages of %s: %v", grpcPath, err)
+		return nil, false
+	}
+	return decoded, true
+}
+
+// isGrpcMimeType tells whether the messages of a body are protobuf encoded, which gRPC allows to be replaced by other codecs.
+// The bodies of gRPC-Web and Connect streaming calls were already unwrapped into the messages of native gRPC by the tapper.
+func isGrpcMimeType(mimeType string) bool {
+	switch strings.TrimSpace(strings.Split(mimeType, ";")[0]) {
+	case "application/grpc", "application/grpc+proto",
+		"application/grpc-web", "application/grpc-web+proto",
+		"application/grpc-web-text", "application/grpc-web-text+proto",
+		"application/connect+proto":
+		return true
+	}
+	return false
+}
+
+// isConnectUnaryCall tells whether a request is a Connect unary call with a protobuf message, whose bodies are bare messages.
+func isConnectUnaryCall(request *har.Request) bool {
+	mimeType := strings.TrimSpace(strings.Split(request.PostData.MimeType, ";")[0])
+	return mimeType == "application/proto" && getHeader(request.Headers, "connect-protocol-version") != ""
+}
+
+// getGrpcPath returns the path of a call, e.g. /package.Service/Method.
+// Only HTTP/2 requests have a :path header, HTTP/1 requests of gRPC-Web and Connect have it in their URL.
+func getGrpcPath(request *har.Request) string {
+	if grpcPath := getHeader(request.Headers, ":path"); grpcPath != "" {
+		return grpcPath
+	}
+	requestURL, err := url.Parse(request.URL)
+	if err != nil {
+		return ""
+	}
+	return requestURL.Path
+}
+
+func getGrpcEncoding(headers []har.Header) string {
+	if grpcEncoding := getHeader(headers, "grpc-encoding"); grpcEncoding != "" {
+		return grpcEncoding
+	}
+	return getHeader(headers, "connect-content-encoding")
+}
+
+func getHeader(headers []har.Header, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/martian/har"
+	"github.com/romana/rlog"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// StatusDetailsHeaderName holds the decoded grpc-status-details-bin trailer of a response, as JSON.
+const StatusDetailsHeaderName = "x-mizu-grpc-status-details"
+
+// GrpcStatus is the status of a gRPC call, which servers send in the trailers of the response.
+type GrpcStatus struct {
+	Code    int
+	Message string
+}
+
+// GetGrpcStatus returns the status of a gRPC HAR entry, or nil if its response has no grpc-status header or trailer.
+func GetGrpcStatus(entry *har.Entry) *GrpcStatus {
+	if entry.Response == nil {
+		return nil
+	}
+	headers := entry.Response.Headers
+	code, err := strconv.Atoi(getHeader(headers, "grpc-status"))
+	if err != nil {
+		return nil
+	}
+
+	// grpc-message is percent-encoded
+	message := getHeader(headers, "grpc-message")
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return &GrpcStatus{Code: code, Message: message}
+}
+
+// decodeGrpcStatusDetails adds the decoded grpc-status-details-bin trailer of a response to its headers.
+func decodeGrpcStatusDetails(response *har.Response) {
+	if response == nil {
+		return
+	}
+	value := getHeader(response.Headers, "grpc-status-details-bin")
+	if value == "" {
+		return
+	}
+
+	// Binary headers are base64 encoded, usually without padding
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		rlog.Debugf("Failed to decode grpc-status-details-bin: %v", err)
+		return
+	}
+	details, err := decodeStatus(data)
+	if err != nil {
+		rlog.Debugf("Failed to decode grpc-status-details-bin: %v", err)
+		return
+	}
+	response.Headers = append(response.Headers, har.Header{Name: StatusDetailsHeaderName, Value: string(details)})
+}
+
+/* decodeStatus decodes a google.rpc.Status message into JSON:
+ *   message Status { int32 code = 1; string message = 2; repeated google.protobuf.Any details = 3; }
+ * The details are decoded by their wire format, since the descriptors of error details are rarely uploaded.
+ */
+func decodeStatus(b []byte) ([]byte, error) {
+	status := struct {
+		Code    int32                    `json:"code"`
+		Message string                   `json:"message,omitempty"`
+		Details []map[string]interface{} `json:"details,omitempty"`
+	}{}
+
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case number == 1 && wireType == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			status.Code = int32(v)
+		case number == 2 && wireType == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			status.Message = string(v)
+		case number == 3 && wireType == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				detail, err := decodeAny(v)
+				if err != nil {
+					return nil, err
+				}
+				status.Details = append(status.Details, detail)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return json.Marshal(status)
+}
+
+// decodeAny decodes a google.protobuf.Any message { string type_url = 1; bytes value = 2; } like protojson does.
+func decodeAny(b []byte) (map[string]interface{}, error) {
+	detail := make(map[string]interface{})
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if wireType != protowire.BytesType || (number != 1 && number != 2) {
+			n = protowire.ConsumeFieldValue(number, wireType, b)
+		} else {
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if number == 1 {
+				detail["@type"] = string(v)
+			} else if value, err := decodeWireFormat(v, 0); err == nil {
+				detail["value"] = value
+			} else {
+				detail["value"] = base64.StdEncoding.EncodeToString(v)
+			}
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if _, ok := detail["@type"]; !ok {
+		return nil, errors.New("google.protobuf.Any without type_url")
+	}
+	return detail, nil
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/romana/rlog"
+	"net"
+	"strconv"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 
 	corev1 "k8s.io/api/core/v1"
@@ -67,6 +69,10 @@ func (resolver *Resolver) watchPods(ctx context.Context) error {
 				if event.Type == watch.Deleted {
 					pod := event.Object.(*corev1.Pod)
 					resolver.saveResolvedName(pod.Status.PodIP, "", event.Type)
+					// Pods of dual-stack clusters have an address of each family
+					for _, podIP := range pod.Status.PodIPs {
+						resolver.saveResolvedName(podIP.IP, "", event.Type)
+					}
 				}
 			case <- ctx.Done():
 				watcher.Stop()
@@ -103,7 +109,7 @@ func (resolver *Resolver) watchEndpoints(ctx context.Context) error {
 							for _, address := range subset.Addresses {
 								resolver.saveResolvedName(address.IP, serviceHostname, event.Type)
 								for _, port := range ports {
-									ipWithPort := fmt.Sprintf("%s:%d", address.IP, port)
+									ipWithPort := net.JoinHostPort(address.IP, strconv.Itoa(int(port)))
 									resolver.saveResolvedName(ipWithPort, serviceHostname, event.Type)
 								}
 							}
@@ -133,9 +139,16 @@ func (resolver *Resolver) watchServices(ctx context.Context) error {
 
 			service := event.Object.(*corev1.Service)
 			serviceHostname := fmt.Sprintf("%s.%s", service.Name, service.Namespace)
-			if service.Spec.ClusterIP != "" && service.Spec.ClusterIP != kubClientNullString {
-				resolver.saveResolvedName(service.Spec.ClusterIP, serviceHostname, event.Type)
-				resolver.saveServiceIP(service.Spec.ClusterIP, serviceHostname, event.Type)
+			// Services of dual-stack clusters have a cluster IP of each family
+			clusterIPs := service.Spec.ClusterIPs
+			if len(clusterIPs) == 0 {
+				clusterIPs = []string{service.Spec.ClusterIP}
+			}
+			for _, clusterIP := range clusterIPs {
+				if clusterIP != "" && clusterIP != kubClientNullString {
+					resolver.saveResolvedName(clusterIP, serviceHostname, event.Type)
+					resolver.saveServiceIP(clusterIP, serviceHostname, event.Type)
+				}
 			}
 			if service.Status.LoadBalancer.Ingress != nil {
 				for _, ingress := range service.Status.LoadBalancer.Ingress {
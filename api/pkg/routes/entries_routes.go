@@ -11,6 +11,7 @@ func EntriesRoutes(fiberApp *fiber.App) {
 
 	routeGroup.Get("/entries", controllers.GetEntries)        // get entries (base/thin entries)
 	routeGroup.Get("/entries/:entryId", controllers.GetEntry) // get single (full) entry
+	routeGroup.Get("/streams/:streamId", controllers.GetStreamEntries) // get the entries of a stream, e.g. a gRPC call and its messages
 	routeGroup.Get("/exportEntries", controllers.GetFullEntries)
 	routeGroup.Get("/uploadEntries", controllers.UploadEntries)
 	routeGroup.Get("/resolving", controllers.GetCurrentResolvingInformation)
@@ -21,5 +22,6 @@ func EntriesRoutes(fiberApp *fiber.App) {
 	routeGroup.Get("/generalStats", controllers.GetGeneralStats) // get general stats about entries in DB
 
 	routeGroup.Get("/tapStatus", controllers.GetTappingStatus) // get tapping status
+	routeGroup.Get("/tappersStats", controllers.GetTappersStats) // get the items that the capture pipeline of each tapper dropped
 	routeGroup.Get("/analyzeStatus", controllers.AnalyzeInformation)
 }
@@ -0,0 +1,13 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"mizuserver/pkg/controllers"
+)
+
+// ProtobufRoutes defines the group of protobuf descriptors routes.
+func ProtobufRoutes(fiberApp *fiber.App) {
+	routeGroup := fiberApp.Group("/api")
+
+	routeGroup.Post("/protobufDescriptors", controllers.UploadProtobufDescriptors) // upload a FileDescriptorSet for decoding gRPC messages
+}
@@ -0,0 +1,13 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"mizuserver/pkg/controllers"
+)
+
+// TLSRoutes defines the group of TLS decryption routes.
+func TLSRoutes(fiberApp *fiber.App) {
+	routeGroup := fiberApp.Group("/api")
+
+	routeGroup.Post("/tlsKeyLog", controllers.UploadTLSKeyLog) // upload an SSLKEYLOGFILE for decrypting TLS connections
+}
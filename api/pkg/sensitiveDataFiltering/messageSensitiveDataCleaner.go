@@ -33,6 +33,8 @@ func FilterSensitiveInfoFromHarRequest(harOutputItem *tap.OutputChannelItem, opt
 		filteredRequestBody, err := filterHttpBody([]byte(harOutputItem.HarEntry.Request.PostData.Text), requestContentType, options)
 		if err == nil {
 			harOutputItem.HarEntry.Request.PostData.Text = string(filteredRequestBody)
+		} else if isTruncated(harOutputItem.HarEntry.RequestDecoding) {
+			harOutputItem.HarEntry.Request.PostData.Text = ""
 		}
 	}
 	if harOutputItem.HarEntry.Response.Content != nil {
@@ -40,10 +42,17 @@ func FilterSensitiveInfoFromHarRequest(harOutputItem *tap.OutputChannelItem, opt
 		filteredResponseBody, err := filterHttpBody(harOutputItem.HarEntry.Response.Content.Text, responseContentType, options)
 		if err == nil {
 			harOutputItem.HarEntry.Response.Content.Text = filteredResponseBody
+		} else if isTruncated(harOutputItem.HarEntry.ResponseDecoding) {
+			harOutputItem.HarEntry.Response.Content.Text = nil
 		}
 	}
 }
 
+// isTruncated reports whether a body was cut when it was decoded. Its start can't be parsed to mask it, so it is dropped rather than kept unmasked.
+func isTruncated(decoding *tap.ContentDecoding) bool {
+	return decoding != nil && decoding.Truncated
+}
+
 func filterHarHeaders(headers []har.Header) []har.Header {
 	newHeaders := make([]har.Header, 0)
 	for i, header := range headers {
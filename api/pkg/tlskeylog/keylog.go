@@ -0,0 +1,61 @@
+package tlskeylog
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/up9inc/mizu/tap"
+)
+
+// Never keep more than maxKeyLogLen bytes of uploaded key logs, which are sent to every tapper that connects
+const maxKeyLogLen = 16 * 1024 * 1024
+
+var (
+	keyLog   []byte
+	listener func(keyLog []byte)
+	mutex    sync.Mutex
+)
+
+// SetListener sets the function that sends key logs to tappers as they are uploaded.
+func SetListener(f func(keyLog []byte)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	listener = f
+}
+
+// Add adds a key log in the NSS format, decrypting the TLS connections tapped by this process and by every tapper.
+// It returns how many lines held a secret.
+func Add(data []byte) (int, error) {
+	count, err := tap.AddTLSKeyLog(data)
+	if err != nil {
+		return 0, err
+	}
+	// The body of a request is reused once it is handled
+	data = append([]byte(nil), data...)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+
+	mutex.Lock()
+	keyLog = append(keyLog, data...)
+	if len(keyLog) > maxKeyLogLen {
+		// Drop the oldest lines
+		start := len(keyLog) - maxKeyLogLen
+		start += bytes.IndexByte(keyLog[start:], '\n') + 1
+		keyLog = append([]byte(nil), keyLog[start:]...)
+	}
+	notify := listener
+	mutex.Unlock()
+
+	if notify != nil {
+		notify(data)
+	}
+	return count, nil
+}
+
+// Get returns the key logs uploaded so far, for tappers that connect after they were uploaded.
+func Get() []byte {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return append([]byte(nil), keyLog...)
+}
@@ -25,6 +25,8 @@ type MizuTapOptions struct {
 	HideHealthChecks       bool
 	MaxEntriesDBSizeBytes  int64
 	SleepIntervalSec       uint16
+	ProtobufDescriptors    string
+	TLSKeyLogSecret        string
 }
 
 var mizuTapOptions = &MizuTapOptions{}
@@ -102,4 +104,6 @@ func init() {
 	tapCmd.Flags().StringVarP(&direction, "direction", "", "in", "Record traffic that goes in this direction (relative to the tapped pod): in/any")
 	tapCmd.Flags().BoolVar(&mizuTapOptions.HideHealthChecks, "hide-healthchecks", false, "hides requests with kube-probe or prometheus user-agent headers")
 	tapCmd.Flags().StringVarP(&humanMaxEntriesDBSize, maxEntriesDBSizeFlagName, "", "200MB", "override the default max entries db size of 200mb")
+	tapCmd.Flags().StringVar(&mizuTapOptions.ProtobufDescriptors, "protobuf-descriptors", "", "Name of a config map in the mizu namespace whose keys are FileDescriptorSets used for decoding gRPC messages")
+	tapCmd.Flags().StringVar(&mizuTapOptions.TLSKeyLogSecret, "tls-keylog-secret", "", "Name of a secret in the mizu namespace whose keys are TLS key log files (SSLKEYLOGFILE) used for decrypting tapped connections")
 }
@@ -40,8 +40,12 @@ type Provider struct {
 }
 
 const (
-	serviceAccountName = "mizu-service-account"
-	fieldManagerName   = "mizu-manager"
+	serviceAccountName            = "mizu-service-account"
+	fieldManagerName              = "mizu-manager"
+	protobufDescriptorsVolumeName = "protobuf-descriptors"
+	protobufDescriptorsMountPath  = "/app/protobuf-descriptors"
+	tlsKeyLogVolumeName           = "tls-keylog"
+	tlsKeyLogMountPath            = "/app/tls-keylog"
 )
 
 func NewProvider(kubeConfigPath string) *Provider {
@@ -72,7 +76,7 @@ func (provider *Provider) GetPodWatcher(ctx context.Context, namespace string) w
 	return watcher
 }
 
-func (provider *Provider) CreateMizuAggregatorPod(ctx context.Context, namespace string, podName string, podImage string, linkServiceAccount bool, mizuApiFilteringOptions *shared.TrafficFilteringOptions, maxEntriesDBSizeBytes int64) (*core.Pod, error) {
+func (provider *Provider) CreateMizuAggregatorPod(ctx context.Context, namespace string, podName string, podImage string, linkServiceAccount bool, mizuApiFilteringOptions *shared.TrafficFilteringOptions, maxEntriesDBSizeBytes int64, protobufDescriptorsConfigMap string) (*core.Pod, error) {
 	marshaledFilteringOptions, err := json.Marshal(mizuApiFilteringOptions)
 	if err != nil {
 		return nil, err
@@ -142,6 +146,27 @@ func (provider *Provider) CreateMizuAggregatorPod(ctx context.Context, namespace
 	if linkServiceAccount {
 		pod.Spec.ServiceAccountName = serviceAccountName
 	}
+	if protobufDescriptorsConfigMap != "" {
+		// every key of the config map is a FileDescriptorSet used for decoding gRPC messages
+		pod.Spec.Volumes = append(pod.Spec.Volumes, core.Volume{
+			Name: protobufDescriptorsVolumeName,
+			VolumeSource: core.VolumeSource{
+				ConfigMap: &core.ConfigMapVolumeSource{
+					LocalObjectReference: core.LocalObjectReference{Name: protobufDescriptorsConfigMap},
+				},
+			},
+		})
+		container := &pod.Spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, core.VolumeMount{
+			Name:      protobufDescriptorsVolumeName,
+			MountPath: protobufDescriptorsMountPath,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env, core.EnvVar{
+			Name:  shared.ProtobufDescriptorsDirEnvVar,
+			Value: protobufDescriptorsMountPath,
+		})
+	}
 	return provider.clientSet.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
 }
 
@@ -331,7 +356,7 @@ func (provider *Provider) CheckDaemonSetExists(ctx context.Context, namespace st
 	return false, nil
 }
 
-func (provider *Provider) ApplyMizuTapperDaemonSet(ctx context.Context, namespace string, daemonSetName string, podImage string, tapperPodName string, aggregatorPodIp string, nodeToTappedPodIPMap map[string][]string, linkServiceAccount bool, tapOutgoing bool) error {
+func (provider *Provider) ApplyMizuTapperDaemonSet(ctx context.Context, namespace string, daemonSetName string, podImage string, tapperPodName string, aggregatorPodIp string, nodeToTappedPodIPMap map[string][]string, linkServiceAccount bool, tapOutgoing bool, tlsKeyLogSecret string) error {
 	if len(nodeToTappedPodIPMap) == 0 {
 		return fmt.Errorf("Daemon set %s must tap at least 1 pod", daemonSetName)
 	}
@@ -396,6 +421,10 @@ func (provider *Provider) ApplyMizuTapperDaemonSet(ctx context.Context, namespac
 	}
 	agentResources := applyconfcore.ResourceRequirements().WithRequests(agentResourceRequests).WithLimits(agentResourceLimits)
 	agentContainer.WithResources(agentResources)
+	if tlsKeyLogSecret != "" {
+		agentContainer.WithVolumeMounts(applyconfcore.VolumeMount().WithName(tlsKeyLogVolumeName).WithMountPath(tlsKeyLogMountPath).WithReadOnly(true))
+		agentContainer.WithEnv(applyconfcore.EnvVar().WithName(shared.TLSKeyLogPathEnvVar).WithValue(tlsKeyLogMountPath))
+	}
 
 	nodeNames := make([]string, 0, len(nodeToTappedPodIPMap))
 	for nodeName := range nodeToTappedPodIPMap {
@@ -431,6 +460,9 @@ func (provider *Provider) ApplyMizuTapperDaemonSet(ctx context.Context, namespac
 	podSpec.WithContainers(agentContainer)
 	podSpec.WithAffinity(affinity)
 	podSpec.WithTolerations(noExecuteToleration, noScheduleToleration)
+	if tlsKeyLogSecret != "" {
+		podSpec.WithVolumes(applyconfcore.Volume().WithName(tlsKeyLogVolumeName).WithSecret(applyconfcore.SecretVolumeSource().WithSecretName(tlsKeyLogSecret)))
+	}
 
 	podTemplate := applyconfcore.PodTemplateSpec()
 	podTemplate.WithLabels(map[string]string{"app": tapperPodName})
@@ -6,4 +6,6 @@ const (
 	NodeNameEnvVar                   = "NODE_NAME"
 	TappedAddressesPerNodeDictEnvVar = "TAPPED_ADDRESSES_PER_HOST"
 	MaxEntriesDBSizeByteSEnvVar      = "MAX_ENTRIES_DB_BYTES"
+	ProtobufDescriptorsDirEnvVar     = "PROTOBUF_DESCRIPTORS_DIR"
+	TLSKeyLogPathEnvVar              = "TLS_KEYLOG_PATH"
 )
@@ -7,6 +7,8 @@ const (
 	WebSocketMessageTypeTappedEntry   WebSocketMessageType = "tappedEntry"
 	WebSocketMessageTypeUpdateStatus  WebSocketMessageType = "status"
 	WebSocketMessageTypeAnalyzeStatus WebSocketMessageType = "analyzeStatus"
+	WebSocketMessageTypeTLSKeyLog     WebSocketMessageType = "tlsKeyLog"
+	WebSocketMessageTypeTapperStats   WebSocketMessageType = "tapperStats"
 )
 
 type WebSocketMessageMetadata struct {
@@ -57,6 +59,48 @@ func CreateWebSocketMessageTypeAnalyzeStatus(analyzeStatus AnalyzeStatus) WebSoc
 	}
 }
 
+// WebSocketTLSKeyLogMessage is sent by the aggregator to tappers, with TLS secrets in the NSS key log format.
+type WebSocketTLSKeyLogMessage struct {
+	*WebSocketMessageMetadata
+	KeyLog string `json:"keyLog"`
+}
+
+func CreateWebSocketTLSKeyLogMessage(keyLog []byte) WebSocketTLSKeyLogMessage {
+	return WebSocketTLSKeyLogMessage{
+		WebSocketMessageMetadata: &WebSocketMessageMetadata{
+			MessageType: WebSocketMessageTypeTLSKeyLog,
+		},
+		KeyLog: string(keyLog),
+	}
+}
+
+// WebSocketTapperStatsMessage is sent by tappers to the aggregator, with the items that the stages of their capture pipeline dropped.
+type WebSocketTapperStatsMessage struct {
+	*WebSocketMessageMetadata
+	TapperStats TapperStats `json:"tapperStats"`
+}
+
+type TapperStats struct {
+	NodeName string       `json:"nodeName"`
+	Queues   []QueueStats `json:"queues"`
+}
+
+// QueueStats are the items that a stage dropped, or waited to queue, since the tapper started.
+type QueueStats struct {
+	Stage   string `json:"stage"`
+	Dropped uint64 `json:"dropped"`
+	Blocked uint64 `json:"blocked"`
+}
+
+func CreateWebSocketTapperStatsMessage(tapperStats TapperStats) WebSocketTapperStatsMessage {
+	return WebSocketTapperStatsMessage{
+		WebSocketMessageMetadata: &WebSocketMessageMetadata{
+			MessageType: WebSocketMessageTypeTapperStats,
+		},
+		TapperStats: tapperStats,
+	}
+}
+
 type TrafficFilteringOptions struct {
 	PlainTextMaskingRegexes []*SerializableRegexp
 	HideHealthChecks        bool
@@ -0,0 +1,258 @@
+package tap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	afpacketFrameSize = 2048
+	// The kernel hands a block that isn't full to the tapper after this many milliseconds, so that quiet connections aren't delayed
+	afpacketBlockTimeoutMs = 50
+	afpacketPollTimeoutMs  = 1000
+	// The link-layer address of a packet follows its header, aligned to TPACKET_ALIGNMENT
+	afpacketSockaddrOffset = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+	// The header of a block follows its version and the offset to its private area
+	afpacketBlockHeaderOffset = 8
+	// DLT_RAW, the link type that libpcap compiles filters for raw IP packets with on Linux,
+	// which differs from LINKTYPE_RAW (layers.LinkTypeRaw), the number of the same link type in capture files
+	afpacketFilterLinkType = layers.LinkType(12)
+	// The length that filters accept packets with, which covers the largest IP packet, coalesced or not
+	afpacketFilterSnaplen = 262144
+)
+
+/* afpacketCapture reads the packets of an AF_PACKET socket from a TPACKET_V3 ring, which the kernel shares with the tapper.
+ * The kernel fills blocks of packets, and hands each one to the tapper until it is done with all of the packets in it.
+ * The socket is of the cooked kind, whose packets start at their network header whatever the interface,
+ * so that interface "any" captures interfaces of every link type, like libpcap does.
+ */
+type afpacketCapture struct {
+	fd         int
+	ring       []byte
+	blockSize  int
+	blockCount int
+	block      int // the block being read
+	packet     int // the offset of the next packet in the block, 0 until the block is handed to the tapper
+	remaining  uint32
+	statsMutex sync.Mutex
+	stats      captureStats
+}
+
+func openAFPacket(iface string, blockSize int, blockCount int, fanoutGroup int) (packetCapture, error) {
+	if blockSize <= 0 || blockSize%os.Getpagesize() != 0 || blockSize%afpacketFrameSize != 0 {
+		return nil, fmt.Errorf("AF_PACKET block size %d is not a multiple of the page size %d", blockSize, os.Getpagesize())
+	}
+	if blockCount <= 0 {
+		return nil, fmt.Errorf("AF_PACKET ring needs at least 1 block, not %d", blockCount)
+	}
+	ifindex := 0
+	if iface != "any" {
+		netInterface, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("could not find interface %s: %v", iface, err)
+		}
+		ifindex = netInterface.Index
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("could not create AF_PACKET socket: %v", err)
+	}
+	c := &afpacketCapture{fd: fd, blockSize: blockSize, blockCount: blockCount}
+	if err := c.setup(ifindex, fanoutGroup); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *afpacketCapture) setup(ifindex int, fanoutGroup int) error {
+	if err := unix.SetsockoptInt(c.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("could not set TPACKET_V3: %v", err)
+	}
+	req := &unix.TpacketReq3{
+		Block_size:     uint32(c.blockSize),
+		Block_nr:       uint32(c.blockCount),
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       uint32(c.blockSize / afpacketFrameSize * c.blockCount),
+		Retire_blk_tov: afpacketBlockTimeoutMs,
+	}
+	if err := unix.SetsockoptTpacketReq3(c.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, req); err != nil {
+		return fmt.Errorf("could not set up AF_PACKET ring of %d blocks of %d bytes: %v", c.blockCount, c.blockSize, err)
+	}
+	ring, err := unix.Mmap(c.fd, 0, c.blockSize*c.blockCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("could not map AF_PACKET ring: %v", err)
+	}
+	c.ring = ring
+
+	if err := unix.Bind(c.fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		return fmt.Errorf("could not bind AF_PACKET socket: %v", err)
+	}
+	if ifindex != 0 && *promisc {
+		mreq := &unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(c.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			return fmt.Errorf("could not set promisc mode: %v", err)
+		}
+	}
+	if fanoutGroup != 0 {
+		// Hash fanout keeps both directions of a connection on the same socket, and defrag hashes IP fragments as whole packets
+		fanout := fanoutGroup&0xffff | (unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16
+		if err := unix.SetsockoptInt(c.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, fanout); err != nil {
+			return fmt.Errorf("could not join AF_PACKET fanout group %d: %v", fanoutGroup, err)
+		}
+	}
+	return nil
+}
+
+// LinkType is raw IP, as the packets of cooked sockets start at their network header.
+func (c *afpacketCapture) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+// ReadPacketData returns a copy of the next packet, since the kernel reuses its block once the tapper is done with it.
+func (c *afpacketCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if c.remaining == 0 {
+			if err := c.nextBlock(); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			continue
+		}
+
+		blockStart := c.block * c.blockSize
+		packetStart := blockStart + c.packet
+		header := (*unix.Tpacket3Hdr)(unsafe.Pointer(&c.ring[packetStart]))
+		c.remaining--
+		if c.remaining > 0 {
+			c.packet += int(header.Next_offset)
+		}
+
+		// Only IPv4 and IPv6 packets are dissected, and the protocol of a cooked packet is in its link-layer address
+		// Its protocol is in network byte order, and its other fields in the byte order of the host
+		sockaddrStart := packetStart + afpacketSockaddrOffset
+		sockaddr := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&c.ring[sockaddrStart]))
+		protocol := binary.BigEndian.Uint16(c.ring[sockaddrStart+2 : sockaddrStart+4])
+		if protocol != unix.ETH_P_IP && protocol != unix.ETH_P_IPV6 {
+			continue
+		}
+		// Loopback devices capture every packet as it leaves and again as it arrives, so only arrivals are kept (as libpcap does)
+		if sockaddr.Hatype == unix.ARPHRD_LOOPBACK && sockaddr.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		dataStart := packetStart + int(header.Mac)
+		data := make([]byte, header.Snaplen)
+		copy(data, c.ring[dataStart:dataStart+int(header.Snaplen)])
+		return data, gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(header.Sec), int64(header.Nsec)),
+			CaptureLength:  int(header.Snaplen),
+			Length:         int(header.Len),
+			InterfaceIndex: int(sockaddr.Ifindex),
+		}, nil
+	}
+}
+
+// nextBlock hands the block that was read back to the kernel, and waits for the kernel to hand over the next one.
+func (c *afpacketCapture) nextBlock() error {
+	if c.packet != 0 {
+		atomic.StoreUint32(c.blockStatus(), unix.TP_STATUS_KERNEL)
+		c.block = (c.block + 1) % c.blockCount
+		c.packet = 0
+	}
+
+	for atomic.LoadUint32(c.blockStatus())&unix.TP_STATUS_USER == 0 {
+		fds := []unix.PollFd{{Fd: int32(c.fd), Events: unix.POLLIN | unix.POLLERR}}
+		n, err := unix.Poll(fds, afpacketPollTimeoutMs)
+		if err != nil && err != unix.EINTR {
+			return err
+		}
+		if n == 0 {
+			// Reads return now and then while no packet arrives, so that the filter can be changed between them
+			return unix.EAGAIN
+		}
+	}
+
+	blockHeader := (*unix.TpacketHdrV1)(unsafe.Pointer(&c.ring[c.block*c.blockSize+afpacketBlockHeaderOffset]))
+	c.packet = int(blockHeader.Offset_to_first_pkt)
+	c.remaining = blockHeader.Num_pkts
+	if c.remaining == 0 {
+		// The block has no packets to read, so it goes back to the kernel right away
+		atomic.StoreUint32(c.blockStatus(), unix.TP_STATUS_KERNEL)
+		c.block = (c.block + 1) % c.blockCount
+		c.packet = 0
+	}
+	return nil
+}
+
+func (c *afpacketCapture) blockStatus() *uint32 {
+	return (*uint32)(unsafe.Pointer(&c.ring[c.block*c.blockSize+afpacketBlockHeaderOffset]))
+}
+
+// SetBPFFilter attaches a filter expression, which is compiled for raw IP packets.
+func (c *afpacketCapture) SetBPFFilter(expr string) error {
+	instructions, err := compileAFPacketFilter(expr)
+	if err != nil {
+		return err
+	}
+	return c.setBPFInstructions(instructions)
+}
+
+/* compileAFPacketFilter compiles a filter expression for the packets of cooked sockets.
+ * The kernel cuts the packets that a filter accepts to the length that it returns, which is the snap length of its compilation,
+ * so that is never the size of a frame of the ring, which packets coalesced by GRO or TSO exceed.
+ */
+func compileAFPacketFilter(expr string) ([]bpf.RawInstruction, error) {
+	return compileBPFFilter(afpacketFilterLinkType, afpacketFilterSnaplen, expr)
+}
+
+func (c *afpacketCapture) setBPFInstructions(instructions []bpf.RawInstruction) error {
+	filter := make([]unix.SockFilter, len(instructions))
+	for i, instruction := range instructions {
+		filter[i] = unix.SockFilter{Code: instruction.Op, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+	program := &unix.SockFprog{Len: uint16(len(filter))}
+	if len(filter) > 0 {
+		program.Filter = &filter[0]
+	}
+	return unix.SetsockoptSockFprog(c.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, program)
+}
+
+// captureStats adds up the statistics of the socket, which the kernel resets whenever they are read.
+func (c *afpacketCapture) captureStats() (captureStats, error) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	stats, err := unix.GetsockoptTpacketStatsV3(c.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		return c.stats, err
+	}
+	c.stats.received += int(stats.Packets)
+	c.stats.dropped += int(stats.Drops)
+	return c.stats, nil
+}
+
+func (c *afpacketCapture) Close() {
+	if c.ring != nil {
+		_ = unix.Munmap(c.ring)
+		c.ring = nil
+	}
+	_ = unix.Close(c.fd)
+}
+
+// htons returns a value in network byte order, which is big endian, as the host stores it.
+func htons(value uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], value)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,84 @@
+//go:build !nopcap
+// +build !nopcap
+
+package tap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// rawTCPPacket returns an IPv4 packet of a TCP segment, as the cooked AF_PACKET socket reads it, without a link-layer header.
+func rawTCPPacket(t *testing.T, dstPort int) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(dstPort), SYN: true, Window: 1024}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// compileAFPacketTestFilter compiles a filter as SetBPFFilter does, and returns its instructions.
+func compileAFPacketTestFilter(t *testing.T, expr string) []bpf.Instruction {
+	rawInstructions, err := compileAFPacketFilter(expr)
+	if err != nil {
+		t.Fatalf("compiling a filter for raw IP packets: %v", err)
+	}
+	instructions := make([]bpf.Instruction, len(rawInstructions))
+	for i, instruction := range rawInstructions {
+		instructions[i] = instruction.Disassemble()
+	}
+	return instructions
+}
+
+func TestAFPacketFilterMatchesRawIP(t *testing.T) {
+	vm, err := bpf.NewVM(compileAFPacketTestFilter(t, "tcp dst port 80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		port    int
+		isMatch bool
+	}{{80, true}, {81, false}} {
+		n, err := vm.Run(rawTCPPacket(t, test.port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isMatch := n > 0; isMatch != test.isMatch {
+			t.Errorf("a packet to port %d matched %v, want %v", test.port, isMatch, test.isMatch)
+		}
+	}
+}
+
+// The kernel cuts accepted packets to the length that the filter returns, which must leave the largest IP packets whole.
+func TestAFPacketFilterAcceptsWholePackets(t *testing.T) {
+	isAccepting := false
+	for _, instruction := range compileAFPacketTestFilter(t, "tcp dst port 80") {
+		ret, ok := instruction.(bpf.RetConstant)
+		if !ok || ret.Val == 0 {
+			continue
+		}
+		isAccepting = true
+		if ret.Val < 65535 {
+			t.Errorf("the filter accepts packets with %d bytes, want at least 65535", ret.Val)
+		}
+	}
+	if !isAccepting {
+		t.Error("the filter accepts no packet")
+	}
+}
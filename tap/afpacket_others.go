@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package tap
+
+import "errors"
+
+func openAFPacket(iface string, blockSize int, blockCount int, fanoutGroup int) (packetCapture, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on Linux")
+}
@@ -0,0 +1,393 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+const maxAMQPFrameSize = 64 * 1024 * 1024
+const maxAMQPBodySize = 1024 * 1024
+
+var errAMQPShortBuffer = errors.New("amqp: not enough bytes")
+
+var amqpMethodNames = map[uint32]string{
+	10<<16 | 10:  "connection.start",
+	10<<16 | 11:  "connection.start-ok",
+	10<<16 | 20:  "connection.secure",
+	10<<16 | 21:  "connection.secure-ok",
+	10<<16 | 30:  "connection.tune",
+	10<<16 | 31:  "connection.tune-ok",
+	10<<16 | 40:  "connection.open",
+	10<<16 | 41:  "connection.open-ok",
+	10<<16 | 50:  "connection.close",
+	10<<16 | 51:  "connection.close-ok",
+	20<<16 | 10:  "channel.open",
+	20<<16 | 11:  "channel.open-ok",
+	20<<16 | 20:  "channel.flow",
+	20<<16 | 21:  "channel.flow-ok",
+	20<<16 | 40:  "channel.close",
+	20<<16 | 41:  "channel.close-ok",
+	40<<16 | 10:  "exchange.declare",
+	40<<16 | 11:  "exchange.declare-ok",
+	40<<16 | 20:  "exchange.delete",
+	40<<16 | 21:  "exchange.delete-ok",
+	50<<16 | 10:  "queue.declare",
+	50<<16 | 11:  "queue.declare-ok",
+	50<<16 | 20:  "queue.bind",
+	50<<16 | 21:  "queue.bind-ok",
+	50<<16 | 30:  "queue.purge",
+	50<<16 | 31:  "queue.purge-ok",
+	50<<16 | 40:  "queue.delete",
+	50<<16 | 41:  "queue.delete-ok",
+	50<<16 | 50:  "queue.unbind",
+	50<<16 | 51:  "queue.unbind-ok",
+	60<<16 | 10:  "basic.qos",
+	60<<16 | 11:  "basic.qos-ok",
+	60<<16 | 20:  "basic.consume",
+	60<<16 | 21:  "basic.consume-ok",
+	60<<16 | 30:  "basic.cancel",
+	60<<16 | 31:  "basic.cancel-ok",
+	60<<16 | 40:  "basic.publish",
+	60<<16 | 50:  "basic.return",
+	60<<16 | 60:  "basic.deliver",
+	60<<16 | 70:  "basic.get",
+	60<<16 | 71:  "basic.get-ok",
+	60<<16 | 72:  "basic.get-empty",
+	60<<16 | 80:  "basic.ack",
+	60<<16 | 90:  "basic.reject",
+	60<<16 | 110: "basic.recover",
+	60<<16 | 111: "basic.recover-ok",
+	60<<16 | 120: "basic.nack",
+	85<<16 | 10:  "confirm.select",
+	85<<16 | 11:  "confirm.select-ok",
+	90<<16 | 10:  "tx.select",
+	90<<16 | 11:  "tx.select-ok",
+	90<<16 | 20:  "tx.commit",
+	90<<16 | 21:  "tx.commit-ok",
+	90<<16 | 30:  "tx.rollback",
+	90<<16 | 31:  "tx.rollback-ok",
+}
+
+type AMQPProperties struct {
+	ContentType     string                 `json:"contentType,omitempty"`
+	ContentEncoding string                 `json:"contentEncoding,omitempty"`
+	Headers         map[string]interface{} `json:"headers,omitempty"`
+	DeliveryMode    uint8                  `json:"deliveryMode,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+	CorrelationID   string                 `json:"correlationId,omitempty"`
+	ReplyTo         string                 `json:"replyTo,omitempty"`
+	Expiration      string                 `json:"expiration,omitempty"`
+	MessageID       string                 `json:"messageId,omitempty"`
+	Timestamp       uint64                 `json:"timestamp,omitempty"`
+	Type            string                 `json:"type,omitempty"`
+	UserID          string                 `json:"userId,omitempty"`
+	AppID           string                 `json:"appId,omitempty"`
+	ClusterID       string                 `json:"clusterId,omitempty"`
+}
+
+// AMQPMessage is a content carrying method (basic.publish, basic.deliver, basic.get-ok or basic.return) with its content.
+type AMQPMessage struct {
+	Method       string          `json:"method"`
+	Channel      uint16          `json:"channel"`
+	Exchange     string          `json:"exchange"`
+	RoutingKey   string          `json:"routingKey"`
+	ConsumerTag  string          `json:"consumerTag,omitempty"`
+	DeliveryTag  uint64          `json:"deliveryTag,omitempty"`
+	Redelivered  bool            `json:"redelivered,omitempty"`
+	Mandatory    bool            `json:"mandatory,omitempty"`
+	Immediate    bool            `json:"immediate,omitempty"`
+	MessageCount uint32          `json:"messageCount,omitempty"`
+	ReplyCode    uint16          `json:"replyCode,omitempty"`
+	ReplyText    string          `json:"replyText,omitempty"`
+	Properties   *AMQPProperties `json:"properties,omitempty"`
+	BodySize     uint64          `json:"bodySize"`
+	Body         *string         `json:"body"`
+	Truncated    bool            `json:"truncated,omitempty"`
+}
+
+// AMQPMethod is a method without content that is recorded on its own, such as basic.ack or channel.close.
+type AMQPMethod struct {
+	Method      string `json:"method"`
+	Channel     uint16 `json:"channel"`
+	DeliveryTag uint64 `json:"deliveryTag,omitempty"`
+	Multiple    bool   `json:"multiple,omitempty"`
+	Requeue     bool   `json:"requeue,omitempty"`
+	ReplyCode   uint16 `json:"replyCode,omitempty"`
+	ReplyText   string `json:"replyText,omitempty"`
+	FailedOn    string `json:"failedOn,omitempty"`
+}
+
+// readAMQPFrame reads a frame. The payload of frames above maxAMQPFrameSize is skipped and returned as nil.
+func readAMQPFrame(b *bufio.Reader) (frameType uint8, channel uint16, payload []byte, err error) {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(b, header); err != nil {
+		return
+	}
+	frameType = header[0]
+	channel = binary.BigEndian.Uint16(header[1:])
+	size := binary.BigEndian.Uint32(header[3:])
+
+	if size > maxAMQPFrameSize {
+		_, err = b.Discard(int(size) + 1)
+		return
+	}
+	frame := make([]byte, size+1)
+	if _, err = io.ReadFull(b, frame); err != nil {
+		return
+	}
+	if frame[size] != amqpFrameEnd {
+		// The stream is not aligned on a frame boundary and cannot be recovered
+		err = fmt.Errorf("amqp: invalid frame end 0x%x", frame[size])
+		return
+	}
+	payload = frame[:size]
+	return
+}
+
+// amqpDecoder reads the fields of a frame payload. Like kafkaDecoder, its first error is sticky.
+type amqpDecoder struct {
+	raw []byte
+	off int
+	err error
+}
+
+func (d *amqpDecoder) remaining() int {
+	return len(d.raw) - d.off
+}
+
+func (d *amqpDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errAMQPShortBuffer
+		return nil
+	}
+	buf := d.raw[d.off : d.off+n]
+	d.off += n
+	return buf
+}
+
+func (d *amqpDecoder) uint8() uint8 {
+	if buf := d.next(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (d *amqpDecoder) uint16() uint16 {
+	if buf := d.next(2); buf != nil {
+		return binary.BigEndian.Uint16(buf)
+	}
+	return 0
+}
+
+func (d *amqpDecoder) uint32() uint32 {
+	if buf := d.next(4); buf != nil {
+		return binary.BigEndian.Uint32(buf)
+	}
+	return 0
+}
+
+func (d *amqpDecoder) uint64() uint64 {
+	if buf := d.next(8); buf != nil {
+		return binary.BigEndian.Uint64(buf)
+	}
+	return 0
+}
+
+func (d *amqpDecoder) shortString() string {
+	return string(d.next(int(d.uint8())))
+}
+
+func (d *amqpDecoder) longString() []byte {
+	return d.next(int(d.uint32()))
+}
+
+func (d *amqpDecoder) table() map[string]interface{} {
+	table := make(map[string]interface{})
+	fields := &amqpDecoder{raw: d.longString()}
+	for fields.remaining() > 0 && fields.err == nil {
+		name := fields.shortString()
+		table[name] = fields.fieldValue()
+	}
+	if fields.err != nil && d.err == nil {
+		d.err = fields.err
+	}
+	return table
+}
+
+// fieldValue decodes a value of a field table, with the type tags used by RabbitMQ.
+func (d *amqpDecoder) fieldValue() interface{} {
+	switch kind := d.uint8(); kind {
+	case 't':
+		return d.uint8() != 0
+	case 'b':
+		return int8(d.uint8())
+	case 'B':
+		return d.uint8()
+	case 's':
+		return int16(d.uint16())
+	case 'u':
+		return d.uint16()
+	case 'I':
+		return int32(d.uint32())
+	case 'i':
+		return d.uint32()
+	case 'l':
+		return int64(d.uint64())
+	case 'f':
+		return math.Float32frombits(d.uint32())
+	case 'd':
+		return math.Float64frombits(d.uint64())
+	case 'D':
+		scale := d.uint8()
+		value := int32(d.uint32())
+		return float64(value) / math.Pow10(int(scale))
+	case 'S', 'x':
+		return payloadString(d.longString())
+	case 'A':
+		values := make([]interface{}, 0)
+		array := &amqpDecoder{raw: d.longString()}
+		for array.remaining() > 0 && array.err == nil {
+			values = append(values, array.fieldValue())
+		}
+		return values
+	case 'T':
+		return d.uint64()
+	case 'F':
+		return d.table()
+	case 'V':
+		return nil
+	default:
+		d.err = fmt.Errorf("amqp: unknown field type %q", kind)
+		return nil
+	}
+}
+
+// decodeAMQPProperties decodes the basic class properties of a content header frame, past its class, weight and body size.
+func decodeAMQPProperties(d *amqpDecoder) *AMQPProperties {
+	properties := &AMQPProperties{}
+	flags := d.uint16()
+	has := func(bit uint) bool {
+		return flags&(1<<(15-bit)) != 0
+	}
+
+	if has(0) {
+		properties.ContentType = d.shortString()
+	}
+	if has(1) {
+		properties.ContentEncoding = d.shortString()
+	}
+	if has(2) {
+		properties.Headers = d.table()
+	}
+	if has(3) {
+		properties.DeliveryMode = d.uint8()
+	}
+	if has(4) {
+		properties.Priority = d.uint8()
+	}
+	if has(5) {
+		properties.CorrelationID = d.shortString()
+	}
+	if has(6) {
+		properties.ReplyTo = d.shortString()
+	}
+	if has(7) {
+		properties.Expiration = d.shortString()
+	}
+	if has(8) {
+		properties.MessageID = d.shortString()
+	}
+	if has(9) {
+		properties.Timestamp = d.uint64()
+	}
+	if has(10) {
+		properties.Type = d.shortString()
+	}
+	if has(11) {
+		properties.UserID = d.shortString()
+	}
+	if has(12) {
+		properties.AppID = d.shortString()
+	}
+	if has(13) {
+		properties.ClusterID = d.shortString()
+	}
+	return properties
+}
+
+/* decodeAMQPMethod decodes the methods this dissector records. It returns either an *AMQPMessage,
+ * for methods followed by content, or an *AMQPMethod, or nil for the methods that are not recorded.
+ */
+func decodeAMQPMethod(channel uint16, payload []byte) (interface{}, error) {
+	d := &amqpDecoder{raw: payload}
+	classID := d.uint16()
+	methodID := d.uint16()
+	name := amqpMethodNames[uint32(classID)<<16|uint32(methodID)]
+
+	var result interface{}
+	switch name {
+	case "basic.publish":
+		d.uint16() // reserved
+		message := &AMQPMessage{Method: name, Channel: channel, Exchange: d.shortString(), RoutingKey: d.shortString()}
+		bits := d.uint8()
+		message.Mandatory = bits&1 != 0
+		message.Immediate = bits&2 != 0
+		result = message
+	case "basic.deliver":
+		message := &AMQPMessage{Method: name, Channel: channel, ConsumerTag: d.shortString(), DeliveryTag: d.uint64()}
+		message.Redelivered = d.uint8()&1 != 0
+		message.Exchange = d.shortString()
+		message.RoutingKey = d.shortString()
+		result = message
+	case "basic.get-ok":
+		message := &AMQPMessage{Method: name, Channel: channel, DeliveryTag: d.uint64()}
+		message.Redelivered = d.uint8()&1 != 0
+		message.Exchange = d.shortString()
+		message.RoutingKey = d.shortString()
+		message.MessageCount = d.uint32()
+		result = message
+	case "basic.return":
+		message := &AMQPMessage{Method: name, Channel: channel, ReplyCode: d.uint16(), ReplyText: d.shortString()}
+		message.Exchange = d.shortString()
+		message.RoutingKey = d.shortString()
+		result = message
+	case "basic.ack", "basic.nack", "basic.reject":
+		method := &AMQPMethod{Method: name, Channel: channel, DeliveryTag: d.uint64()}
+		bits := d.uint8()
+		if name == "basic.reject" {
+			method.Requeue = bits&1 != 0
+		} else {
+			method.Multiple = bits&1 != 0
+			method.Requeue = name == "basic.nack" && bits&2 != 0
+		}
+		result = method
+	case "connection.close", "channel.close":
+		method := &AMQPMethod{Method: name, Channel: channel, ReplyCode: d.uint16(), ReplyText: d.shortString()}
+		failedClassID := d.uint16()
+		failedMethodID := d.uint16()
+		method.FailedOn = amqpMethodNames[uint32(failedClassID)<<16|uint32(failedMethodID)]
+		result = method
+	default:
+		return nil, nil
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return result, nil
+}
@@ -0,0 +1,157 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const amqpPortsEnvVar = "AMQP_PORTS"
+
+var amqpProtocolHeader = []byte("AMQP")
+
+var amqpProtocol = &Protocol{
+	Name:         "amqp",
+	Abbreviation: "AMQP",
+}
+
+func init() {
+	RegisterDissector(&amqpDissector{ports: portsFromEnv(amqpPortsEnvVar, []int{5672})})
+}
+
+// amqpContent is a message whose header and body frames are still being received.
+type amqpContent struct {
+	message     *AMQPMessage
+	captureTime time.Time
+	body        []byte
+	received    uint64
+}
+
+/* amqpDissector parses AMQP 0-9-1 frames.
+ * Published and delivered messages become entries once their content header and body frames are complete,
+ * as do acknowledgements and the closing of channels and connections.
+ * Messages are not requests awaiting a response, so both directions are parsed independently.
+ */
+type amqpDissector struct {
+	ports []int
+}
+
+func (d *amqpDissector) Protocol() *Protocol {
+	return amqpProtocol
+}
+
+func (d *amqpDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *amqpDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *amqpDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	// Content frames are interleaved between channels, but not within a channel
+	contents := make(map[uint16]*amqpContent)
+
+	for {
+		if header, err := b.Peek(len(amqpProtocolHeader)); err == nil && bytes.Equal(header, amqpProtocolHeader) {
+			// The protocol header that opens the connection, "AMQP" followed by the version
+			if _, err := b.Discard(8); err != nil {
+				return err
+			}
+			continue
+		}
+
+		frameType, channel, payload, err := readAMQPFrame(b)
+		if err != nil {
+			return err
+		}
+		if payload == nil {
+			continue
+		}
+
+		switch frameType {
+		case amqpFrameMethod:
+			method, err := decodeAMQPMethod(channel, payload)
+			if err != nil {
+				SilentError("AMQP", "stream %s error: %s (%v,%+v)", reader.ident, err, err, err)
+				continue
+			}
+			delete(contents, channel)
+			switch method := method.(type) {
+			case *AMQPMessage:
+				contents[channel] = &amqpContent{message: method, captureTime: reader.CaptureTime()}
+			case *AMQPMethod:
+				d.emitEntry(method, method.Method, "", method.ReplyCode, method.ReplyText, reader.CaptureTime(), clientTcpID, reader)
+			}
+		case amqpFrameHeader:
+			content, ok := contents[channel]
+			if !ok {
+				continue
+			}
+			decoder := &amqpDecoder{raw: payload}
+			decoder.uint16() // class
+			decoder.uint16() // weight
+			content.message.BodySize = decoder.uint64()
+			content.message.Properties = decodeAMQPProperties(decoder)
+			if decoder.err != nil {
+				SilentError("AMQP", "stream %s error: %s (%v,%+v)", reader.ident, decoder.err, decoder.err, decoder.err)
+			}
+			d.completeContent(contents, channel, clientTcpID, reader)
+		case amqpFrameBody:
+			content, ok := contents[channel]
+			if !ok {
+				continue
+			}
+			content.received += uint64(len(payload))
+			if kept := maxAMQPBodySize - len(content.body); kept > 0 {
+				if kept > len(payload) {
+					kept = len(payload)
+				}
+				content.body = append(content.body, payload[:kept]...)
+			}
+			d.completeContent(contents, channel, clientTcpID, reader)
+		}
+	}
+}
+
+// completeContent emits the message of a channel once all of its body has been received.
+func (d *amqpDissector) completeContent(contents map[uint16]*amqpContent, channel uint16, clientTcpID *TcpID, reader *TcpReader) {
+	content := contents[channel]
+	if content.message.Properties == nil || content.received < content.message.BodySize {
+		return
+	}
+	delete(contents, channel)
+
+	message := content.message
+	if content.body == nil {
+		content.body = []byte{}
+	}
+	message.Body = payloadString(content.body)
+	message.Truncated = content.received > uint64(len(content.body))
+	path := fmt.Sprintf("%s/%s", message.Exchange, message.RoutingKey)
+	d.emitEntry(message, message.Method, path, message.ReplyCode, message.ReplyText, content.captureTime, clientTcpID, reader)
+}
+
+func (d *amqpDissector) emitEntry(request interface{}, method string, path string, replyCode uint16, replyText string, captureTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	statsTracker.incMatchedMessages()
+
+	entry := newEntry(amqpProtocol, captureTime, captureTime)
+	entry.Method = method
+	entry.Path = path
+	entry.Status = int(replyCode)
+	entry.StatusText = replyText
+	entry.Request = request
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       amqpProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
@@ -0,0 +1,206 @@
+package tap
+
+import (
+	"flag"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/romana/rlog"
+)
+
+var assemblers = flag.Int("assemblers", runtime.NumCPU(), "Number of goroutines that reassemble TCP connections, each one its own shard of them")
+
+// The packets that wait for a busy assembler, before its queue overflows
+const assemblerShardQueueLen = 1024
+
+// tcpStats are the TCP reassembly statistics of a shard, updated by its assembler only.
+type tcpStats struct {
+	missedBytes         int
+	pkt                 int
+	sz                  int
+	totalsz             int
+	rejectFsm           int
+	rejectOpt           int
+	rejectConnFsm       int
+	reassembled         int
+	outOfOrderBytes     int
+	outOfOrderPackets   int
+	biggestChunkBytes   int
+	biggestChunkPackets int
+	overlapBytes        int
+	overlapPackets      int
+}
+
+func (s *tcpStats) add(other *tcpStats) {
+	s.missedBytes += other.missedBytes
+	s.pkt += other.pkt
+	s.sz += other.sz
+	s.totalsz += other.totalsz
+	s.rejectFsm += other.rejectFsm
+	s.rejectOpt += other.rejectOpt
+	s.rejectConnFsm += other.rejectConnFsm
+	s.reassembled += other.reassembled
+	s.outOfOrderBytes += other.outOfOrderBytes
+	s.outOfOrderPackets += other.outOfOrderPackets
+	if other.biggestChunkBytes > s.biggestChunkBytes {
+		s.biggestChunkBytes = other.biggestChunkBytes
+	}
+	if other.biggestChunkPackets > s.biggestChunkPackets {
+		s.biggestChunkPackets = other.biggestChunkPackets
+	}
+	s.overlapBytes += other.overlapBytes
+	s.overlapPackets += other.overlapPackets
+}
+
+// AssemblerShardStats are the statistics of a shard since they were last dumped.
+type AssemblerShardStats struct {
+	shard         int
+	packets       int
+	bytes         int
+	queuedPackets int
+	cleaner       CleanerStats
+}
+
+type assemblerPacket struct {
+	netFlow gopacket.Flow
+	tcp     *layers.TCP
+	context *Context
+}
+
+/* assemblerShard reassembles the TCP connections whose 5-tuple hashes to it, in a goroutine of its own.
+ * Each shard has its own assembler, stream pool and cleaner, so shards never wait for one another,
+ * and the capture loop only waits for a shard when its queue is full and the overflow policy is to block.
+ */
+type assemblerShard struct {
+	index          int
+	packets        chan assemblerPacket
+	factory        *tcpStreamFactory
+	streamPool     *reassembly.StreamPool
+	assembler      *reassembly.Assembler
+	assemblerMutex sync.Mutex
+	cleaner        Cleaner
+	stats          tcpStats // guarded by assemblerMutex
+	packetCount    int      // since the last dump, guarded by assemblerMutex
+	byteCount      int      // since the last dump, guarded by assemblerMutex
+	done           chan bool
+}
+
+func newAssemblerShards(count int, newFactory func(stats *tcpStats) *tcpStreamFactory, connectionTimeout time.Duration) []*assemblerShard {
+	if count < 1 {
+		count = 1
+	}
+	shards := make([]*assemblerShard, count)
+	for i := range shards {
+		shard := &assemblerShard{
+			index:   i,
+			packets: make(chan assemblerPacket, assemblerShardQueueLen),
+			done:    make(chan bool),
+		}
+		shard.factory = newFactory(&shard.stats)
+		shard.streamPool = reassembly.NewStreamPool(shard.factory)
+		shard.assembler = reassembly.NewAssembler(shard.streamPool)
+		shard.cleaner = Cleaner{
+			assembler:         shard.assembler,
+			assemblerMutex:    &shard.assemblerMutex,
+			cleanPeriod:       cleanPeriod,
+			connectionTimeout: connectionTimeout,
+		}
+		if i == 0 {
+			// Messages are matched by all of the shards, so only one of them cleans the matcher
+			shard.cleaner.matcher = &reqResMatcher
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// shardIndex hashes the 5-tuple of a packet, which is the same for both of the directions of its connection.
+func shardIndex(netFlow gopacket.Flow, tcp *layers.TCP, count int) int {
+	// The FastHash of a flow is the FastHash of its reverse
+	hash := netFlow.FastHash()*31 + tcp.TransportFlow().FastHash()
+	// The low bits of FNV hashes are poorly mixed, so they are mixed with the high bits (as in the finalizer of MurmurHash3)
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	return int(hash % uint64(count))
+}
+
+func dispatchTCPPacket(shards []*assemblerShard, netFlow gopacket.Flow, tcp *layers.TCP, context *Context) {
+	shard := shards[shardIndex(netFlow, tcp, len(shards))]
+	packet := assemblerPacket{netFlow: netFlow, tcp: tcp, context: context}
+	select {
+	case shard.packets <- packet:
+	default:
+		assemblerQueue.overflow(shard.packets, packet)
+	}
+}
+
+func (shard *assemblerShard) start() {
+	shard.cleaner.start()
+	go func() {
+		for packet := range shard.packets {
+			shard.assemblerMutex.Lock()
+			shard.packetCount++
+			shard.byteCount += len(packet.tcp.Payload)
+			shard.stats.totalsz += len(packet.tcp.Payload)
+			shard.assembler.AssembleWithContext(packet.netFlow, packet.tcp, packet.context)
+			shard.assemblerMutex.Unlock()
+		}
+		shard.done <- true
+	}()
+}
+
+// stop waits for the shard to reassemble the packets in its queue, then flushes all of its connections.
+func (shard *assemblerShard) stop() {
+	close(shard.packets)
+	<-shard.done
+
+	shard.assemblerMutex.Lock()
+	closed := shard.assembler.FlushAll()
+	shard.assemblerMutex.Unlock()
+	rlog.Debugf("Final flush of assembler %d: %d closed", shard.index, closed)
+	if outputLevel >= 2 {
+		shard.streamPool.Dump()
+	}
+}
+
+func (shard *assemblerShard) dumpStats() AssemblerShardStats {
+	shard.assemblerMutex.Lock()
+	stats := AssemblerShardStats{
+		shard:         shard.index,
+		packets:       shard.packetCount,
+		bytes:         shard.byteCount,
+		queuedPackets: len(shard.packets),
+	}
+	shard.packetCount = 0
+	shard.byteCount = 0
+	shard.assemblerMutex.Unlock()
+
+	stats.cleaner = shard.cleaner.dumpStats()
+	return stats
+}
+
+func logAssemblerShardsStats(shards []*assemblerShard) CleanerStats {
+	var cleanStats CleanerStats
+	for _, shard := range shards {
+		shardStats := shard.dumpStats()
+		log.Printf(
+			"assembler %d: packets: %d, bytes: %d, queued packets: %d, flushed connections: %d, closed connections: %d",
+			shardStats.shard,
+			shardStats.packets,
+			shardStats.bytes,
+			shardStats.queuedPackets,
+			shardStats.cleaner.flushed,
+			shardStats.cleaner.closed,
+		)
+		cleanStats.flushed += shardStats.cleaner.flushed
+		cleanStats.closed += shardStats.cleaner.closed
+		cleanStats.deleted += shardStats.cleaner.deleted
+	}
+	return cleanStats
+}
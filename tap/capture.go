@@ -0,0 +1,48 @@
+package tap
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	pcapCaptureBackend     = "pcap"
+	afpacketCaptureBackend = "afpacket"
+)
+
+var captureBackend = flag.String("capture", pcapCaptureBackend, "Backend that captures packets: pcap (libpcap) or afpacket (an AF_PACKET TPACKET_V3 ring, without libpcap, on Linux only)")
+var afpacketBlockSize = flag.Int("afpacketblocksize", 1024*1024, "Size in bytes of each block of the AF_PACKET ring, a multiple of the page size")
+var afpacketBlocks = flag.Int("afpacketblocks", 64, "Number of blocks of the AF_PACKET ring")
+var afpacketFanoutGroup = flag.Int("afpacketfanoutgroup", 0, "ID of an AF_PACKET fanout group, among whose sockets the kernel splits the connections by their hash (0 to capture without fanout)")
+
+// packetCapture is a source of captured packets, whichever backend captures them.
+type packetCapture interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	SetBPFFilter(expr string) error
+	captureStats() (captureStats, error)
+	Close()
+}
+
+// captureStats are the packets that a backend captured since it started.
+type captureStats struct {
+	received int
+	dropped  int
+}
+
+func openCapture() (packetCapture, error) {
+	if *fname != "" {
+		return openPcapOffline(*fname)
+	}
+	switch *captureBackend {
+	case pcapCaptureBackend:
+		return openPcapLive(*iface)
+	case afpacketCaptureBackend:
+		return openAFPacket(*iface, *afpacketBlockSize, *afpacketBlocks, *afpacketFanoutGroup)
+	default:
+		return nil, fmt.Errorf("unknown capture backend %s, should be %s or %s", *captureBackend, pcapCaptureBackend, afpacketCaptureBackend)
+	}
+}
@@ -0,0 +1,252 @@
+package tap
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/romana/rlog"
+)
+
+var noautobpf = flag.Bool("noautobpf", false, "Capture every packet, instead of only the packets of the tap targets (ignored when a BPF filter is given)")
+
+// The fragments of a packet that aren't the first have no ports, so they are let through by the filters of ports
+const fragmentsFilterExpr = "(ip[6:2] & 0x1fff != 0) or (ip6[6] == 44)"
+
+// portsDissector is a Dissector that claims the connections of some ports only, so that the capture can leave out the other ports.
+type portsDissector interface {
+	claimedPorts() []int
+}
+
+/* tapTargetsFilter is the BPF filter that lets through the packets of the tap targets only,
+ * so that the packets that getStreamProps would reject aren't copied from the kernel and decoded at all.
+ * It is applied again whenever the tap targets change, by the goroutine that reads the packets,
+ * since a libpcap handle can't be changed while a packet is read from it.
+ */
+type tapTargetsFilter struct {
+	mutex   sync.Mutex
+	capture packetCapture
+	pending chan string // the last expression of the tap targets, until the capture applies it
+	expr    string      // the expression that the capture applied
+}
+
+var targetsFilter = &tapTargetsFilter{pending: make(chan string, 1)}
+
+// targetsFilteredCapture applies the filter of the tap targets between the packets that it reads.
+type targetsFilteredCapture struct {
+	packetCapture
+	filter *tapTargetsFilter
+}
+
+func (c *targetsFilteredCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	c.filter.applyPending()
+	return c.packetCapture.ReadPacketData()
+}
+
+// start applies the filter of the current tap targets before the capture starts, and returns the capture that reads packets with the next ones.
+func (f *tapTargetsFilter) start(capture packetCapture) packetCapture {
+	if !canCompileBPFFilters {
+		log.Printf("The tapper was built without libpcap (nopcap), which compiles BPF filters, so every packet is captured rather than only those of the tap targets")
+		return capture
+	}
+	f.mutex.Lock()
+	f.capture = capture
+	f.mutex.Unlock()
+
+	f.apply(buildTapTargetsFilterExpr())
+	return &targetsFilteredCapture{packetCapture: capture, filter: f}
+}
+
+// update queues the filter of the current tap targets for the capture, if it started.
+func (f *tapTargetsFilter) update() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.capture == nil {
+		return
+	}
+	// Only the last filter is applied, so one that the capture didn't apply yet is replaced
+	select {
+	case <-f.pending:
+	default:
+	}
+	f.pending <- buildTapTargetsFilterExpr()
+}
+
+// applyPending applies the filter that update queued, if any, on the goroutine that reads the packets.
+func (f *tapTargetsFilter) applyPending() {
+	select {
+	case expr := <-f.pending:
+		f.apply(expr)
+	default:
+	}
+}
+
+// apply applies a filter, if it changed.
+func (f *tapTargetsFilter) apply(expr string) {
+	if expr == f.expr {
+		return
+	}
+	if err := f.capture.SetBPFFilter(expr); err != nil {
+		// Too many targets for a filter, or a capture that can't compile filters, so every packet is captured as before
+		Error("BPF-Filter", "Failed to apply BPF filter of the tap targets %q, capturing every packet: %s (%v,%+v)", expr, err, err, err)
+		if f.expr != "" {
+			if err := f.capture.SetBPFFilter(""); err != nil {
+				log.Printf("Failed to remove BPF filter %q: %v", f.expr, err)
+				return
+			}
+		}
+		f.expr = ""
+		return
+	}
+	rlog.Infof("Using BPF filter of the tap targets %q", expr)
+	f.expr = expr
+}
+
+/* buildTapTargetsFilterExpr returns the filter expression of the connections that getStreamProps and getDNSStreamProps tap,
+ * or an empty string when every packet should be captured.
+ */
+func buildTapTargetsFilterExpr() string {
+	dnsPorts := dnsDissectorInstance.claimedPorts()
+	if hostMode {
+		return buildHostModeFilterExpr(gSettings.filterAuthorities, dnsPorts)
+	}
+
+	ports, ok := tappedPorts()
+	if !ok {
+		return ""
+	}
+	if *anydirection {
+		return orExpr(portsExpr("", ports), fragmentsFilterExpr)
+	}
+	var ownHosts []string
+	for _, ip := range ownIps {
+		if ip := filterIP(ip); ip != "" {
+			ownHosts = append(ownHosts, ip)
+		}
+	}
+	if len(ownHosts) == 0 {
+		return ""
+	}
+	// Connections are tapped when they come in to the tapped ports, but DNS messages either way
+	return orExpr(
+		fmt.Sprintf("(%s and %s)", hostsExpr("dst", ownHosts), portsExpr("dst", ports)),
+		fmt.Sprintf("(%s and %s)", hostsExpr("src", ownHosts), portsExpr("src", ports)),
+		fmt.Sprintf("(%s and %s)", hostsExpr("", ownHosts), orExpr(portsExpr("", dnsPorts), fragmentsFilterExpr)),
+	)
+}
+
+/* buildHostModeFilterExpr returns the filter of the authorities, which are IP addresses or IP addresses and ports.
+ * The connections of an address are tapped whatever their port, those of an address and port only when they come in to that port,
+ * and DNS messages either way.
+ */
+func buildHostModeFilterExpr(authorities []string, dnsPorts []int) string {
+	var hosts []string
+	var clauses []string
+	for _, authority := range authorities {
+		host, portStr, err := net.SplitHostPort(authority)
+		if err != nil {
+			if ip := filterIP(authority); ip != "" {
+				hosts = append(hosts, ip)
+			}
+			continue
+		}
+		ip := filterIP(host)
+		port, err := strconv.Atoi(portStr)
+		if ip == "" || err != nil {
+			continue
+		}
+		clauses = append(clauses, fmt.Sprintf("((dst host %s and dst port %d) or (src host %s and src port %d))", ip, port, ip, port))
+		clauses = append(clauses, fmt.Sprintf("(host %s and %s)", ip, orExpr(portsExpr("", dnsPorts), fragmentsFilterExpr)))
+	}
+	if len(hosts) == 0 && len(clauses) == 0 {
+		return ""
+	}
+	if len(hosts) > 0 {
+		clauses = append([]string{hostsExpr("", hosts)}, clauses...)
+	}
+	return orExpr(clauses...)
+}
+
+// tappedPorts returns the ports whose connections getStreamProps taps when not in host mode, unless a dissector claims connections of any port.
+func tappedPorts() ([]int, bool) {
+	ports := append([]int{80}, gSettings.filterPorts...)
+
+	dissectorsMutex.RLock()
+	defer dissectorsMutex.RUnlock()
+	for _, dissector := range dissectors {
+		claimer, ok := dissector.(portsDissector)
+		if !ok {
+			return nil, false
+		}
+		ports = append(ports, claimer.claimedPorts()...)
+	}
+	return uniqueInts(ports), true
+}
+
+// filterIP returns the IP address without its zone, which filters don't accept, or an empty string if it isn't an IP address.
+func filterIP(address string) string {
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func hostsExpr(direction string, hosts []string) string {
+	qualifier := "host"
+	if direction != "" {
+		qualifier = direction + " host"
+	}
+	clauses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		clauses = append(clauses, fmt.Sprintf("%s %s", qualifier, host))
+	}
+	return orExpr(clauses...)
+}
+
+func portsExpr(direction string, ports []int) string {
+	qualifier := "port"
+	if direction != "" {
+		qualifier = direction + " port"
+	}
+	clauses := make([]string, 0, len(ports))
+	for _, port := range ports {
+		clauses = append(clauses, fmt.Sprintf("%s %d", qualifier, port))
+	}
+	return orExpr(clauses...)
+}
+
+// orExpr joins the expressions that aren't empty, in parentheses unless there is only one.
+func orExpr(exprs ...string) string {
+	clauses := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		if expr != "" {
+			clauses = append(clauses, expr)
+		}
+	}
+	if len(clauses) <= 1 {
+		return strings.Join(clauses, "")
+	}
+	return "(" + strings.Join(clauses, " or ") + ")"
+}
+
+func uniqueInts(values []int) []int {
+	sort.Ints(values)
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
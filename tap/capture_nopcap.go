@@ -0,0 +1,30 @@
+//go:build nopcap
+// +build nopcap
+
+package tap
+
+import (
+	"errors"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// Tappers built with the nopcap tag capture with AF_PACKET only, so that they don't need libpcap
+
+var errNoPcap = errors.New("the tapper was built without libpcap (nopcap), capture with -capture afpacket")
+
+// Filter expressions are compiled with libpcap, so the tapper captures every packet, and can't be given a filter
+const canCompileBPFFilters = false
+
+func openPcapOffline(filename string) (packetCapture, error) {
+	return nil, errNoPcap
+}
+
+func openPcapLive(iface string) (packetCapture, error) {
+	return nil, errNoPcap
+}
+
+func compileBPFFilter(linkType layers.LinkType, captureLength int, expr string) ([]bpf.RawInstruction, error) {
+	return nil, errors.New("BPF filter expressions are compiled with libpcap, which the tapper was built without (nopcap)")
+}
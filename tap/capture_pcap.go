@@ -0,0 +1,79 @@
+//go:build !nopcap
+// +build !nopcap
+
+package tap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+const canCompileBPFFilters = true
+
+// pcapCapture captures packets with libpcap, which tappers built with the nopcap tag do without.
+type pcapCapture struct {
+	*pcap.Handle
+}
+
+func openPcapOffline(filename string) (packetCapture, error) {
+	handle, err := pcap.OpenOffline(filename)
+	if err != nil {
+		return nil, fmt.Errorf("PCAP OpenOffline error: %v", err)
+	}
+	return &pcapCapture{handle}, nil
+}
+
+func openPcapLive(iface string) (packetCapture, error) {
+	// This is a little complicated because we want to allow all possible options
+	// for creating the packet capture handle... instead of all this you can
+	// just call pcap.OpenLive if you want a simple handle.
+	inactive, err := pcap.NewInactiveHandle(iface)
+	if err != nil {
+		return nil, fmt.Errorf("could not create: %v", err)
+	}
+	defer inactive.CleanUp()
+	if err = inactive.SetSnapLen(*snaplen); err != nil {
+		return nil, fmt.Errorf("could not set snap length: %v", err)
+	} else if err = inactive.SetPromisc(*promisc); err != nil {
+		return nil, fmt.Errorf("could not set promisc mode: %v", err)
+	} else if err = inactive.SetTimeout(time.Second); err != nil {
+		return nil, fmt.Errorf("could not set timeout: %v", err)
+	}
+	if *tstype != "" {
+		if t, err := pcap.TimestampSourceFromString(*tstype); err != nil {
+			return nil, fmt.Errorf("Supported timestamp types: %v", inactive.SupportedTimestamps())
+		} else if err := inactive.SetTimestampSource(t); err != nil {
+			return nil, fmt.Errorf("Supported timestamp types: %v", inactive.SupportedTimestamps())
+		}
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("PCAP Activate error: %v", err)
+	}
+	return &pcapCapture{handle}, nil
+}
+
+func (c *pcapCapture) captureStats() (captureStats, error) {
+	stats, err := c.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{received: stats.PacketsReceived, dropped: stats.PacketsDropped + stats.PacketsIfDropped}, nil
+}
+
+// compileBPFFilter compiles a filter expression with libpcap, for the backends that don't compile expressions themselves.
+func compileBPFFilter(linkType layers.LinkType, captureLength int, expr string) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, captureLength, expr)
+	if err != nil {
+		return nil, err
+	}
+	rawInstructions := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		rawInstructions[i] = bpf.RawInstruction{Op: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+	return rawInstructions, nil
+}
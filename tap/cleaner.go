@@ -30,7 +30,10 @@ func (cl *Cleaner) clean() {
 	flushed, closed := cl.assembler.FlushCloseOlderThan(startCleanTime.Add(-cl.connectionTimeout))
 	cl.assemblerMutex.Unlock()
 
-	deleted := cl.matcher.deleteOlderThan(startCleanTime.Add(-cl.connectionTimeout))
+	deleted := 0
+	if cl.matcher != nil {
+		deleted = cl.matcher.deleteOlderThan(startCleanTime.Add(-cl.connectionTimeout))
+	}
 
 	cl.statsMutex.Lock()
 	cl.stats.flushed += flushed
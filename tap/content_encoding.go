@@ -0,0 +1,181 @@
+package tap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/google/martian/har"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Never decode a body to more than maxDecodedBodyLen bytes, as a small compressed body may decode to a huge one
+const maxDecodedBodyLen = 16 * 1024 * 1024
+
+const contentEncodingHeader = "Content-Encoding"
+
+/* decodedContent is the body of a message decoded from its Content-Encoding, before it is converted to HAR.
+ * The entry keeps the Content-Encoding of the encoded message and the size of the encoded body as its bodySize,
+ * while its text is the decoded body, as the HAR spec has it.
+ */
+type decodedContent struct {
+	header      http.Header // the header of the message, without its Content-Encoding
+	encoding    []string    // the values of the Content-Encoding of the message
+	body        []byte
+	encodedSize int64
+	isTruncated bool
+}
+
+// ContentDecoding records on a HAR entry that the body of a message was decoded from its Content-Encoding.
+type ContentDecoding struct {
+	Encoding  string `json:"encoding"`            // the Content-Encoding of the message, e.g. "gzip" or "gzip, br"
+	Truncated bool   `json:"truncated,omitempty"` // the decoded body was larger than maxDecodedBodyLen, and its HAR text is only its start
+}
+
+// decodeRequestContent returns a copy of a request with its body decoded, and its decoded content, or nil if it has no Content-Encoding.
+func decodeRequestContent(request *http.Request) (*http.Request, *decodedContent) {
+	content := decodeContent(request.Header, request.Body)
+	if content == nil {
+		return request, nil
+	}
+	decoded := *request
+	decoded.Header = content.header
+	decoded.Body = ioutil.NopCloser(bytes.NewReader(content.body))
+	decoded.ContentLength = int64(len(content.body))
+	decoded.TransferEncoding = nil
+	return &decoded, content
+}
+
+// decodeResponseContent returns a copy of a response with its body decoded, and its decoded content, or nil if it has no Content-Encoding.
+func decodeResponseContent(response *http.Response) (*http.Response, *decodedContent) {
+	if response.StatusCode == http.StatusPartialContent {
+		// A part of an encoded body can't be decoded by itself
+		return response, nil
+	}
+	content := decodeContent(response.Header, response.Body)
+	if content == nil {
+		return response, nil
+	}
+	decoded := *response
+	decoded.Header = content.header
+	decoded.Body = ioutil.NopCloser(bytes.NewReader(content.body))
+	decoded.ContentLength = int64(len(content.body))
+	decoded.TransferEncoding = nil
+	return &decoded, content
+}
+
+/* decodeContent reads a body whose header has a Content-Encoding, and decodes it when it knows every coding of it.
+ * A body that can't be decoded is kept as it was, since it would otherwise fail the conversion of the whole entry to HAR.
+ */
+func decodeContent(header http.Header, body io.ReadCloser) *decodedContent {
+	encodings := contentEncodings(header)
+	if len(encodings) == 0 || body == nil || body == http.NoBody {
+		return nil
+	}
+	encoded, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+
+	content := &decodedContent{
+		header:      header.Clone(),
+		encoding:    header.Values(contentEncodingHeader),
+		body:        encoded,
+		encodedSize: int64(len(encoded)),
+	}
+	content.header.Del(contentEncodingHeader)
+	if len(encoded) == 0 {
+		return content
+	}
+
+	decoded := encoded
+	// The codings are listed in the order in which they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		if decoded, err = decodeContentCoding(decoded, encodings[i]); err != nil {
+			SilentError("content-decoding", "Failed decoding body of %s: %s (%v,%+v)", strings.Join(encodings, ", "), err, err, err)
+			content.body = encoded
+			return content
+		}
+	}
+	if len(decoded) > maxDecodedBodyLen {
+		Debug("Decoded body of %s is larger than %d bytes, truncating it", strings.Join(encodings, ", "), maxDecodedBodyLen)
+		decoded = decoded[:maxDecodedBodyLen]
+		content.isTruncated = true
+	}
+	content.body = decoded
+	return content
+}
+
+func contentEncodings(header http.Header) []string {
+	var encodings []string
+	for _, value := range header.Values(contentEncodingHeader) {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+func decodeContentCoding(encoded []byte, encoding string) ([]byte, error) {
+	var reader io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(encoded))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		// deflate is the zlib format, though some servers send a raw deflate stream
+		zlibReader, err := zlib.NewReader(bytes.NewReader(encoded))
+		if err != nil {
+			flateReader := flate.NewReader(bytes.NewReader(encoded))
+			defer flateReader.Close()
+			reader = flateReader
+		} else {
+			defer zlibReader.Close()
+			reader = zlibReader
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(encoded))
+	case "zstd":
+		zstdReader, err := zstd.NewReader(bytes.NewReader(encoded), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	default:
+		return nil, fmt.Errorf("unsupported content coding %s", encoding)
+	}
+
+	// One more byte than the limit tells a body that is too large from one that fits it exactly
+	return ioutil.ReadAll(io.LimitReader(reader, maxDecodedBodyLen+1))
+}
+
+// recordContentEncoding records the Content-Encoding and the body size of an encoded message on its HAR conversion,
+// and returns the record of its decoding for the entry, or nil if it had no Content-Encoding.
+func recordContentEncoding(headers *[]har.Header, bodySize *int64, content *decodedContent) *ContentDecoding {
+	if content == nil {
+		return nil
+	}
+	for _, value := range content.encoding {
+		*headers = append(*headers, har.Header{Name: contentEncodingHeader, Value: value})
+	}
+	*bodySize = content.encodedSize
+	return &ContentDecoding{
+		Encoding:  strings.Join(content.encoding, ", "),
+		Truncated: content.isTruncated,
+	}
+}
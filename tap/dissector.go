@@ -0,0 +1,135 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Protocol describes an application protocol handled by a Dissector.
+type Protocol struct {
+	Name         string
+	Abbreviation string
+}
+
+/* A Dissector parses the reassembled payload of the TCP connections it claims.
+ * Dissect is called once for the client side and once for the server side of a connection,
+ * each in its own goroutine, and should keep parsing until b returns io.EOF.
+ * Parsed messages are emitted as OutputChannelItem objects through reader.Emit.
+ */
+type Dissector interface {
+	Protocol() *Protocol
+	Claims(tcpID *TcpID) bool
+	Dissect(b *bufio.Reader, reader *TcpReader) error
+}
+
+// Emitter receives the output items produced by dissectors.
+type Emitter interface {
+	Emit(item *OutputChannelItem)
+}
+
+// Entry is the protocol-neutral representation of a request and its response,
+// used by dissectors of protocols that do not map onto HAR.
+type Entry struct {
+	Protocol        string      `json:"protocol"`
+	Method          string      `json:"method"`
+	Path            string      `json:"path"`
+	Status          int         `json:"status"`
+	StatusText      string      `json:"statusText,omitempty"`
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         interface{} `json:"request"`
+	Response        interface{} `json:"response,omitempty"`
+}
+
+const HTTPProtocolName = "http"
+
+var dissectors []Dissector
+var dissectorsMutex sync.RWMutex
+
+// The HTTP dissector is the fallback for every tapped connection that no other dissector claims.
+var defaultDissector Dissector = &httpDissector{}
+
+// RegisterDissector adds a dissector that is consulted, in registration order, for every new TCP connection.
+func RegisterDissector(dissector Dissector) {
+	dissectorsMutex.Lock()
+	dissectors = append(dissectors, dissector)
+	dissectorsMutex.Unlock()
+}
+
+func GetProtocols() []*Protocol {
+	dissectorsMutex.RLock()
+	defer dissectorsMutex.RUnlock()
+
+	protocols := []*Protocol{defaultDissector.Protocol()}
+	for _, dissector := range dissectors {
+		protocols = append(protocols, dissector.Protocol())
+	}
+	return protocols
+}
+
+func findDissector(tcpID *TcpID) Dissector {
+	dissectorsMutex.RLock()
+	defer dissectorsMutex.RUnlock()
+
+	for _, dissector := range dissectors {
+		if dissector.Claims(tcpID) {
+			return dissector
+		}
+	}
+	return nil
+}
+
+func newEntry(protocol *Protocol, requestTime time.Time, responseTime time.Time) *Entry {
+	totalTime := responseTime.Sub(requestTime).Round(time.Millisecond).Milliseconds()
+	if totalTime < 1 {
+		totalTime = 1
+	}
+
+	return &Entry{
+		Protocol:        protocol.Name,
+		StartedDateTime: requestTime.UTC(),
+		Time:            totalTime,
+	}
+}
+
+// portsFromEnv returns the comma separated ports in envVar, or defaultPorts if it is not set.
+func portsFromEnv(envVar string, defaultPorts []int) []int {
+	portsStr := os.Getenv(envVar)
+	if portsStr == "" {
+		return defaultPorts
+	}
+	return parseAppPorts(portsStr)
+}
+
+// isServerPort reports whether the destination port of tcpID is one of ports.
+func isServerPort(tcpID *TcpID, ports []int) bool {
+	dstPort, err := strconv.Atoi(tcpID.DstPort)
+	if err != nil {
+		return false
+	}
+	return inArrayInt(ports, dstPort)
+}
+
+// claimsPorts reports whether either side of tcpID uses one of ports.
+func claimsPorts(tcpID *TcpID, ports []int) bool {
+	return isServerPort(tcpID, ports) || isServerPort(tcpID.Reverse(), ports)
+}
+
+// payloadString renders a binary payload as text when possible, and as base64 otherwise.
+func payloadString(payload []byte) *string {
+	if payload == nil {
+		return nil
+	}
+	var str string
+	if utf8.Valid(payload) {
+		str = string(payload)
+	} else {
+		str = base64.StdEncoding.EncodeToString(payload)
+	}
+	return &str
+}
@@ -0,0 +1,137 @@
+package tap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+var dnsResponseCodeNames = map[layers.DNSResponseCode]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+type DNSQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+type DNSMessage struct {
+	ID                 uint16        `json:"id"`
+	OpCode             string        `json:"opCode"`
+	Transport          string        `json:"transport"`
+	RecursionDesired   bool          `json:"recursionDesired,omitempty"`
+	RecursionAvailable bool          `json:"recursionAvailable,omitempty"`
+	Authoritative      bool          `json:"authoritative,omitempty"`
+	Truncated          bool          `json:"truncated,omitempty"`
+	ResponseCode       string        `json:"responseCode,omitempty"`
+	Questions          []DNSQuestion `json:"questions"`
+	Answers            []DNSRecord   `json:"answers,omitempty"`
+	Authorities        []DNSRecord   `json:"authorities,omitempty"`
+	Additionals        []DNSRecord   `json:"additionals,omitempty"`
+	isResponse         bool
+	responseCode       layers.DNSResponseCode
+}
+
+func newDNSMessage(dns *layers.DNS, transport string) *DNSMessage {
+	message := &DNSMessage{
+		ID:                 dns.ID,
+		OpCode:             dns.OpCode.String(),
+		Transport:          transport,
+		RecursionDesired:   dns.RD,
+		RecursionAvailable: dns.RA,
+		Authoritative:      dns.AA,
+		Truncated:          dns.TC,
+		Questions:          make([]DNSQuestion, 0),
+		isResponse:         dns.QR,
+		responseCode:       dns.ResponseCode,
+	}
+	if dns.QR {
+		message.ResponseCode = dnsResponseCodeName(dns.ResponseCode)
+	}
+
+	for _, question := range dns.Questions {
+		message.Questions = append(message.Questions, DNSQuestion{
+			Name:  string(question.Name),
+			Type:  question.Type.String(),
+			Class: question.Class.String(),
+		})
+	}
+	message.Answers = newDNSRecords(dns.Answers)
+	message.Authorities = newDNSRecords(dns.Authorities)
+	message.Additionals = newDNSRecords(dns.Additionals)
+	return message
+}
+
+func newDNSRecords(resourceRecords []layers.DNSResourceRecord) []DNSRecord {
+	records := make([]DNSRecord, 0)
+	for _, record := range resourceRecords {
+		if record.Type == layers.DNSTypeOPT {
+			// The EDNS pseudo record carries no data about the name
+			continue
+		}
+		records = append(records, DNSRecord{
+			Name:  string(record.Name),
+			Type:  record.Type.String(),
+			Class: record.Class.String(),
+			TTL:   record.TTL,
+			Data:  dnsRecordData(&record),
+		})
+	}
+	return records
+}
+
+func dnsRecordData(record *layers.DNSResourceRecord) string {
+	switch record.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return record.IP.String()
+	case layers.DNSTypeNS:
+		return string(record.NS)
+	case layers.DNSTypeCNAME:
+		return string(record.CNAME)
+	case layers.DNSTypePTR:
+		return string(record.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", record.MX.Preference, record.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.SRV.Priority, record.SRV.Weight, record.SRV.Port, record.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", record.SOA.MName, record.SOA.RName, record.SOA.Serial, record.SOA.Refresh, record.SOA.Retry, record.SOA.Expire, record.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		texts := make([]string, 0)
+		for _, text := range record.TXTs {
+			texts = append(texts, string(text))
+		}
+		return strings.Join(texts, " ")
+	}
+	if record.Data == nil {
+		return ""
+	}
+	return *payloadString(record.Data)
+}
+
+func dnsResponseCodeName(code layers.DNSResponseCode) string {
+	if name, ok := dnsResponseCodeNames[code]; ok {
+		return name
+	}
+	return code.String()
+}
@@ -0,0 +1,154 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const dnsPortsEnvVar = "DNS_PORTS"
+
+var dnsProtocol = &Protocol{
+	Name:         "dns",
+	Abbreviation: "DNS",
+}
+
+// dnsDissectorInstance is registered for DNS over TCP, and called directly by the packet loop for DNS over UDP.
+var dnsDissectorInstance = &dnsDissector{ports: portsFromEnv(dnsPortsEnvVar, []int{53})}
+
+func init() {
+	RegisterDissector(dnsDissectorInstance)
+}
+
+/* dnsDissector turns DNS queries and their answers into entries.
+ * Queries are matched with answers by their ID. Queries that are never answered are dropped by the Cleaner.
+ * Unlike other protocols, DNS is tapped when the tapped pod is the client, since pods mostly resolve names
+ * rather than answer queries, see getDNSStreamProps.
+ */
+type dnsDissector struct {
+	ports []int
+}
+
+func (d *dnsDissector) Protocol() *Protocol {
+	return dnsProtocol
+}
+
+func (d *dnsDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *dnsDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *dnsDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	sizeBytes := make([]byte, 2)
+	for {
+		// Over TCP, every message is prefixed by its size
+		if _, err := io.ReadFull(b, sizeBytes); err != nil {
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(sizeBytes))
+		if _, err := io.ReadFull(b, payload); err != nil {
+			return err
+		}
+		d.handleMessage(payload, "tcp", reader.TcpID(), reader.IsOutgoing(), reader.CaptureTime(), reader)
+	}
+}
+
+// DissectUDP handles a UDP datagram captured by the packet loop.
+func (d *dnsDissector) DissectUDP(netFlow gopacket.Flow, udp *layers.UDP, captureTime time.Time, emitter Emitter) {
+	tcpID := &TcpID{
+		SrcIP:   netFlow.Src().String(),
+		DstIP:   netFlow.Dst().String(),
+		SrcPort: fmt.Sprintf("%d", udp.SrcPort),
+		DstPort: fmt.Sprintf("%d", udp.DstPort),
+	}
+	if !d.Claims(tcpID) {
+		return
+	}
+
+	// The client side of the exchange is the one that does not use a DNS port
+	clientIP, serverIP := tcpID.SrcIP, tcpID.DstIP
+	if !isServerPort(tcpID, d.ports) {
+		clientIP, serverIP = serverIP, clientIP
+	}
+	props := getDNSStreamProps(clientIP, serverIP)
+	if !props.isTapTarget {
+		return
+	}
+	d.handleMessage(udp.Payload, "udp", tcpID, props.isOutgoing, captureTime, emitter)
+}
+
+func (d *dnsDissector) handleMessage(payload []byte, transport string, tcpID *TcpID, isOutgoing bool, captureTime time.Time, emitter Emitter) {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		SilentError("DNS-parser", "Failed to decode DNS: %s (%v,%+v)", err, err, err)
+		return
+	}
+	message := newDNSMessage(dns, transport)
+
+	clientTcpID := tcpID
+	if message.isResponse {
+		clientTcpID = tcpID.Reverse()
+	}
+	ident := fmt.Sprintf("%s %d", clientTcpID, message.ID)
+	var pair *requestResponsePair
+	if message.isResponse {
+		pair = reqResMatcher.registerResponse(ident, message, captureTime)
+	} else {
+		pair = reqResMatcher.registerRequest(ident, message, captureTime)
+	}
+	if pair == nil {
+		return
+	}
+	statsTracker.incMatchedMessages()
+
+	request := pair.Request.orig.(*DNSMessage)
+	response := pair.Response.orig.(*DNSMessage)
+	entry := newEntry(dnsProtocol, pair.Request.captureTime, pair.Response.captureTime)
+	if len(request.Questions) > 0 {
+		entry.Method = request.Questions[0].Type
+		entry.Path = request.Questions[0].Name
+	}
+	entry.Status = int(response.responseCode)
+	if response.responseCode != layers.DNSResponseCodeNoErr {
+		entry.StatusText = response.ResponseCode
+	}
+	entry.Request = request
+	entry.Response = response
+
+	if emitter == nil {
+		return
+	}
+	emitter.Emit(&OutputChannelItem{
+		Protocol:       dnsProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, isOutgoing),
+	})
+}
+
+/* getDNSStreamProps decides whether a DNS exchange between clientIP and serverIP is tapped.
+ * It is the counterpart of tcpStreamFactory.getStreamProps, except that the tapped pod may be on either side,
+ * in which case the exchange is outgoing when the tapped pod is the client.
+ */
+func getDNSStreamProps(clientIP string, serverIP string) *streamProps {
+	if hostMode {
+		if inArrayString(gSettings.filterAuthorities, clientIP) {
+			return &streamProps{isTapTarget: true, isOutgoing: true}
+		} else if inArrayString(gSettings.filterAuthorities, serverIP) {
+			return &streamProps{isTapTarget: true, isOutgoing: false}
+		}
+		return &streamProps{isTapTarget: false}
+	}
+
+	if inArrayString(ownIps, serverIP) {
+		return &streamProps{isTapTarget: true, isOutgoing: false}
+	}
+	return &streamProps{isTapTarget: inArrayString(ownIps, clientIP), isOutgoing: true}
+}
@@ -3,9 +3,14 @@ module github.com/up9inc/mizu/tap
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.1
 	github.com/google/gopacket v1.1.19
 	github.com/google/martian v2.1.0+incompatible
+	github.com/klauspost/compress v1.11.13
 	github.com/orcaman/concurrent-map v0.0.0-20210106121528-16402b402231
 	github.com/romana/rlog v0.0.0-20171115192701-f018bc92e7d7
+	go.mongodb.org/mongo-driver v1.5.1
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 	golang.org/x/net v0.0.0-20210421230115-4e50805a0758
+	golang.org/x/sys v0.0.0-20210420072515-93ed5bcd2bfe
 )
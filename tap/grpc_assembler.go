@@ -3,20 +3,24 @@ package tap
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 )
 
 const frameHeaderLen = 9
+const defaultMaxFrameSize = 1 << 14
+const grpcMessageHeaderLen = 5
 var clientPreface = []byte(http2.ClientPreface)
 const initialHeaderTableSize = 4096
 const protoHTTP2 = "HTTP/2.0"
@@ -28,60 +32,186 @@ var maxHTTP2DataLen int = maxHTTP2DataLenDefault // value initialized during ini
 type messageFragment struct {
 	headers []hpack.HeaderField
 	data []byte
+	partialHeaders bool // some of the headers could not be decoded, or were sent before the connection was tapped
+	isGrpc bool
+	grpcMessage *grpcMessageBuffer // the gRPC message whose DATA frames are still being received
+	grpcMessageCount int
 }
 
-type fragmentsByStream map[uint32]*messageFragment
+// headerBlock is a header block whose CONTINUATION frames are still being received.
+type headerBlock struct {
+	streamID uint32
+	fragments []byte
+	endStream bool
+	isPushPromise bool
+}
 
-func (fbs *fragmentsByStream) appendFrame(streamID uint32, frame http2.Frame) {
-	switch frame := frame.(type) {
-	case *http2.MetaHeadersFrame:
-		if existingFragment, ok := (*fbs)[streamID]; ok {
-			existingFragment.headers = append(existingFragment.headers, frame.Fields...)
-		} else {
-			// new fragment
-			(*fbs)[streamID] = &messageFragment{headers: frame.Fields}
+// grpcMessageBuffer assembles a length-prefixed gRPC message out of the DATA frames of a stream.
+type grpcMessageBuffer struct {
+	header []byte
+	length uint32
+	received uint32
+	data []byte
+}
+
+// completedGrpcMessage is a gRPC message of a stream, available before the stream ends.
+type completedGrpcMessage struct {
+	streamID uint32
+	path string // only known on the client side
+	index int
+	isCompressed bool
+	length uint32
+	data []byte
+}
+
+func (fragment *messageFragment) header(name string) string {
+	for _, header := range fragment.headers {
+		if header.Name == name {
+			return header.Value
 		}
-	case *http2.DataFrame:
-		newDataLen := len(frame.Data())
-		if existingFragment, ok := (*fbs)[streamID]; ok {
-			existingDataLen := len(existingFragment.data)
-			// Never save more than maxHTTP2DataLen bytes
-			numBytesToAppend := int(math.Min(float64(maxHTTP2DataLen - existingDataLen), float64(newDataLen)))
+	}
+	return ""
+}
 
-			existingFragment.data = append(existingFragment.data, frame.Data()[:numBytesToAppend]...)
-		} else {
-			// new fragment
-			// In principle, should not happen with DATA frames, because they are always preceded by HEADERS
+type fragmentsByStream map[uint32]*messageFragment
 
-			// Never save more than maxHTTP2DataLen bytes
-			numBytesToAppend := int(math.Min(float64(maxHTTP2DataLen), float64(newDataLen)))
+func (fbs *fragmentsByStream) appendHeaders(streamID uint32, headers []hpack.HeaderField, isPartial bool) {
+	if existingFragment, ok := (*fbs)[streamID]; ok {
+		existingFragment.headers = append(existingFragment.headers, headers...)
+		existingFragment.partialHeaders = existingFragment.partialHeaders || isPartial
+	} else {
+		// new fragment
+		(*fbs)[streamID] = &messageFragment{headers: headers, partialHeaders: isPartial, isGrpc: isGrpcContentType(headers)}
+	}
+}
 
-			(*fbs)[streamID] = &messageFragment{data: frame.Data()[:numBytesToAppend]}
-		}
+func (fbs *fragmentsByStream) appendData(streamID uint32, data []byte) {
+	newDataLen := len(data)
+	if existingFragment, ok := (*fbs)[streamID]; ok {
+		existingDataLen := len(existingFragment.data)
+		// Never save more than maxHTTP2DataLen bytes
+		numBytesToAppend := int(math.Min(float64(maxHTTP2DataLen - existingDataLen), float64(newDataLen)))
+
+		existingFragment.data = append(existingFragment.data, data[:numBytesToAppend]...)
+	} else {
+		// new fragment
+		// Happens when the HEADERS of the stream were sent before the connection was tapped
+
+		// Never save more than maxHTTP2DataLen bytes
+		numBytesToAppend := int(math.Min(float64(maxHTTP2DataLen), float64(newDataLen)))
+
+		(*fbs)[streamID] = &messageFragment{data: append([]byte(nil), data[:numBytesToAppend]...), partialHeaders: true}
 	}
 }
 
-func (fbs *fragmentsByStream) pop(streamID uint32) ([]hpack.HeaderField, []byte) {
-	headers := (*fbs)[streamID].headers
-	data := (*fbs)[streamID].data
+func (fbs *fragmentsByStream) pop(streamID uint32) *messageFragment {
+	fragment := (*fbs)[streamID]
 	delete(*fbs, streamID)
 
-	return headers, data
+	return fragment
 }
 
-func createGrpcAssembler(b *bufio.Reader) GrpcAssembler {
+func createGrpcAssembler(b *bufio.Reader, isClient bool) *GrpcAssembler {
 	var framerOutput bytes.Buffer
 	framer := http2.NewFramer(&framerOutput, b)
-	framer.ReadMetaHeaders = hpack.NewDecoder(initialHeaderTableSize, nil)
-	return GrpcAssembler{
+	// Header blocks are decoded by the assembler, which tolerates connections that were tapped after they started.
+	// For the same reason, a CONTINUATION frame may come first.
+	framer.AllowIllegalReads = true
+	return &GrpcAssembler{
 		fragmentsByStream: make(fragmentsByStream),
 		framer: framer,
+		headerDecoder: newHeaderBlockDecoder(),
+		isClient: isClient,
 	}
 }
 
 type GrpcAssembler struct {
+	fragmentsMutex sync.Mutex // fragments are also popped by the reader of the other direction when a stream is reset
 	fragmentsByStream fragmentsByStream
 	framer *http2.Framer
+	headerDecoder *headerBlockDecoder
+	headerBlock *headerBlock
+	isClient bool
+	grpcMessages []*completedGrpcMessage
+	streamErrors []*http2StreamError
+}
+
+// popGrpcMessages returns the gRPC messages completed by the frames read so far.
+func (ga *GrpcAssembler) popGrpcMessages() []*completedGrpcMessage {
+	messages := ga.grpcMessages
+	ga.grpcMessages = nil
+	return messages
+}
+
+// popStreamErrors returns the RST_STREAM and GOAWAY frames read so far.
+func (ga *GrpcAssembler) popStreamErrors() []*http2StreamError {
+	streamErrors := ga.streamErrors
+	ga.streamErrors = nil
+	return streamErrors
+}
+
+// popFragment removes the fragment of a stream that will not end normally, and returns it if there was one.
+func (ga *GrpcAssembler) popFragment(streamID uint32) *messageFragment {
+	ga.fragmentsMutex.Lock()
+	defer ga.fragmentsMutex.Unlock()
+
+	if _, ok := ga.fragmentsByStream[streamID]; !ok {
+		return nil
+	}
+	return ga.fragmentsByStream.pop(streamID)
+}
+
+func (ga *GrpcAssembler) streamIDs() []uint32 {
+	ga.fragmentsMutex.Lock()
+	defer ga.fragmentsMutex.Unlock()
+
+	streamIDs := make([]uint32, 0, len(ga.fragmentsByStream))
+	for streamID := range ga.fragmentsByStream {
+		streamIDs = append(streamIDs, streamID)
+	}
+	return streamIDs
+}
+
+// readGrpcMessages splits the DATA frames of gRPC streams into messages, so that streaming calls
+// can be followed message by message without waiting for the end of the stream.
+func (ga *GrpcAssembler) readGrpcMessages(streamID uint32, fragment *messageFragment, data []byte) {
+	for len(data) > 0 {
+		message := fragment.grpcMessage
+		if message == nil {
+			message = &grpcMessageBuffer{header: make([]byte, 0, grpcMessageHeaderLen)}
+			fragment.grpcMessage = message
+		}
+
+		if len(message.header) < grpcMessageHeaderLen {
+			n := int(math.Min(float64(grpcMessageHeaderLen - len(message.header)), float64(len(data))))
+			message.header = append(message.header, data[:n]...)
+			data = data[n:]
+			if len(message.header) < grpcMessageHeaderLen {
+				return
+			}
+			message.length = binary.BigEndian.Uint32(message.header[1:])
+		}
+
+		n := int(math.Min(float64(message.length - message.received), float64(len(data))))
+		// Never save more than maxHTTP2DataLen bytes
+		numBytesToAppend := int(math.Min(float64(maxHTTP2DataLen - len(message.data)), float64(n)))
+		message.data = append(message.data, data[:numBytesToAppend]...)
+		message.received += uint32(n)
+		data = data[n:]
+
+		if message.received == message.length {
+			ga.grpcMessages = append(ga.grpcMessages, &completedGrpcMessage{
+				streamID: streamID,
+				path: fragment.header(":path"),
+				index: fragment.grpcMessageCount,
+				isCompressed: message.header[0] == 1,
+				length: message.length,
+				data: message.data,
+			})
+			fragment.grpcMessage = nil
+			fragment.grpcMessageCount++
+		}
+	}
 }
 
 func (ga *GrpcAssembler) readMessage() (uint32, interface{}, error) {
@@ -96,13 +226,69 @@ func (ga *GrpcAssembler) readMessage() (uint32, interface{}, error) {
 
 	streamID := frame.Header().StreamID
 
-	ga.fragmentsByStream.appendFrame(streamID, frame)
+	ga.fragmentsMutex.Lock()
+	var isStreamEnd bool
+	switch frame := frame.(type) {
+	case *http2.HeadersFrame:
+		ga.headerBlock = &headerBlock{
+			streamID: streamID,
+			fragments: append([]byte(nil), frame.HeaderBlockFragment()...),
+			endStream: frame.StreamEnded(),
+		}
+		if frame.HeadersEnded() {
+			isStreamEnd = ga.endHeaderBlock()
+		}
+	case *http2.PushPromiseFrame:
+		// Pushed requests are not recorded, but their headers still update the compression context
+		ga.headerBlock = &headerBlock{
+			streamID: streamID,
+			fragments: append([]byte(nil), frame.HeaderBlockFragment()...),
+			isPushPromise: true,
+		}
+		if frame.HeadersEnded() {
+			ga.endHeaderBlock()
+		}
+	case *http2.ContinuationFrame:
+		if ga.headerBlock == nil || ga.headerBlock.streamID != streamID {
+			// The header block started before the connection was tapped
+			break
+		}
+		ga.headerBlock.fragments = append(ga.headerBlock.fragments, frame.HeaderBlockFragment()...)
+		if frame.HeadersEnded() {
+			isStreamEnd = ga.endHeaderBlock()
+		}
+	case *http2.DataFrame:
+		ga.fragmentsByStream.appendData(streamID, frame.Data())
+		if fragment := ga.fragmentsByStream[streamID]; fragment.isGrpc {
+			ga.readGrpcMessages(streamID, fragment, frame.Data())
+		}
+		isStreamEnd = frame.StreamEnded()
+	case *http2.RSTStreamFrame:
+		ga.streamErrors = append(ga.streamErrors, &http2StreamError{frameType: http2.FrameRSTStream, streamID: streamID, errCode: frame.ErrCode})
+	case *http2.GoAwayFrame:
+		ga.streamErrors = append(ga.streamErrors, &http2StreamError{frameType: http2.FrameGoAway, streamID: frame.LastStreamID, errCode: frame.ErrCode})
+	}
+
+	var fragment *messageFragment
+	if isStreamEnd {
+		fragment = ga.fragmentsByStream.pop(streamID)
+	}
+	ga.fragmentsMutex.Unlock()
 
-	if !(ga.isStreamEnd(frame)) {
+	if fragment == nil {
 		return 0, nil, nil
 	}
 
-	headers, data := ga.fragmentsByStream.pop(streamID)
+	messageHTTP1, err := ga.assembleMessage(fragment)
+	if err != nil {
+		return 0, nil, err
+	}
+	return streamID, messageHTTP1, nil
+}
+
+// assembleMessage converts the headers and data of a stream into a request or a response.
+func (ga *GrpcAssembler) assembleMessage(fragment *messageFragment) (interface{}, error) {
+	headers, data := fragment.headers, fragment.data
 
 	// Note: header keys are converted by http.Header.Set to canonical names, e.g. content-type -> Content-Type.
 	// By converting the keys we violate the HTTP/2 specification, which state that all headers must be lowercase.
@@ -110,51 +296,87 @@ func (ga *GrpcAssembler) readMessage() (uint32, interface{}, error) {
 	for _, header := range headers {
 		headersHTTP1.Add(header.Name, header.Value)
 	}
-	dataString := base64.StdEncoding.EncodeToString(data)
+	if fragment.partialHeaders {
+		headersHTTP1.Set(partialHeadersHeaderName, "true")
+	}
+
+	// When the pseudo-headers could not be decoded, the direction of the stream tells requests from responses
+	method, status := headersHTTP1.Get(":method"), headersHTTP1.Get(":status")
+	isRequest := method != "" || (status == "" && fragment.partialHeaders && ga.isClient)
+	isResponse := status != "" || (method == "" && fragment.partialHeaders && !ga.isClient)
 
 	// Use http1 types only because they are expected in http_matcher.
 	// TODO: Create an interface that will be used by http_matcher:registerRequest and http_matcher:registerRequest
 	//       to accept both HTTP/1.x and HTTP/2 requests and responses
 	var messageHTTP1 interface{}
-	if _, ok := headersHTTP1[":method"]; ok {
+	if isRequest {
+		authority := headersHTTP1.Get(":authority")
+		if authority == "" {
+			authority = headersHTTP1.Get("Host")
+		}
+		requestURL, err := url.ParseRequestURI(headersHTTP1.Get(":path"))
+		if err != nil {
+			requestURL = &url.URL{Path: headersHTTP1.Get(":path")}
+		}
+		requestURL.Scheme = headersHTTP1.Get(":scheme")
+		requestURL.Host = authority
+
 		messageHTTP1 = http.Request{
-			URL: &url.URL{},
-			Method: "POST",
+			URL: requestURL,
+			Method: method,
+			Host: authority,
 			Header: headersHTTP1,
 			Proto: protoHTTP2,
 			ProtoMajor: protoMajorHTTP2,
 			ProtoMinor: protoMinorHTTP2,
-			Body: io.NopCloser(strings.NewReader(dataString)),
-			ContentLength: int64(len(dataString)),
+			Body: io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+		}
+	} else if isResponse {
+		var statusCode int
+		if status != "" {
+			var err error
+			if statusCode, err = strconv.Atoi(status); err != nil {
+				return nil, fmt.Errorf("Failed to assemble stream: invalid status %q", status)
+			}
+			status = fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
 		}
-	} else if _, ok := headersHTTP1[":status"]; ok {
 		messageHTTP1 = http.Response{
+			StatusCode: statusCode,
+			Status: status,
 			Header: headersHTTP1,
 			Proto: protoHTTP2,
 			ProtoMajor: protoMajorHTTP2,
 			ProtoMinor: protoMinorHTTP2,
-			Body: io.NopCloser(strings.NewReader(dataString)),
-			ContentLength: int64(len(dataString)),
+			Body: io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
 		}
 	} else {
-		return 0, nil, errors.New("Failed to assemble stream: neither a request nor a message")
+		return nil, errors.New("Failed to assemble stream: neither a request nor a message")
 	}
 
-	return streamID, messageHTTP1, nil
+	return messageHTTP1, nil
 }
 
-func (ga *GrpcAssembler) isStreamEnd(frame http2.Frame) bool {
-	switch frame := frame.(type) {
-	case *http2.MetaHeadersFrame:
-		if frame.StreamEnded() {
-			return true
-		}
-	case *http2.DataFrame:
-		if frame.StreamEnded() {
+// endHeaderBlock decodes the header block that was completed by the last frame, and tells whether it ended its stream.
+func (ga *GrpcAssembler) endHeaderBlock() bool {
+	block := ga.headerBlock
+	ga.headerBlock = nil
+
+	headers, isComplete := ga.headerDecoder.decode(block.fragments)
+	if block.isPushPromise {
+		return false
+	}
+	ga.fragmentsByStream.appendHeaders(block.streamID, headers, !isComplete)
+	return block.endStream
+}
+
+func isGrpcContentType(headers []hpack.HeaderField) bool {
+	for _, header := range headers {
+		if header.Name == "content-type" && strings.HasPrefix(header.Value, "application/grpc") {
 			return true
 		}
 	}
-
 	return false
 }
 
@@ -168,16 +390,43 @@ func checkIsHTTP2Connection(b *bufio.Reader, isClient bool) (bool, error) {
 	return checkIsHTTP2ServerStream(b)
 }
 
+/* Skip the bytes that come before the first frame.
+ * These are the client preface when the connection was tapped from its start,
+ * and the rest of a frame when the connection was tapped after it started.
+ */
 func prepareHTTP2Connection(b *bufio.Reader, isClient bool) error {
-	if !isClient {
-		return nil
+	if isClient {
+		if isClientPrefacePresent, err := checkClientPreface(b); err != nil {
+			return err
+		} else if isClientPrefacePresent {
+			return discardClientPreface(b)
+		}
 	}
 
-	return discardClientPreface(b)
+	offset, ok, err := findFrameBoundary(b)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("prepareHTTP2Connection: no HTTP/2 frame found")
+	}
+
+	if _, err := b.Discard(offset); err != nil {
+		return err
+	}
+	return nil
 }
 
 func checkIsHTTP2ClientStream(b *bufio.Reader) (bool, error) {
-	return checkClientPreface(b)
+	if isClientPrefacePresent, err := checkClientPreface(b); err != nil || isClientPrefacePresent {
+		return isClientPrefacePresent, err
+	}
+
+	// The connection may have been tapped after it started
+	if startsLikeHTTP1(b) {
+		return false, nil
+	}
+	_, ok, err := findFrameBoundary(b)
+	return ok, err
 }
 
 func checkIsHTTP2ServerStream(b *bufio.Reader) (bool, error) {
@@ -192,19 +441,132 @@ func checkIsHTTP2ServerStream(b *bufio.Reader) (bool, error) {
 	}
 
 	// Check server connection preface (a settings frame)
-	frameHeader := http2.FrameHeader{
+	if frameHeader := parseFrameHeader(buf); frameHeader.Type == http2.FrameSettings {
+		return true, nil
+	}
+
+	// If HTTP/2, but not start of stream
+	if startsLikeHTTP1(b) {
+		return false, nil
+	}
+	_, ok, err := findFrameBoundary(b)
+	return ok, err
+}
+
+/* startsLikeHTTP1 tells whether a stream starts with an HTTP/1 request line or status line.
+ * Such a stream is never searched for HTTP/2 frames, that may follow an upgrade to h2c in the buffered bytes.
+ */
+func startsLikeHTTP1(b *bufio.Reader) bool {
+	buf, err := b.Peek(b.Buffered())
+	if err != nil {
+		return false
+	}
+	if bytes.HasPrefix(buf, []byte("HTTP/1.")) {
+		return true
+	}
+
+	// Request methods are upper case tokens
+	for i, c := range buf {
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return false
+}
+
+func parseFrameHeader(buf []byte) http2.FrameHeader {
+	return http2.FrameHeader{
 		Length:   uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2]),
 		Type:     http2.FrameType(buf[3]),
 		Flags:    http2.Flags(buf[4]),
 		StreamID: binary.BigEndian.Uint32(buf[5:]) & (1<<31 - 1),
 	}
+}
 
-	if frameHeader.Type != http2.FrameSettings {
-		// If HTTP/2, but not start of stream, will also fulfill this condition.
-		return false, nil
+// The flags defined for each frame type (RFC 7540, section 6)
+var definedFrameFlags = map[http2.FrameType]http2.Flags{
+	http2.FrameData:         http2.FlagDataEndStream | http2.FlagDataPadded,
+	http2.FrameHeaders:      http2.FlagHeadersEndStream | http2.FlagHeadersEndHeaders | http2.FlagHeadersPadded | http2.FlagHeadersPriority,
+	http2.FramePriority:     0,
+	http2.FrameRSTStream:    0,
+	http2.FrameSettings:     http2.FlagSettingsAck,
+	http2.FramePushPromise:  http2.FlagPushPromiseEndHeaders | http2.FlagPushPromisePadded,
+	http2.FramePing:         http2.FlagPingAck,
+	http2.FrameGoAway:       0,
+	http2.FrameWindowUpdate: 0,
+	http2.FrameContinuation: http2.FlagContinuationEndHeaders,
+}
+
+/* isPlausibleFrameHeader tells whether bytes are likely to be the header of a frame, rather than part of a payload.
+ * Beyond the type, the flags, the length and the stream of a frame must all be valid for that type.
+ * Frames longer than the default maximal frame size are not expected, since most peers keep that default.
+ */
+func isPlausibleFrameHeader(buf []byte) bool {
+	if buf[5]&0x80 != 0 {
+		// Reserved bit
+		return false
 	}
 
-	return true, nil
+	frameHeader := parseFrameHeader(buf)
+	flags, ok := definedFrameFlags[frameHeader.Type]
+	if !ok || frameHeader.Flags&^flags != 0 || frameHeader.Length > defaultMaxFrameSize {
+		return false
+	}
+
+	length, isConnectionFrame := frameHeader.Length, frameHeader.StreamID == 0
+	switch frameHeader.Type {
+	case http2.FrameData, http2.FrameHeaders, http2.FrameContinuation:
+		return !isConnectionFrame
+	case http2.FramePushPromise:
+		return !isConnectionFrame && length >= 4
+	case http2.FramePriority:
+		return !isConnectionFrame && length == 5
+	case http2.FrameRSTStream:
+		return !isConnectionFrame && length == 4
+	case http2.FrameSettings:
+		return isConnectionFrame && length%6 == 0 && (frameHeader.Flags&http2.FlagSettingsAck == 0 || length == 0)
+	case http2.FramePing:
+		return isConnectionFrame && length == 8
+	case http2.FrameGoAway:
+		return isConnectionFrame && length >= 8
+	case http2.FrameWindowUpdate:
+		return length == 4
+	}
+	return false
+}
+
+/* findFrameBoundary looks for the first frame in the buffered bytes, for connections that were tapped after they started.
+ * An offset is a frame boundary when plausible frame headers follow each other from it up to the end of the buffered bytes.
+ * Past the start of the buffer, at least two frames are required, to rule out a frame header that is only part of a payload.
+ */
+func findFrameBoundary(b *bufio.Reader) (int, bool, error) {
+	if _, err := b.Peek(frameHeaderLen); err != nil {
+		return 0, false, err
+	}
+	buf, err := b.Peek(b.Buffered())
+	if err != nil {
+		return 0, false, err
+	}
+
+	for offset := 0; offset+frameHeaderLen <= len(buf); offset++ {
+		frames := 0
+		end := offset
+		for end+frameHeaderLen <= len(buf) && isPlausibleFrameHeader(buf[end:]) {
+			frames++
+			end += frameHeaderLen + int(parseFrameHeader(buf[end:]).Length)
+		}
+		if frames == 0 || end < len(buf) {
+			continue
+		}
+		// The last frame may continue past the buffered bytes
+		if offset == 0 || frames >= 2 {
+			return offset, true, nil
+		}
+	}
+	return 0, false, nil
 }
 
 func checkClientPreface(b *bufio.Reader) (bool, error) {
@@ -0,0 +1,165 @@
+package tap
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+const GrpcProtocolName = "grpc"
+
+var grpcProtocol = &Protocol{
+	Name:         GrpcProtocolName,
+	Abbreviation: "gRPC",
+}
+
+const (
+	GrpcRequestMessage  = "request"
+	GrpcResponseMessage = "response"
+)
+
+// GrpcMessage is one of the length-prefixed messages of a gRPC call.
+// The HAR entry of the call holds all of its messages, while every message is also emitted on its own
+// as soon as it is complete, which matters for streaming calls that may last for a long time.
+type GrpcMessage struct {
+	Direction   string          `json:"direction"`
+	Index       int             `json:"index"`
+	HTTP2Stream uint32          `json:"http2Stream"`
+	Compressed  bool            `json:"compressed"`
+	Size        uint32          `json:"size"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	Data        string          `json:"data"`
+	Message     json.RawMessage `json:"message,omitempty"` // set by the aggregator when it decodes Data
+}
+
+// grpcCall is the state of a gRPC call shared by both directions of an HTTP/2 connection.
+type grpcCall struct {
+	id   string
+	path string
+	// The messages of the server that were complete before the HEADERS of the client, which hold the path that decoding needs
+	pending []*OutputChannelItem
+}
+
+type grpcCalls struct {
+	sync.Mutex
+	byStream map[uint32]*grpcCall
+}
+
+func (h *httpReader) grpcCalls() *grpcCalls {
+	return h.http2Connection().grpcCalls
+}
+
+/* queueGrpcMessage returns the messages of the call of an HTTP/2 stream that can be emitted, once its path is known.
+ * The path is recorded when given, and messages are held back until then, so that each one is emitted with the path of its call.
+ * A nil item only records the path of a call that has messages.
+ */
+func (h *httpReader) queueGrpcMessage(streamID uint32, path string, item *OutputChannelItem) []*OutputChannelItem {
+	calls := h.grpcCalls()
+	calls.Lock()
+	defer calls.Unlock()
+
+	call, ok := calls.byStream[streamID]
+	if !ok {
+		if item == nil {
+			return nil
+		}
+		call = &grpcCall{id: newStreamID()}
+		calls.byStream[streamID] = call
+	}
+	if path != "" {
+		call.path = path
+	}
+	if item != nil {
+		item.StreamID = call.id
+		call.pending = append(call.pending, item)
+	}
+	if call.path == "" {
+		return nil
+	}
+
+	items := call.pending
+	call.pending = nil
+	for _, item := range items {
+		item.Entry.Path = call.path
+	}
+	return items
+}
+
+// setGrpcCallPath emits the messages that the server sent before the request of their call, whose path is now known.
+func (h *httpReader) setGrpcCallPath(streamID uint32, path string) {
+	for _, item := range h.queueGrpcMessage(streamID, path, nil) {
+		h.reader.Emit(item)
+	}
+}
+
+/* endGrpcCall returns the ID of the call of an HTTP/2 stream that ended, or "" if it had no gRPC messages.
+ * The messages that were held back for a path that never came are emitted without it.
+ */
+func (h *httpReader) endGrpcCall(streamID uint32) string {
+	calls := h.grpcCalls()
+	calls.Lock()
+	call, ok := calls.byStream[streamID]
+	delete(calls.byStream, streamID)
+	calls.Unlock()
+
+	if !ok {
+		return ""
+	}
+	for _, item := range call.pending {
+		h.reader.Emit(item)
+	}
+	return call.id
+}
+
+// endGrpcCalls ends the calls of the streams of a connection that closed, which will not end normally.
+func (h *httpReader) endGrpcCalls() {
+	calls := h.grpcCalls()
+	calls.Lock()
+	streamIDs := make([]uint32, 0, len(calls.byStream))
+	for streamID := range calls.byStream {
+		streamIDs = append(streamIDs, streamID)
+	}
+	calls.Unlock()
+
+	for _, streamID := range streamIDs {
+		h.endGrpcCall(streamID)
+	}
+}
+
+func (h *httpReader) emitGrpcMessage(message *completedGrpcMessage) {
+	direction := GrpcResponseMessage
+	if h.isClient {
+		direction = GrpcRequestMessage
+	}
+	entry := newEntry(grpcProtocol, h.captureTime(), h.captureTime())
+	entry.Method = direction
+	entry.Request = &GrpcMessage{
+		Direction:   direction,
+		Index:       message.index,
+		HTTP2Stream: message.streamID,
+		Compressed:  message.isCompressed,
+		Size:        message.length,
+		Truncated:   uint32(len(message.data)) < message.length,
+		Data:        base64.StdEncoding.EncodeToString(message.data),
+	}
+
+	statsTracker.incMatchedMessages()
+	item := &OutputChannelItem{
+		Protocol: grpcProtocol.Name,
+		Entry:    entry,
+	}
+	for _, item := range h.queueGrpcMessage(message.streamID, message.path, item) {
+		h.reader.Emit(item)
+	}
+}
+
+// newStreamID returns a random ID that links the entries of a stream, such as the messages of a gRPC call.
+func newStreamID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		SilentError("Stream-ID", "Failed to generate stream ID: %s (%v,%+v)", err, err, err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,242 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Flags of the length-prefixed messages of gRPC, gRPC-Web and Connect, and the headers of their status
+const (
+	grpcWebTrailersFlag   = 0x80
+	connectEndStreamFlag  = 0x02
+	grpcStatusHeader      = "Grpc-Status"
+	grpcMessageHeader     = "Grpc-Message"
+	connectProtocolHeader = "Connect-Protocol-Version"
+	connectEncodingHeader = "Connect-Content-Encoding"
+	grpcCompressedFlag    = 0x01
+)
+
+// The gRPC status codes of the error codes of Connect, which are the names of the gRPC codes in snake case
+var connectErrorCodes = map[string]int{
+	"canceled":            1,
+	"unknown":             2,
+	"invalid_argument":    3,
+	"deadline_exceeded":   4,
+	"not_found":           5,
+	"already_exists":      6,
+	"permission_denied":   7,
+	"resource_exhausted":  8,
+	"failed_precondition": 9,
+	"aborted":             10,
+	"out_of_range":        11,
+	"unimplemented":       12,
+	"internal":            13,
+	"unavailable":         14,
+	"data_loss":           15,
+	"unauthenticated":     16,
+}
+
+// connectError is the error of a Connect call, in the body of unary responses and in the end of stream message of streaming ones.
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+/* unwrapGrpcWeb presents gRPC-Web and Connect calls like native gRPC calls, which browsers cannot make.
+ * Both protocols carry the length-prefixed messages of gRPC over HTTP/1.1, but send the status of the call
+ * in the body, since browsers cannot read trailers:
+ *   - gRPC-Web ends the response with a message flagged as trailers, which holds HTTP/1 header lines.
+ *     Its text variant base64 encodes the whole body.
+ *   - Connect streaming calls end the response with a message flagged as the end of the stream, which holds JSON.
+ *     Connect unary calls send a bare message, and report errors with an HTTP status and a JSON body.
+ * The bodies are replaced with the messages alone, and the status is added to the response headers
+ * as grpc-status and grpc-message, where native gRPC calls have it.
+ */
+func unwrapGrpcWeb(request *http.Request, response *http.Response) {
+	contentType := mediaType(request.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(contentType, "application/grpc-web"):
+		isText := strings.HasPrefix(contentType, "application/grpc-web-text")
+		request.Body, request.ContentLength = unwrapGrpcWebBody(request.Body, isText, nil)
+		response.Body, response.ContentLength = unwrapGrpcWebBody(response.Body, isText, response.Header)
+	case strings.HasPrefix(contentType, "application/connect+"):
+		request.Body, request.ContentLength = unwrapConnectBody(request.Body, nil)
+		response.Body, response.ContentLength = unwrapConnectBody(response.Body, response.Header)
+	case request.Header.Get(connectProtocolHeader) != "":
+		setConnectUnaryStatus(response)
+	}
+}
+
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+func readBody(body io.ReadCloser) []byte {
+	if body == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		SilentError("gRPC-Web-body", "Failed to read body: %s (%v,%+v)", err, err, err)
+	}
+	return data
+}
+
+func newBody(data []byte) (io.ReadCloser, int64) {
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data))
+}
+
+// unwrapGrpcWebBody removes the trailers message of a gRPC-Web body, and adds its headers to trailers when given.
+func unwrapGrpcWebBody(body io.ReadCloser, isText bool, trailers http.Header) (io.ReadCloser, int64) {
+	data := readBody(body)
+	if isText {
+		data = decodeGrpcWebText(data)
+	}
+
+	messages := make([]byte, 0, len(data))
+	for len(data) >= grpcMessageHeaderLen {
+		length := binary.BigEndian.Uint32(data[1:grpcMessageHeaderLen])
+		end := grpcMessageHeaderLen + int(length)
+		if uint64(len(data)) < uint64(end) {
+			// Truncated message
+			break
+		}
+		if data[0]&grpcWebTrailersFlag != 0 {
+			if trailers != nil {
+				addGrpcWebTrailers(data[grpcMessageHeaderLen:end], trailers)
+			}
+		} else {
+			messages = append(messages, data[:end]...)
+		}
+		data = data[end:]
+	}
+	return newBody(append(messages, data...))
+}
+
+// decodeGrpcWebText decodes a gRPC-Web text body, which may be made of several base64 chunks that are each padded.
+func decodeGrpcWebText(text []byte) []byte {
+	text = bytes.Join(bytes.Fields(text), nil)
+	decoded := make([]byte, 0, base64.StdEncoding.DecodedLen(len(text)))
+	for start := 0; start < len(text); start += 4 {
+		end := start + 4
+		if end > len(text) {
+			end = len(text)
+		}
+		chunk, err := base64.StdEncoding.DecodeString(string(text[start:end]))
+		if err != nil {
+			SilentError("gRPC-Web-text", "Failed to decode body: %s (%v,%+v)", err, err, err)
+			break
+		}
+		decoded = append(decoded, chunk...)
+	}
+	return decoded
+}
+
+func addGrpcWebTrailers(block []byte, trailers http.Header) {
+	// Trailers are HTTP/1 header lines, without the empty line that ends headers
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(block), strings.NewReader("\r\n"))))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		SilentError("gRPC-Web-trailers", "Failed to parse trailers: %s (%v,%+v)", err, err, err)
+		return
+	}
+	for name, values := range header {
+		for _, value := range values {
+			trailers.Add(name, value)
+		}
+	}
+}
+
+// unwrapConnectBody removes the end of stream message of a Connect streaming body, and adds the status it holds to trailers when given.
+func unwrapConnectBody(body io.ReadCloser, trailers http.Header) (io.ReadCloser, int64) {
+	data := readBody(body)
+
+	messages := make([]byte, 0, len(data))
+	for len(data) >= grpcMessageHeaderLen {
+		length := binary.BigEndian.Uint32(data[1:grpcMessageHeaderLen])
+		end := grpcMessageHeaderLen + int(length)
+		if uint64(len(data)) < uint64(end) {
+			// Truncated message
+			break
+		}
+		if data[0]&connectEndStreamFlag != 0 {
+			if trailers != nil {
+				addConnectEndStream(data[0], data[grpcMessageHeaderLen:end], trailers)
+			}
+		} else {
+			messages = append(messages, data[:end]...)
+		}
+		data = data[end:]
+	}
+	return newBody(append(messages, data...))
+}
+
+// addConnectEndStream adds the status of an end of stream message, which is compressed with the Connect-Content-Encoding of the response when its flags say so.
+func addConnectEndStream(flags byte, message []byte, trailers http.Header) {
+	if flags&grpcCompressedFlag != 0 {
+		encoding := strings.ToLower(strings.TrimSpace(trailers.Get(connectEncodingHeader)))
+		decoded, err := decodeContentCoding(message, encoding)
+		if err != nil {
+			SilentError("Connect-end-stream", "Failed to decompress end of stream message of %s: %s (%v,%+v)", encoding, err, err, err)
+			return
+		}
+		message = decoded
+	}
+
+	endStream := struct {
+		Error    *connectError       `json:"error"`
+		Metadata map[string][]string `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(message, &endStream); err != nil {
+		SilentError("Connect-end-stream", "Failed to parse end of stream message: %s (%v,%+v)", err, err, err)
+		return
+	}
+	for name, values := range endStream.Metadata {
+		for _, value := range values {
+			trailers.Add(name, value)
+		}
+	}
+	setConnectStatus(trailers, endStream.Error)
+}
+
+// setConnectUnaryStatus adds the status of a Connect unary call, which is an error in the body of responses that failed.
+func setConnectUnaryStatus(response *http.Response) {
+	if response.StatusCode == http.StatusOK {
+		setConnectStatus(response.Header, nil)
+		return
+	}
+
+	data := readBody(response.Body)
+	response.Body, response.ContentLength = newBody(data)
+	var err connectError
+	if json.Unmarshal(data, &err) != nil || err.Code == "" {
+		// Not a Connect error, e.g. returned by a proxy
+		return
+	}
+	setConnectStatus(response.Header, &err)
+}
+
+func setConnectStatus(header http.Header, err *connectError) {
+	if err == nil {
+		header.Set(grpcStatusHeader, "0")
+		return
+	}
+
+	code, ok := connectErrorCodes[err.Code]
+	if !ok {
+		code = connectErrorCodes["unknown"]
+	}
+	header.Set(grpcStatusHeader, strconv.Itoa(code))
+	if err.Message != "" {
+		header.Set(grpcMessageHeader, err.Message)
+	}
+}
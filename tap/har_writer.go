@@ -8,8 +8,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/google/martian/har"
@@ -18,14 +16,18 @@ import (
 const readPermission = 0644
 const harFilenameSuffix = ".har"
 const tempFilenameSuffix = ".har.tmp"
+// The entries of the protocols that HAR doesn't describe are written one JSON object per line, next to the har files
+const entriesFilename = "entries.jsonl"
 
 type PairChanItem struct {
+	OutputItem      *OutputChannelItem
 	Request         *http.Request
 	RequestTime     time.Time
 	Response        *http.Response
 	ResponseTime    time.Time
 	RequestSenderIp string
 	ConnectionInfo  *ConnectionInfo
+	StreamID        string
 }
 
 func openNewHarFile(filename string) *HarFile {
@@ -45,7 +47,13 @@ type HarFile struct {
 	entryCount int
 }
 
-func NewEntry(request *http.Request, requestTime time.Time, response *http.Response, responseTime time.Time) (*har.Entry, error) {
+func NewEntry(request *http.Request, requestTime time.Time, response *http.Response, responseTime time.Time) (*HarEntry, error) {
+	// Bodies are decoded before they are converted, so that their HAR text is readable and can be filtered
+	request, requestContent := decodeRequestContent(request)
+	response, responseContent := decodeResponseContent(response)
+	// gRPC-Web and Connect calls are unwrapped once their bodies are decoded, as the messages are in the encoded bodies
+	unwrapGrpcWeb(request, response)
+
 	harRequest, err := har.NewRequest(request, true)
 	if err != nil {
 		SilentError("convert-request-to-har", "Failed converting request to HAR %s (%v,%+v)", err, err, err)
@@ -57,18 +65,12 @@ func NewEntry(request *http.Request, requestTime time.Time, response *http.Respo
 		SilentError("convert-response-to-har", "Failed converting response to HAR %s (%v,%+v)", err, err, err)
 		return nil, errors.New("Failed converting response to HAR")
 	}
+	requestDecoding := recordContentEncoding(&harRequest.Headers, &harRequest.BodySize, requestContent)
+	responseDecoding := recordContentEncoding(&harResponse.Headers, &harResponse.BodySize, responseContent)
 
-	if harRequest.PostData != nil && strings.HasPrefix(harRequest.PostData.MimeType, "application/grpc") {
-		// Force HTTP/2 gRPC into HAR template
-
-		harRequest.URL = fmt.Sprintf("%s://%s%s", request.Header.Get(":scheme"), request.Header.Get(":authority"), request.Header.Get(":path"))
-
-		status, err := strconv.Atoi(response.Header.Get(":status"))
-		if err != nil {
-			SilentError("convert-response-status-for-har", "Failed converting status to int %s (%v,%+v)", err, err, err)
-			return nil, errors.New("Failed converting response status to int for HAR")
-		}
-		harResponse.Status = status
+	if request.ProtoMajor == protoMajorHTTP2 {
+		// The URL of HTTP/2 requests is reconstructed from their pseudo-headers, and is already absolute.
+		harRequest.URL = request.URL.String()
 	} else {
 		// Martian copies http.Request.URL.String() to har.Request.URL, which usually contains the path.
 		// However, according to the HAR spec, the URL field needs to be the absolute URL.
@@ -99,10 +101,14 @@ func NewEntry(request *http.Request, requestTime time.Time, response *http.Respo
 		},
 	}
 
-	return &harEntry, nil
+	return &HarEntry{
+		Entry: &harEntry,
+		RequestDecoding: requestDecoding,
+		ResponseDecoding: responseDecoding,
+	}, nil
 }
 
-func (f *HarFile) WriteEntry(harEntry *har.Entry) {
+func (f *HarFile) WriteEntry(harEntry *HarEntry) {
 	harEntryJson, err := json.Marshal(harEntry)
 	if err != nil {
 		SilentError("har-entry-marshal", "Failed converting har entry object to JSON%s (%v,%+v)", err, err, err)
@@ -156,16 +162,29 @@ func NewHarWriter(outputDir string, maxEntries int) *HarWriter {
 	return &HarWriter{
 		OutputDirPath: outputDir,
 		MaxEntries: maxEntries,
-		PairChan: make(chan *PairChanItem),
-		OutChan: make(chan *OutputChannelItem, 1000),
+		PairChan: make(chan *PairChanItem, pairQueueLen),
+		OutChan: make(chan *OutputChannelItem, outputQueueLen),
 		currentFile: nil,
 		done: make(chan bool),
 	}
 }
 
+// HarEntry is a HAR entry, with the custom fields that record how the bodies of its request and response were decoded.
+type HarEntry struct {
+	*har.Entry
+	RequestDecoding *ContentDecoding `json:"_requestDecoding,omitempty"`
+	ResponseDecoding *ContentDecoding `json:"_responseDecoding,omitempty"`
+}
+
+// OutputChannelItem is the common output of all dissectors.
+// HTTP traffic is described by HarEntry, other protocols by Entry.
+// StreamID links the entries of a stream, such as a gRPC call and each of its messages.
 type OutputChannelItem struct {
-	HarEntry       *har.Entry
+	Protocol       string
+	HarEntry       *HarEntry
+	Entry          *Entry
 	ConnectionInfo *ConnectionInfo
+	StreamID       string
 }
 
 type HarWriter struct {
@@ -174,16 +193,41 @@ type HarWriter struct {
 	PairChan chan *PairChanItem
 	OutChan chan *OutputChannelItem
 	currentFile *HarFile
+	entriesFile *os.File
 	done chan bool
 }
 
-func (hw *HarWriter) WritePair(request *http.Request, requestTime time.Time, response *http.Response, responseTime time.Time, connectionInfo *ConnectionInfo) {
-	hw.PairChan <- &PairChanItem{
+func (hw *HarWriter) WritePair(request *http.Request, requestTime time.Time, response *http.Response, responseTime time.Time, connectionInfo *ConnectionInfo, streamID string) {
+	hw.queuePair(&PairChanItem{
 		Request:        request,
 		RequestTime:    requestTime,
 		Response:       response,
 		ResponseTime:   responseTime,
 		ConnectionInfo: connectionInfo,
+		StreamID:       streamID,
+	})
+}
+
+// Emit queues an item that was already converted by its dissector.
+func (hw *HarWriter) Emit(item *OutputChannelItem) {
+	hw.queuePair(&PairChanItem{OutputItem: item})
+}
+
+// queuePair queues a pair without waiting for the writer, unless the overflow policy is to block.
+func (hw *HarWriter) queuePair(pair *PairChanItem) {
+	select {
+	case hw.PairChan <- pair:
+	default:
+		pairQueue.overflow(hw.PairChan, pair)
+	}
+}
+
+// queueOutput queues an item without waiting for its consumer, unless the overflow policy is to block.
+func (hw *HarWriter) queueOutput(item *OutputChannelItem) {
+	select {
+	case hw.OutChan <- item:
+	default:
+		outputQueue.overflow(hw.OutChan, item)
 	}
 }
 
@@ -196,6 +240,15 @@ func (hw *HarWriter) Start() {
 
 	go func() {
 		for pair := range hw.PairChan {
+			if pair.OutputItem != nil {
+				if hw.OutputDirPath == "" {
+					hw.queueOutput(pair.OutputItem)
+				} else {
+					hw.writeOutputItem(pair.OutputItem)
+				}
+				continue
+			}
+
 			harEntry, err := NewEntry(pair.Request, pair.RequestTime, pair.Response, pair.ResponseTime)
 			if err != nil {
 				continue
@@ -212,16 +265,23 @@ func (hw *HarWriter) Start() {
 					hw.closeFile()
 				}
 			} else {
-				hw.OutChan <- &OutputChannelItem{
+				hw.queueOutput(&OutputChannelItem{
+					Protocol:       HTTPProtocolName,
 					HarEntry:       harEntry,
 					ConnectionInfo: pair.ConnectionInfo,
-				}
+					StreamID:       pair.StreamID,
+				})
 			}
 		}
 
 		if hw.currentFile != nil {
 			hw.closeFile()
 		}
+		if hw.entriesFile != nil {
+			if err := hw.entriesFile.Close(); err != nil {
+				log.Panicf("Failed to close output file: %s (%v,%+v)", err, err, err)
+			}
+		}
 		hw.done <- true
 	} ()
 }
@@ -237,6 +297,26 @@ func (hw *HarWriter) openNewFile() {
 	hw.currentFile = openNewHarFile(filename)
 }
 
+// writeOutputItem writes an item that was already converted by its dissector, since only HTTP is written to har files.
+func (hw *HarWriter) writeOutputItem(item *OutputChannelItem) {
+	if hw.entriesFile == nil {
+		file, err := os.OpenFile(filepath.Join(hw.OutputDirPath, entriesFilename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, readPermission)
+		if err != nil {
+			log.Panicf("Failed to open output file: %s (%v,%+v)", err, err, err)
+		}
+		hw.entriesFile = file
+	}
+
+	itemJson, err := json.Marshal(item)
+	if err != nil {
+		SilentError("entry-marshal", "Failed converting entry object to JSON%s (%v,%+v)", err, err, err)
+		return
+	}
+	if _, err := hw.entriesFile.Write(append(itemJson, '\n')); err != nil {
+		log.Panicf("Failed to write to output file: %s (%v,%+v)", err, err, err)
+	}
+}
+
 func (hw *HarWriter) closeFile() {
 	hw.currentFile.Close()
 	tmpFilename := hw.currentFile.file.Name()
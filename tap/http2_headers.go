@@ -0,0 +1,163 @@
+package tap
+
+import (
+	"errors"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// unknownHeaderName replaces the names of header fields that refer to HPACK table entries that were never seen.
+const unknownHeaderName = "x-mizu-unknown-header"
+
+// partialHeadersHeaderName marks the HTTP/2 messages whose headers could only be partially decoded.
+const partialHeadersHeaderName = "x-mizu-partial-headers"
+
+var errHeaderBlockTruncated = errors.New("truncated header block")
+
+/* headerBlockDecoder decodes HPACK header blocks, even when the connection was tapped after it started.
+ * The dynamic table of the peer then contains entries that were added before the tapper saw them, so fields
+ * that refer to these entries cannot be decoded. Rather than dropping the whole header block, and with it
+ * every later block of the connection, the block is decoded one field at a time:
+ * fields with an unknown index are skipped, and literal fields with an unknown name are still added to the
+ * dynamic table, so that the table resynchronizes as the peer keeps adding literal fields to it.
+ */
+type headerBlockDecoder struct {
+	decoder *hpack.Decoder
+	fields  []hpack.HeaderField
+}
+
+func newHeaderBlockDecoder() *headerBlockDecoder {
+	hd := &headerBlockDecoder{}
+	hd.decoder = hpack.NewDecoder(initialHeaderTableSize, func(field hpack.HeaderField) {
+		hd.fields = append(hd.fields, field)
+	})
+	return hd
+}
+
+// decode returns the fields of a header block, and whether none of them had to be skipped.
+func (hd *headerBlockDecoder) decode(block []byte) ([]hpack.HeaderField, bool) {
+	hd.fields = nil
+	isComplete := true
+	for len(block) > 0 {
+		representation, literalNameIndex, err := nextHeaderFieldRepresentation(block)
+		if err != nil {
+			// The rest of the block cannot be split into fields
+			isComplete = false
+			break
+		}
+		block = block[len(representation):]
+
+		if _, err := hd.decoder.Write(representation); err != nil {
+			isComplete = false
+			if literalNameIndex == 0 || !isInvalidIndexError(err) {
+				continue
+			}
+			// Decode the value with a placeholder name, so that it is added to the dynamic table if needed
+			if _, err := hd.decoder.Write(withLiteralName(representation, literalNameIndex)); err != nil {
+				continue
+			}
+		}
+	}
+	if err := hd.decoder.Close(); err != nil {
+		isComplete = false
+	}
+
+	fields := make([]hpack.HeaderField, 0, len(hd.fields))
+	for _, field := range hd.fields {
+		if field.Name != unknownHeaderName {
+			fields = append(fields, field)
+		}
+	}
+	return fields, isComplete
+}
+
+func isInvalidIndexError(err error) bool {
+	decodingErr, ok := err.(hpack.DecodingError)
+	if !ok {
+		return false
+	}
+	_, ok = decodingErr.Err.(hpack.InvalidIndexError)
+	return ok
+}
+
+// nextHeaderFieldRepresentation returns the first field representation of a header block (RFC 7541, section 6),
+// and the prefix length of its name index if it is a literal field with an indexed name.
+func nextHeaderFieldRepresentation(block []byte) ([]byte, uint8, error) {
+	var prefixLen uint8
+	var isLiteral bool
+	switch {
+	case block[0]&0x80 != 0: // indexed field
+		prefixLen = 7
+	case block[0]&0xc0 == 0x40: // literal field with incremental indexing
+		prefixLen, isLiteral = 6, true
+	case block[0]&0xe0 == 0x20: // dynamic table size update
+		prefixLen = 5
+	default: // literal field without indexing, or never indexed
+		prefixLen, isLiteral = 4, true
+	}
+
+	index, n, err := readHpackInteger(block, prefixLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !isLiteral {
+		return block[:n], 0, nil
+	}
+
+	strings := 1
+	if index == 0 {
+		strings = 2
+	}
+	for i := 0; i < strings; i++ {
+		if n >= len(block) {
+			return nil, 0, errHeaderBlockTruncated
+		}
+		length, lengthLen, err := readHpackInteger(block[n:], 7)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += lengthLen
+		if uint64(len(block)-n) < length {
+			return nil, 0, errHeaderBlockTruncated
+		}
+		n += int(length)
+	}
+
+	if index == 0 {
+		return block[:n], 0, nil
+	}
+	return block[:n], prefixLen, nil
+}
+
+// withLiteralName rewrites a literal field with an indexed name into one with the placeholder name.
+func withLiteralName(representation []byte, prefixLen uint8) []byte {
+	_, n, _ := readHpackInteger(representation, prefixLen)
+	rewritten := []byte{representation[0] &^ (1<<prefixLen - 1), byte(len(unknownHeaderName))}
+	rewritten = append(rewritten, unknownHeaderName...)
+	return append(rewritten, representation[n:]...)
+}
+
+// readHpackInteger decodes an integer with an N-bit prefix (RFC 7541, section 5.1), and returns its length.
+func readHpackInteger(b []byte, prefixLen uint8) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errHeaderBlockTruncated
+	}
+	mask := uint64(1)<<prefixLen - 1
+	value := uint64(b[0]) & mask
+	if value < mask {
+		return value, 1, nil
+	}
+
+	var shift uint
+	for i := 1; i < len(b); i++ {
+		value += uint64(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		if shift >= 63 {
+			return 0, 0, errors.New("hpack integer overflow")
+		}
+	}
+	return 0, 0, errHeaderBlockTruncated
+}
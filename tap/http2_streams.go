@@ -0,0 +1,191 @@
+package tap
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// streamErrorHeaderName holds the frame and the error code that ended an HTTP/2 stream before its end, e.g. "RST_STREAM CANCEL".
+const streamErrorHeaderName = "x-mizu-stream-error"
+
+// http2StreamError is an RST_STREAM frame that reset a stream, or a GOAWAY frame that refused the streams after its last stream.
+type http2StreamError struct {
+	frameType http2.FrameType
+	streamID  uint32 // the stream that was reset, or the last stream that the sender of the GOAWAY processed
+	errCode   http2.ErrCode
+}
+
+func (e *http2StreamError) String() string {
+	return fmt.Sprintf("%s %s", e.frameType, e.errCode)
+}
+
+/* http2Connection is the state of an HTTP/2 connection shared by both of its directions.
+ * A stream that is reset, or refused, is seen in one direction only, but its request and response
+ * may both be incomplete, so the reader that sees the error ends the stream in both directions.
+ */
+type http2Connection struct {
+	sync.Mutex
+	client      *GrpcAssembler
+	server      *GrpcAssembler
+	openStreams map[uint32]struct{} // streams whose request was registered without a response
+	goAway      *http2StreamError
+	closedCount int
+	grpcCalls   *grpcCalls
+	// The number of the HTTP/1 request that upgraded the connection to h2c, which identifies stream 1 for matching
+	upgradeMessageNumber uint
+}
+
+func (h *httpReader) http2Connection() *http2Connection {
+	return h.httpConnection().http2
+}
+
+func (connection *http2Connection) setUpgradeMessageNumber(messageNumber uint) {
+	connection.Lock()
+	defer connection.Unlock()
+	connection.upgradeMessageNumber = messageNumber
+}
+
+func (h *httpReader) registerGrpcAssembler() {
+	connection := h.http2Connection()
+	connection.Lock()
+	defer connection.Unlock()
+
+	if h.isClient {
+		connection.client = h.grpcAssembler
+	} else {
+		connection.server = h.grpcAssembler
+	}
+}
+
+func (h *httpReader) handleHTTP2StreamError(streamError *http2StreamError) {
+	if streamError.frameType == http2.FrameRSTStream {
+		h.abortHTTP2Streams(streamError, []uint32{streamError.streamID})
+		return
+	}
+
+	// The streams that a GOAWAY refuses are initiated by its receiver, and only requests initiated by clients are recorded
+	if h.isClient {
+		return
+	}
+	connection := h.http2Connection()
+	connection.Lock()
+	connection.goAway = streamError
+	connection.Unlock()
+
+	var refusedStreams []uint32
+	for _, streamID := range h.http2StreamIDs() {
+		if streamID%2 == 1 && streamID > streamError.streamID {
+			refusedStreams = append(refusedStreams, streamID)
+		}
+	}
+	h.abortHTTP2Streams(streamError, refusedStreams)
+}
+
+// closeHTTP2Connection ends the streams that were left open after a GOAWAY, once both directions of the connection are closed.
+func (h *httpReader) closeHTTP2Connection() {
+	connection := h.http2Connection()
+	connection.Lock()
+	connection.closedCount++
+	isClosed, goAway := connection.closedCount == 2, connection.goAway
+	connection.Unlock()
+
+	if isClosed && goAway != nil {
+		h.abortHTTP2Streams(goAway, h.http2StreamIDs())
+	}
+	// The calls of streams that were cut off, such as by the end of the capture, are never matched
+	if isClosed {
+		h.endGrpcCalls()
+	}
+}
+
+// http2StreamIDs returns the streams that are still open in either direction.
+func (h *httpReader) http2StreamIDs() []uint32 {
+	connection := h.http2Connection()
+	connection.Lock()
+	defer connection.Unlock()
+
+	streamIDs := make(map[uint32]struct{})
+	for streamID := range connection.openStreams {
+		streamIDs[streamID] = struct{}{}
+	}
+	for _, assembler := range []*GrpcAssembler{connection.client, connection.server} {
+		if assembler == nil {
+			continue
+		}
+		for _, streamID := range assembler.streamIDs() {
+			streamIDs[streamID] = struct{}{}
+		}
+	}
+
+	ids := make([]uint32, 0, len(streamIDs))
+	for streamID := range streamIDs {
+		ids = append(ids, streamID)
+	}
+	return ids
+}
+
+/* abortHTTP2Streams ends streams that will not end normally, and frees their fragments in both directions.
+ * What was received of their request and response is matched as usual, and marked with the error.
+ * A response is made up when the server sent none, so that a request that was cancelled or refused is still recorded.
+ */
+func (h *httpReader) abortHTTP2Streams(streamError *http2StreamError, streamIDs []uint32) {
+	connection := h.http2Connection()
+	connection.Lock()
+	client, server := connection.client, connection.server
+	connection.Unlock()
+
+	for _, streamID := range streamIDs {
+		request := h.abortedHTTP2Message(client, streamID, streamError)
+		response := h.abortedHTTP2Message(server, streamID, streamError)
+
+		if request != nil {
+			h.registerHTTP2Message(streamID, request)
+		}
+
+		connection.Lock()
+		_, isRequestOpen := connection.openStreams[streamID]
+		connection.Unlock()
+
+		if response == nil && isRequestOpen {
+			response = http.Response{
+				Status:     streamError.String(),
+				Header:     http.Header{http.CanonicalHeaderKey(streamErrorHeaderName): []string{streamError.String()}},
+				Proto:      protoHTTP2,
+				ProtoMajor: protoMajorHTTP2,
+				ProtoMinor: protoMinorHTTP2,
+				Body:       http.NoBody,
+			}
+		}
+		if response != nil {
+			h.registerHTTP2Message(streamID, response)
+		}
+		// A stream whose request was lost is never matched, so its call ends here
+		h.endGrpcCall(streamID)
+	}
+}
+
+func (h *httpReader) abortedHTTP2Message(assembler *GrpcAssembler, streamID uint32, streamError *http2StreamError) interface{} {
+	if assembler == nil {
+		return nil
+	}
+	fragment := assembler.popFragment(streamID)
+	if fragment == nil {
+		return nil
+	}
+	messageHTTP1, err := assembler.assembleMessage(fragment)
+	if err != nil {
+		SilentError("HTTP/2-Stream-Error", "stream %s Failed to assemble stream %d after %s: %s (%v,%+v)", h.ident, streamID, streamError, err, err, err)
+		return nil
+	}
+
+	switch messageHTTP1 := messageHTTP1.(type) {
+	case http.Request:
+		messageHTTP1.Header.Set(streamErrorHeaderName, streamError.String())
+	case http.Response:
+		messageHTTP1.Header.Set(streamErrorHeaderName, streamError.String())
+	}
+	return messageHTTP1
+}
@@ -2,7 +2,6 @@ package tap
 
 import (
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
 
@@ -32,7 +31,7 @@ func createResponseRequestMatcher() requestResponseMatcher {
 	return *newMatcher
 }
 
-func (matcher *requestResponseMatcher) registerRequest(ident string, request *http.Request, captureTime time.Time) *requestResponsePair {
+func (matcher *requestResponseMatcher) registerRequest(ident string, request interface{}, captureTime time.Time) *requestResponsePair {
 	split := splitIdent(ident)
 	key := genKey(split)
 
@@ -58,7 +57,7 @@ func (matcher *requestResponseMatcher) registerRequest(ident string, request *ht
 	return nil
 }
 
-func (matcher *requestResponseMatcher) registerResponse(ident string, response *http.Response, captureTime time.Time) *requestResponsePair {
+func (matcher *requestResponseMatcher) registerResponse(ident string, response interface{}, captureTime time.Time) *requestResponsePair {
 	split := splitIdent(ident)
 	key := genKey(split)
 
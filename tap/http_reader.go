@@ -8,76 +8,94 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 )
 
-type httpReaderDataMsg struct {
-	bytes     []byte
-	timestamp time.Time
+// Protocols that an HTTP/1 connection can be upgraded to
+const (
+	webSocketUpgrade = "websocket"
+	h2cUpgrade       = "h2c"
+)
+
+var httpProtocol = &Protocol{
+	Name:         HTTPProtocolName,
+	Abbreviation: "HTTP",
+}
+
+// httpDissector parses HTTP/1.x and HTTP/2 (including gRPC) connections.
+type httpDissector struct{}
+
+func (d *httpDissector) Protocol() *Protocol {
+	return httpProtocol
 }
 
-type tcpID struct {
-	srcIP string
-	dstIP string
-	srcPort string
-	dstPort string
+func (d *httpDissector) Claims(tcpID *TcpID) bool {
+	return true
 }
 
-type ConnectionInfo struct {
-	ClientIP   string
-	ClientPort string
-	ServerIP   string
-	ServerPort string
-	IsOutgoing bool
+func (d *httpDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	h := &httpReader{
+		ident:      reader.ident,
+		tcpID:      reader.tcpID,
+		isClient:   reader.isClient,
+		isOutgoing: reader.isOutgoing,
+		hexdump:    *hexdump,
+		parent:     reader.parent,
+		reader:     reader,
+		harWriter:  reader.harWriter,
+	}
+	h.run(b)
+	return nil
 }
 
-func (tid *tcpID) String() string {
-	return fmt.Sprintf("%s->%s %s->%s", tid.srcIP, tid.dstIP, tid.srcPort, tid.dstPort)
+// httpConnection is the state of an HTTP connection shared by both of its directions.
+type httpConnection struct {
+	http2           *http2Connection
+	webSocket       *webSocketSession
+	responseStreams *responseStreams
 }
 
-/* httpReader gets reads from a channel of bytes of tcp payload, and parses it into HTTP/1 requests and responses.
- * The payload is written to the channel by a tcpStream object that is dedicated to one tcp connection.
+func (h *httpReader) httpConnection() *httpConnection {
+	return h.reader.SharedState(func() interface{} {
+		return &httpConnection{
+			http2: &http2Connection{
+				openStreams: make(map[uint32]struct{}),
+				grpcCalls:   &grpcCalls{byStream: make(map[uint32]*grpcCall)},
+			},
+			webSocket:       &webSocketSession{},
+			responseStreams: &responseStreams{ids: make(map[*http.Response]string)},
+		}
+	}).(*httpConnection)
+}
+
+/* httpReader parses the payload of one direction of a tcp connection into HTTP/1 requests and responses,
+ * or HTTP/2 messages.
+ * Once a connection is upgraded to WebSocket, the rest of its payload is parsed into WebSocket messages.
  * An httpReader object is unidirectional: it parses either a client stream or a server stream.
- * Implements io.Reader interface (Read)
  */
 type httpReader struct {
 	ident         string
-	tcpID         tcpID
+	tcpID         *TcpID
 	isClient      bool
 	isHTTP2       bool
 	isOutgoing    bool
-	msgQueue      chan httpReaderDataMsg // Channel of captured reassembled tcp payload
-	data          []byte
-	captureTime   time.Time
 	hexdump       bool
 	parent        *tcpStream
-	grpcAssembler GrpcAssembler
+	reader        *TcpReader
+	grpcAssembler *GrpcAssembler
+	webSocket     *webSocketReader
+	upgrade       string // the protocol that the client requested to upgrade the connection to
 	messageCount  uint
 	harWriter     *HarWriter
 }
 
-func (h *httpReader) Read(p []byte) (int, error) {
-	var msg httpReaderDataMsg
-	ok := true
-	for ok && len(h.data) == 0 {
-		msg, ok = <-h.msgQueue
-		h.data = msg.bytes
-		h.captureTime = msg.timestamp
-	}
-	if !ok || len(h.data) == 0 {
-		return 0, io.EOF
-	}
-
-	l := copy(p, h.data)
-	h.data = h.data[l:]
-	return l, nil
+func (h *httpReader) captureTime() time.Time {
+	return h.reader.CaptureTime()
 }
 
-func (h *httpReader) run(wg *sync.WaitGroup) {
-	defer wg.Done()
-	b := bufio.NewReader(h)
-
+func (h *httpReader) run(b *bufio.Reader) {
 	if isHTTP2, err := checkIsHTTP2Connection(b, h.isClient); err != nil {
 		SilentError("HTTP/2-Prepare-Connection", "stream %s Failed to check if client is HTTP/2: %s (%v,%+v)", h.ident, err, err, err)
 		// Do something?
@@ -86,17 +104,26 @@ func (h *httpReader) run(wg *sync.WaitGroup) {
 	}
 
 	if h.isHTTP2 {
-		err := prepareHTTP2Connection(b, h.isClient)
-		if err != nil {
-			SilentError("HTTP/2-Prepare-Connection-After-Check", "stream %s error: %s (%v,%+v)", h.ident, err, err, err)
-		}
-		h.grpcAssembler = createGrpcAssembler(b)
+		h.startHTTP2(b)
 	}
 
 	for true {
-		if h.isHTTP2 {
+		if h.isClient && h.upgrade != "" && !h.isHTTP2 && h.webSocket == nil {
+			h.checkUpgrade(b)
+		}
+
+		if h.webSocket != nil {
+			err := h.handleWebSocketFrame(b)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				SilentError("WebSocket", "stream %s error: %s (%v,%+v)", h.ident, err, err, err)
+				continue
+			}
+		} else if h.isHTTP2 {
 			err := h.handleHTTP2Stream()
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				h.closeHTTP2Connection()
 				break
 			} else if err != nil {
 				SilentError("HTTP/2", "stream %s error: %s (%v,%+v)", h.ident, err, err, err)
@@ -122,54 +149,117 @@ func (h *httpReader) run(wg *sync.WaitGroup) {
 	}
 }
 
+func (h *httpReader) startHTTP2(b *bufio.Reader) {
+	err := prepareHTTP2Connection(b, h.isClient)
+	if err != nil {
+		SilentError("HTTP/2-Prepare-Connection-After-Check", "stream %s error: %s (%v,%+v)", h.ident, err, err, err)
+	}
+	h.isHTTP2 = true
+	h.grpcAssembler = createGrpcAssembler(b, h.isClient)
+	h.registerGrpcAssembler()
+}
+
+// checkUpgrade switches the client stream to the protocol it requested to upgrade to, once its next bytes show that the server accepted.
+// Otherwise, the client keeps sending HTTP/1 requests.
+func (h *httpReader) checkUpgrade(b *bufio.Reader) {
+	switch h.upgrade {
+	case webSocketUpgrade:
+		if isWebSocketFrame(b) {
+			h.startWebSocket()
+		}
+	case h2cUpgrade:
+		// After the upgrade, clients send the connection preface as if they had started with HTTP/2
+		if isClientPrefacePresent, err := checkClientPreface(b); err == nil && isClientPrefacePresent {
+			h.startHTTP2(b)
+		}
+	}
+}
+
+func upgradeProtocol(header http.Header) string {
+	return strings.ToLower(strings.TrimSpace(header.Get("Upgrade")))
+}
+
 func (h *httpReader) handleHTTP2Stream() error {
 	streamID, messageHTTP1, err := h.grpcAssembler.readMessage()
 	h.messageCount++
+	for _, message := range h.grpcAssembler.popGrpcMessages() {
+		h.emitGrpcMessage(message)
+	}
+	for _, streamError := range h.grpcAssembler.popStreamErrors() {
+		h.handleHTTP2StreamError(streamError)
+	}
 	if err != nil {
 		return err
 	}
 
-	var reqResPair *requestResponsePair
-	var connectionInfo *ConnectionInfo
+	if messageHTTP1 != nil {
+		h.registerHTTP2Message(streamID, messageHTTP1)
+	}
+	return nil
+}
+
+// registerHTTP2Message matches a request or a response of a stream, and writes the pair once both are known.
+func (h *httpReader) registerHTTP2Message(streamID uint32, messageHTTP1 interface{}) *requestResponsePair {
+	connection := h.http2Connection()
+	connection.Lock()
+	// Streams are told apart from the HTTP/1 messages that came before an upgrade, whose numbers may be the same
+	messageID := fmt.Sprintf("h2-%d", streamID)
+	if streamID == 1 && connection.upgradeMessageNumber != 0 {
+		// The request was sent over HTTP/1, and registered with its number
+		messageID = strconv.FormatUint(uint64(connection.upgradeMessageNumber), 10)
+	}
+	connection.Unlock()
+
+	connectionInfo := h.reader.ConnectionInfo()
+	ident := fmt.Sprintf("%s->%s %s->%s %s", connectionInfo.ClientIP, connectionInfo.ServerIP, connectionInfo.ClientPort, connectionInfo.ServerPort, messageID)
 
+	var reqResPair *requestResponsePair
 	switch messageHTTP1 := messageHTTP1.(type) {
 	case http.Request:
-		ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.srcIP, h.tcpID.dstIP, h.tcpID.srcPort, h.tcpID.dstPort, streamID)
-		connectionInfo = &ConnectionInfo{
-			ClientIP:   h.tcpID.srcIP,
-			ClientPort: h.tcpID.srcPort,
-			ServerIP:   h.tcpID.dstIP,
-			ServerPort: h.tcpID.dstPort,
-			IsOutgoing: h.isOutgoing,
-		}
-		reqResPair = reqResMatcher.registerRequest(ident, &messageHTTP1, h.captureTime)
+		h.setGrpcCallPath(streamID, messageHTTP1.URL.Path)
+		reqResPair = reqResMatcher.registerRequest(ident, &messageHTTP1, h.captureTime())
 	case http.Response:
-		ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.dstIP, h.tcpID.srcIP, h.tcpID.dstPort, h.tcpID.srcPort, streamID)
-		connectionInfo = &ConnectionInfo{
-			ClientIP:   h.tcpID.dstIP,
-			ClientPort: h.tcpID.dstPort,
-			ServerIP:   h.tcpID.srcIP,
-			ServerPort: h.tcpID.srcPort,
-			IsOutgoing: h.isOutgoing,
-		}
-		reqResPair = reqResMatcher.registerResponse(ident, &messageHTTP1, h.captureTime)
+		reqResPair = reqResMatcher.registerResponse(ident, &messageHTTP1, h.captureTime())
 	}
 
+	connection.Lock()
+	if _, isRequest := messageHTTP1.(http.Request); isRequest && reqResPair == nil {
+		connection.openStreams[streamID] = struct{}{}
+	} else {
+		delete(connection.openStreams, streamID)
+	}
+	connection.Unlock()
+
 	if reqResPair != nil {
 		statsTracker.incMatchedMessages()
+		callID := h.endGrpcCall(streamID)
 
 		if h.harWriter != nil {
+			request, response := reqResPair.Request.orig.(*http.Request), reqResPair.Response.orig.(*http.Response)
 			h.harWriter.WritePair(
-				reqResPair.Request.orig.(*http.Request),
+				request,
 				reqResPair.Request.captureTime,
-				reqResPair.Response.orig.(*http.Response),
+				response,
 				reqResPair.Response.captureTime,
 				connectionInfo,
+				callID,
 			)
 		}
 	}
 
-	return nil
+	return reqResPair
+}
+
+// pairStreamID returns the ID that links the entries that follow a response to its pair,
+// which are the events of a streaming response, or the messages of a WebSocket session.
+func (h *httpReader) pairStreamID(request *http.Request, response *http.Response) string {
+	if streamID := h.popResponseStreamID(response); streamID != "" {
+		return streamID
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || upgradeProtocol(response.Header) != webSocketUpgrade {
+		return ""
+	}
+	return h.webSocketSessionID(request)
 }
 
 func (h *httpReader) handleHTTP1ClientStream(b *bufio.Reader) error {
@@ -191,25 +281,30 @@ func (h *httpReader) handleHTTP1ClientStream(b *bufio.Reader) error {
 	}
 	encoding := req.Header["Content-Encoding"]
 	Debug("HTTP/1 Request: %s %s %s (Body:%d) -> %s", h.ident, req.Method, req.URL, s, encoding)
+	if h.upgrade = upgradeProtocol(req.Header); h.upgrade == webSocketUpgrade {
+		h.webSocketSessionID(req)
+	}
 
-	ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.srcIP, h.tcpID.dstIP, h.tcpID.srcPort, h.tcpID.dstPort, h.messageCount)
-	reqResPair := reqResMatcher.registerRequest(ident, req, h.captureTime)
+	ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.SrcIP, h.tcpID.DstIP, h.tcpID.SrcPort, h.tcpID.DstPort, h.messageCount)
+	reqResPair := reqResMatcher.registerRequest(ident, req, h.captureTime())
 	if reqResPair != nil {
 		statsTracker.incMatchedMessages()
 
 		if h.harWriter != nil {
+			request, response := reqResPair.Request.orig.(*http.Request), reqResPair.Response.orig.(*http.Response)
 			h.harWriter.WritePair(
-				reqResPair.Request.orig.(*http.Request),
+				request,
 				reqResPair.Request.captureTime,
-				reqResPair.Response.orig.(*http.Response),
+				response,
 				reqResPair.Response.captureTime,
 				&ConnectionInfo{
-					ClientIP:   h.tcpID.srcIP,
-					ClientPort: h.tcpID.srcPort,
-					ServerIP:   h.tcpID.dstIP,
-					ServerPort: h.tcpID.dstPort,
+					ClientIP:   h.tcpID.SrcIP,
+					ClientPort: h.tcpID.SrcPort,
+					ServerIP:   h.tcpID.DstIP,
+					ServerPort: h.tcpID.DstPort,
 					IsOutgoing: h.isOutgoing,
 				},
+				h.pairStreamID(request, response),
 			)
 		}
 	}
@@ -235,6 +330,19 @@ func (h *httpReader) handleHTTP1ServerStream(b *bufio.Reader) error {
 	if err != nil {
 		return err
 	}
+	var stream io.ReadCloser
+	var streamID string
+	captureTime := h.captureTime
+	if isStreamingResponse(res) {
+		stream, streamID = h.startResponseStream(res)
+	} else if res.ContentLength < 0 && *streamWait > 0 {
+		// A response whose length is unknown may be a long poll, which ends only once the server has something to send
+		rest, restCaptureTime := h.waitForResponseBody(res)
+		captureTime = func() time.Time { return restCaptureTime }
+		if rest != nil {
+			stream, streamID, captureTime = rest, h.registerResponseStream(res), rest.CaptureTime
+		}
+	}
 	body, err := ioutil.ReadAll(res.Body)
 	res.Body = io.NopCloser(bytes.NewBuffer(body)) // rewind
 	s := len(body)
@@ -258,27 +366,44 @@ func (h *httpReader) handleHTTP1ServerStream(b *bufio.Reader) error {
 	encoding := res.Header["Content-Encoding"]
 	Debug("HTTP/1 Response: %s %s URL:%s (%d%s%d%s) -> %s", h.ident, res.Status, req, res.ContentLength, sym, s, contentType, encoding)
 
-	ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.dstIP, h.tcpID.srcIP, h.tcpID.dstPort, h.tcpID.srcPort, h.messageCount)
-	reqResPair := reqResMatcher.registerResponse(ident, res, h.captureTime)
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		switch upgradeProtocol(res.Header) {
+		case webSocketUpgrade:
+			h.startWebSocket()
+		case h2cUpgrade:
+			// The response to the request that upgraded the connection is sent on HTTP/2 stream 1
+			h.http2Connection().setUpgradeMessageNumber(h.messageCount)
+			h.startHTTP2(b)
+			return nil
+		}
+	}
+
+	ident := fmt.Sprintf("%s->%s %s->%s %d", h.tcpID.DstIP, h.tcpID.SrcIP, h.tcpID.DstPort, h.tcpID.SrcPort, h.messageCount)
+	reqResPair := reqResMatcher.registerResponse(ident, res, captureTime())
 	if reqResPair != nil {
 		statsTracker.incMatchedMessages()
 
 		if h.harWriter != nil {
+			request, response := reqResPair.Request.orig.(*http.Request), reqResPair.Response.orig.(*http.Response)
 			h.harWriter.WritePair(
-				reqResPair.Request.orig.(*http.Request),
+				request,
 				reqResPair.Request.captureTime,
-				reqResPair.Response.orig.(*http.Response),
+				response,
 				reqResPair.Response.captureTime,
 				&ConnectionInfo{
-					ClientIP:   h.tcpID.dstIP,
-					ClientPort: h.tcpID.dstPort,
-					ServerIP:   h.tcpID.srcIP,
-					ServerPort: h.tcpID.srcPort,
+					ClientIP:   h.tcpID.DstIP,
+					ClientPort: h.tcpID.DstPort,
+					ServerIP:   h.tcpID.SrcIP,
+					ServerPort: h.tcpID.SrcPort,
 					IsOutgoing: h.isOutgoing,
 				},
+				h.pairStreamID(request, response),
 			)
 		}
 	}
 
+	if stream != nil {
+		return h.readResponseStream(stream, captureTime, res, streamID, req)
+	}
 	return nil
 }
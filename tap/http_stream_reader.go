@@ -0,0 +1,479 @@
+package tap
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SSEProtocolName        = "sse"
+	HTTPStreamProtocolName = "http-stream"
+)
+
+var sseProtocol = &Protocol{
+	Name:         SSEProtocolName,
+	Abbreviation: "SSE",
+}
+
+var httpStreamProtocol = &Protocol{
+	Name:         HTTPStreamProtocolName,
+	Abbreviation: "STREAM",
+}
+
+// Media types of responses that servers send a piece at a time, for as long as they have something to send
+var streamingMediaTypes = map[string]bool{
+	"text/event-stream":         true,
+	"application/x-ndjson":      true,
+	"application/stream+json":   true,
+	"application/json-seq":      true,
+	"multipart/x-mixed-replace": true,
+}
+
+var streamMediaTypes = flag.String("streammediatypes", "", "Comma-separated media types of other responses to stream as they arrive, besides Server-Sent Events, NDJSON, JSON text sequences and multipart/x-mixed-replace")
+var streamWait = flag.Duration("streamwait", 2*time.Second, "How long to wait for the end of a response without a Content-Length, such as a chunked long poll, before streaming the rest of its body as it arrives (0 to always wait for the end)")
+
+// The separators of the records of streaming media types, whose records are emitted one at a time rather than as they are read
+var streamRecordSeparators = map[string]byte{
+	"application/x-ndjson":    '\n',
+	"application/stream+json": '\n',
+	"application/json-seq":    0x1e, // every record starts with RS (RFC 7464)
+}
+
+// Never save more than maxStreamEventLen bytes of an event or a chunk
+const maxStreamEventLen = 1024 * 1024
+
+const (
+	sseDefaultEventType = "message"
+	streamChunkMethod   = "chunk"
+	streamRecordMethod  = "record"
+	streamEndMethod     = "end"
+)
+
+// StreamEvent is an event of a Server-Sent Events response, or a record or a chunk of another streaming response,
+// linked to the HTTP entry of the response by its stream ID. The last one of every stream ends it.
+type StreamEvent struct {
+	Index      int    `json:"index"`
+	Event      string `json:"event,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Retry      string `json:"retry,omitempty"`
+	Data       string `json:"data,omitempty"`
+	Size       int    `json:"size"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Incomplete bool   `json:"incomplete,omitempty"` // the response was still open when the capture of the connection ended
+}
+
+// responseStreams holds the stream IDs of the streaming responses of a connection, until either direction writes their pair.
+type responseStreams struct {
+	sync.Mutex
+	ids map[*http.Response]string
+}
+
+func isStreamingResponse(response *http.Response) bool {
+	contentType := mediaType(response.Header.Get("Content-Type"))
+	if streamingMediaTypes[contentType] {
+		return true
+	}
+	for _, streamMediaType := range strings.Split(*streamMediaTypes, ",") {
+		if contentType != "" && mediaType(streamMediaType) == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+/* startResponseStream takes the body of a streaming response out of it, so that the response is matched
+ * and written as soon as its headers arrive, rather than when a body that may never end is complete.
+ * Only HTTP/1 responses are streamed, as HTTP/2 responses are assembled from their frames once their stream ends.
+ */
+func (h *httpReader) startResponseStream(response *http.Response) (io.ReadCloser, string) {
+	body := response.Body
+	response.Body = http.NoBody
+	return body, h.registerResponseStream(response)
+}
+
+// registerResponseStream returns a new stream ID for a response, which its pair links to once it is written.
+func (h *httpReader) registerResponseStream(response *http.Response) string {
+	streams := h.httpConnection().responseStreams
+	streams.Lock()
+	defer streams.Unlock()
+
+	streamID := newStreamID()
+	streams.ids[response] = streamID
+	return streamID
+}
+
+/* waitForResponseBody reads the body of a response without a Content-Length for up to streamwait, so that a response
+ * that does not end by then, such as a long poll, is written with the part of its body read so far, and the rest of
+ * its body is streamed. It returns that rest, which is nil when the body ended, and the capture time of the last read.
+ * The body is then read on a goroutine of its own, so the capture time of the reader must not be read until it ends.
+ */
+func (h *httpReader) waitForResponseBody(response *http.Response) (*bodyReads, time.Time) {
+	reads := h.startBodyReads(response.Body)
+	body := reads.readFor(*streamWait)
+	if reads.err != nil {
+		// The body ended, with the error of its last read, if any
+		response.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), reads))
+		return nil, reads.captureTime
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return reads, reads.captureTime
+}
+
+// bodyRead is a read of a body, with the capture time of its payload.
+type bodyRead struct {
+	data        []byte
+	captureTime time.Time
+	err         error
+}
+
+// bodyReads hands on the reads of a body that a goroutine of its own makes, so that waiting for them can time out.
+type bodyReads struct {
+	reads       chan bodyRead
+	data        []byte
+	captureTime time.Time
+	err         error
+}
+
+func (h *httpReader) startBodyReads(body io.Reader) *bodyReads {
+	reads := make(chan bodyRead)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := body.Read(buf)
+			reads <- bodyRead{
+				data:        append([]byte(nil), buf[:n]...),
+				captureTime: h.captureTime(),
+				err:         err,
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &bodyReads{reads: reads}
+}
+
+// readFor returns what is read of the body until it ends or the wait is over.
+func (r *bodyReads) readFor(wait time.Duration) []byte {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var body []byte
+	for r.err == nil {
+		select {
+		case read := <-r.reads:
+			body = append(body, read.data...)
+			r.captureTime, r.err = read.captureTime, read.err
+		case <-timer.C:
+			return body
+		}
+	}
+	return body
+}
+
+func (r *bodyReads) Read(p []byte) (int, error) {
+	for len(r.data) == 0 && r.err == nil {
+		read := <-r.reads
+		r.data, r.captureTime, r.err = read.data, read.captureTime, read.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, r.err
+	}
+	return n, nil
+}
+
+// Close does nothing, as the goroutine reads the body until it ends.
+func (r *bodyReads) Close() error {
+	return nil
+}
+
+// CaptureTime returns the capture time of the payload of the last read.
+func (r *bodyReads) CaptureTime() time.Time {
+	return r.captureTime
+}
+
+// popResponseStreamID returns the stream ID of a streaming response when its pair is written, or "".
+func (h *httpReader) popResponseStreamID(response *http.Response) string {
+	streams := h.httpConnection().responseStreams
+	streams.Lock()
+	defer streams.Unlock()
+
+	streamID := streams.ids[response]
+	delete(streams.ids, response)
+	return streamID
+}
+
+// responseStreamReader emits the events of the body of a streaming response as they arrive.
+type responseStreamReader struct {
+	h           *httpReader
+	protocol    *Protocol
+	streamID    string
+	path        string
+	index       int
+	size        int
+	isSSE       bool
+	separator   byte // the end of the records of the stream, or 0 when it is emitted as it is read
+	line        []byte
+	event       *sseEvent
+	record      *streamRecord
+	skipLF      bool // the last read ended with a CR, which may be the start of a CRLF
+	isTruncated bool
+	lastTime    time.Time // the capture time of the last read, since no more payload is captured at the end
+}
+
+type streamRecord struct {
+	data      []byte
+	size      int
+	startTime time.Time
+}
+
+type sseEvent struct {
+	eventType string
+	id        string
+	retry     string
+	data      []byte
+	size      int
+	hasData   bool
+	startTime time.Time
+}
+
+// readResponseStream emits the body of a streaming response, with captureTime returning the capture time of its last read.
+func (h *httpReader) readResponseStream(body io.ReadCloser, captureTime func() time.Time, response *http.Response, streamID string, path string) error {
+	stream := &responseStreamReader{
+		h:        h,
+		protocol: httpStreamProtocol,
+		streamID: streamID,
+		path:     path,
+		lastTime: captureTime(),
+	}
+	contentType := mediaType(response.Header.Get("Content-Type"))
+	if contentType == "text/event-stream" {
+		stream.protocol = sseProtocol
+		stream.isSSE = true
+	}
+	stream.separator = streamRecordSeparators[contentType]
+	defer body.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			stream.write(buf[:n], captureTime())
+		}
+		if err == io.EOF {
+			stream.end(false)
+			return nil
+		} else if err != nil {
+			// The connection ended, or the capture of it did, before the response
+			stream.end(true)
+			return err
+		}
+	}
+}
+
+func (stream *responseStreamReader) write(data []byte, captureTime time.Time) {
+	stream.size += len(data)
+	stream.lastTime = captureTime
+	if stream.separator != 0 {
+		stream.writeRecords(data, captureTime)
+		return
+	}
+	if !stream.isSSE {
+		stream.emitChunk(data, captureTime)
+		return
+	}
+
+	if stream.skipLF && len(data) > 0 && data[0] == '\n' {
+		data = data[1:]
+	}
+	stream.skipLF = false
+
+	for len(data) > 0 {
+		if stream.event == nil {
+			stream.event = &sseEvent{startTime: captureTime}
+		}
+		end := bytes.IndexAny(data, "\r\n")
+		if end < 0 {
+			stream.appendToLine(data)
+			return
+		}
+		stream.appendToLine(data[:end])
+		// A line ends with CRLF, LF or CR
+		if data[end] == '\r' {
+			if end+1 == len(data) {
+				stream.skipLF = true
+			} else if data[end+1] == '\n' {
+				end++
+			}
+		}
+		data = data[end+1:]
+		stream.handleLine(captureTime)
+	}
+}
+
+// writeRecords splits the body into its records, which may end in any of the reads of the body.
+func (stream *responseStreamReader) writeRecords(data []byte, captureTime time.Time) {
+	for len(data) > 0 {
+		if stream.record == nil {
+			stream.record = &streamRecord{startTime: captureTime}
+		}
+		end := bytes.IndexByte(data, stream.separator)
+		if end < 0 {
+			stream.appendToRecord(data)
+			return
+		}
+		stream.appendToRecord(data[:end])
+		data = data[end+1:]
+		stream.emitRecord(captureTime)
+	}
+}
+
+func (stream *responseStreamReader) appendToRecord(data []byte) {
+	record := stream.record
+	numBytesToAppend := len(data)
+	if numBytesToAppend > maxStreamEventLen-len(record.data) {
+		numBytesToAppend = maxStreamEventLen - len(record.data)
+		stream.isTruncated = true
+	}
+	record.data = append(record.data, data[:numBytesToAppend]...)
+	record.size += len(data)
+}
+
+// emitRecord emits the record that was read, unless it is blank, such as what comes before the first RS of a JSON text sequence.
+func (stream *responseStreamReader) emitRecord(captureTime time.Time) {
+	record := stream.record
+	stream.record = nil
+	data := bytes.TrimSpace(record.data)
+	if len(data) == 0 && !stream.isTruncated {
+		return
+	}
+	stream.emit(streamRecordMethod, &StreamEvent{
+		Data:      string(data),
+		Size:      record.size,
+		Truncated: stream.isTruncated,
+	}, record.startTime, captureTime)
+	stream.isTruncated = false
+}
+
+func (stream *responseStreamReader) appendToLine(data []byte) {
+	numBytesToAppend := len(data)
+	if numBytesToAppend > maxStreamEventLen-len(stream.line) {
+		numBytesToAppend = maxStreamEventLen - len(stream.line)
+		stream.isTruncated = true
+	}
+	stream.line = append(stream.line, data[:numBytesToAppend]...)
+	stream.event.size += len(data)
+}
+
+// handleLine parses a line of an event stream (https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation).
+func (stream *responseStreamReader) handleLine(captureTime time.Time) {
+	line := string(stream.line)
+	stream.line = stream.line[:0]
+	event := stream.event
+
+	if line == "" {
+		// An empty line dispatches the event, unless it has no data
+		if event.hasData {
+			stream.emitEvent(event, captureTime)
+		}
+		stream.event = nil
+		stream.isTruncated = false
+		return
+	}
+	if strings.HasPrefix(line, ":") {
+		// Comments, which servers send to keep the connection alive
+		return
+	}
+
+	field, value := line, ""
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+	}
+	switch field {
+	case "event":
+		event.eventType = value
+	case "data":
+		if event.hasData {
+			event.data = append(event.data, '\n')
+		}
+		event.data = append(event.data, value...)
+		event.hasData = true
+		if len(event.data) > maxStreamEventLen {
+			event.data = event.data[:maxStreamEventLen]
+			stream.isTruncated = true
+		}
+	case "id":
+		event.id = value
+	case "retry":
+		event.retry = value
+	}
+}
+
+func (stream *responseStreamReader) emitEvent(event *sseEvent, captureTime time.Time) {
+	eventType := event.eventType
+	if eventType == "" {
+		eventType = sseDefaultEventType
+	}
+	stream.emit(eventType, &StreamEvent{
+		Event:     eventType,
+		ID:        event.id,
+		Retry:     event.retry,
+		Data:      string(event.data),
+		Size:      event.size,
+		Truncated: stream.isTruncated,
+	}, event.startTime, captureTime)
+	stream.isTruncated = false
+}
+
+func (stream *responseStreamReader) emitChunk(data []byte, captureTime time.Time) {
+	savedLen := len(data)
+	if savedLen > maxStreamEventLen {
+		savedLen = maxStreamEventLen
+	}
+	stream.emit(streamChunkMethod, &StreamEvent{
+		Data:      string(data[:savedLen]),
+		Size:      len(data),
+		Truncated: savedLen < len(data),
+	}, captureTime, captureTime)
+}
+
+// end emits the end of the stream, which is incomplete when the response was cut off.
+func (stream *responseStreamReader) end(isIncomplete bool) {
+	captureTime := stream.lastTime
+	if stream.event != nil && stream.event.hasData {
+		// An event that was cut off is still recorded, as the end of a stream dispatches no event
+		stream.emitEvent(stream.event, captureTime)
+	}
+	if stream.record != nil {
+		// The last record needs no separator after it
+		stream.emitRecord(captureTime)
+	}
+	stream.emit(streamEndMethod, &StreamEvent{
+		Size:       stream.size,
+		Incomplete: isIncomplete,
+	}, captureTime, captureTime)
+}
+
+func (stream *responseStreamReader) emit(method string, event *StreamEvent, startTime time.Time, endTime time.Time) {
+	event.Index = stream.index
+	stream.index++
+
+	entry := newEntry(stream.protocol, startTime, endTime)
+	entry.Method = method
+	entry.Path = stream.path
+	entry.Request = event
+
+	statsTracker.incMatchedMessages()
+	stream.h.reader.Emit(&OutputChannelItem{
+		Protocol: stream.protocol.Name,
+		Entry:    entry,
+		StreamID: stream.streamID,
+	})
+}
@@ -0,0 +1,165 @@
+package tap
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// A reassembled packet has at most the largest payload of an IPv6 header that isn't a jumbogram
+	maxIPv6DatagramLen = 65535
+	// Every fragment but the last carries at least 8 bytes of the packet
+	maxIPv6FragmentsPerDatagram = maxIPv6DatagramLen/8 + 1
+	maxIPv6PendingDatagrams     = 4096
+	// Hosts give up on reassembly after 60 seconds (RFC 8200 4.5)
+	ipv6FragmentTimeout = 60 * time.Second
+)
+
+type ipv6FragmentKey struct {
+	src            [16]byte
+	dst            [16]byte
+	identification uint32
+}
+
+type ipv6Fragment struct {
+	offset int
+	data   []byte
+}
+
+type ipv6Datagram struct {
+	fragments  []ipv6Fragment
+	nextHeader layers.IPProtocol
+	totalLen   int // known once the last fragment arrives, -1 until then
+	firstSeen  time.Time
+}
+
+/* ipv6Defragmenter reassembles the fragments of IPv6 packets, as gopacket only reassembles IPv4.
+ * Like the IPv4 defragmenter, it is used by the single goroutine that reads packets.
+ */
+type ipv6Defragmenter struct {
+	datagrams map[ipv6FragmentKey]*ipv6Datagram
+	order     []ipv6FragmentKey
+}
+
+func newIPv6Defragmenter() *ipv6Defragmenter {
+	return &ipv6Defragmenter{datagrams: make(map[ipv6FragmentKey]*ipv6Datagram)}
+}
+
+/* DefragIPv6 adds a fragment, and returns the payload of the packet and the protocol of the payload once all of its fragments arrived.
+ * The payload is nil while fragments are missing.
+ */
+func (d *ipv6Defragmenter) DefragIPv6(ip6 *layers.IPv6, fragment *layers.IPv6Fragment, captureTime time.Time) ([]byte, layers.IPProtocol, error) {
+	offset := int(fragment.FragmentOffset) * 8
+	data := fragment.LayerPayload()
+	if offset == 0 && !fragment.MoreFragments {
+		// An atomic fragment is a whole packet (RFC 6946)
+		return data, fragment.NextHeader, nil
+	}
+	if fragment.MoreFragments && len(data)%8 != 0 {
+		return nil, 0, errors.New("fragment that isn't the last has a length that isn't a multiple of 8")
+	}
+	if offset+len(data) > maxIPv6DatagramLen {
+		return nil, 0, errors.New("fragment ends past the largest packet")
+	}
+
+	d.discardOlderThan(captureTime.Add(-ipv6FragmentTimeout))
+
+	var key ipv6FragmentKey
+	copy(key.src[:], ip6.SrcIP.To16())
+	copy(key.dst[:], ip6.DstIP.To16())
+	key.identification = fragment.Identification
+
+	datagram, ok := d.datagrams[key]
+	if !ok {
+		if len(d.order) >= maxIPv6PendingDatagrams {
+			d.remove(d.order[0])
+		}
+		datagram = &ipv6Datagram{totalLen: -1, firstSeen: captureTime}
+		d.datagrams[key] = datagram
+		d.order = append(d.order, key)
+	}
+
+	end := offset + len(data)
+	for _, other := range datagram.fragments {
+		if offset == other.offset && bytes.Equal(data, other.data) {
+			// A retransmitted fragment, or one captured on two interfaces, is the same fragment again rather than an overlap
+			return nil, 0, nil
+		}
+		if offset < other.offset+len(other.data) && other.offset < end {
+			// Overlapping fragments discard the whole packet (RFC 5722)
+			d.remove(key)
+			return nil, 0, errors.New("overlapping fragments")
+		}
+	}
+	if !fragment.MoreFragments {
+		if datagram.totalLen >= 0 {
+			d.remove(key)
+			return nil, 0, errors.New("more than one last fragment")
+		}
+		datagram.totalLen = end
+	}
+	if offset == 0 {
+		// The protocol of the payload is the one that the first fragment names (RFC 8200 4.5)
+		datagram.nextHeader = fragment.NextHeader
+	}
+	if len(datagram.fragments) >= maxIPv6FragmentsPerDatagram {
+		d.remove(key)
+		return nil, 0, errors.New("too many fragments")
+	}
+	// Packets are read without copying, so the fragment is copied out of the buffer that the next packet reuses
+	datagram.fragments = append(datagram.fragments, ipv6Fragment{offset: offset, data: append([]byte(nil), data...)})
+
+	payload := datagram.reassemble()
+	if payload == nil {
+		return nil, 0, nil
+	}
+	d.remove(key)
+	return payload, datagram.nextHeader, nil
+}
+
+// reassemble returns the payload of the datagram, or nil if any of its fragments is missing.
+func (datagram *ipv6Datagram) reassemble() []byte {
+	if datagram.totalLen < 0 {
+		return nil
+	}
+	received := 0
+	for _, fragment := range datagram.fragments {
+		if fragment.offset+len(fragment.data) > datagram.totalLen {
+			return nil
+		}
+		received += len(fragment.data)
+	}
+	// Fragments don't overlap, so they cover the packet when their lengths add up to it
+	if received != datagram.totalLen {
+		return nil
+	}
+
+	payload := make([]byte, datagram.totalLen)
+	for _, fragment := range datagram.fragments {
+		copy(payload[fragment.offset:], fragment.data)
+	}
+	return payload
+}
+
+func (d *ipv6Defragmenter) discardOlderThan(t time.Time) {
+	for len(d.order) > 0 {
+		datagram, ok := d.datagrams[d.order[0]]
+		if ok && !datagram.firstSeen.Before(t) {
+			return
+		}
+		d.remove(d.order[0])
+	}
+}
+
+func (d *ipv6Defragmenter) remove(key ipv6FragmentKey) {
+	delete(d.datagrams, key)
+	for i, other := range d.order {
+		if other == key {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			return
+		}
+	}
+}
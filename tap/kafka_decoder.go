@@ -0,0 +1,188 @@
+package tap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errKafkaShortBuffer = errors.New("kafka: not enough bytes")
+
+/* kafkaDecoder reads Kafka protocol primitives from a single message.
+ * The first error is sticky: once a read fails every following read returns a zero value,
+ * so callers only need to check err after decoding a whole structure.
+ */
+type kafkaDecoder struct {
+	raw []byte
+	off int
+	err error
+}
+
+func newKafkaDecoder(raw []byte) *kafkaDecoder {
+	return &kafkaDecoder{raw: raw}
+}
+
+func (d *kafkaDecoder) remaining() int {
+	return len(d.raw) - d.off
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errKafkaShortBuffer
+		return nil
+	}
+	buf := d.raw[d.off : d.off+n]
+	d.off += n
+	return buf
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if buf := d.next(1); buf != nil {
+		return int8(buf[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) bool() bool {
+	return d.int8() != 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if buf := d.next(2); buf != nil {
+		return int16(binary.BigEndian.Uint16(buf))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if buf := d.next(4); buf != nil {
+		return int32(binary.BigEndian.Uint32(buf))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if buf := d.next(8); buf != nil {
+		return int64(binary.BigEndian.Uint64(buf))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(d.raw[d.off:])
+	if n <= 0 {
+		d.err = errKafkaShortBuffer
+		return 0
+	}
+	d.off += n
+	return value
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(d.raw[d.off:])
+	if n <= 0 {
+		d.err = errKafkaShortBuffer
+		return 0
+	}
+	d.off += n
+	return value
+}
+
+func (d *kafkaDecoder) uuid() string {
+	buf := d.next(16)
+	if buf == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16])
+}
+
+// compactLength decodes the unsigned varint length used by flexible versions, where 0 stands for null.
+func (d *kafkaDecoder) compactLength() int {
+	return int(d.uvarint()) - 1
+}
+
+func (d *kafkaDecoder) string(flexible bool) string {
+	var length int
+	if flexible {
+		length = d.compactLength()
+	} else {
+		length = int(d.int16())
+	}
+	if length < 0 {
+		return ""
+	}
+	return string(d.next(length))
+}
+
+func (d *kafkaDecoder) nullableString(flexible bool) *string {
+	var length int
+	if flexible {
+		length = d.compactLength()
+	} else {
+		length = int(d.int16())
+	}
+	if length < 0 || d.err != nil {
+		return nil
+	}
+	str := string(d.next(length))
+	return &str
+}
+
+func (d *kafkaDecoder) bytes(flexible bool) []byte {
+	var length int
+	if flexible {
+		length = d.compactLength()
+	} else {
+		length = int(d.int32())
+	}
+	if length < 0 {
+		return nil
+	}
+	return d.next(length)
+}
+
+// varintBytes decodes the varint length prefixed bytes used inside records, where -1 stands for null.
+func (d *kafkaDecoder) varintBytes() []byte {
+	length := int(d.varint())
+	if length < 0 {
+		return nil
+	}
+	return d.next(length)
+}
+
+func (d *kafkaDecoder) arrayLength(flexible bool) int {
+	if flexible {
+		return d.compactLength()
+	}
+	return int(d.int32())
+}
+
+func (d *kafkaDecoder) int32Array(flexible bool) []int32 {
+	length := d.arrayLength(flexible)
+	values := make([]int32, 0)
+	for i := 0; i < length && d.err == nil; i++ {
+		values = append(values, d.int32())
+	}
+	return values
+}
+
+// taggedFields skips the tagged fields section that ends every structure in flexible versions.
+func (d *kafkaDecoder) taggedFields(flexible bool) {
+	if !flexible {
+		return
+	}
+	count := d.uvarint()
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		d.uvarint() // tag
+		d.next(int(d.uvarint()))
+	}
+}
@@ -0,0 +1,537 @@
+package tap
+
+import (
+	"fmt"
+)
+
+const (
+	kafkaApiKeyProduce  = 0
+	kafkaApiKeyFetch    = 1
+	kafkaApiKeyMetadata = 3
+)
+
+var kafkaApiKeyNames = map[int16]string{
+	0:  "Produce",
+	1:  "Fetch",
+	2:  "ListOffsets",
+	3:  "Metadata",
+	8:  "OffsetCommit",
+	9:  "OffsetFetch",
+	10: "FindCoordinator",
+	11: "JoinGroup",
+	12: "Heartbeat",
+	13: "LeaveGroup",
+	14: "SyncGroup",
+	15: "DescribeGroups",
+	16: "ListGroups",
+	17: "SaslHandshake",
+	18: "ApiVersions",
+	19: "CreateTopics",
+	20: "DeleteTopics",
+	21: "DeleteRecords",
+	22: "InitProducerId",
+	23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn",
+	25: "AddOffsetsToTxn",
+	26: "EndTxn",
+	28: "TxnOffsetCommit",
+	29: "DescribeAcls",
+	30: "CreateAcls",
+	31: "DeleteAcls",
+	32: "DescribeConfigs",
+	33: "AlterConfigs",
+	36: "SaslAuthenticate",
+	37: "CreatePartitions",
+	42: "DeleteGroups",
+	44: "IncrementalAlterConfigs",
+	47: "OffsetDelete",
+	60: "DescribeCluster",
+	61: "DescribeProducers",
+}
+
+var kafkaErrorNames = map[int16]string{
+	-1:  "UNKNOWN_SERVER_ERROR",
+	1:   "OFFSET_OUT_OF_RANGE",
+	2:   "CORRUPT_MESSAGE",
+	3:   "UNKNOWN_TOPIC_OR_PARTITION",
+	5:   "LEADER_NOT_AVAILABLE",
+	6:   "NOT_LEADER_OR_FOLLOWER",
+	7:   "REQUEST_TIMED_OUT",
+	10:  "MESSAGE_TOO_LARGE",
+	13:  "NETWORK_EXCEPTION",
+	15:  "COORDINATOR_NOT_AVAILABLE",
+	16:  "NOT_COORDINATOR",
+	17:  "INVALID_TOPIC_EXCEPTION",
+	18:  "RECORD_LIST_TOO_LARGE",
+	19:  "NOT_ENOUGH_REPLICAS",
+	20:  "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	22:  "ILLEGAL_GENERATION",
+	25:  "UNKNOWN_MEMBER_ID",
+	27:  "REBALANCE_IN_PROGRESS",
+	29:  "TOPIC_AUTHORIZATION_FAILED",
+	30:  "GROUP_AUTHORIZATION_FAILED",
+	31:  "CLUSTER_AUTHORIZATION_FAILED",
+	35:  "UNSUPPORTED_VERSION",
+	36:  "TOPIC_ALREADY_EXISTS",
+	41:  "NOT_CONTROLLER",
+	42:  "INVALID_REQUEST",
+	47:  "INVALID_PRODUCER_EPOCH",
+	58:  "SASL_AUTHENTICATION_FAILED",
+	72:  "LISTENER_NOT_FOUND",
+	74:  "FENCED_LEADER_EPOCH",
+	75:  "UNKNOWN_LEADER_EPOCH",
+	100: "UNKNOWN_TOPIC_ID",
+}
+
+// kafkaFlexibleVersions holds, per API key, the first version that uses compact encodings and tagged fields.
+var kafkaFlexibleVersions = map[int16]int16{
+	kafkaApiKeyProduce:  9,
+	kafkaApiKeyFetch:    12,
+	kafkaApiKeyMetadata: 9,
+}
+
+type KafkaRequest struct {
+	ApiKey        int16       `json:"apiKey"`
+	ApiKeyName    string      `json:"apiKeyName"`
+	ApiVersion    int16       `json:"apiVersion"`
+	CorrelationID int32       `json:"correlationId"`
+	ClientID      *string     `json:"clientId"`
+	Size          int         `json:"size"`
+	Payload       interface{} `json:"payload,omitempty"`
+}
+
+type KafkaResponse struct {
+	CorrelationID int32       `json:"correlationId"`
+	Size          int         `json:"size"`
+	Payload       interface{} `json:"payload,omitempty"`
+	body          []byte
+}
+
+type KafkaProducePartition struct {
+	Partition int32             `json:"partition"`
+	Records   *KafkaRecordBatch `json:"records"`
+}
+
+type KafkaProduceTopic struct {
+	Topic      string                  `json:"topic"`
+	Partitions []KafkaProducePartition `json:"partitions"`
+}
+
+type KafkaProduceRequest struct {
+	TransactionalID *string             `json:"transactionalId"`
+	Acks            int16               `json:"acks"`
+	TimeoutMs       int32               `json:"timeoutMs"`
+	Topics          []KafkaProduceTopic `json:"topics"`
+}
+
+type KafkaProducePartitionResponse struct {
+	Partition    int32   `json:"partition"`
+	ErrorCode    int16   `json:"errorCode"`
+	BaseOffset   int64   `json:"baseOffset"`
+	ErrorMessage *string `json:"errorMessage,omitempty"`
+}
+
+type KafkaProduceTopicResponse struct {
+	Topic      string                          `json:"topic"`
+	Partitions []KafkaProducePartitionResponse `json:"partitions"`
+}
+
+type KafkaProduceResponse struct {
+	Topics         []KafkaProduceTopicResponse `json:"topics"`
+	ThrottleTimeMs int32                       `json:"throttleTimeMs"`
+}
+
+type KafkaFetchPartition struct {
+	Partition         int32 `json:"partition"`
+	FetchOffset       int64 `json:"fetchOffset"`
+	PartitionMaxBytes int32 `json:"partitionMaxBytes"`
+}
+
+type KafkaFetchTopic struct {
+	Topic      string                `json:"topic,omitempty"`
+	TopicID    string                `json:"topicId,omitempty"`
+	Partitions []KafkaFetchPartition `json:"partitions"`
+}
+
+type KafkaFetchRequest struct {
+	ReplicaID      int32             `json:"replicaId"`
+	MaxWaitMs      int32             `json:"maxWaitMs"`
+	MinBytes       int32             `json:"minBytes"`
+	MaxBytes       int32             `json:"maxBytes"`
+	IsolationLevel int8              `json:"isolationLevel"`
+	SessionID      int32             `json:"sessionId"`
+	SessionEpoch   int32             `json:"sessionEpoch"`
+	Topics         []KafkaFetchTopic `json:"topics"`
+}
+
+type KafkaFetchPartitionResponse struct {
+	Partition     int32             `json:"partition"`
+	ErrorCode     int16             `json:"errorCode"`
+	HighWatermark int64             `json:"highWatermark"`
+	Records       *KafkaRecordBatch `json:"records"`
+}
+
+type KafkaFetchTopicResponse struct {
+	Topic      string                        `json:"topic,omitempty"`
+	TopicID    string                        `json:"topicId,omitempty"`
+	Partitions []KafkaFetchPartitionResponse `json:"partitions"`
+}
+
+type KafkaFetchResponse struct {
+	ThrottleTimeMs int32                     `json:"throttleTimeMs"`
+	ErrorCode      int16                     `json:"errorCode"`
+	SessionID      int32                     `json:"sessionId"`
+	Topics         []KafkaFetchTopicResponse `json:"topics"`
+}
+
+type KafkaMetadataRequest struct {
+	Topics                 []string `json:"topics"`
+	AllowAutoTopicCreation bool     `json:"allowAutoTopicCreation"`
+}
+
+type KafkaBroker struct {
+	NodeID int32   `json:"nodeId"`
+	Host   string  `json:"host"`
+	Port   int32   `json:"port"`
+	Rack   *string `json:"rack"`
+}
+
+type KafkaMetadataPartition struct {
+	ErrorCode int16   `json:"errorCode"`
+	Partition int32   `json:"partition"`
+	Leader    int32   `json:"leader"`
+	Replicas  []int32 `json:"replicas"`
+	Isr       []int32 `json:"isr"`
+}
+
+type KafkaMetadataTopic struct {
+	ErrorCode  int16                    `json:"errorCode"`
+	Topic      string                   `json:"topic"`
+	IsInternal bool                     `json:"isInternal"`
+	Partitions []KafkaMetadataPartition `json:"partitions"`
+}
+
+type KafkaMetadataResponse struct {
+	ThrottleTimeMs int32                `json:"throttleTimeMs"`
+	Brokers        []KafkaBroker        `json:"brokers"`
+	ClusterID      *string              `json:"clusterId"`
+	ControllerID   int32                `json:"controllerId"`
+	Topics         []KafkaMetadataTopic `json:"topics"`
+}
+
+func kafkaApiKeyName(apiKey int16) string {
+	if name, ok := kafkaApiKeyNames[apiKey]; ok {
+		return name
+	}
+	return fmt.Sprintf("ApiKey%d", apiKey)
+}
+
+func isKafkaFlexible(apiKey int16, apiVersion int16) bool {
+	flexibleVersion, ok := kafkaFlexibleVersions[apiKey]
+	return ok && apiVersion >= flexibleVersion
+}
+
+func decodeKafkaRequest(raw []byte) (*KafkaRequest, error) {
+	d := newKafkaDecoder(raw)
+	request := &KafkaRequest{Size: len(raw)}
+	request.ApiKey = d.int16()
+	request.ApiVersion = d.int16()
+	request.CorrelationID = d.int32()
+	request.ClientID = d.nullableString(false) // the client id is never a compact string
+	if d.err != nil {
+		return nil, d.err
+	}
+	request.ApiKeyName = kafkaApiKeyName(request.ApiKey)
+
+	flexible := isKafkaFlexible(request.ApiKey, request.ApiVersion)
+	d.taggedFields(flexible)
+
+	var payload interface{}
+	switch request.ApiKey {
+	case kafkaApiKeyProduce:
+		payload = decodeKafkaProduceRequest(d, request.ApiVersion, flexible)
+	case kafkaApiKeyFetch:
+		payload = decodeKafkaFetchRequest(d, request.ApiVersion, flexible)
+	case kafkaApiKeyMetadata:
+		payload = decodeKafkaMetadataRequest(d, request.ApiVersion, flexible)
+	}
+	if d.err != nil {
+		SilentError("Kafka-request-body", "Failed to decode %s v%d request: %s (%v,%+v)", request.ApiKeyName, request.ApiVersion, d.err, d.err, d.err)
+	} else {
+		request.Payload = payload
+	}
+
+	return request, nil
+}
+
+func decodeKafkaResponseHeader(raw []byte) (*KafkaResponse, error) {
+	d := newKafkaDecoder(raw)
+	response := &KafkaResponse{Size: len(raw)}
+	response.CorrelationID = d.int32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	response.body = raw[d.off:]
+	return response, nil
+}
+
+// decodeBody decodes the response body, which can only be done once the matching request is known.
+func (response *KafkaResponse) decodeBody(request *KafkaRequest) {
+	flexible := isKafkaFlexible(request.ApiKey, request.ApiVersion)
+	d := newKafkaDecoder(response.body)
+	d.taggedFields(flexible)
+
+	var payload interface{}
+	switch request.ApiKey {
+	case kafkaApiKeyProduce:
+		payload = decodeKafkaProduceResponse(d, request.ApiVersion, flexible)
+	case kafkaApiKeyFetch:
+		payload = decodeKafkaFetchResponse(d, request.ApiVersion, flexible)
+	case kafkaApiKeyMetadata:
+		payload = decodeKafkaMetadataResponse(d, request.ApiVersion, flexible)
+	}
+	if d.err != nil {
+		SilentError("Kafka-response-body", "Failed to decode %s v%d response: %s (%v,%+v)", request.ApiKeyName, request.ApiVersion, d.err, d.err, d.err)
+	} else {
+		response.Payload = payload
+	}
+	response.body = nil
+}
+
+func decodeKafkaProduceRequest(d *kafkaDecoder, version int16, flexible bool) *KafkaProduceRequest {
+	request := &KafkaProduceRequest{Topics: make([]KafkaProduceTopic, 0)}
+	if version >= 3 {
+		request.TransactionalID = d.nullableString(flexible)
+	}
+	request.Acks = d.int16()
+	request.TimeoutMs = d.int32()
+	topicCount := d.arrayLength(flexible)
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		topic := KafkaProduceTopic{Topic: d.string(flexible), Partitions: make([]KafkaProducePartition, 0)}
+		partitionCount := d.arrayLength(flexible)
+		for j := 0; j < partitionCount && d.err == nil; j++ {
+			partition := KafkaProducePartition{Partition: d.int32()}
+			partition.Records = decodeKafkaRecords(d.bytes(flexible))
+			d.taggedFields(flexible)
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		d.taggedFields(flexible)
+		request.Topics = append(request.Topics, topic)
+	}
+	d.taggedFields(flexible)
+	return request
+}
+
+func decodeKafkaProduceResponse(d *kafkaDecoder, version int16, flexible bool) *KafkaProduceResponse {
+	response := &KafkaProduceResponse{Topics: make([]KafkaProduceTopicResponse, 0)}
+	topicCount := d.arrayLength(flexible)
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		topic := KafkaProduceTopicResponse{Topic: d.string(flexible), Partitions: make([]KafkaProducePartitionResponse, 0)}
+		partitionCount := d.arrayLength(flexible)
+		for j := 0; j < partitionCount && d.err == nil; j++ {
+			partition := KafkaProducePartitionResponse{Partition: d.int32(), ErrorCode: d.int16(), BaseOffset: d.int64()}
+			if version >= 2 {
+				d.int64() // logAppendTimeMs
+			}
+			if version >= 5 {
+				d.int64() // logStartOffset
+			}
+			if version >= 8 {
+				recordErrorCount := d.arrayLength(flexible)
+				for k := 0; k < recordErrorCount && d.err == nil; k++ {
+					d.int32()                  // batchIndex
+					d.nullableString(flexible) // batchIndexErrorMessage
+					d.taggedFields(flexible)
+				}
+				partition.ErrorMessage = d.nullableString(flexible)
+			}
+			d.taggedFields(flexible)
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		d.taggedFields(flexible)
+		response.Topics = append(response.Topics, topic)
+	}
+	if version >= 1 {
+		response.ThrottleTimeMs = d.int32()
+	}
+	d.taggedFields(flexible)
+	return response
+}
+
+func decodeKafkaFetchRequest(d *kafkaDecoder, version int16, flexible bool) *KafkaFetchRequest {
+	request := &KafkaFetchRequest{Topics: make([]KafkaFetchTopic, 0)}
+	request.ReplicaID = d.int32()
+	request.MaxWaitMs = d.int32()
+	request.MinBytes = d.int32()
+	if version >= 3 {
+		request.MaxBytes = d.int32()
+	}
+	if version >= 4 {
+		request.IsolationLevel = d.int8()
+	}
+	if version >= 7 {
+		request.SessionID = d.int32()
+		request.SessionEpoch = d.int32()
+	}
+	topicCount := d.arrayLength(flexible)
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		topic := KafkaFetchTopic{Partitions: make([]KafkaFetchPartition, 0)}
+		if version >= 13 {
+			topic.TopicID = d.uuid()
+		} else {
+			topic.Topic = d.string(flexible)
+		}
+		partitionCount := d.arrayLength(flexible)
+		for j := 0; j < partitionCount && d.err == nil; j++ {
+			partition := KafkaFetchPartition{Partition: d.int32()}
+			if version >= 9 {
+				d.int32() // currentLeaderEpoch
+			}
+			partition.FetchOffset = d.int64()
+			if version >= 12 {
+				d.int32() // lastFetchedEpoch
+			}
+			if version >= 5 {
+				d.int64() // logStartOffset
+			}
+			partition.PartitionMaxBytes = d.int32()
+			d.taggedFields(flexible)
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		d.taggedFields(flexible)
+		request.Topics = append(request.Topics, topic)
+	}
+	// The forgotten topics and the rack id that follow are not needed
+	return request
+}
+
+func decodeKafkaFetchResponse(d *kafkaDecoder, version int16, flexible bool) *KafkaFetchResponse {
+	response := &KafkaFetchResponse{Topics: make([]KafkaFetchTopicResponse, 0)}
+	if version >= 1 {
+		response.ThrottleTimeMs = d.int32()
+	}
+	if version >= 7 {
+		response.ErrorCode = d.int16()
+		response.SessionID = d.int32()
+	}
+	topicCount := d.arrayLength(flexible)
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		topic := KafkaFetchTopicResponse{Partitions: make([]KafkaFetchPartitionResponse, 0)}
+		if version >= 13 {
+			topic.TopicID = d.uuid()
+		} else {
+			topic.Topic = d.string(flexible)
+		}
+		partitionCount := d.arrayLength(flexible)
+		for j := 0; j < partitionCount && d.err == nil; j++ {
+			partition := KafkaFetchPartitionResponse{Partition: d.int32(), ErrorCode: d.int16(), HighWatermark: d.int64()}
+			if version >= 4 {
+				d.int64() // lastStableOffset
+			}
+			if version >= 5 {
+				d.int64() // logStartOffset
+			}
+			if version >= 4 {
+				abortedCount := d.arrayLength(flexible)
+				for k := 0; k < abortedCount && d.err == nil; k++ {
+					d.int64() // producerId
+					d.int64() // firstOffset
+					d.taggedFields(flexible)
+				}
+			}
+			if version >= 11 {
+				d.int32() // preferredReadReplica
+			}
+			partition.Records = decodeKafkaRecords(d.bytes(flexible))
+			d.taggedFields(flexible)
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		d.taggedFields(flexible)
+		response.Topics = append(response.Topics, topic)
+	}
+	d.taggedFields(flexible)
+	return response
+}
+
+func decodeKafkaMetadataRequest(d *kafkaDecoder, version int16, flexible bool) *KafkaMetadataRequest {
+	request := &KafkaMetadataRequest{}
+	// A null topics array (from v1 on) requests all topics
+	topicCount := d.arrayLength(flexible)
+	if topicCount >= 0 {
+		request.Topics = make([]string, 0)
+	}
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		if version >= 10 {
+			d.uuid()
+			if name := d.nullableString(flexible); name != nil {
+				request.Topics = append(request.Topics, *name)
+			}
+		} else {
+			request.Topics = append(request.Topics, d.string(flexible))
+		}
+		d.taggedFields(flexible)
+	}
+	if version >= 4 {
+		request.AllowAutoTopicCreation = d.bool()
+	}
+	return request
+}
+
+func decodeKafkaMetadataResponse(d *kafkaDecoder, version int16, flexible bool) *KafkaMetadataResponse {
+	response := &KafkaMetadataResponse{Brokers: make([]KafkaBroker, 0), Topics: make([]KafkaMetadataTopic, 0)}
+	if version >= 3 {
+		response.ThrottleTimeMs = d.int32()
+	}
+	brokerCount := d.arrayLength(flexible)
+	for i := 0; i < brokerCount && d.err == nil; i++ {
+		broker := KafkaBroker{NodeID: d.int32(), Host: d.string(flexible), Port: d.int32()}
+		if version >= 1 {
+			broker.Rack = d.nullableString(flexible)
+		}
+		d.taggedFields(flexible)
+		response.Brokers = append(response.Brokers, broker)
+	}
+	if version >= 2 {
+		response.ClusterID = d.nullableString(flexible)
+	}
+	if version >= 1 {
+		response.ControllerID = d.int32()
+	}
+	topicCount := d.arrayLength(flexible)
+	for i := 0; i < topicCount && d.err == nil; i++ {
+		topic := KafkaMetadataTopic{ErrorCode: d.int16(), Partitions: make([]KafkaMetadataPartition, 0)}
+		if name := d.nullableString(flexible); name != nil {
+			topic.Topic = *name
+		}
+		if version >= 10 {
+			d.uuid()
+		}
+		if version >= 1 {
+			topic.IsInternal = d.bool()
+		}
+		partitionCount := d.arrayLength(flexible)
+		for j := 0; j < partitionCount && d.err == nil; j++ {
+			partition := KafkaMetadataPartition{ErrorCode: d.int16(), Partition: d.int32(), Leader: d.int32()}
+			if version >= 7 {
+				d.int32() // leaderEpoch
+			}
+			partition.Replicas = d.int32Array(flexible)
+			partition.Isr = d.int32Array(flexible)
+			if version >= 5 {
+				d.int32Array(flexible) // offlineReplicas
+			}
+			d.taggedFields(flexible)
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		if version >= 8 {
+			d.int32() // topicAuthorizedOperations
+		}
+		d.taggedFields(flexible)
+		response.Topics = append(response.Topics, topic)
+	}
+	if version >= 8 && version <= 10 {
+		d.int32() // clusterAuthorizedOperations
+	}
+	d.taggedFields(flexible)
+	return response
+}
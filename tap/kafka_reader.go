@@ -0,0 +1,216 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const kafkaPortsEnvVar = "KAFKA_PORTS"
+const maxKafkaMessageSize = 64 * 1024 * 1024
+
+var kafkaProtocol = &Protocol{
+	Name:         "kafka",
+	Abbreviation: "KAFKA",
+}
+
+func init() {
+	RegisterDissector(&kafkaDissector{ports: portsFromEnv(kafkaPortsEnvVar, []int{9092})})
+}
+
+/* kafkaDissector parses the Kafka wire protocol.
+ * Requests are matched with their responses by correlation ID.
+ * Produce, Fetch and Metadata bodies are decoded, other API keys are recorded by name only.
+ */
+type kafkaDissector struct {
+	ports []int
+}
+
+func (d *kafkaDissector) Protocol() *Protocol {
+	return kafkaProtocol
+}
+
+func (d *kafkaDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *kafkaDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *kafkaDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	// The broker side is recognized by its port, since the capture may have missed the connection start
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	for {
+		raw, err := readKafkaMessage(b)
+		if err != nil {
+			return err
+		} else if raw == nil {
+			continue
+		}
+
+		if isClient {
+			err = d.handleRequest(raw, clientTcpID, reader)
+		} else {
+			err = d.handleResponse(raw, clientTcpID, reader)
+		}
+		if err != nil {
+			SilentError("Kafka", "stream %s error: %s (%v,%+v)", reader.ident, err, err, err)
+		}
+	}
+}
+
+// readKafkaMessage reads one size prefixed message. Messages above maxKafkaMessageSize are skipped and returned as nil.
+func readKafkaMessage(b *bufio.Reader) ([]byte, error) {
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(b, sizeBytes); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(sizeBytes))
+	if size < 0 {
+		// The stream is not aligned on a message boundary and cannot be recovered
+		return nil, fmt.Errorf("kafka: invalid message size %d", size)
+	}
+	if size > maxKafkaMessageSize {
+		_, err := b.Discard(int(size))
+		return nil, err
+	}
+
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(b, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (d *kafkaDissector) handleRequest(raw []byte, clientTcpID *TcpID, reader *TcpReader) error {
+	request, err := decodeKafkaRequest(raw)
+	if err != nil {
+		return err
+	}
+
+	if produce, ok := request.Payload.(*KafkaProduceRequest); ok && produce.Acks == 0 {
+		// The broker does not respond when no acknowledgement is requested
+		d.emitEntry(request, nil, reader.CaptureTime(), reader.CaptureTime(), clientTcpID, reader)
+		return nil
+	}
+
+	ident := fmt.Sprintf("%s %d", clientTcpID, request.CorrelationID)
+	pair := reqResMatcher.registerRequest(ident, request, reader.CaptureTime())
+	d.emitPair(pair, clientTcpID, reader)
+	return nil
+}
+
+func (d *kafkaDissector) handleResponse(raw []byte, clientTcpID *TcpID, reader *TcpReader) error {
+	response, err := decodeKafkaResponseHeader(raw)
+	if err != nil {
+		return err
+	}
+
+	ident := fmt.Sprintf("%s %d", clientTcpID, response.CorrelationID)
+	pair := reqResMatcher.registerResponse(ident, response, reader.CaptureTime())
+	d.emitPair(pair, clientTcpID, reader)
+	return nil
+}
+
+func (d *kafkaDissector) emitPair(pair *requestResponsePair, clientTcpID *TcpID, reader *TcpReader) {
+	if pair == nil {
+		return
+	}
+	statsTracker.incMatchedMessages()
+
+	request := pair.Request.orig.(*KafkaRequest)
+	response := pair.Response.orig.(*KafkaResponse)
+	response.decodeBody(request)
+	d.emitEntry(request, response, pair.Request.captureTime, pair.Response.captureTime, clientTcpID, reader)
+}
+
+func (d *kafkaDissector) emitEntry(request *KafkaRequest, response *KafkaResponse, requestTime time.Time, responseTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	entry := newEntry(kafkaProtocol, requestTime, responseTime)
+	entry.Method = request.ApiKeyName
+	entry.Path = strings.Join(kafkaTopics(request, response), ",")
+	entry.Request = request
+	if response != nil {
+		entry.Status = int(kafkaErrorCode(response))
+		if entry.Status != 0 {
+			entry.StatusText = kafkaErrorNames[int16(entry.Status)]
+		}
+		entry.Response = response
+	}
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       kafkaProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
+
+func kafkaTopics(request *KafkaRequest, response *KafkaResponse) []string {
+	topics := make([]string, 0)
+	switch payload := request.Payload.(type) {
+	case *KafkaProduceRequest:
+		for _, topic := range payload.Topics {
+			topics = append(topics, topic.Topic)
+		}
+	case *KafkaFetchRequest:
+		for _, topic := range payload.Topics {
+			if topic.Topic != "" {
+				topics = append(topics, topic.Topic)
+			} else {
+				topics = append(topics, topic.TopicID)
+			}
+		}
+	case *KafkaMetadataRequest:
+		topics = append(topics, payload.Topics...)
+		if len(topics) > 0 || response == nil {
+			break
+		}
+		// All topics were requested
+		if metadata, ok := response.Payload.(*KafkaMetadataResponse); ok {
+			for _, topic := range metadata.Topics {
+				topics = append(topics, topic.Topic)
+			}
+		}
+	}
+	return topics
+}
+
+// kafkaErrorCode returns the first error code reported by the response, or 0 if none.
+func kafkaErrorCode(response *KafkaResponse) int16 {
+	switch payload := response.Payload.(type) {
+	case *KafkaProduceResponse:
+		for _, topic := range payload.Topics {
+			for _, partition := range topic.Partitions {
+				if partition.ErrorCode != 0 {
+					return partition.ErrorCode
+				}
+			}
+		}
+	case *KafkaFetchResponse:
+		if payload.ErrorCode != 0 {
+			return payload.ErrorCode
+		}
+		for _, topic := range payload.Topics {
+			for _, partition := range topic.Partitions {
+				if partition.ErrorCode != 0 {
+					return partition.ErrorCode
+				}
+			}
+		}
+	case *KafkaMetadataResponse:
+		for _, topic := range payload.Topics {
+			if topic.ErrorCode != 0 {
+				return topic.ErrorCode
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+package tap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const kafkaCompressionMask = 0x07
+
+var kafkaCompressionCodecs = map[int]string{
+	0: "none",
+	1: "gzip",
+	2: "snappy",
+	3: "lz4",
+	4: "zstd",
+}
+
+type KafkaRecordHeader struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+}
+
+type KafkaRecord struct {
+	Offset    int64               `json:"offset"`
+	Timestamp int64               `json:"timestamp"`
+	Key       *string             `json:"key"`
+	Value     *string             `json:"value"`
+	Headers   []KafkaRecordHeader `json:"headers,omitempty"`
+}
+
+type KafkaRecordBatch struct {
+	Compression string        `json:"compression"`
+	Records     []KafkaRecord `json:"records"`
+	Truncated   bool          `json:"truncated,omitempty"`
+}
+
+/* decodeKafkaRecords decodes the "records" field of Produce requests and Fetch responses.
+ * It holds either record batches (magic 2) or legacy message sets (magic 0 and 1).
+ * Fetch responses may end with a partial batch, which is reported as truncated.
+ */
+func decodeKafkaRecords(raw []byte) *KafkaRecordBatch {
+	if raw == nil {
+		return nil
+	}
+	result := &KafkaRecordBatch{Compression: kafkaCompressionCodecs[0], Records: make([]KafkaRecord, 0)}
+	d := newKafkaDecoder(raw)
+
+	for d.remaining() > 0 {
+		// Both formats start with an offset and a size, and keep the magic byte at the same position
+		if d.remaining() < 17 {
+			result.Truncated = true
+			break
+		}
+		magic := raw[d.off+16]
+		baseOffset := d.int64()
+		size := int(d.int32())
+		body := d.next(size)
+		if d.err != nil {
+			result.Truncated = true
+			break
+		}
+
+		var err error
+		if magic >= 2 {
+			err = decodeKafkaRecordBatch(baseOffset, body, result)
+		} else {
+			err = decodeKafkaLegacyMessage(baseOffset, magic, body, result)
+		}
+		if err != nil {
+			SilentError("Kafka-records", "Failed to decode records: %s (%v,%+v)", err, err, err)
+			result.Truncated = true
+			break
+		}
+	}
+
+	return result
+}
+
+func decodeKafkaRecordBatch(baseOffset int64, body []byte, result *KafkaRecordBatch) error {
+	d := newKafkaDecoder(body)
+	d.int32() // partitionLeaderEpoch
+	d.int8()  // magic
+	d.int32() // crc
+	attributes := int(d.int16())
+	d.int32() // lastOffsetDelta
+	firstTimestamp := d.int64()
+	d.int64() // maxTimestamp
+	d.int64() // producerId
+	d.int16() // producerEpoch
+	d.int32() // baseSequence
+	count := int(d.int32())
+	if d.err != nil {
+		return d.err
+	}
+
+	codec := attributes & kafkaCompressionMask
+	result.Compression = kafkaCompressionCodecs[codec]
+	if codec == 1 {
+		decompressed, err := gunzip(d.raw[d.off:])
+		if err != nil {
+			return err
+		}
+		d = newKafkaDecoder(decompressed)
+	} else if codec != 0 {
+		// Records compressed with other codecs are listed by the batch only
+		return nil
+	}
+
+	for i := 0; i < count && d.remaining() > 0; i++ {
+		length := int(d.varint())
+		record := newKafkaDecoder(d.next(length))
+		if d.err != nil {
+			return d.err
+		}
+		record.int8() // attributes
+		timestampDelta := record.varint()
+		offsetDelta := record.varint()
+		key := record.varintBytes()
+		value := record.varintBytes()
+		headers := make([]KafkaRecordHeader, 0)
+		headerCount := int(record.varint())
+		for j := 0; j < headerCount && record.err == nil; j++ {
+			headerKey := string(record.varintBytes())
+			headerValue := record.varintBytes()
+			headers = append(headers, KafkaRecordHeader{Key: headerKey, Value: payloadString(headerValue)})
+		}
+		if record.err != nil {
+			return record.err
+		}
+
+		result.Records = append(result.Records, KafkaRecord{
+			Offset:    baseOffset + offsetDelta,
+			Timestamp: firstTimestamp + timestampDelta,
+			Key:       payloadString(key),
+			Value:     payloadString(value),
+			Headers:   headers,
+		})
+	}
+
+	return nil
+}
+
+func decodeKafkaLegacyMessage(offset int64, magic byte, body []byte, result *KafkaRecordBatch) error {
+	d := newKafkaDecoder(body)
+	d.int32() // crc
+	d.int8()  // magic
+	attributes := int(d.int8())
+	var timestamp int64
+	if magic == 1 {
+		timestamp = d.int64()
+	}
+	key := d.bytes(false)
+	value := d.bytes(false)
+	if d.err != nil {
+		return d.err
+	}
+
+	codec := attributes & kafkaCompressionMask
+	result.Compression = kafkaCompressionCodecs[codec]
+	if codec == 1 {
+		// The value of a compressed wrapper message is itself a message set
+		decompressed, err := gunzip(value)
+		if err != nil {
+			return err
+		}
+		inner := decodeKafkaRecords(decompressed)
+		result.Records = append(result.Records, inner.Records...)
+		return nil
+	} else if codec != 0 {
+		return nil
+	}
+
+	result.Records = append(result.Records, KafkaRecord{
+		Offset:    offset,
+		Timestamp: timestamp,
+		Key:       payloadString(key),
+		Value:     payloadString(value),
+	})
+	return nil
+}
+
+func gunzip(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, maxKafkaMessageSize))
+}
@@ -0,0 +1,345 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The largest message a MongoDB server accepts.
+const maxMongoDBMessageSize = 48 * 1000 * 1000
+
+const (
+	mongoDBOpReply      = 1
+	mongoDBOpQuery      = 2004
+	mongoDBOpCompressed = 2012
+	mongoDBOpMsg        = 2013
+)
+
+const (
+	mongoDBMsgChecksumPresent = 1 << 0
+	mongoDBMsgMoreToCome      = 1 << 1
+)
+
+var errMongoDBShortBuffer = errors.New("mongodb: not enough bytes")
+
+var mongoDBOpCodeNames = map[int32]string{
+	1:    "OP_REPLY",
+	2001: "OP_UPDATE",
+	2002: "OP_INSERT",
+	2004: "OP_QUERY",
+	2005: "OP_GET_MORE",
+	2006: "OP_DELETE",
+	2007: "OP_KILL_CURSORS",
+	2012: "OP_COMPRESSED",
+	2013: "OP_MSG",
+}
+
+var mongoDBCompressorNames = map[uint8]string{
+	0: "noop",
+	1: "snappy",
+	2: "zlib",
+	3: "zstd",
+}
+
+type mongoDBHeader struct {
+	length     int32
+	requestID  int32
+	responseTo int32
+	opCode     int32
+}
+
+type MongoDBMessage struct {
+	OpCode     string                       `json:"opCode"`
+	RequestID  int32                        `json:"requestId"`
+	ResponseTo int32                        `json:"responseTo,omitempty"`
+	Compressor string                       `json:"compressor,omitempty"`
+	Flags      uint32                       `json:"flags"`
+	Collection string                       `json:"fullCollectionName,omitempty"`
+	Documents  []json.RawMessage            `json:"documents"`
+	Sequences  map[string][]json.RawMessage `json:"sequences,omitempty"`
+	CursorID   int64                        `json:"cursorId,omitempty"`
+	body       bson.Raw
+}
+
+func readMongoDBHeader(b *bufio.Reader) (*mongoDBHeader, error) {
+	raw := make([]byte, 16)
+	if _, err := io.ReadFull(b, raw); err != nil {
+		return nil, err
+	}
+	header := &mongoDBHeader{
+		length:     int32(binary.LittleEndian.Uint32(raw)),
+		requestID:  int32(binary.LittleEndian.Uint32(raw[4:])),
+		responseTo: int32(binary.LittleEndian.Uint32(raw[8:])),
+		opCode:     int32(binary.LittleEndian.Uint32(raw[12:])),
+	}
+	if header.length < 16 {
+		return nil, fmt.Errorf("mongodb: invalid message length %d", header.length)
+	}
+	return header, nil
+}
+
+// mongoDBDecoder reads the fields of a message body. Like kafkaDecoder, its first error is sticky.
+type mongoDBDecoder struct {
+	raw []byte
+	off int
+	err error
+}
+
+func (d *mongoDBDecoder) remaining() int {
+	return len(d.raw) - d.off
+}
+
+func (d *mongoDBDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errMongoDBShortBuffer
+		return nil
+	}
+	buf := d.raw[d.off : d.off+n]
+	d.off += n
+	return buf
+}
+
+func (d *mongoDBDecoder) uint8() uint8 {
+	if buf := d.next(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (d *mongoDBDecoder) int32() int32 {
+	if buf := d.next(4); buf != nil {
+		return int32(binary.LittleEndian.Uint32(buf))
+	}
+	return 0
+}
+
+func (d *mongoDBDecoder) int64() int64 {
+	if buf := d.next(8); buf != nil {
+		return int64(binary.LittleEndian.Uint64(buf))
+	}
+	return 0
+}
+
+func (d *mongoDBDecoder) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(d.raw[d.off:], 0)
+	if end < 0 {
+		d.err = errMongoDBShortBuffer
+		return ""
+	}
+	str := string(d.raw[d.off : d.off+end])
+	d.off += end + 1
+	return str
+}
+
+func (d *mongoDBDecoder) document() bson.Raw {
+	if d.remaining() < 4 {
+		d.err = errMongoDBShortBuffer
+		return nil
+	}
+	length := int(int32(binary.LittleEndian.Uint32(d.raw[d.off:])))
+	doc := bson.Raw(d.next(length))
+	if d.err == nil {
+		if err := doc.Validate(); err != nil {
+			d.err = err
+			return nil
+		}
+	}
+	return doc
+}
+
+/* decodeMongoDBMessage decodes the body of an OP_MSG, OP_QUERY or OP_REPLY message,
+ * after unwrapping it from an OP_COMPRESSED message if needed.
+ * Only the noop and zlib compressors are supported.
+ */
+func decodeMongoDBMessage(header *mongoDBHeader, body []byte) (*MongoDBMessage, error) {
+	message := &MongoDBMessage{
+		RequestID:  header.requestID,
+		ResponseTo: header.responseTo,
+		Documents:  make([]json.RawMessage, 0),
+	}
+
+	opCode := header.opCode
+	if opCode == mongoDBOpCompressed {
+		d := &mongoDBDecoder{raw: body}
+		opCode = d.int32()
+		uncompressedSize := int(d.int32())
+		compressor := d.uint8()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if uncompressedSize < 0 || uncompressedSize > maxMongoDBMessageSize {
+			return nil, fmt.Errorf("mongodb: invalid uncompressed size %d", uncompressedSize)
+		}
+		message.Compressor = mongoDBCompressorNames[compressor]
+
+		compressed := body[d.off:]
+		switch compressor {
+		case 0:
+			body = compressed
+		case 2:
+			reader, err := zlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				return nil, err
+			}
+			body, err = ioutil.ReadAll(io.LimitReader(reader, int64(uncompressedSize)))
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("mongodb: unsupported compressor %d", compressor)
+		}
+	}
+	message.OpCode = mongoDBOpCodeNames[opCode]
+
+	d := &mongoDBDecoder{raw: body}
+	switch opCode {
+	case mongoDBOpMsg:
+		message.Flags = uint32(d.int32())
+		end := len(body)
+		if message.Flags&mongoDBMsgChecksumPresent != 0 {
+			end -= 4
+		}
+		for d.off < end && d.err == nil {
+			switch kind := d.uint8(); kind {
+			case 0:
+				message.body = d.document()
+				message.Documents = append(message.Documents, mongoDBJSON(message.body))
+			case 1:
+				size := int(d.int32())
+				section := &mongoDBDecoder{raw: d.next(size - 4)}
+				identifier := section.cstring()
+				documents := make([]json.RawMessage, 0)
+				for section.remaining() > 0 && section.err == nil {
+					documents = append(documents, mongoDBJSON(section.document()))
+				}
+				if section.err != nil {
+					return nil, section.err
+				}
+				if message.Sequences == nil {
+					message.Sequences = make(map[string][]json.RawMessage)
+				}
+				message.Sequences[identifier] = documents
+			default:
+				return nil, fmt.Errorf("mongodb: unknown section kind %d", kind)
+			}
+		}
+	case mongoDBOpQuery:
+		message.Flags = uint32(d.int32())
+		message.Collection = d.cstring()
+		d.int32() // numberToSkip
+		d.int32() // numberToReturn
+		message.body = d.document()
+		message.Documents = append(message.Documents, mongoDBJSON(message.body))
+		if d.remaining() > 0 {
+			// The fields to return
+			message.Documents = append(message.Documents, mongoDBJSON(d.document()))
+		}
+	case mongoDBOpReply:
+		message.Flags = uint32(d.int32())
+		message.CursorID = d.int64()
+		d.int32() // startingFrom
+		count := int(d.int32())
+		for i := 0; i < count && d.err == nil; i++ {
+			document := d.document()
+			if i == 0 {
+				message.body = document
+			}
+			message.Documents = append(message.Documents, mongoDBJSON(document))
+		}
+	default:
+		return nil, fmt.Errorf("mongodb: unsupported opcode %d", opCode)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return message, nil
+}
+
+// mongoDBJSON renders a document as relaxed extended JSON.
+func mongoDBJSON(document bson.Raw) json.RawMessage {
+	if document == nil {
+		return nil
+	}
+	rendered, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		SilentError("MongoDB-JSON", "Failed to render document: %s (%v,%+v)", err, err, err)
+		return nil
+	}
+	return rendered
+}
+
+// command returns the name of the command in the body document, which is always its first key.
+func (m *MongoDBMessage) command() string {
+	if m.Collection != "" && !strings.HasSuffix(m.Collection, ".$cmd") {
+		// A legacy OP_QUERY on a collection, whose body is the query filter
+		return "query"
+	}
+	if m.body == nil {
+		return ""
+	}
+	elements, err := m.body.Elements()
+	if err != nil || len(elements) == 0 {
+		return ""
+	}
+	return elements[0].Key()
+}
+
+// namespace returns the database and collection the message targets, if any.
+func (m *MongoDBMessage) namespace() (database string, collection string) {
+	if m.Collection != "" {
+		// OP_QUERY targets either "<db>.$cmd" for commands, or "<db>.<collection>"
+		parts := strings.SplitN(m.Collection, ".", 2)
+		database = parts[0]
+		if len(parts) == 2 && parts[1] != "$cmd" {
+			return database, parts[1]
+		}
+	} else if m.body != nil {
+		database, _ = m.body.Lookup("$db").StringValueOK()
+	}
+
+	if m.body != nil {
+		elements, err := m.body.Elements()
+		if err == nil && len(elements) > 0 {
+			// Commands such as find, insert or aggregate hold the collection name as their value
+			collection, _ = elements[0].Value().StringValueOK()
+		}
+	}
+	return database, collection
+}
+
+// failure returns the error code and name of a failed command reply, where "ok" is 0.
+func (m *MongoDBMessage) failure() (code int, codeName string, failed bool) {
+	if m.body == nil {
+		return 0, "", false
+	}
+	ok := m.body.Lookup("ok")
+	if value, isNumber := ok.AsInt32OK(); !isNumber || value != 0 {
+		return 0, "", false
+	}
+
+	if value, isNumber := m.body.Lookup("code").AsInt32OK(); isNumber {
+		code = int(value)
+	}
+	codeName, _ = m.body.Lookup("codeName").StringValueOK()
+	if codeName == "" {
+		codeName, _ = m.body.Lookup("errmsg").StringValueOK()
+	}
+	return code, codeName, true
+}
@@ -0,0 +1,120 @@
+package tap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+const mongoDBPortsEnvVar = "MONGODB_PORTS"
+
+var mongoDBProtocol = &Protocol{
+	Name:         "mongodb",
+	Abbreviation: "MONGO",
+}
+
+func init() {
+	RegisterDissector(&mongoDBDissector{ports: portsFromEnv(mongoDBPortsEnvVar, []int{27017})})
+}
+
+/* mongoDBDissector parses the MongoDB wire protocol: OP_MSG, and the legacy OP_QUERY and OP_REPLY.
+ * Requests are matched with their responses by requestID and responseTo.
+ * OP_MSG requests with the moreToCome flag are never answered and are emitted on their own.
+ */
+type mongoDBDissector struct {
+	ports []int
+}
+
+func (d *mongoDBDissector) Protocol() *Protocol {
+	return mongoDBProtocol
+}
+
+func (d *mongoDBDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *mongoDBDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *mongoDBDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	for {
+		header, err := readMongoDBHeader(b)
+		if err != nil {
+			return err
+		}
+		bodyLength := int(header.length) - 16
+		if bodyLength > maxMongoDBMessageSize {
+			if _, err := b.Discard(bodyLength); err != nil {
+				return err
+			}
+			continue
+		}
+		body := make([]byte, bodyLength)
+		if _, err := io.ReadFull(b, body); err != nil {
+			return err
+		}
+
+		message, err := decodeMongoDBMessage(header, body)
+		if err != nil {
+			SilentError("MongoDB", "stream %s error: %s (%v,%+v)", reader.ident, err, err, err)
+			continue
+		}
+
+		if isClient {
+			if message.Flags&mongoDBMsgMoreToCome != 0 && message.OpCode == mongoDBOpCodeNames[mongoDBOpMsg] {
+				d.emitEntry(message, nil, reader.CaptureTime(), reader.CaptureTime(), clientTcpID, reader)
+				continue
+			}
+			ident := fmt.Sprintf("%s %d", clientTcpID, message.RequestID)
+			pair := reqResMatcher.registerRequest(ident, message, reader.CaptureTime())
+			d.emitPair(pair, clientTcpID, reader)
+		} else {
+			ident := fmt.Sprintf("%s %d", clientTcpID, message.ResponseTo)
+			pair := reqResMatcher.registerResponse(ident, message, reader.CaptureTime())
+			d.emitPair(pair, clientTcpID, reader)
+		}
+	}
+}
+
+func (d *mongoDBDissector) emitPair(pair *requestResponsePair, clientTcpID *TcpID, reader *TcpReader) {
+	if pair == nil {
+		return
+	}
+	statsTracker.incMatchedMessages()
+
+	request := pair.Request.orig.(*MongoDBMessage)
+	response := pair.Response.orig.(*MongoDBMessage)
+	d.emitEntry(request, response, pair.Request.captureTime, pair.Response.captureTime, clientTcpID, reader)
+}
+
+func (d *mongoDBDissector) emitEntry(request *MongoDBMessage, response *MongoDBMessage, requestTime time.Time, responseTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	entry := newEntry(mongoDBProtocol, requestTime, responseTime)
+	entry.Method = request.command()
+	database, collection := request.namespace()
+	entry.Path = database
+	if collection != "" {
+		entry.Path = fmt.Sprintf("%s.%s", database, collection)
+	}
+	entry.Request = request
+	if response != nil {
+		if code, codeName, failed := response.failure(); failed {
+			entry.Status = code
+			entry.StatusText = codeName
+		}
+		entry.Response = response
+	}
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       mongoDBProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
@@ -0,0 +1,433 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const maxMySQLPayloadSize = 0xffffff
+const maxMySQLMessageSize = 64 * 1024 * 1024
+
+const (
+	mysqlClientConnectWithDB         = 0x00000008
+	mysqlClientSSL                   = 0x00000800
+	mysqlClientSecureConnection      = 0x00008000
+	mysqlClientPluginAuthLenencData  = 0x00200000
+	mysqlClientDeprecateEOF          = 0x01000000
+	mysqlServerMoreResultsExists     = 0x0008
+	mysqlHandshakeProtocolVersion    = 0x0a
+	mysqlSSLRequestLength            = 32
+	mysqlHandshakeResponseFixedBytes = 32
+)
+
+const (
+	mysqlComQuit             = 0x01
+	mysqlComInitDB           = 0x02
+	mysqlComQuery            = 0x03
+	mysqlComFieldList        = 0x04
+	mysqlComStatistics       = 0x09
+	mysqlComStmtPrepare      = 0x16
+	mysqlComStmtExecute      = 0x17
+	mysqlComStmtSendLongData = 0x18
+	mysqlComStmtClose        = 0x19
+	mysqlComStmtFetch        = 0x1c
+
+	// Not an actual command, stands for the handshake response
+	mysqlPseudoComConnect = 0xff
+)
+
+var errMySQLShortBuffer = errors.New("mysql: not enough bytes")
+
+var mysqlCommandNames = map[byte]string{
+	0x00: "SLEEP",
+	0x01: "QUIT",
+	0x02: "INIT_DB",
+	0x03: "QUERY",
+	0x04: "FIELD_LIST",
+	0x05: "CREATE_DB",
+	0x06: "DROP_DB",
+	0x07: "REFRESH",
+	0x08: "SHUTDOWN",
+	0x09: "STATISTICS",
+	0x0a: "PROCESS_INFO",
+	0x0c: "PROCESS_KILL",
+	0x0d: "DEBUG",
+	0x0e: "PING",
+	0x11: "CHANGE_USER",
+	0x12: "BINLOG_DUMP",
+	0x16: "STMT_PREPARE",
+	0x17: "STMT_EXECUTE",
+	0x18: "STMT_SEND_LONG_DATA",
+	0x19: "STMT_CLOSE",
+	0x1a: "STMT_RESET",
+	0x1b: "SET_OPTION",
+	0x1c: "STMT_FETCH",
+	0x1e: "BINLOG_DUMP_GTID",
+	0x1f: "RESET_CONNECTION",
+}
+
+type MySQLRequest struct {
+	Command     string        `json:"command"`
+	User        string        `json:"user,omitempty"`
+	Database    string        `json:"database,omitempty"`
+	Query       string        `json:"query,omitempty"`
+	StatementID *uint32       `json:"statementId,omitempty"`
+	Parameters  []interface{} `json:"parameters,omitempty"`
+	command     byte
+	execute     []byte // the payload of a COM_STMT_EXECUTE, until the server side decodes it
+}
+
+type MySQLError struct {
+	Code     uint16 `json:"code"`
+	SQLState string `json:"sqlState,omitempty"`
+	Message  string `json:"message"`
+}
+
+type MySQLResultSet struct {
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+}
+
+type MySQLResponse struct {
+	Type          string            `json:"type"`
+	ServerVersion string            `json:"serverVersion,omitempty"`
+	AffectedRows  uint64            `json:"affectedRows,omitempty"`
+	LastInsertID  uint64            `json:"lastInsertId,omitempty"`
+	Warnings      uint16            `json:"warnings,omitempty"`
+	Info          string            `json:"info,omitempty"`
+	StatementID   *uint32           `json:"statementId,omitempty"`
+	Parameters    int               `json:"parameters,omitempty"`
+	ResultSets    []*MySQLResultSet `json:"resultSets,omitempty"`
+	Error         *MySQLError       `json:"error,omitempty"`
+}
+
+/* readMySQLPacket reads a whole payload, joining the packets a payload above 16MB is split into.
+ * It returns the sequence ID of the first packet and the full length of the payload.
+ * Payloads above maxMySQLMessageSize are not kept. When skipRows is set, only the OK, EOF
+ * and ERR payloads are, since rows are merely counted and the first byte is enough for that.
+ */
+func readMySQLPacket(b *bufio.Reader, skipRows bool) (seq byte, length int, payload []byte, err error) {
+	header := make([]byte, 4)
+	keep := true
+	for first := true; ; first = false {
+		if _, err = io.ReadFull(b, header); err != nil {
+			return
+		}
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if first {
+			seq = header[3]
+			if size > 0 {
+				var firstByte []byte
+				if firstByte, err = b.Peek(1); err != nil {
+					return
+				}
+				keep = !skipRows || firstByte[0] == 0xfe || firstByte[0] == 0xff
+				payload = []byte{firstByte[0]}
+			}
+		}
+
+		if keep && length+size <= maxMySQLMessageSize {
+			chunk := make([]byte, size)
+			if _, err = io.ReadFull(b, chunk); err != nil {
+				return
+			}
+			if first {
+				payload = chunk
+			} else {
+				payload = append(payload, chunk...)
+			}
+		} else if _, err = b.Discard(size); err != nil {
+			return
+		}
+		length += size
+
+		if size < maxMySQLPayloadSize {
+			return
+		}
+	}
+}
+
+// mysqlDecoder reads little endian packet fields. Like kafkaDecoder, its first error is sticky.
+type mysqlDecoder struct {
+	raw []byte
+	off int
+	err error
+}
+
+func (d *mysqlDecoder) remaining() int {
+	return len(d.raw) - d.off
+}
+
+func (d *mysqlDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errMySQLShortBuffer
+		return nil
+	}
+	buf := d.raw[d.off : d.off+n]
+	d.off += n
+	return buf
+}
+
+func (d *mysqlDecoder) uint8() uint8 {
+	if buf := d.next(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (d *mysqlDecoder) uint16() uint16 {
+	if buf := d.next(2); buf != nil {
+		return binary.LittleEndian.Uint16(buf)
+	}
+	return 0
+}
+
+func (d *mysqlDecoder) uint32() uint32 {
+	if buf := d.next(4); buf != nil {
+		return binary.LittleEndian.Uint32(buf)
+	}
+	return 0
+}
+
+func (d *mysqlDecoder) uint64() uint64 {
+	if buf := d.next(8); buf != nil {
+		return binary.LittleEndian.Uint64(buf)
+	}
+	return 0
+}
+
+// lenenc decodes a length encoded integer, isNull is set for the 0xfb NULL marker of text rows.
+func (d *mysqlDecoder) lenenc() (value uint64, isNull bool) {
+	first := d.uint8()
+	switch first {
+	case 0xfb:
+		return 0, true
+	case 0xfc:
+		return uint64(d.uint16()), false
+	case 0xfd:
+		buf := d.next(3)
+		if buf == nil {
+			return 0, false
+		}
+		return uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16, false
+	case 0xfe:
+		return d.uint64(), false
+	}
+	return uint64(first), false
+}
+
+func (d *mysqlDecoder) lenencString() string {
+	length, _ := d.lenenc()
+	return string(d.next(int(length)))
+}
+
+func (d *mysqlDecoder) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(d.raw[d.off:], 0)
+	if end < 0 {
+		d.err = errMySQLShortBuffer
+		return ""
+	}
+	str := string(d.raw[d.off : d.off+end])
+	d.off += end + 1
+	return str
+}
+
+func (d *mysqlDecoder) rest() string {
+	return string(d.next(d.remaining()))
+}
+
+// decodeMySQLHandshake returns the server version and capabilities announced by the initial handshake.
+func decodeMySQLHandshake(payload []byte) (string, uint32) {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // protocol version
+	version := d.cstring()
+	d.uint32() // connection id
+	d.next(9)  // first part of the auth plugin data and a filler
+	lower := uint32(d.uint16())
+	d.next(3) // character set and status flags
+	upper := uint32(d.uint16())
+	return version, lower | upper<<16
+}
+
+func decodeMySQLHandshakeResponse(payload []byte) (*MySQLRequest, uint32) {
+	d := &mysqlDecoder{raw: payload}
+	capabilities := d.uint32()
+	d.next(mysqlHandshakeResponseFixedBytes - 4) // max packet size, character set and filler
+	request := &MySQLRequest{Command: "CONNECT", User: d.cstring()}
+
+	if capabilities&mysqlClientPluginAuthLenencData != 0 {
+		length, _ := d.lenenc()
+		d.next(int(length))
+	} else if capabilities&mysqlClientSecureConnection != 0 {
+		d.next(int(d.uint8()))
+	} else {
+		d.cstring()
+	}
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		request.Database = d.cstring()
+	}
+	return request, capabilities
+}
+
+func decodeMySQLOK(payload []byte, response *MySQLResponse) uint16 {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // header
+	response.AffectedRows, _ = d.lenenc()
+	response.LastInsertID, _ = d.lenenc()
+	status := d.uint16()
+	response.Warnings = d.uint16()
+	if d.remaining() > 0 {
+		response.Info = d.lenencString()
+	}
+	return status
+}
+
+func decodeMySQLEOF(payload []byte, response *MySQLResponse) uint16 {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // header
+	response.Warnings = d.uint16()
+	return d.uint16()
+}
+
+func decodeMySQLError(payload []byte) *MySQLError {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // header
+	mysqlError := &MySQLError{Code: d.uint16()}
+	if d.remaining() > 0 && d.raw[d.off] == '#' {
+		d.next(1)
+		mysqlError.SQLState = string(d.next(5))
+	}
+	mysqlError.Message = d.rest()
+	return mysqlError
+}
+
+// decodeMySQLColumnName returns the name of a column definition (Protocol::ColumnDefinition41).
+func decodeMySQLColumnName(payload []byte) string {
+	d := &mysqlDecoder{raw: payload}
+	for i := 0; i < 4; i++ {
+		d.lenencString() // catalog, schema, table and original table
+	}
+	return d.lenencString()
+}
+
+func decodeMySQLPrepareOK(payload []byte) (statementID uint32, columns int, params int) {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // header
+	statementID = d.uint32()
+	columns = int(d.uint16())
+	params = int(d.uint16())
+	return
+}
+
+/* decodeMySQLExecute decodes a COM_STMT_EXECUTE payload. The parameter count comes from the
+ * COM_STMT_PREPARE response, and their types are only sent when they change, hence the statement.
+ */
+func decodeMySQLExecute(payload []byte, statement *mysqlStatement) (uint32, []interface{}) {
+	d := &mysqlDecoder{raw: payload}
+	d.uint8() // command
+	statementID := d.uint32()
+	d.uint8()  // flags
+	d.uint32() // iteration count
+	if statement == nil || statement.params == 0 {
+		return statementID, nil
+	}
+
+	nullBitmap := d.next((statement.params + 7) / 8)
+	if d.uint8() == 1 {
+		statement.types = make([]uint16, statement.params)
+		for i := range statement.types {
+			statement.types[i] = d.uint16()
+		}
+	}
+	if d.err != nil || len(statement.types) != statement.params {
+		return statementID, nil
+	}
+
+	params := make([]interface{}, 0)
+	for i, paramType := range statement.types {
+		if nullBitmap[i/8]&(1<<(uint(i)%8)) != 0 {
+			params = append(params, nil)
+			continue
+		}
+		params = append(params, d.binaryValue(paramType))
+	}
+	if d.err != nil {
+		return statementID, nil
+	}
+	return statementID, params
+}
+
+// binaryValue decodes a value of the binary protocol, paramType holds the type and the unsigned flag.
+func (d *mysqlDecoder) binaryValue(paramType uint16) interface{} {
+	unsigned := paramType&0x8000 != 0
+	switch paramType & 0xff {
+	case 0x01: // TINY
+		if unsigned {
+			return uint64(d.uint8())
+		}
+		return int64(int8(d.uint8()))
+	case 0x02, 0x0d: // SHORT, YEAR
+		if unsigned {
+			return uint64(d.uint16())
+		}
+		return int64(int16(d.uint16()))
+	case 0x03, 0x09: // LONG, INT24
+		if unsigned {
+			return uint64(d.uint32())
+		}
+		return int64(int32(d.uint32()))
+	case 0x08: // LONGLONG
+		if unsigned {
+			return d.uint64()
+		}
+		return int64(d.uint64())
+	case 0x04: // FLOAT
+		return math.Float32frombits(d.uint32())
+	case 0x05: // DOUBLE
+		return math.Float64frombits(d.uint64())
+	case 0x06: // NULL
+		return nil
+	case 0x07, 0x0a, 0x0c: // TIMESTAMP, DATE, DATETIME
+		date := &mysqlDecoder{raw: d.next(int(d.uint8()))}
+		if date.remaining() == 0 {
+			return "0000-00-00 00:00:00"
+		}
+		value := fmt.Sprintf("%04d-%02d-%02d", date.uint16(), date.uint8(), date.uint8())
+		if date.remaining() >= 3 {
+			value += fmt.Sprintf(" %02d:%02d:%02d", date.uint8(), date.uint8(), date.uint8())
+		}
+		if date.remaining() >= 4 {
+			value += fmt.Sprintf(".%06d", date.uint32())
+		}
+		return value
+	case 0x0b: // TIME
+		duration := &mysqlDecoder{raw: d.next(int(d.uint8()))}
+		if duration.remaining() == 0 {
+			return "00:00:00"
+		}
+		sign := ""
+		if duration.uint8() == 1 {
+			sign = "-"
+		}
+		days := duration.uint32()
+		value := fmt.Sprintf("%s%02d:%02d:%02d", sign, uint32(duration.uint8())+days*24, duration.uint8(), duration.uint8())
+		if duration.remaining() >= 4 {
+			value += fmt.Sprintf(".%06d", duration.uint32())
+		}
+		return value
+	default: // Strings, decimals, blobs, JSON and the like are length encoded
+		length, _ := d.lenenc()
+		return payloadString(d.next(int(length)))
+	}
+}
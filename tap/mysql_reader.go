@@ -0,0 +1,433 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mysqlPortsEnvVar = "MYSQL_PORTS"
+
+// How long a response waits for the client goroutine to hand over the command it answers.
+const mysqlRequestTimeout = time.Second
+
+var mysqlProtocol = &Protocol{
+	Name:         "mysql",
+	Abbreviation: "MYSQL",
+}
+
+func init() {
+	RegisterDissector(&mysqlDissector{ports: portsFromEnv(mysqlPortsEnvVar, []int{3306})})
+}
+
+type mysqlStatement struct {
+	query  string
+	params int
+	types  []uint16
+}
+
+type mysqlPendingRequest struct {
+	request     *MySQLRequest
+	captureTime time.Time
+}
+
+/* mysqlConnection is shared by the two directions of a connection.
+ * The layout of a response depends on the command it answers, so the client side hands every
+ * command that expects a response over to the server side, in order, through pending.
+ * Prepared statements are registered by the server side, which also decodes COM_STMT_EXECUTE with them:
+ * it reads the response to a COM_STMT_EXECUTE after the PREPARE_OK of its statement, which the client side may not have seen yet.
+ */
+type mysqlConnection struct {
+	sync.Mutex
+	pending      chan *mysqlPendingRequest
+	statements   map[uint32]*mysqlStatement
+	deprecateEOF bool
+	isTLS        bool
+}
+
+func newMySQLConnection() interface{} {
+	return &mysqlConnection{
+		pending:    make(chan *mysqlPendingRequest, 64),
+		statements: make(map[uint32]*mysqlStatement),
+	}
+}
+
+func (c *mysqlConnection) statement(id uint32) *mysqlStatement {
+	c.Lock()
+	defer c.Unlock()
+	return c.statements[id]
+}
+
+// decodeExecute decodes the parameters of a COM_STMT_EXECUTE, once the server side reads its response.
+func (c *mysqlConnection) decodeExecute(request *MySQLRequest) {
+	if request.execute == nil {
+		return
+	}
+	statement := c.statement(*request.StatementID)
+	_, request.Parameters = decodeMySQLExecute(request.execute, statement)
+	if statement != nil {
+		request.Query = statement.query
+	}
+	request.execute = nil
+}
+
+/* mysqlDissector parses the client/server protocol of unencrypted connections.
+ * Each command and its response become an entry, the handshake becomes a CONNECT entry.
+ * Result sets are reported by their columns and row count, the rows themselves are not kept.
+ */
+type mysqlDissector struct {
+	ports []int
+}
+
+func (d *mysqlDissector) Protocol() *Protocol {
+	return mysqlProtocol
+}
+
+func (d *mysqlDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *mysqlDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *mysqlDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	connection := reader.SharedState(newMySQLConnection).(*mysqlConnection)
+	if isClient {
+		return d.dissectClient(b, connection, reader)
+	}
+	return d.dissectServer(b, connection, clientTcpID, reader)
+}
+
+func (d *mysqlDissector) dissectClient(b *bufio.Reader, connection *mysqlConnection, reader *TcpReader) error {
+	handshakeSeen := false
+
+	for {
+		seq, _, payload, err := readMySQLPacket(b, false)
+		if err != nil {
+			return err
+		}
+		if len(payload) == 0 {
+			continue
+		}
+
+		if seq != 0 {
+			// Besides the handshake response, these are authentication data and LOAD DATA LOCAL contents
+			if handshakeSeen || seq != 1 {
+				continue
+			}
+			handshakeSeen = true
+
+			request, capabilities := decodeMySQLHandshakeResponse(payload)
+			connection.Lock()
+			connection.deprecateEOF = capabilities&mysqlClientDeprecateEOF != 0
+			connection.isTLS = capabilities&mysqlClientSSL != 0 && len(payload) == mysqlSSLRequestLength
+			connection.Unlock()
+			if connection.isTLS {
+				return nil
+			}
+			request.command = mysqlPseudoComConnect
+			d.handOver(connection, request, reader)
+			continue
+		}
+
+		command := payload[0]
+		request := &MySQLRequest{Command: mysqlCommandNames[command], command: command}
+		switch command {
+		case mysqlComQuit, mysqlComStmtSendLongData, mysqlComStmtClose:
+			// Never answered
+			continue
+		case mysqlComQuery, mysqlComStmtPrepare:
+			request.Query = string(payload[1:])
+		case mysqlComInitDB:
+			request.Database = string(payload[1:])
+		case mysqlComStmtExecute:
+			if len(payload) < 5 {
+				break
+			}
+			statementID := binary.LittleEndian.Uint32(payload[1:])
+			request.StatementID = &statementID
+			request.execute = payload
+		}
+		if request.Command == "" {
+			request.Command = "UNKNOWN"
+		}
+		d.handOver(connection, request, reader)
+	}
+}
+
+func (d *mysqlDissector) handOver(connection *mysqlConnection, request *MySQLRequest, reader *TcpReader) {
+	select {
+	case connection.pending <- &mysqlPendingRequest{request: request, captureTime: reader.CaptureTime()}:
+	default:
+		SilentError("MySQL", "stream %s: dropping %s, too many commands are waiting for a response", reader.ident, request.Command)
+	}
+}
+
+func (d *mysqlDissector) dissectServer(b *bufio.Reader, connection *mysqlConnection, clientTcpID *TcpID, reader *TcpReader) error {
+	var current *mysqlResponseParser
+	serverVersion := ""
+
+	for {
+		seq, length, payload, err := readMySQLPacket(b, current != nil && current.inRows())
+		if err != nil {
+			return err
+		}
+		connection.Lock()
+		isTLS := connection.isTLS
+		connection.Unlock()
+		if isTLS {
+			return nil
+		}
+		if len(payload) == 0 {
+			continue
+		}
+
+		if seq == 0 && payload[0] == mysqlHandshakeProtocolVersion {
+			serverVersion, _ = decodeMySQLHandshake(payload)
+			continue
+		}
+		if current != nil && seq == 1 {
+			// A response starts, the previous one could not be followed to its end
+			current = nil
+		}
+		if current == nil {
+			pending := d.nextRequest(connection)
+			if pending == nil {
+				SilentError("MySQL", "stream %s: got a response to an unknown command", reader.ident)
+				pending = &mysqlPendingRequest{request: &MySQLRequest{Command: "UNKNOWN"}, captureTime: reader.CaptureTime()}
+			}
+			connection.decodeExecute(pending.request)
+			current = newMySQLResponseParser(pending, connection)
+			if pending.request.command == mysqlPseudoComConnect {
+				current.response.ServerVersion = serverVersion
+			}
+		}
+
+		if current.feed(length, payload) {
+			d.emitEntry(current.pending, current.response, reader.CaptureTime(), clientTcpID, reader)
+			current = nil
+		}
+	}
+}
+
+func (d *mysqlDissector) nextRequest(connection *mysqlConnection) *mysqlPendingRequest {
+	select {
+	case pending := <-connection.pending:
+		return pending
+	case <-time.After(mysqlRequestTimeout):
+		return nil
+	}
+}
+
+func (d *mysqlDissector) emitEntry(pending *mysqlPendingRequest, response *MySQLResponse, responseTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	statsTracker.incMatchedMessages()
+
+	request := pending.request
+	entry := newEntry(mysqlProtocol, pending.captureTime, responseTime)
+	entry.Method = request.Command
+	entry.Path = request.Database
+	if request.Query != "" {
+		entry.Path = strings.TrimSpace(request.Query)
+		if words := strings.Fields(request.Query); len(words) > 0 && request.command != mysqlComStmtPrepare {
+			entry.Method = strings.ToUpper(words[0])
+		}
+	}
+	if response.Error != nil {
+		entry.Status = int(response.Error.Code)
+		entry.StatusText = response.Error.SQLState
+	}
+	entry.Request = request
+	entry.Response = response
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       mysqlProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
+
+type mysqlResponseState int
+
+const (
+	mysqlExpectFirst mysqlResponseState = iota
+	mysqlExpectAuthResult
+	mysqlExpectColumns
+	mysqlExpectColumnsEOF
+	mysqlExpectRows
+	mysqlExpectDefinitions
+	mysqlExpectStatus
+)
+
+// mysqlResponseParser follows the packets of a response until its last one.
+type mysqlResponseParser struct {
+	pending    *mysqlPendingRequest
+	response   *MySQLResponse
+	connection *mysqlConnection
+	state      mysqlResponseState
+	remaining  int
+	resultSet  *MySQLResultSet
+}
+
+func newMySQLResponseParser(pending *mysqlPendingRequest, connection *mysqlConnection) *mysqlResponseParser {
+	p := &mysqlResponseParser{
+		pending:    pending,
+		response:   &MySQLResponse{},
+		connection: connection,
+	}
+	switch pending.request.command {
+	case mysqlPseudoComConnect:
+		p.state = mysqlExpectAuthResult
+	case mysqlComStmtFetch:
+		p.startResultSet(0)
+		p.state = mysqlExpectRows
+	}
+	return p
+}
+
+func (p *mysqlResponseParser) inRows() bool {
+	return p.state == mysqlExpectRows
+}
+
+func (p *mysqlResponseParser) deprecateEOF() bool {
+	p.connection.Lock()
+	defer p.connection.Unlock()
+	return p.connection.deprecateEOF
+}
+
+func (p *mysqlResponseParser) startResultSet(columns int) {
+	p.response.Type = "RESULT_SET"
+	p.resultSet = &MySQLResultSet{Columns: make([]string, 0)}
+	p.response.ResultSets = append(p.response.ResultSets, p.resultSet)
+	p.remaining = columns
+}
+
+// feed hands the next packet of the response over, and reports whether it was the last one.
+func (p *mysqlResponseParser) feed(length int, payload []byte) bool {
+	header := payload[0]
+	if header == 0xff {
+		// Neither column definitions nor rows ever start with 0xff
+		p.response.Type = "ERR"
+		p.response.Error = decodeMySQLError(payload)
+		return true
+	}
+
+	switch p.state {
+	case mysqlExpectAuthResult:
+		// Authentication may go through auth switch (0xfe) and more data (0x01) packets before the result
+		if header == 0x00 {
+			p.response.Type = "OK"
+			decodeMySQLOK(payload, p.response)
+			return true
+		}
+		return false
+	case mysqlExpectFirst:
+		switch {
+		case header == 0x00 && p.pending.request.command == mysqlComStmtPrepare:
+			return p.prepared(payload)
+		case header == 0x00 || header == 0xfe:
+			p.response.Type = "OK"
+			return p.status(payload)
+		case header == 0xfb:
+			// LOAD DATA LOCAL INFILE, the server answers once the client has sent the file
+			p.response.Type = "LOCAL_INFILE"
+			p.state = mysqlExpectStatus
+			return false
+		case p.pending.request.command == mysqlComStatistics:
+			p.response.Type = "STATISTICS"
+			p.response.Info = string(payload)
+			return true
+		case p.pending.request.command == mysqlComFieldList:
+			p.startResultSet(0)
+			p.state = mysqlExpectColumns
+			return p.feed(length, payload)
+		default:
+			columns, _ := (&mysqlDecoder{raw: payload}).lenenc()
+			p.startResultSet(int(columns))
+			p.state = mysqlExpectColumns
+			return false
+		}
+	case mysqlExpectStatus:
+		p.response.Type = "OK"
+		return p.status(payload)
+	case mysqlExpectColumns:
+		if header == 0xfe && length < 9 {
+			// Only COM_FIELD_LIST lists an unknown number of columns, ended by an EOF
+			return true
+		}
+		p.resultSet.Columns = append(p.resultSet.Columns, decodeMySQLColumnName(payload))
+		p.remaining--
+		if p.remaining == 0 {
+			if p.deprecateEOF() {
+				p.state = mysqlExpectRows
+			} else {
+				p.state = mysqlExpectColumnsEOF
+			}
+		}
+		return false
+	case mysqlExpectColumnsEOF:
+		p.state = mysqlExpectRows
+		return false
+	case mysqlExpectRows:
+		// Rows never start with 0xfe unless their first value is longer than the packet limit
+		if header == 0xfe && length < maxMySQLPayloadSize {
+			return p.status(payload)
+		}
+		p.resultSet.Rows++
+		return false
+	case mysqlExpectDefinitions:
+		p.remaining--
+		return p.remaining == 0
+	}
+	return false
+}
+
+// prepared handles a COM_STMT_PREPARE_OK, which is followed by the definitions of the parameters and of the columns.
+func (p *mysqlResponseParser) prepared(payload []byte) bool {
+	statementID, columns, params := decodeMySQLPrepareOK(payload)
+	p.response.Type = "PREPARE_OK"
+	p.response.StatementID = &statementID
+	p.response.Parameters = params
+
+	p.connection.Lock()
+	p.connection.statements[statementID] = &mysqlStatement{query: p.pending.request.Query, params: params}
+	p.connection.Unlock()
+
+	p.remaining = params + columns
+	if !p.deprecateEOF() {
+		// Each list of definitions is ended by an EOF
+		if params > 0 {
+			p.remaining++
+		}
+		if columns > 0 {
+			p.remaining++
+		}
+	}
+	p.state = mysqlExpectDefinitions
+	return p.remaining == 0
+}
+
+// status handles OK and EOF packets, and reports whether they end the response.
+func (p *mysqlResponseParser) status(payload []byte) bool {
+	var status uint16
+	if payload[0] == 0xfe && len(payload) < 9 && !p.deprecateEOF() {
+		status = decodeMySQLEOF(payload, p.response)
+	} else {
+		status = decodeMySQLOK(payload, p.response)
+	}
+
+	if status&mysqlServerMoreResultsExists != 0 {
+		// Multiple statements or a stored procedure, another result follows
+		p.state = mysqlExpectFirst
+		return false
+	}
+	return true
+}
@@ -28,7 +28,15 @@ func getLocalhostIPs() ([]string, error) {
 }
 
 func isPrivateIP(ipStr string) bool {
-	ip := net.ParseIP(ipStr)
+	// Link-local IPv6 addresses may name the zone of their interface, as in fe80::1%eth0
+	if i := strings.IndexByte(ipStr, '%'); i >= 0 {
+		ipStr = ipStr[:i]
+	}
+	ip := net.ParseIP(strings.Trim(ipStr, "[]"))
+	if ip == nil {
+		return false
+	}
+	// IPv4-mapped IPv6 addresses, as in ::ffff:10.0.0.1, are matched by the IPv4 blocks
 	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
 		return true
 	}
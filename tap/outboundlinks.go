@@ -8,7 +8,7 @@ type OutboundLink struct {
 
 func NewOutboundLinkWriter() *OutboundLinkWriter {
 	return &OutboundLinkWriter{
-		OutChan: make(chan *OutboundLink),
+		OutChan: make(chan *OutboundLink, outboundLinkQueueLen),
 	}
 }
 
@@ -17,11 +17,16 @@ type OutboundLinkWriter struct {
 }
 
 func (olw *OutboundLinkWriter) WriteOutboundLink(src string, DstIP string, DstPort int) {
-	olw.OutChan <- &OutboundLink{
+	link := &OutboundLink{
 		Src: src,
 		DstIP: DstIP,
 		DstPort: DstPort,
 	}
+	select {
+	case olw.OutChan <- link:
+	default:
+		outboundLinkQueue.overflow(olw.OutChan, link)
+	}
 }
 
 func (olw *OutboundLinkWriter) Stop() {
@@ -27,8 +27,6 @@ import (
 	"github.com/google/gopacket/examples/util"
 	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers" // pulls in all layers decoders
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/reassembly"
 )
 
 const AppPortsEnvVar = "APP_PORTS"
@@ -55,7 +53,7 @@ var maxcount = flag.Int("c", -1, "Only grab this many packets, then exit")
 var decoder = flag.String("decoder", "", "Name of the decoder to use (default: guess from capture)")
 var statsevery = flag.Int("stats", 60, "Output statistics every N seconds")
 var lazy = flag.Bool("lazy", false, "If true, do lazy decoding")
-var nodefrag = flag.Bool("nodefrag", false, "If true, do not do IPv4 defrag")
+var nodefrag = flag.Bool("nodefrag", false, "If true, do not do IPv4 and IPv6 defrag")
 var checksum = flag.Bool("checksum", false, "Check TCP checksum")  // global
 var nooptcheck = flag.Bool("nooptcheck", true, "Do not check TCP options (useful to ignore MSS on captures with TSO)")  // global
 var ignorefsmerr = flag.Bool("ignorefsmerr", true, "Ignore TCP FSM errors")  // global
@@ -93,21 +91,7 @@ var statsTracker = StatsTracker{}
 
 // global
 var stats struct {
-	ipdefrag            int
-	missedBytes         int
-	pkt                 int
-	sz                  int
-	totalsz             int
-	rejectFsm           int
-	rejectOpt           int
-	rejectConnFsm       int
-	reassembled         int
-	outOfOrderBytes     int
-	outOfOrderPackets   int
-	biggestChunkBytes   int
-	biggestChunkPackets int
-	overlapBytes        int
-	overlapPackets      int
+	ipdefrag int
 }
 
 type TapOpts struct {
@@ -213,7 +197,7 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 	if localhostIPs, err := getLocalhostIPs(); err != nil {
 		// TODO: think this over
 		rlog.Info("Failed to get self IP addresses")
-		rlog.Errorf("Getting-Self-Address", "Error getting self ip address: %s (%v,%+v)", err, err, err)
+		rlog.Errorf("Getting-Self-Address: Error getting self ip address: %s (%v,%+v)", err, err, err)
 		ownIps = make([]string, 0)
 	} else {
 		ownIps = localhostIPs
@@ -244,46 +228,23 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 
 	log.Printf("App Ports: %v", gSettings.filterPorts)
 
-	var handle *pcap.Handle
-	var err error
-	if *fname != "" {
-		if handle, err = pcap.OpenOffline(*fname); err != nil {
-			log.Fatalf("PCAP OpenOffline error: %v", err)
-		}
-	} else {
-		// This is a little complicated because we want to allow all possible options
-		// for creating the packet capture handle... instead of all this you can
-		// just call pcap.OpenLive if you want a simple handle.
-		inactive, err := pcap.NewInactiveHandle(*iface)
-		if err != nil {
-			log.Fatalf("could not create: %v", err)
-		}
-		defer inactive.CleanUp()
-		if err = inactive.SetSnapLen(*snaplen); err != nil {
-			log.Fatalf("could not set snap length: %v", err)
-		} else if err = inactive.SetPromisc(*promisc); err != nil {
-			log.Fatalf("could not set promisc mode: %v", err)
-		} else if err = inactive.SetTimeout(time.Second); err != nil {
-			log.Fatalf("could not set timeout: %v", err)
-		}
-		if *tstype != "" {
-			if t, err := pcap.TimestampSourceFromString(*tstype); err != nil {
-				log.Fatalf("Supported timestamp types: %v", inactive.SupportedTimestamps())
-			} else if err := inactive.SetTimestampSource(t); err != nil {
-				log.Fatalf("Supported timestamp types: %v", inactive.SupportedTimestamps())
-			}
-		}
-		if handle, err = inactive.Activate(); err != nil {
-			log.Fatalf("PCAP Activate error: %v", err)
-		}
-		defer handle.Close()
+	if err := checkQueueOverflowPolicy(); err != nil {
+		log.Fatalf("Queue error: %v", err)
+	}
+
+	handle, err := openCapture()
+	if err != nil {
+		log.Fatalf("Capture error: %v", err)
 	}
+	defer handle.Close()
 	if len(flag.Args()) > 0 {
 		bpffilter := strings.Join(flag.Args(), " ")
 		rlog.Infof("Using BPF filter %q", bpffilter)
 		if err = handle.SetBPFFilter(bpffilter); err != nil {
 			log.Fatalf("BPF filter error: %v", err)
 		}
+	} else if !*noautobpf {
+		handle = targetsFilter.start(handle)
 	}
 
 	if *dumpToHar {
@@ -309,30 +270,27 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 	bytes := int64(0)
 	start := time.Now()
 	defragger := ip4defrag.NewIPv4Defragmenter()
+	ip6Defragger := newIPv6Defragmenter()
 
-	streamFactory := &tcpStreamFactory{
-		doHTTP: !*nohttp,
-		harWriter: harWriter,
-		outbountLinkWriter: outboundLinkWriter,
-
+	staleConnectionTimeout := time.Second * time.Duration(*staleTimeoutSeconds)
+	assemblerShards := newAssemblerShards(*assemblers, func(shardStats *tcpStats) *tcpStreamFactory {
+		return &tcpStreamFactory{
+			doHTTP:             !*nohttp,
+			harWriter:          harWriter,
+			outbountLinkWriter: outboundLinkWriter,
+			stats:              shardStats,
+		}
+	}, staleConnectionTimeout)
+	for _, shard := range assemblerShards {
+		shard.start()
 	}
-	streamPool := reassembly.NewStreamPool(streamFactory)
-	assembler := reassembly.NewAssembler(streamPool)
-	var assemblerMutex sync.Mutex
+	rlog.Infof("Reassembling TCP connections with %d assemblers", len(assemblerShards))
+	// The DNS dissector emits the messages of UDP packets, which the capture loop dissects itself
+	streamFactory := assemblerShards[0].factory
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
 
-	staleConnectionTimeout := time.Second * time.Duration(*staleTimeoutSeconds)
-	cleaner := Cleaner{
-		assembler: assembler,
-		assemblerMutex: &assemblerMutex,
-		matcher: &reqResMatcher,
-		cleanPeriod: cleanPeriod,
-		connectionTimeout: staleConnectionTimeout,
-	}
-	cleaner.start()
-
 	go func() {
 		statsPeriod := time.Second * time.Duration(*statsevery)
 		ticker := time.NewTicker(statsPeriod)
@@ -353,6 +311,12 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 				errorMapLen,
 				errorsSummery,
 			)
+			if captureStats, err := handle.captureStats(); err == nil {
+				log.Printf("captured packets: %d, dropped packets: %d", captureStats.received, captureStats.dropped)
+			}
+			for _, queueStats := range GetQueueStats() {
+				log.Printf("%s queue: dropped items: %d, blocked items: %d", queueStats.Stage, queueStats.Dropped, queueStats.Blocked)
+			}
 
 			// At this moment
 			memStats := runtime.MemStats{}
@@ -365,7 +329,7 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 			)
 
 			// Since the last print
-			cleanStats := cleaner.dumpStats()
+			cleanStats := logAssemblerShardsStats(assemblerShards)
 			appStats := statsTracker.dumpStats()
 			log.Printf(
 				"flushed connections %d, closed connections: %d, deleted messages: %d, matched messages: %d",
@@ -386,30 +350,48 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 			rlog.Debugf("Packet content (%d/0x%x) - %s", len(data), len(data), hex.Dump(data))
 		}
 
-		// defrag the IPv4 packet if required
+		// defrag the IPv4 and IPv6 packets if required
 		if !*nodefrag {
-			ip4Layer := packet.Layer(layers.LayerTypeIPv4)
-			if ip4Layer == nil {
-				continue
-			}
-			ip4 := ip4Layer.(*layers.IPv4)
-			l := ip4.Length
-			newip4, err := defragger.DefragIPv4(ip4)
-			if err != nil {
-				log.Fatalln("Error while de-fragmenting", err)
-			} else if newip4 == nil {
-				rlog.Debugf("Fragment...")
-				continue // packet fragment, we don't have whole packet yet.
-			}
-			if newip4.Length != l {
-				stats.ipdefrag++
-				rlog.Debugf("Decoding re-assembled packet: %s", newip4.NextLayerType())
-				pb, ok := packet.(gopacket.PacketBuilder)
-				if !ok {
-					log.Panic("Not a PacketBuilder")
+			if ip4Layer := packet.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
+				ip4 := ip4Layer.(*layers.IPv4)
+				l := ip4.Length
+				newip4, err := defragger.DefragIPv4(ip4)
+				if err != nil {
+					log.Fatalln("Error while de-fragmenting", err)
+				} else if newip4 == nil {
+					rlog.Debugf("Fragment...")
+					continue // packet fragment, we don't have whole packet yet.
+				}
+				if newip4.Length != l {
+					stats.ipdefrag++
+					rlog.Debugf("Decoding re-assembled packet: %s", newip4.NextLayerType())
+					pb, ok := packet.(gopacket.PacketBuilder)
+					if !ok {
+						log.Panic("Not a PacketBuilder")
+					}
+					nextDecoder := newip4.NextLayerType()
+					_ = nextDecoder.Decode(newip4.Payload, pb)
 				}
-				nextDecoder := newip4.NextLayerType()
-				_ = nextDecoder.Decode(newip4.Payload, pb)
+			} else if ip6Layer := packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+				if fragmentLayer := packet.Layer(layers.LayerTypeIPv6Fragment); fragmentLayer != nil {
+					payload, nextHeader, err := ip6Defragger.DefragIPv6(ip6Layer.(*layers.IPv6), fragmentLayer.(*layers.IPv6Fragment), packet.Metadata().CaptureInfo.Timestamp)
+					if err != nil {
+						SilentError("IPv6-defrag", "Dropping IPv6 fragment: %s (%v,%+v)", err, err, err)
+						continue
+					} else if payload == nil {
+						rlog.Debugf("Fragment...")
+						continue // packet fragment, we don't have whole packet yet.
+					}
+					stats.ipdefrag++
+					rlog.Debugf("Decoding re-assembled packet: %s", nextHeader.LayerType())
+					pb, ok := packet.(gopacket.PacketBuilder)
+					if !ok {
+						log.Panic("Not a PacketBuilder")
+					}
+					_ = nextHeader.LayerType().Decode(payload, pb)
+				}
+			} else {
+				continue
 			}
 		}
 
@@ -425,11 +407,10 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 			c := Context{
 				CaptureInfo: packet.Metadata().CaptureInfo,
 			}
-			stats.totalsz += len(tcp.Payload)
 			rlog.Debugf("%s : %v -> %s : %v", packet.NetworkLayer().NetworkFlow().Src(), tcp.SrcPort, packet.NetworkLayer().NetworkFlow().Dst(), tcp.DstPort)
-			assemblerMutex.Lock()
-			assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &c)
-			assemblerMutex.Unlock()
+			dispatchTCPPacket(assemblerShards, packet.NetworkLayer().NetworkFlow(), tcp, &c)
+		} else if udp := packet.Layer(layers.LayerTypeUDP); udp != nil {
+			dnsDissectorInstance.DissectUDP(packet.NetworkLayer().NetworkFlow(), udp.(*layers.UDP), packet.Metadata().CaptureInfo.Timestamp, streamFactory.emitter())
 		}
 
 		done := *maxcount > 0 && count >= *maxcount
@@ -451,12 +432,8 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 		}
 	}
 
-	assemblerMutex.Lock()
-	closed := assembler.FlushAll()
-	assemblerMutex.Unlock()
-	rlog.Debugf("Final flush: %d closed", closed)
-	if outputLevel >= 2 {
-		streamPool.Dump()
+	for _, shard := range assemblerShards {
+		shard.stop()
 	}
 
 	if *memprofile != "" {
@@ -468,28 +445,32 @@ func startPassiveTapper(harWriter *HarWriter, outboundLinkWriter *OutboundLinkWr
 		_ = f.Close()
 	}
 
-	streamFactory.WaitGoRoutines()
-	assemblerMutex.Lock()
-	rlog.Debugf("%s", assembler.Dump())
-	assemblerMutex.Unlock()
+	var tcpTotals tcpStats
+	for _, shard := range assemblerShards {
+		shard.factory.WaitGoRoutines()
+		shard.assemblerMutex.Lock()
+		rlog.Debugf("%s", shard.assembler.Dump())
+		tcpTotals.add(&shard.stats)
+		shard.assemblerMutex.Unlock()
+	}
 	if !*nodefrag {
 		log.Printf("IPdefrag:\t\t%d", stats.ipdefrag)
 	}
 	log.Printf("TCP stats:")
-	log.Printf(" missed bytes:\t\t%d", stats.missedBytes)
-	log.Printf(" total packets:\t\t%d", stats.pkt)
-	log.Printf(" rejected FSM:\t\t%d", stats.rejectFsm)
-	log.Printf(" rejected Options:\t%d", stats.rejectOpt)
-	log.Printf(" reassembled bytes:\t%d", stats.sz)
-	log.Printf(" total TCP bytes:\t%d", stats.totalsz)
-	log.Printf(" conn rejected FSM:\t%d", stats.rejectConnFsm)
-	log.Printf(" reassembled chunks:\t%d", stats.reassembled)
-	log.Printf(" out-of-order packets:\t%d", stats.outOfOrderPackets)
-	log.Printf(" out-of-order bytes:\t%d", stats.outOfOrderBytes)
-	log.Printf(" biggest-chunk packets:\t%d", stats.biggestChunkPackets)
-	log.Printf(" biggest-chunk bytes:\t%d", stats.biggestChunkBytes)
-	log.Printf(" overlap packets:\t%d", stats.overlapPackets)
-	log.Printf(" overlap bytes:\t\t%d", stats.overlapBytes)
+	log.Printf(" missed bytes:\t\t%d", tcpTotals.missedBytes)
+	log.Printf(" total packets:\t\t%d", tcpTotals.pkt)
+	log.Printf(" rejected FSM:\t\t%d", tcpTotals.rejectFsm)
+	log.Printf(" rejected Options:\t%d", tcpTotals.rejectOpt)
+	log.Printf(" reassembled bytes:\t%d", tcpTotals.sz)
+	log.Printf(" total TCP bytes:\t%d", tcpTotals.totalsz)
+	log.Printf(" conn rejected FSM:\t%d", tcpTotals.rejectConnFsm)
+	log.Printf(" reassembled chunks:\t%d", tcpTotals.reassembled)
+	log.Printf(" out-of-order packets:\t%d", tcpTotals.outOfOrderPackets)
+	log.Printf(" out-of-order bytes:\t%d", tcpTotals.outOfOrderBytes)
+	log.Printf(" biggest-chunk packets:\t%d", tcpTotals.biggestChunkPackets)
+	log.Printf(" biggest-chunk bytes:\t%d", tcpTotals.biggestChunkBytes)
+	log.Printf(" overlap packets:\t%d", tcpTotals.overlapPackets)
+	log.Printf(" overlap bytes:\t\t%d", tcpTotals.overlapBytes)
 	log.Printf("Errors: %d", nErrors)
 	for e := range errorsMap {
 		log.Printf(" %s:\t\t%d", e, errorsMap[e])
@@ -0,0 +1,102 @@
+package tap
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+const (
+	dropNewestOverflowPolicy = "dropnewest"
+	dropOldestOverflowPolicy = "dropoldest"
+	blockOverflowPolicy      = "block"
+)
+
+var queueOverflow = flag.String("queueoverflow", blockOverflowPolicy, "What a full queue between stages of the capture pipeline does with a new item: block (which stalls the stages before it, so that a live capture drops packets in the kernel instead), dropnewest or dropoldest (with which a connection is dissected up to its first dropped chunk)")
+
+const (
+	// The chunks of payload of each direction of a connection that wait for its dissector
+	readerQueueLen       = 64
+	pairQueueLen         = 1000
+	outputQueueLen       = 1000
+	outboundLinkQueueLen = 1000
+)
+
+// QueueStats are the items that a stage of the capture pipeline dropped, or waited to queue, since the tapper started.
+type QueueStats struct {
+	Stage   string
+	Dropped uint64
+	Blocked uint64
+}
+
+/* pipelineQueue accounts for the queues between two stages of the capture pipeline, which are bounded channels.
+ * Stages queue items without waiting, and call overflow only when the queue is full.
+ */
+type pipelineQueue struct {
+	stage   string
+	dropped uint64 // atomic
+	blocked uint64 // atomic
+}
+
+var (
+	assemblerQueue    = &pipelineQueue{stage: "assembler"}
+	readerQueue       = &pipelineQueue{stage: "reader"}
+	pairQueue         = &pipelineQueue{stage: "harWriter"}
+	outputQueue       = &pipelineQueue{stage: "output"}
+	outboundLinkQueue = &pipelineQueue{stage: "outboundLink"}
+)
+
+var pipelineQueues = []*pipelineQueue{assemblerQueue, readerQueue, pairQueue, outputQueue, outboundLinkQueue}
+
+func checkQueueOverflowPolicy() error {
+	switch *queueOverflow {
+	case dropNewestOverflowPolicy, dropOldestOverflowPolicy, blockOverflowPolicy:
+		return nil
+	default:
+		return fmt.Errorf("unknown queue overflow policy %s, should be %s, %s or %s", *queueOverflow, dropNewestOverflowPolicy, dropOldestOverflowPolicy, blockOverflowPolicy)
+	}
+}
+
+/* overflow queues item to queue, a full channel of items of its type, according to the overflow policy.
+ * It goes through reflection, which only full queues pay for.
+ */
+func (q *pipelineQueue) overflow(queue interface{}, item interface{}) {
+	channel := reflect.ValueOf(queue)
+	value := reflect.ValueOf(item)
+	switch *queueOverflow {
+	case blockOverflowPolicy:
+		atomic.AddUint64(&q.blocked, 1)
+		channel.Send(value)
+	case dropOldestOverflowPolicy:
+		for !channel.TrySend(value) {
+			if _, ok := channel.TryRecv(); ok {
+				atomic.AddUint64(&q.dropped, 1)
+			}
+		}
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// drop counts an item that was dropped without going through overflow.
+func (q *pipelineQueue) drop() {
+	atomic.AddUint64(&q.dropped, 1)
+}
+
+func (q *pipelineQueue) stats() QueueStats {
+	return QueueStats{
+		Stage:   q.stage,
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Blocked: atomic.LoadUint64(&q.blocked),
+	}
+}
+
+// GetQueueStats returns the statistics of every stage of the capture pipeline, in the order of the pipeline.
+func GetQueueStats() []QueueStats {
+	stats := make([]QueueStats, len(pipelineQueues))
+	for i, queue := range pipelineQueues {
+		stats[i] = queue.stats()
+	}
+	return stats
+}
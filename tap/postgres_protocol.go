@@ -0,0 +1,311 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxPostgresMessageSize = 64 * 1024 * 1024
+
+const (
+	postgresProtocolVersion3 = 196608
+	postgresCancelRequest    = 80877102
+	postgresSSLRequest       = 80877103
+	postgresGSSENCRequest    = 80877104
+)
+
+var errPostgresShortBuffer = errors.New("postgres: not enough bytes")
+var errPostgresInvalidCount = errors.New("postgres: invalid count")
+
+var postgresAuthenticationNames = map[int32]string{
+	0:  "ok",
+	2:  "kerberos-v5",
+	3:  "cleartext-password",
+	5:  "md5-password",
+	7:  "gss",
+	9:  "sspi",
+	10: "sasl",
+}
+
+var postgresTransactionStatuses = map[byte]string{
+	'I': "idle",
+	'T': "in-transaction",
+	'E': "failed-transaction",
+}
+
+type PostgresQuery struct {
+	Statement  string    `json:"statement,omitempty"`
+	Portal     string    `json:"portal,omitempty"`
+	Query      string    `json:"query"`
+	Parameters []*string `json:"parameters,omitempty"`
+}
+
+type PostgresRequest struct {
+	Type       string            `json:"type"`
+	Queries    []*PostgresQuery  `json:"queries,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+type PostgresError struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+type PostgresResult struct {
+	CommandTag   string         `json:"commandTag,omitempty"`
+	Columns      []string       `json:"columns,omitempty"`
+	Rows         int            `json:"rows"`
+	RowsAffected *int64         `json:"rowsAffected,omitempty"`
+	Suspended    bool           `json:"suspended,omitempty"`
+	Error        *PostgresError `json:"error,omitempty"`
+}
+
+type PostgresResponse struct {
+	Authentication    string            `json:"authentication,omitempty"`
+	Results           []*PostgresResult `json:"results"`
+	Error             *PostgresError    `json:"error,omitempty"`
+	TransactionStatus string            `json:"transactionStatus"`
+}
+
+// readPostgresMessage reads a typed message. The bodies of data rows, copy data and oversized messages are skipped and returned as nil.
+func readPostgresMessage(b *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(b, header); err != nil {
+		return 0, nil, err
+	}
+	kind := header[0]
+	length := int(int32(binary.BigEndian.Uint32(header[1:]))) - 4
+	if length < 0 {
+		return kind, nil, fmt.Errorf("postgres: invalid message length %d", length)
+	}
+	if kind == 'D' || kind == 'd' || length > maxPostgresMessageSize {
+		_, err := b.Discard(length)
+		return kind, nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(b, body); err != nil {
+		return kind, nil, err
+	}
+	return kind, body, nil
+}
+
+// readPostgresUntypedMessage reads the messages a client sends before the startup completes, which have no type byte.
+func readPostgresUntypedMessage(b *bufio.Reader) (int32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(b, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(int32(binary.BigEndian.Uint32(header))) - 8
+	code := int32(binary.BigEndian.Uint32(header[4:]))
+	if length < 0 || length > maxPostgresMessageSize {
+		return code, nil, fmt.Errorf("postgres: invalid startup message length %d", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(b, body); err != nil {
+		return code, nil, err
+	}
+	return code, body, nil
+}
+
+// postgresDecoder reads message fields. Like kafkaDecoder, its first error is sticky.
+type postgresDecoder struct {
+	raw []byte
+	off int
+	err error
+}
+
+func (d *postgresDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.raw)-d.off < n {
+		d.err = errPostgresShortBuffer
+		return nil
+	}
+	buf := d.raw[d.off : d.off+n]
+	d.off += n
+	return buf
+}
+
+func (d *postgresDecoder) byte() byte {
+	if buf := d.next(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (d *postgresDecoder) int16() int16 {
+	if buf := d.next(2); buf != nil {
+		return int16(binary.BigEndian.Uint16(buf))
+	}
+	return 0
+}
+
+func (d *postgresDecoder) int32() int32 {
+	if buf := d.next(4); buf != nil {
+		return int32(binary.BigEndian.Uint32(buf))
+	}
+	return 0
+}
+
+// count reads the count of the elements that follow, each at least elementLen bytes long, which must fit the rest of the message.
+func (d *postgresDecoder) count(elementLen int) int {
+	count := int(d.int16())
+	if d.err != nil {
+		return 0
+	}
+	if count < 0 || count > (len(d.raw)-d.off)/elementLen {
+		d.err = errPostgresInvalidCount
+		return 0
+	}
+	return count
+}
+
+func (d *postgresDecoder) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(d.raw[d.off:], 0)
+	if end < 0 {
+		d.err = errPostgresShortBuffer
+		return ""
+	}
+	str := string(d.raw[d.off : d.off+end])
+	d.off += end + 1
+	return str
+}
+
+func decodePostgresStartup(body []byte) *PostgresRequest {
+	d := &postgresDecoder{raw: body}
+	request := &PostgresRequest{Type: "startup", Parameters: make(map[string]string)}
+	for d.err == nil {
+		name := d.cstring()
+		if name == "" {
+			break
+		}
+		request.Parameters[name] = d.cstring()
+	}
+	return request
+}
+
+func decodePostgresParse(body []byte) (name string, query string, err error) {
+	d := &postgresDecoder{raw: body}
+	name = d.cstring()
+	query = d.cstring()
+	return name, query, d.err
+}
+
+// decodePostgresBind returns the portal created by a Bind message, with the statement it binds and its parameters.
+func decodePostgresBind(body []byte) (*PostgresQuery, error) {
+	d := &postgresDecoder{raw: body}
+	query := &PostgresQuery{Parameters: make([]*string, 0)}
+	query.Portal = d.cstring()
+	query.Statement = d.cstring()
+
+	formats := make([]int16, d.count(2))
+	for i := range formats {
+		formats[i] = d.int16()
+	}
+	// Every parameter starts with its length
+	count := d.count(4)
+	for i := 0; i < count && d.err == nil; i++ {
+		length := int(d.int32())
+		if length < 0 {
+			query.Parameters = append(query.Parameters, nil)
+			continue
+		}
+		value := d.next(length)
+
+		// A single format code applies to all parameters, no format codes means they are all text
+		format := int16(0)
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if i < len(formats) {
+			format = formats[i]
+		}
+		var str string
+		if format == 0 {
+			str = string(value)
+		} else {
+			str = `\x` + hex.EncodeToString(value)
+		}
+		query.Parameters = append(query.Parameters, &str)
+	}
+	return query, d.err
+}
+
+func decodePostgresExecute(body []byte) (string, error) {
+	d := &postgresDecoder{raw: body}
+	portal := d.cstring()
+	return portal, d.err
+}
+
+func decodePostgresError(body []byte) *PostgresError {
+	d := &postgresDecoder{raw: body}
+	pgError := &PostgresError{}
+	for d.err == nil {
+		field := d.byte()
+		if field == 0 {
+			break
+		}
+		value := d.cstring()
+		switch field {
+		case 'V':
+			pgError.Severity = value
+		case 'S':
+			// The localized severity is only used by servers older than 9.6
+			if pgError.Severity == "" {
+				pgError.Severity = value
+			}
+		case 'C':
+			pgError.Code = value
+		case 'M':
+			pgError.Message = value
+		case 'D':
+			pgError.Detail = value
+		case 'H':
+			pgError.Hint = value
+		case 'P':
+			pgError.Position = value
+		}
+	}
+	return pgError
+}
+
+func decodePostgresRowDescription(body []byte) []string {
+	d := &postgresDecoder{raw: body}
+	// Every column has a name, at least its terminator, and 18 bytes of fields
+	count := d.count(19)
+	columns := make([]string, 0)
+	for i := 0; i < count && d.err == nil; i++ {
+		columns = append(columns, d.cstring())
+		d.next(18) // table OID, column number, type OID, type size, type modifier and format
+	}
+	return columns
+}
+
+func decodePostgresCommandComplete(body []byte, result *PostgresResult) {
+	d := &postgresDecoder{raw: body}
+	result.CommandTag = d.cstring()
+
+	// Tags such as "INSERT 0 5", "UPDATE 3" or "SELECT 3" end with the number of affected rows
+	words := strings.Fields(result.CommandTag)
+	if len(words) > 1 {
+		if count, err := strconv.ParseInt(words[len(words)-1], 10, 64); err == nil {
+			result.RowsAffected = &count
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// postgresBindBody builds the body of a Bind message, whose counts are written as given.
+func postgresBindBody(formatCount int16, formats []int16, parameterCount int16, parameters [][]byte) []byte {
+	var body bytes.Buffer
+	body.WriteString("portal\x00statement\x00")
+	_ = binary.Write(&body, binary.BigEndian, formatCount)
+	for _, format := range formats {
+		_ = binary.Write(&body, binary.BigEndian, format)
+	}
+	_ = binary.Write(&body, binary.BigEndian, parameterCount)
+	for _, parameter := range parameters {
+		if parameter == nil {
+			_ = binary.Write(&body, binary.BigEndian, int32(-1))
+			continue
+		}
+		_ = binary.Write(&body, binary.BigEndian, int32(len(parameter)))
+		body.Write(parameter)
+	}
+	return body.Bytes()
+}
+
+func TestDecodePostgresBind(t *testing.T) {
+	body := postgresBindBody(2, []int16{0, 1}, 3, [][]byte{[]byte("text"), {0xde, 0xad}, nil})
+	query, err := decodePostgresBind(body)
+	if err != nil {
+		t.Fatalf("decodePostgresBind: %v", err)
+	}
+	if query.Portal != "portal" || query.Statement != "statement" {
+		t.Errorf("portal %q and statement %q", query.Portal, query.Statement)
+	}
+	if len(query.Parameters) != 3 {
+		t.Fatalf("got %d parameters, want 3", len(query.Parameters))
+	}
+	if *query.Parameters[0] != "text" || *query.Parameters[1] != `\xdead` || query.Parameters[2] != nil {
+		t.Errorf("unexpected parameters %q, %q, %v", *query.Parameters[0], *query.Parameters[1], query.Parameters[2])
+	}
+}
+
+func TestDecodePostgresBindTruncated(t *testing.T) {
+	body := postgresBindBody(1, []int16{0}, 2, [][]byte{[]byte("value"), []byte("other")})
+	for i := 0; i < len(body); i++ {
+		if _, err := decodePostgresBind(body[:i]); err == nil {
+			t.Errorf("decoding the first %d bytes of %d succeeded", i, len(body))
+		}
+	}
+}
+
+func TestDecodePostgresBindInvalidCounts(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"negative format count", postgresBindBody(-1, nil, 0, nil)},
+		{"format count past the end", postgresBindBody(100, []int16{0}, 0, nil)},
+		{"negative parameter count", postgresBindBody(0, nil, -1, nil)},
+		{"parameter count past the end", postgresBindBody(0, nil, 0x7fff, [][]byte{[]byte("value")})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodePostgresBind(test.body); err == nil {
+				t.Error("decoding succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package tap
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const postgresPortsEnvVar = "POSTGRES_PORTS"
+
+var postgresProtocol = &Protocol{
+	Name:         "postgres",
+	Abbreviation: "PG",
+}
+
+func init() {
+	RegisterDissector(&postgresDissector{ports: portsFromEnv(postgresPortsEnvVar, []int{5432})})
+}
+
+/* postgresDissector parses the frontend/backend protocol (version 3) of unencrypted connections.
+ * The server answers every simple query, Sync and startup message with exactly one ReadyForQuery,
+ * so each such cycle becomes an entry and the cycles of both directions are matched FIFO, like Redis.
+ * An extended query cycle (Parse/Bind/Execute up to Sync) may execute several statements.
+ * Connections that switch to TLS are dropped once the handshake begins.
+ */
+type postgresDissector struct {
+	ports []int
+}
+
+func (d *postgresDissector) Protocol() *Protocol {
+	return postgresProtocol
+}
+
+func (d *postgresDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *postgresDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *postgresDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	if isClient {
+		return d.dissectFrontend(b, clientTcpID, reader)
+	}
+	return d.dissectBackend(b, clientTcpID, reader)
+}
+
+func (d *postgresDissector) dissectFrontend(b *bufio.Reader, clientTcpID *TcpID, reader *TcpReader) error {
+	var sequence uint64
+	statements := make(map[string]string)
+	portals := make(map[string]*PostgresQuery)
+	var current *PostgresRequest
+	var currentTime time.Time
+
+	register := func(request *PostgresRequest, requestTime time.Time) {
+		ident := fmt.Sprintf("%s %d", clientTcpID, sequence)
+		sequence++
+		pair := reqResMatcher.registerRequest(ident, request, requestTime)
+		d.emitPair(pair, clientTcpID, reader)
+	}
+	extended := func() *PostgresRequest {
+		if current == nil {
+			current = &PostgresRequest{Type: "extended", Queries: make([]*PostgresQuery, 0)}
+			currentTime = reader.CaptureTime()
+		}
+		return current
+	}
+
+	for {
+		first, err := b.Peek(1)
+		if err != nil {
+			return err
+		}
+		if first[0] == 0x16 {
+			// A TLS handshake record, the server accepted an SSLRequest
+			return nil
+		}
+
+		if first[0] == 0 {
+			// Startup packets have no type byte, and their length never reaches 16MB
+			code, body, err := readPostgresUntypedMessage(b)
+			if err != nil {
+				return err
+			}
+			switch code {
+			case postgresProtocolVersion3:
+				register(decodePostgresStartup(body), reader.CaptureTime())
+			case postgresSSLRequest, postgresGSSENCRequest:
+				// Answered by a single byte, and followed by a handshake if the server accepts
+			case postgresCancelRequest:
+				// Cancellations are sent over a new connection and are never answered
+				request := &PostgresRequest{Type: "cancel"}
+				d.emitEntry(request, nil, reader.CaptureTime(), reader.CaptureTime(), clientTcpID, reader)
+			}
+			continue
+		}
+
+		kind, body, err := readPostgresMessage(b)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case 'Q':
+			query := &PostgresQuery{Query: strings.TrimRight(string(body), "\x00")}
+			register(&PostgresRequest{Type: "simple", Queries: []*PostgresQuery{query}}, reader.CaptureTime())
+		case 'F':
+			register(&PostgresRequest{Type: "function-call"}, reader.CaptureTime())
+		case 'P':
+			name, query, err := decodePostgresParse(body)
+			if err != nil {
+				return err
+			}
+			statements[name] = query
+			extended()
+		case 'B':
+			query, err := decodePostgresBind(body)
+			if err != nil {
+				return err
+			}
+			query.Query = statements[query.Statement]
+			portals[query.Portal] = query
+			extended()
+		case 'E':
+			portal, err := decodePostgresExecute(body)
+			if err != nil {
+				return err
+			}
+			query, ok := portals[portal]
+			if !ok {
+				// The portal was bound before the capture started
+				query = &PostgresQuery{Portal: portal}
+			}
+			request := extended()
+			request.Queries = append(request.Queries, query)
+		case 'S':
+			extended()
+			register(current, currentTime)
+			current = nil
+		}
+	}
+}
+
+func (d *postgresDissector) dissectBackend(b *bufio.Reader, clientTcpID *TcpID, reader *TcpReader) error {
+	var sequence uint64
+	var current *PostgresResponse
+	var result *PostgresResult
+
+	response := func() *PostgresResponse {
+		if current == nil {
+			current = &PostgresResponse{Results: make([]*PostgresResult, 0)}
+		}
+		return current
+	}
+	pending := func() *PostgresResult {
+		if result == nil {
+			result = &PostgresResult{}
+		}
+		return result
+	}
+	complete := func() {
+		current := response()
+		current.Results = append(current.Results, pending())
+		result = nil
+	}
+
+	for {
+		header, err := b.Peek(5)
+		if err != nil {
+			return err
+		}
+		if (header[0] == 'S' || header[0] == 'N' || header[0] == 'G') && header[1] != 0 {
+			// A single byte answer to an SSLRequest or GSSENCRequest, rather than a message length
+			if _, err := b.Discard(1); err != nil {
+				return err
+			}
+			if header[0] != 'N' {
+				return nil
+			}
+			continue
+		}
+
+		kind, body, err := readPostgresMessage(b)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case 'R':
+			method := (&postgresDecoder{raw: body}).int32()
+			if name, ok := postgresAuthenticationNames[method]; ok {
+				response().Authentication = name
+			}
+		case 'T':
+			pending().Columns = decodePostgresRowDescription(body)
+		case 'D':
+			pending().Rows++
+		case 'C':
+			decodePostgresCommandComplete(body, pending())
+			complete()
+		case 'I':
+			complete()
+		case 's':
+			pending().Suspended = true
+			complete()
+		case 'E':
+			pgError := decodePostgresError(body)
+			pending().Error = pgError
+			if response().Error == nil {
+				current.Error = pgError
+			}
+			complete()
+		case 'Z':
+			if len(body) > 0 {
+				response().TransactionStatus = postgresTransactionStatuses[body[0]]
+			}
+			ident := fmt.Sprintf("%s %d", clientTcpID, sequence)
+			sequence++
+			pair := reqResMatcher.registerResponse(ident, response(), reader.CaptureTime())
+			d.emitPair(pair, clientTcpID, reader)
+			current = nil
+			result = nil
+		}
+	}
+}
+
+func (d *postgresDissector) emitPair(pair *requestResponsePair, clientTcpID *TcpID, reader *TcpReader) {
+	if pair == nil {
+		return
+	}
+	statsTracker.incMatchedMessages()
+
+	request := pair.Request.orig.(*PostgresRequest)
+	response := pair.Response.orig.(*PostgresResponse)
+	if request.Type == "extended" && len(request.Queries) == 0 {
+		// A Sync that followed no Execute, e.g. after only preparing a statement
+		return
+	}
+	d.emitEntry(request, response, pair.Request.captureTime, pair.Response.captureTime, clientTcpID, reader)
+}
+
+func (d *postgresDissector) emitEntry(request *PostgresRequest, response *PostgresResponse, requestTime time.Time, responseTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	entry := newEntry(postgresProtocol, requestTime, responseTime)
+	entry.Method = strings.ToUpper(request.Type)
+	entry.Request = request
+	if request.Type == "startup" {
+		entry.Path = request.Parameters["database"]
+	} else if len(request.Queries) > 0 {
+		entry.Path = strings.TrimSpace(request.Queries[0].Query)
+		entry.Method = postgresCommand(request.Queries[0], response)
+	}
+	if response != nil {
+		if response.Error != nil {
+			entry.StatusText = response.Error.Code
+		}
+		entry.Response = response
+	}
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       postgresProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
+
+// postgresCommand names a query after its command tag, or after the first keyword of its SQL when there is none.
+func postgresCommand(query *PostgresQuery, response *PostgresResponse) string {
+	if response != nil && len(response.Results) > 0 && response.Results[0].CommandTag != "" {
+		return strings.Fields(response.Results[0].CommandTag)[0]
+	}
+	if words := strings.Fields(query.Query); len(words) > 0 {
+		return strings.ToUpper(words[0])
+	}
+	return "EXECUTE"
+}
@@ -0,0 +1,235 @@
+package tap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxRedisValueSize = 64 * 1024
+const maxRedisElements = 1000
+
+// Aggregates nested deeper than this are rejected, rather than decoded by unbounded recursion
+const maxRedisDepth = 32
+
+var redisTypeNames = map[byte]string{
+	'+': "simple-string",
+	'-': "error",
+	':': "integer",
+	'$': "bulk-string",
+	'*': "array",
+	'_': "null",
+	',': "double",
+	'#': "boolean",
+	'!': "blob-error",
+	'=': "verbatim-string",
+	'(': "big-number",
+	'%': "map",
+	'~': "set",
+	'>': "push",
+}
+
+type RedisRequest struct {
+	Command   string        `json:"command"`
+	Arguments []interface{} `json:"arguments"`
+	Inline    bool          `json:"inline,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+type RedisResponse struct {
+	Type      string      `json:"type"`
+	Value     interface{} `json:"value"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+func (r *RedisResponse) isError() bool {
+	return r.Type == redisTypeNames['-'] || r.Type == redisTypeNames['!']
+}
+
+// errorKind returns the first word of an error reply, such as ERR or WRONGTYPE.
+func (r *RedisResponse) errorKind() string {
+	message, _ := r.Value.(string)
+	return strings.SplitN(message, " ", 2)[0]
+}
+
+/* redisDecoder reads RESP2 and RESP3 values.
+ * Bulk strings longer than maxRedisValueSize and aggregates with more than maxRedisElements elements
+ * are consumed in full but only partially kept, in which case truncated is set.
+ */
+type redisDecoder struct {
+	b         *bufio.Reader
+	truncated bool
+}
+
+func (d *redisDecoder) readLine() (string, error) {
+	line, err := d.b.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("redis: line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (d *redisDecoder) readRequest() (*RedisRequest, error) {
+	d.truncated = false
+	first, err := d.b.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &RedisRequest{Arguments: make([]interface{}, 0)}
+	var words []interface{}
+	if first[0] == '*' {
+		_, value, err := d.readValue()
+		if err != nil {
+			return nil, err
+		}
+		words, _ = value.([]interface{})
+	} else {
+		// Inline commands are sent by hand, e.g. through telnet
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		for _, word := range strings.Fields(line) {
+			words = append(words, word)
+		}
+		request.Inline = true
+	}
+
+	if len(words) > 0 {
+		request.Command = strings.ToUpper(fmt.Sprint(words[0]))
+		request.Arguments = append(request.Arguments, words[1:]...)
+	}
+	request.Truncated = d.truncated
+	return request, nil
+}
+
+func (d *redisDecoder) readResponse() (*RedisResponse, error) {
+	d.truncated = false
+	kind, value, err := d.readValue()
+	if err != nil {
+		return nil, err
+	}
+	return &RedisResponse{Type: redisTypeNames[kind], Value: value, Truncated: d.truncated}, nil
+}
+
+// readValue reads a single value and returns its type byte along with the decoded value.
+func (d *redisDecoder) readValue() (byte, interface{}, error) {
+	return d.readNestedValue(0)
+}
+
+// readNestedValue reads a value that is nested in depth aggregates.
+func (d *redisDecoder) readNestedValue(depth int) (byte, interface{}, error) {
+	if depth > maxRedisDepth {
+		return 0, nil, fmt.Errorf("redis: values are nested deeper than %d", maxRedisDepth)
+	}
+	line, err := d.readLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(line) == 0 {
+		return 0, nil, fmt.Errorf("redis: empty line")
+	}
+
+	kind, payload := line[0], line[1:]
+	switch kind {
+	case '+', '-', ',', '(':
+		// Doubles and big numbers are kept as text since they may not fit JSON numbers
+		return kind, payload, nil
+	case ':':
+		value, err := strconv.ParseInt(payload, 10, 64)
+		return kind, value, err
+	case '#':
+		return kind, payload == "t", nil
+	case '_':
+		return kind, nil, nil
+	case '$', '!', '=':
+		length, err := strconv.Atoi(payload)
+		if err != nil {
+			return kind, nil, err
+		}
+		if length < 0 {
+			return kind, nil, nil
+		}
+		value, err := d.readBulk(length)
+		if err != nil {
+			return kind, nil, err
+		}
+		if kind == '=' && len(value) >= 4 {
+			// Verbatim strings start with their format, such as "txt:"
+			value = value[4:]
+		}
+		return kind, *payloadString(value), nil
+	case '*', '~', '>':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return kind, nil, err
+		}
+		if count < 0 {
+			return kind, nil, nil
+		}
+		elements := make([]interface{}, 0)
+		for i := 0; i < count; i++ {
+			_, element, err := d.readNestedValue(depth + 1)
+			if err != nil {
+				return kind, nil, err
+			}
+			if i < maxRedisElements {
+				elements = append(elements, element)
+			} else {
+				d.truncated = true
+			}
+		}
+		return kind, elements, nil
+	case '%', '|':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return kind, nil, err
+		}
+		pairs := make(map[string]interface{})
+		for i := 0; i < count; i++ {
+			_, key, err := d.readNestedValue(depth + 1)
+			if err != nil {
+				return kind, nil, err
+			}
+			_, value, err := d.readNestedValue(depth + 1)
+			if err != nil {
+				return kind, nil, err
+			}
+			if i < maxRedisElements {
+				pairs[fmt.Sprint(key)] = value
+			} else {
+				d.truncated = true
+			}
+		}
+		if kind == '|' {
+			// Attributes carry auxiliary data and are followed by the actual value
+			return d.readNestedValue(depth + 1)
+		}
+		return kind, pairs, nil
+	default:
+		return kind, nil, fmt.Errorf("redis: unknown type byte %q", kind)
+	}
+}
+
+func (d *redisDecoder) readBulk(length int) ([]byte, error) {
+	kept := length
+	if kept > maxRedisValueSize {
+		kept = maxRedisValueSize
+		d.truncated = true
+	}
+	value := make([]byte, kept)
+	if _, err := io.ReadFull(d.b, value); err != nil {
+		return nil, err
+	}
+	// Skips the rest of the value and its CRLF terminator
+	if _, err := d.b.Discard(length - kept + 2); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,247 @@
+package tap
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const redisPortsEnvVar = "REDIS_PORTS"
+const redisMaskedValue = "[REDACTED]"
+
+var redisProtocol = &Protocol{
+	Name:         "redis",
+	Abbreviation: "REDIS",
+}
+
+var redisSubscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+}
+
+// The kind of subscriptions of each subscribe command, which its unsubscribe command ends
+var redisSubscriptionKinds = map[string]string{
+	"SUBSCRIBE":    "channel",
+	"UNSUBSCRIBE":  "channel",
+	"PSUBSCRIBE":   "pattern",
+	"PUNSUBSCRIBE": "pattern",
+	"SSUBSCRIBE":   "shard",
+	"SUNSUBSCRIBE": "shard",
+}
+
+var redisPushKinds = map[string]bool{
+	"message":  true,
+	"pmessage": true,
+	"smessage": true,
+}
+
+func init() {
+	RegisterDissector(&redisDissector{ports: portsFromEnv(redisPortsEnvVar, []int{6379})})
+}
+
+/* redisDissector parses RESP2 and RESP3 traffic.
+ * Redis answers commands in order, so pipelined commands are matched with their replies FIFO:
+ * both directions count the messages they see, and the n-th command is paired with the n-th reply.
+ * Pub/sub messages are not replies to any command and are emitted on their own.
+ */
+type redisDissector struct {
+	ports []int
+}
+
+func (d *redisDissector) Protocol() *Protocol {
+	return redisProtocol
+}
+
+func (d *redisDissector) Claims(tcpID *TcpID) bool {
+	return claimsPorts(tcpID, d.ports)
+}
+
+func (d *redisDissector) claimedPorts() []int {
+	return d.ports
+}
+
+func (d *redisDissector) Dissect(b *bufio.Reader, reader *TcpReader) error {
+	isClient := isServerPort(reader.TcpID(), d.ports)
+	clientTcpID := reader.TcpID()
+	if !isClient {
+		clientTcpID = clientTcpID.Reverse()
+	}
+
+	decoder := &redisDecoder{b: b}
+	if isClient {
+		return d.dissectRequests(decoder, clientTcpID, reader)
+	}
+	return d.dissectResponses(decoder, clientTcpID, reader)
+}
+
+func (d *redisDissector) dissectRequests(decoder *redisDecoder, clientTcpID *TcpID, reader *TcpReader) error {
+	var sequence uint64
+	isRESP3 := false
+	subscriptions := make(redisSubscriptions)
+
+	for {
+		request, err := decoder.readRequest()
+		if err != nil {
+			return err
+		}
+		if request.Command == "" {
+			continue
+		}
+		if request.Command == "HELLO" && len(request.Arguments) > 0 {
+			isRESP3 = fmt.Sprint(request.Arguments[0]) == "3"
+		}
+		maskRedisRequest(request)
+
+		replies := uint64(1)
+		if redisSubscribeCommands[request.Command] {
+			if isRESP3 {
+				// RESP3 confirms subscriptions with push messages instead of replies
+				d.emitEntry(request, nil, reader.CaptureTime(), reader.CaptureTime(), clientTcpID, reader)
+				continue
+			}
+			// RESP2 sends one reply per channel, only the first one is paired with the command
+			replies = subscriptions.replies(request)
+		}
+
+		ident := fmt.Sprintf("%s %d", clientTcpID, sequence)
+		sequence += replies
+		pair := reqResMatcher.registerRequest(ident, request, reader.CaptureTime())
+		d.emitPair(pair, clientTcpID, reader)
+	}
+}
+
+func (d *redisDissector) dissectResponses(decoder *redisDecoder, clientTcpID *TcpID, reader *TcpReader) error {
+	var sequence uint64
+
+	for {
+		response, err := decoder.readResponse()
+		if err != nil {
+			return err
+		}
+		if isRedisPush(response) {
+			d.emitEntry(nil, response, reader.CaptureTime(), reader.CaptureTime(), clientTcpID, reader)
+			continue
+		}
+
+		ident := fmt.Sprintf("%s %d", clientTcpID, sequence)
+		sequence++
+		pair := reqResMatcher.registerResponse(ident, response, reader.CaptureTime())
+		d.emitPair(pair, clientTcpID, reader)
+	}
+}
+
+func (d *redisDissector) emitPair(pair *requestResponsePair, clientTcpID *TcpID, reader *TcpReader) {
+	if pair == nil {
+		return
+	}
+	statsTracker.incMatchedMessages()
+
+	request := pair.Request.orig.(*RedisRequest)
+	response := pair.Response.orig.(*RedisResponse)
+	d.emitEntry(request, response, pair.Request.captureTime, pair.Response.captureTime, clientTcpID, reader)
+}
+
+// emitEntry emits a command with its reply. Either may be nil, for subscriptions and pub/sub messages respectively.
+func (d *redisDissector) emitEntry(request *RedisRequest, response *RedisResponse, requestTime time.Time, responseTime time.Time, clientTcpID *TcpID, reader *TcpReader) {
+	entry := newEntry(redisProtocol, requestTime, responseTime)
+	if request != nil {
+		entry.Method = request.Command
+		if len(request.Arguments) > 0 {
+			entry.Path = fmt.Sprint(request.Arguments[0])
+		}
+		entry.Request = request
+	} else {
+		// Pub/sub messages are named after their kind and channel
+		elements := response.Value.([]interface{})
+		entry.Method = strings.ToUpper(fmt.Sprint(elements[0]))
+		if len(elements) >= 3 {
+			entry.Path = fmt.Sprint(elements[len(elements)-2])
+		}
+	}
+	if response != nil {
+		if response.isError() {
+			entry.StatusText = response.errorKind()
+		}
+		entry.Response = response
+	}
+
+	reader.Emit(&OutputChannelItem{
+		Protocol:       redisProtocol.Name,
+		Entry:          entry,
+		ConnectionInfo: newConnectionInfo(clientTcpID, reader.IsOutgoing()),
+	})
+}
+
+// redisSubscriptions are the names that a RESP2 connection is subscribed to, by the kind of subscription.
+type redisSubscriptions map[string]map[string]bool
+
+/* replies returns the number of replies to a subscribe or unsubscribe command, which is one per name,
+ * or one per subscription of its kind for an unsubscribe command without names, and updates the subscriptions.
+ * Subscriptions made before the capture started are unknown, so unsubscribing from them may still desynchronize the replies.
+ */
+func (s redisSubscriptions) replies(request *RedisRequest) uint64 {
+	kind := redisSubscriptionKinds[request.Command]
+	names := s[kind]
+	if names == nil {
+		names = make(map[string]bool)
+		s[kind] = names
+	}
+
+	isUnsubscribe := strings.Contains(request.Command, "UNSUBSCRIBE")
+	if isUnsubscribe && len(request.Arguments) == 0 {
+		replies := uint64(len(names))
+		s[kind] = make(map[string]bool)
+		if replies == 0 {
+			// Unsubscribing without any subscription is confirmed by a single reply
+			return 1
+		}
+		return replies
+	}
+
+	for _, argument := range request.Arguments {
+		name := fmt.Sprint(argument)
+		if isUnsubscribe {
+			delete(names, name)
+		} else {
+			names[name] = true
+		}
+	}
+	if len(request.Arguments) == 0 {
+		return 1
+	}
+	return uint64(len(request.Arguments))
+}
+
+func isRedisPush(response *RedisResponse) bool {
+	elements, ok := response.Value.([]interface{})
+	if !ok || len(elements) == 0 {
+		return false
+	}
+	if response.Type == redisTypeNames['>'] {
+		return true
+	}
+	kind, _ := elements[0].(string)
+	return response.Type == redisTypeNames['*'] && redisPushKinds[kind]
+}
+
+// maskRedisRequest hides the credentials sent by AUTH and HELLO ... AUTH.
+func maskRedisRequest(request *RedisRequest) {
+	switch request.Command {
+	case "AUTH":
+		for i := range request.Arguments {
+			request.Arguments[i] = redisMaskedValue
+		}
+	case "HELLO":
+		for i := 0; i < len(request.Arguments)-2; i++ {
+			if strings.ToUpper(fmt.Sprint(request.Arguments[i])) == "AUTH" {
+				request.Arguments[i+1] = redisMaskedValue
+				request.Arguments[i+2] = redisMaskedValue
+			}
+		}
+	}
+}
@@ -12,6 +12,7 @@ var gSettings = &globalSettings{
 
 func SetFilterPorts(ports []int) {
 	gSettings.filterPorts = ports
+	targetsFilter.update()
 }
 
 func GetFilterPorts() []int {
@@ -22,6 +23,7 @@ func GetFilterPorts() []int {
 
 func SetFilterAuthorities(ipAddresses []string) {
 	gSettings.filterAuthorities = ipAddresses
+	targetsFilter.update()
 }
 
 func GetFilterIPs() []string {
@@ -0,0 +1,163 @@
+package tap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+type tcpReaderDataMsg struct {
+	bytes     []byte
+	timestamp time.Time
+}
+
+type TcpID struct {
+	SrcIP   string
+	DstIP   string
+	SrcPort string
+	DstPort string
+}
+
+type ConnectionInfo struct {
+	ClientIP   string
+	ClientPort string
+	ServerIP   string
+	ServerPort string
+	IsOutgoing bool
+}
+
+// ClientAddress returns the host:port address of the client, in which IPv6 addresses are bracketed.
+func (info *ConnectionInfo) ClientAddress() string {
+	return net.JoinHostPort(info.ClientIP, info.ClientPort)
+}
+
+// ServerAddress returns the host:port address of the server, in which IPv6 addresses are bracketed.
+func (info *ConnectionInfo) ServerAddress() string {
+	return net.JoinHostPort(info.ServerIP, info.ServerPort)
+}
+
+func (tid *TcpID) String() string {
+	return fmt.Sprintf("%s->%s %s->%s", tid.SrcIP, tid.DstIP, tid.SrcPort, tid.DstPort)
+}
+
+func (tid *TcpID) Reverse() *TcpID {
+	return &TcpID{
+		SrcIP:   tid.DstIP,
+		DstIP:   tid.SrcIP,
+		SrcPort: tid.DstPort,
+		DstPort: tid.SrcPort,
+	}
+}
+
+/* TcpReader gets reads from a channel of bytes of tcp payload, and hands it to the Dissector of its connection.
+ * The payload is written to the channel by a tcpStream object that is dedicated to one tcp connection.
+ * A TcpReader object is unidirectional: it reads either a client stream or a server stream.
+ * Implements io.Reader interface (Read)
+ */
+type TcpReader struct {
+	ident       string
+	tcpID       *TcpID
+	isClient    bool
+	isOutgoing  bool
+	msgQueue    chan tcpReaderDataMsg // Channel of captured reassembled tcp payload
+	isDesynced  bool                  // set by the assembler when it dropped a chunk, and closed msgQueue
+	data        []byte
+	captureTime time.Time
+	parent      *tcpStream
+	emitter     Emitter
+	harWriter   *HarWriter
+}
+
+func (r *TcpReader) Read(p []byte) (int, error) {
+	var msg tcpReaderDataMsg
+	ok := true
+	for ok && len(r.data) == 0 {
+		msg, ok = <-r.msgQueue
+		r.data = msg.bytes
+		r.captureTime = msg.timestamp
+	}
+	if !ok || len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	l := copy(p, r.data)
+	r.data = r.data[l:]
+	return l, nil
+}
+
+func (r *TcpReader) TcpID() *TcpID {
+	return r.tcpID
+}
+
+func (r *TcpReader) IsClient() bool {
+	return r.isClient
+}
+
+func (r *TcpReader) IsOutgoing() bool {
+	return r.isOutgoing
+}
+
+// CaptureTime returns the capture timestamp of the last chunk of payload read.
+func (r *TcpReader) CaptureTime() time.Time {
+	return r.captureTime
+}
+
+// SharedState returns the state shared by both directions of the connection, created by newState on first use.
+func (r *TcpReader) SharedState(newState func() interface{}) interface{} {
+	r.parent.Lock()
+	defer r.parent.Unlock()
+	if r.parent.dissectorState == nil {
+		r.parent.dissectorState = newState()
+	}
+	return r.parent.dissectorState
+}
+
+// ConnectionInfo returns the connection details of this direction, with the client side being the TCP initiator.
+func (r *TcpReader) ConnectionInfo() *ConnectionInfo {
+	tcpID := r.tcpID
+	if !r.isClient {
+		tcpID = tcpID.Reverse()
+	}
+	return newConnectionInfo(tcpID, r.isOutgoing)
+}
+
+func newConnectionInfo(clientTcpID *TcpID, isOutgoing bool) *ConnectionInfo {
+	return &ConnectionInfo{
+		ClientIP:   clientTcpID.SrcIP,
+		ClientPort: clientTcpID.SrcPort,
+		ServerIP:   clientTcpID.DstIP,
+		ServerPort: clientTcpID.DstPort,
+		IsOutgoing: isOutgoing,
+	}
+}
+
+func (r *TcpReader) Emit(item *OutputChannelItem) {
+	if r.emitter == nil {
+		return
+	}
+	if item.ConnectionInfo == nil {
+		item.ConnectionInfo = r.ConnectionInfo()
+	}
+	r.emitter.Emit(item)
+}
+
+func (r *TcpReader) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	b := bufio.NewReader(r)
+	// Only the connections of the default dissector are taken for TLS sessions that started before the capture
+	if isTLSRecord(b, r.parent.dissector == defaultDissector) {
+		// Dissectors parse the plaintext of TLS connections that can be decrypted
+		tlsReader := newTLSReader(b, r)
+		defer tlsReader.close()
+		b = bufio.NewReader(tlsReader)
+	}
+	if err := r.parent.dissector.Dissect(b, r); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		SilentError("Dissect", "stream %s %s error: %s (%v,%+v)", r.ident, r.parent.dissector.Protocol().Name, err, err, err)
+	}
+	// Drain whatever the dissector did not consume so that reassembly is never blocked on this reader.
+	_, _ = io.Copy(ioutil.Discard, b)
+}
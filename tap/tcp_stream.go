@@ -1,7 +1,6 @@
 package tap
 
 import (
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"sync"
@@ -14,18 +13,21 @@ import (
 /* It's a connection (bidirectional)
  * Implements gopacket.reassembly.Stream interface (Accept, ReassembledSG, ReassemblyComplete)
  * ReassembledSG gets called when new reassembled data is ready (i.e. bytes in order, no duplicates, complete)
- * In our implementation, we pass information from ReassembledSG to the httpReader through a shared channel.
+ * In our implementation, we pass information from ReassembledSG to the TcpReader objects through a shared channel,
+ * and each TcpReader hands it to the Dissector that claimed the connection.
  */
 type tcpStream struct {
 	tcpstate       *reassembly.TCPSimpleFSM
 	fsmerr         bool
 	optchecker     reassembly.TCPOptionCheck
 	net, transport gopacket.Flow
-	isDNS          bool
-	isHTTP         bool
+	dissector      Dissector
 	reversed       bool
-	client         httpReader
-	server         httpReader
+	client         TcpReader
+	server         TcpReader
+	dissectorState interface{} // State shared by the dissector goroutines of both directions
+	tlsState       *tlsConnection
+	stats          *tcpStats // of the assembler shard of the connection
 	urls           []string
 	ident          string
 	sync.Mutex
@@ -35,10 +37,10 @@ func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassem
 	// FSM
 	if !t.tcpstate.CheckState(tcp, dir) {
 		SilentError("FSM-rejection", "%s: Packet rejected by FSM (state:%s)", t.ident, t.tcpstate.String())
-		stats.rejectFsm++
+		t.stats.rejectFsm++
 		if !t.fsmerr {
 			t.fsmerr = true
-			stats.rejectConnFsm++
+			t.stats.rejectConnFsm++
 		}
 		if !*ignorefsmerr {
 			return false
@@ -48,7 +50,7 @@ func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassem
 	err := t.optchecker.Accept(tcp, ci, dir, nextSeq, start)
 	if err != nil {
 		SilentError("OptionChecker-rejection", "%s: Packet rejected by OptionChecker: %s", t.ident, err)
-		stats.rejectOpt++
+		t.stats.rejectOpt++
 		if !*nooptcheck {
 			return false
 		}
@@ -66,7 +68,7 @@ func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassem
 		}
 	}
 	if !accept {
-		stats.rejectOpt++
+		t.stats.rejectOpt++
 	}
 	return accept
 }
@@ -77,28 +79,28 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 	// update stats
 	sgStats := sg.Stats()
 	if skip > 0 {
-		stats.missedBytes += skip
+		t.stats.missedBytes += skip
 	}
-	stats.sz += length - saved
-	stats.pkt += sgStats.Packets
+	t.stats.sz += length - saved
+	t.stats.pkt += sgStats.Packets
 	if sgStats.Chunks > 1 {
-		stats.reassembled++
+		t.stats.reassembled++
 	}
-	stats.outOfOrderPackets += sgStats.QueuedPackets
-	stats.outOfOrderBytes += sgStats.QueuedBytes
-	if length > stats.biggestChunkBytes {
-		stats.biggestChunkBytes = length
+	t.stats.outOfOrderPackets += sgStats.QueuedPackets
+	t.stats.outOfOrderBytes += sgStats.QueuedBytes
+	if length > t.stats.biggestChunkBytes {
+		t.stats.biggestChunkBytes = length
 	}
-	if sgStats.Packets > stats.biggestChunkPackets {
-		stats.biggestChunkPackets = sgStats.Packets
+	if sgStats.Packets > t.stats.biggestChunkPackets {
+		t.stats.biggestChunkPackets = sgStats.Packets
 	}
 	if sgStats.OverlapBytes != 0 && sgStats.OverlapPackets == 0 {
 		// In the original example this was handled with panic().
 		// I don't know what this error means or how to handle it properly.
 		SilentError("Invalid-Overlap", "bytes:%d, pkts:%d", sgStats.OverlapBytes, sgStats.OverlapPackets)
 	}
-	stats.overlapBytes += sgStats.OverlapBytes
-	stats.overlapPackets += sgStats.OverlapPackets
+	t.stats.overlapBytes += sgStats.OverlapBytes
+	t.stats.overlapPackets += sgStats.OverlapPackets
 
 	var ident string
 	if dir == reassembly.TCPDirClientToServer {
@@ -114,54 +116,52 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 		return
 	}
 	data := sg.Fetch(length)
-	if t.isDNS {
-		dns := &layers.DNS{}
-		var decoded []gopacket.LayerType
-		if len(data) < 2 {
-			if len(data) > 0 {
-				sg.KeepFrom(0)
-			}
-			return
-		}
-		dnsSize := binary.BigEndian.Uint16(data[:2])
-		missing := int(dnsSize) - len(data[2:])
-		Trace("dnsSize: %d, missing: %d", dnsSize, missing)
-		if missing > 0 {
-			Debug("Missing some bytes: %d", missing)
-			sg.KeepFrom(0)
-			return
-		}
-		p := gopacket.NewDecodingLayerParser(layers.LayerTypeDNS, dns)
-		err := p.DecodeLayers(data[2:], &decoded)
-		if err != nil {
-			SilentError("DNS-parser", "Failed to decode DNS: %v", err)
-		} else {
-			Trace("DNS: %s", gopacket.LayerDump(dns))
-		}
-		if len(data) > 2+int(dnsSize) {
-			sg.KeepFrom(2 + int(dnsSize))
-		}
-	} else if t.isHTTP {
+	if t.dissector != nil {
 		if length > 0 {
 			if *hexdump {
-				Trace("Feeding http with:%s", hex.Dump(data))
+				Trace("Feeding %s with:%s", t.dissector.Protocol().Name, hex.Dump(data))
 			}
-			// This is where we pass the reassembled information onwards
-			// This channel is read by an httpReader object
+			reader := &t.server
 			if dir == reassembly.TCPDirClientToServer && !t.reversed {
-				t.client.msgQueue <- httpReaderDataMsg{data, ac.GetCaptureInfo().Timestamp}
-			} else {
-				t.server.msgQueue <- httpReaderDataMsg{data, ac.GetCaptureInfo().Timestamp}
+				reader = &t.client
+			}
+			if reader.isDesynced {
+				readerQueue.drop()
+				return
+			}
+			// This is where we pass the reassembled information onwards
+			// This channel is read by a TcpReader object
+			// The data may be in a page of the assembler, which it reuses once this returns, so the reader gets a copy
+			msg := tcpReaderDataMsg{append([]byte(nil), data...), ac.GetCaptureInfo().Timestamp}
+			select {
+			case reader.msgQueue <- msg:
+			default:
+				if *queueOverflow == blockOverflowPolicy {
+					readerQueue.overflow(reader.msgQueue, msg)
+				} else {
+					// The dissector is behind, and a stream with a hole in it can't be parsed, so it ends here
+					readerQueue.drop()
+					t.desync(reader)
+				}
 			}
 		}
 	}
 }
 
+// desync ends the stream of a reader that missed a chunk, and discards the rest of it.
+func (t *tcpStream) desync(reader *TcpReader) {
+	reader.isDesynced = true
+	close(reader.msgQueue)
+}
+
 func (t *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 	Trace("%s: Connection closed", t.ident)
-	if t.isHTTP {
-		close(t.client.msgQueue)
-		close(t.server.msgQueue)
+	if t.dissector != nil {
+		for _, reader := range []*TcpReader{&t.client, &t.server} {
+			if !reader.isDesynced {
+				close(reader.msgQueue)
+			}
+		}
 	}
 	// do not remove the connection to allow last ACK
 	return false
@@ -3,6 +3,8 @@ package tap
 import (
 	"fmt"
 	"github.com/romana/rlog"
+	"net"
+	"strconv"
 	"sync"
 
 	"github.com/google/gopacket"
@@ -20,6 +22,7 @@ type tcpStreamFactory struct {
 	doHTTP             bool
 	harWriter          *HarWriter
 	outbountLinkWriter *OutboundLinkWriter
+	stats              *tcpStats
 }
 
 func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
@@ -35,47 +38,53 @@ func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.T
 	if factory.shouldNotifyOnOutboundLink(dstIp, dstPort) {
 		factory.outbountLinkWriter.WriteOutboundLink(net.Src().String(), dstIp, dstPort)
 	}
-	props := factory.getStreamProps(srcIp, dstIp, dstPort)
-	isHTTP := props.isTapTarget
+	tcpID := &TcpID{
+		SrcIP:   srcIp,
+		DstIP:   dstIp,
+		SrcPort: transport.Src().String(),
+		DstPort: transport.Dst().String(),
+	}
+	dissector := findDissector(tcpID)
+	var props *streamProps
+	if dissector == dnsDissectorInstance {
+		props = getDNSStreamProps(srcIp, dstIp)
+	} else {
+		props = factory.getStreamProps(srcIp, dstIp, dstPort, dissector != nil)
+	}
+	if !props.isTapTarget {
+		dissector = nil
+	} else if dissector == nil && factory.doHTTP {
+		dissector = defaultDissector
+	}
 	stream := &tcpStream{
 		net:        net,
 		transport:  transport,
-		isDNS:      tcp.SrcPort == 53 || tcp.DstPort == 53,
-		isHTTP:     isHTTP && factory.doHTTP,
+		dissector:  dissector,
 		reversed:   tcp.SrcPort == 80,
 		tcpstate:   reassembly.NewTCPSimpleFSM(fsmOptions),
 		ident:      fmt.Sprintf("%s:%s", net, transport),
 		optchecker: reassembly.NewTCPOptionCheck(),
+		stats:      factory.stats,
 	}
-	if stream.isHTTP {
-		stream.client = httpReader{
-			msgQueue: make(chan httpReaderDataMsg),
-			ident:    fmt.Sprintf("%s %s", net, transport),
-			tcpID: tcpID{
-				srcIP:   net.Src().String(),
-				dstIP:   net.Dst().String(),
-				srcPort: transport.Src().String(),
-				dstPort: transport.Dst().String(),
-			},
-			hexdump:  *hexdump,
-			parent:   stream,
-			isClient: true,
+	if stream.dissector != nil {
+		stream.client = TcpReader{
+			msgQueue:   make(chan tcpReaderDataMsg, readerQueueLen),
+			ident:      fmt.Sprintf("%s %s", net, transport),
+			tcpID:      tcpID,
+			parent:     stream,
+			isClient:   true,
 			isOutgoing: props.isOutgoing,
-			harWriter: factory.harWriter,
+			emitter:    factory.emitter(),
+			harWriter:  factory.harWriter,
 		}
-		stream.server = httpReader{
-			msgQueue: make(chan httpReaderDataMsg),
-			ident:    fmt.Sprintf("%s %s", net.Reverse(), transport.Reverse()),
-			tcpID: tcpID{
-				srcIP:   net.Dst().String(),
-				dstIP:   net.Src().String(),
-				srcPort: transport.Dst().String(),
-				dstPort: transport.Src().String(),
-			},
-			hexdump: *hexdump,
-			parent:  stream,
+		stream.server = TcpReader{
+			msgQueue:   make(chan tcpReaderDataMsg, readerQueueLen),
+			ident:      fmt.Sprintf("%s %s", net.Reverse(), transport.Reverse()),
+			tcpID:      tcpID.Reverse(),
+			parent:     stream,
 			isOutgoing: props.isOutgoing,
-			harWriter: factory.harWriter,
+			emitter:    factory.emitter(),
+			harWriter:  factory.harWriter,
 		}
 		factory.wg.Add(2)
 		// Start reading from channels stream.client.bytes and stream.server.bytes
@@ -89,10 +98,19 @@ func (factory *tcpStreamFactory) WaitGoRoutines() {
 	factory.wg.Wait()
 }
 
-func (factory *tcpStreamFactory) getStreamProps(srcIP string, dstIP string, dstPort int) *streamProps {
+func (factory *tcpStreamFactory) emitter() Emitter {
+	// Avoid wrapping a nil *HarWriter in a non-nil interface
+	if factory.harWriter == nil {
+		return nil
+	}
+	return factory.harWriter
+}
+
+func (factory *tcpStreamFactory) getStreamProps(srcIP string, dstIP string, dstPort int, isClaimed bool) *streamProps {
 	if hostMode {
-		if inArrayString(gSettings.filterAuthorities, fmt.Sprintf("%s:%d", dstIP, dstPort)) == true {
-			rlog.Debugf("getStreamProps %s", fmt.Sprintf("+ host1 %s:%d", dstIP, dstPort))
+		dstAddress := net.JoinHostPort(dstIP, strconv.Itoa(dstPort))
+		if inArrayString(gSettings.filterAuthorities, dstAddress) == true {
+			rlog.Debugf("getStreamProps %s", fmt.Sprintf("+ host1 %s", dstAddress))
 			return &streamProps{isTapTarget: true, isOutgoing: false}
 		} else if inArrayString(gSettings.filterAuthorities, dstIP) == true {
 			rlog.Debugf("getStreamProps %s", fmt.Sprintf("+ host2 %s", dstIP))
@@ -103,7 +121,7 @@ func (factory *tcpStreamFactory) getStreamProps(srcIP string, dstIP string, dstP
 		}
 		return &streamProps{isTapTarget: false}
 	} else {
-		isTappedPort := dstPort == 80 || (gSettings.filterPorts != nil && (inArrayInt(gSettings.filterPorts, dstPort)))
+		isTappedPort := isClaimed || dstPort == 80 || (gSettings.filterPorts != nil && (inArrayInt(gSettings.filterPorts, dstPort)))
 		if !isTappedPort {
 			rlog.Debugf("getStreamProps %s", fmt.Sprintf("- notHost1 %d", dstPort))
 			return &streamProps{isTapTarget: false, isOutgoing: false}
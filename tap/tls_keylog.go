@@ -0,0 +1,190 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of the NSS key log format (https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format)
+const (
+	keyLogLabelTLS12           = "CLIENT_RANDOM"
+	keyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogLabelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+	tlsClientRandomLen         = 32
+	maxTLSKeyLogSessions       = 100000
+	tlsKeyLogPollPeriod        = time.Second
+)
+
+var keyLogLabels = map[string]bool{
+	keyLogLabelTLS12:           true,
+	keyLogLabelClientHandshake: true,
+	keyLogLabelServerHandshake: true,
+	keyLogLabelClientTraffic:   true,
+	keyLogLabelServerTraffic:   true,
+}
+
+/* tlsKeyLogStore holds the secrets of the TLS sessions that the tapped applications logged, by the client random of each session.
+ * Applications keep logging secrets for as long as they run, so only the secrets of the last sessions are kept.
+ */
+type tlsKeyLogStore struct {
+	sync.RWMutex
+	secrets map[string]map[string][]byte
+	order   []string
+}
+
+var tlsKeyLog = &tlsKeyLogStore{secrets: make(map[string]map[string][]byte)}
+
+// AddTLSKeyLog adds the secrets of a key log in the NSS format, and returns how many lines held a secret.
+func AddTLSKeyLog(keyLog []byte) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(keyLog))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !keyLogLabels[fields[0]] {
+			continue
+		}
+		clientRandom, err := hex.DecodeString(fields[1])
+		if err != nil || len(clientRandom) != tlsClientRandomLen {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			continue
+		}
+		tlsKeyLog.add(string(clientRandom), fields[0], secret)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if count == 0 && len(bytes.TrimSpace(keyLog)) > 0 {
+		return 0, errors.New("no secrets found in the key log")
+	}
+	return count, nil
+}
+
+func (store *tlsKeyLogStore) add(clientRandom string, label string, secret []byte) {
+	store.Lock()
+	defer store.Unlock()
+
+	sessionSecrets, ok := store.secrets[clientRandom]
+	if !ok {
+		if len(store.order) >= maxTLSKeyLogSessions {
+			delete(store.secrets, store.order[0])
+			store.order = store.order[1:]
+		}
+		sessionSecrets = make(map[string][]byte)
+		store.secrets[clientRandom] = sessionSecrets
+		store.order = append(store.order, clientRandom)
+	}
+	sessionSecrets[label] = secret
+}
+
+func (store *tlsKeyLogStore) secret(clientRandom []byte, label string) []byte {
+	store.RLock()
+	defer store.RUnlock()
+	return store.secrets[string(clientRandom)][label]
+}
+
+/* WatchTLSKeyLogFiles keeps adding the secrets of a key log file, or of every file in a directory such as a mounted Secret,
+ * as the applications append them. It never returns.
+ */
+func WatchTLSKeyLogFiles(path string) {
+	offsets := make(map[string]int64)
+	for {
+		for _, keyLogPath := range keyLogFiles(path) {
+			offsets[keyLogPath] = readTLSKeyLogFile(keyLogPath, offsets[keyLogPath])
+		}
+		time.Sleep(tlsKeyLogPollPeriod)
+	}
+}
+
+func keyLogFiles(path string) []string {
+	info, err := os.Stat(path)
+	if err != nil {
+		SilentError("TLS-key-log", "Failed to read key log %s: %s (%v,%+v)", path, err, err, err)
+		return nil
+	}
+	if !info.IsDir() {
+		return []string{path}
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		SilentError("TLS-key-log", "Failed to read key log directory %s: %s (%v,%+v)", path, err, err, err)
+		return nil
+	}
+	var paths []string
+	for _, entry := range entries {
+		// Mounted Secrets and ConfigMaps keep their data in hidden directories, linked to by every key
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if filePath := filepath.Join(path, entry.Name()); isRegularFile(filePath) {
+			paths = append(paths, filePath)
+		}
+	}
+	return paths
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// readTLSKeyLogFile adds the lines of a key log file from an offset, and returns the offset after its last complete line.
+func readTLSKeyLogFile(path string, offset int64) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		SilentError("TLS-key-log", "Failed to open key log %s: %s (%v,%+v)", path, err, err, err)
+		return offset
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return offset
+	}
+	if info.Size() < offset {
+		// The file was replaced or truncated
+		offset = 0
+	}
+	if info.Size() == offset {
+		return offset
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		SilentError("TLS-key-log", "Failed to read key log %s: %s (%v,%+v)", path, err, err, err)
+		return offset
+	}
+
+	// The last line may still be being written
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == 0 {
+		return offset
+	}
+	if count, err := AddTLSKeyLog(data[:end]); err != nil {
+		SilentError("TLS-key-log", "Failed to parse key log %s: %s (%v,%+v)", path, err, err, err)
+	} else {
+		Debug("Added %d TLS secrets from %s", count, path)
+	}
+	return offset + int64(end)
+}
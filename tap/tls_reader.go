@@ -0,0 +1,893 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256" // registers the hashes of the cipher suites
+	_ "crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const TLSProtocolName = "tls"
+
+var tlsProtocol = &Protocol{
+	Name:         TLSProtocolName,
+	Abbreviation: "TLS",
+}
+
+// TLS record content types, handshake message types and extensions (RFC 8446, appendix B)
+const (
+	tlsRecordChangeCipherSpec     = 20
+	tlsRecordAlert                = 21
+	tlsRecordHandshake            = 22
+	tlsRecordApplicationData      = 23
+	tlsHandshakeClientHello       = 1
+	tlsHandshakeServerHello       = 2
+	tlsHandshakeFinished          = 20
+	tlsHandshakeKeyUpdate         = 24
+	tlsExtensionServerName        = 0
+	tlsExtensionALPN              = 16
+	tlsExtensionSupportedVersions = 43
+	tlsRecordHeaderLen            = 5
+	tlsHandshakeHeaderLen         = 4
+	maxTLSCiphertextLen           = 16384 + 2048
+	maxTLSHandshakeLen            = 64 * 1024
+)
+
+// How long the end of a connection waits for the secrets of its session, which applications may log after the session ended
+var tlsKeyWaitTimeout = 5 * time.Second
+
+// Never hold more than maxPendingTLSLen bytes of records that wait for the secrets of their session
+const maxPendingTLSLen = 4 * 1024 * 1024
+
+// The reasons why a TLS connection is recorded as encrypted
+const (
+	tlsHandshakeNotCaptured = "the handshake of the session was not captured"
+	tlsNoSecrets            = "no secrets were logged for the session"
+	tlsWrongSecrets         = "the secrets logged for the session do not decrypt it"
+	tlsInvalidRecord        = "invalid TLS record"
+)
+
+// The random of a ServerHello that is a HelloRetryRequest (RFC 8446, section 4.1.3)
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// The AEAD cipher suites of TLS 1.2 that crypto/tls does not implement
+const (
+	tlsDHERSAWithAES128GCMSHA256        uint16 = 0x009e
+	tlsDHERSAWithAES256GCMSHA384        uint16 = 0x009f
+	tlsDHERSAWithChaCha20Poly1305SHA256 uint16 = 0xccaa
+)
+
+// tlsCipherSuite is an AEAD cipher suite, which are the only suites of TLS 1.3 and the ones that TLS 1.2 peers prefer.
+type tlsCipherSuite struct {
+	keyLen           int
+	fixedIVLen       int // the implicit part of the nonce in TLS 1.2, which is the whole nonce otherwise
+	explicitNonceLen int // the part of the nonce that TLS 1.2 sends in each record
+	hash             crypto.Hash
+	newAEAD          func(key []byte) (cipher.AEAD, error)
+}
+
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	tls.TLS_AES_128_GCM_SHA256:                        {16, 12, 0, crypto.SHA256, newAESGCM},
+	tls.TLS_AES_256_GCM_SHA384:                        {32, 12, 0, crypto.SHA384, newAESGCM},
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  {32, 12, 0, crypto.SHA256, chacha20poly1305.New},
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               {16, 4, 8, crypto.SHA256, newAESGCM},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               {32, 4, 8, crypto.SHA384, newAESGCM},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         {16, 4, 8, crypto.SHA256, newAESGCM},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         {32, 4, 8, crypto.SHA384, newAESGCM},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       {16, 4, 8, crypto.SHA256, newAESGCM},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       {32, 4, 8, crypto.SHA384, newAESGCM},
+	tlsDHERSAWithAES128GCMSHA256:                      {16, 4, 8, crypto.SHA256, newAESGCM},
+	tlsDHERSAWithAES256GCMSHA384:                      {32, 4, 8, crypto.SHA384, newAESGCM},
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {32, 12, 0, crypto.SHA256, chacha20poly1305.New},
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {32, 12, 0, crypto.SHA256, chacha20poly1305.New},
+	tlsDHERSAWithChaCha20Poly1305SHA256:               {32, 12, 0, crypto.SHA256, chacha20poly1305.New},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// TLSConnection is a TLS connection that could not be decrypted, recorded when it ends.
+type TLSConnection struct {
+	Version     string   `json:"version,omitempty"`
+	CipherSuite string   `json:"cipherSuite,omitempty"`
+	ServerName  string   `json:"serverName,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"` // the protocols that the client offered
+	Reason      string   `json:"reason"`
+	ClientBytes int      `json:"clientBytes"`
+	ServerBytes int      `json:"serverBytes"`
+}
+
+// tlsConnection is the state of a TLS connection shared by both of its directions, which each see one of the hellos.
+type tlsConnection struct {
+	sync.Mutex
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	cipherSuite  uint16
+	serverName   string
+	alpn         []string
+	failure      string
+	isDecrypted  bool
+	closedCount  int
+	startTime    time.Time
+	endTime      time.Time
+	clientBytes  int
+	serverBytes  int
+}
+
+func (r *TcpReader) tlsConnection() *tlsConnection {
+	r.parent.Lock()
+	defer r.parent.Unlock()
+	if r.parent.tlsState == nil {
+		r.parent.tlsState = &tlsConnection{}
+	}
+	return r.parent.tlsState
+}
+
+type tlsRecord struct {
+	header      []byte
+	payload     []byte
+	captureTime time.Time
+}
+
+type tlsPlaintext struct {
+	data        []byte
+	captureTime time.Time
+}
+
+// tlsSessionKeys are the secrets of one direction of a session.
+type tlsSessionKeys struct {
+	version uint16
+	suite   *tlsCipherSuite
+	key     []byte // TLS 1.2
+	iv      []byte
+	// TLS 1.3
+	handshakeSecret []byte
+	trafficSecret   []byte
+}
+
+/* tlsReader decrypts one direction of a TLS connection, with the secrets that the tapped applications logged,
+ * so that dissectors parse the plaintext as if the connection was not encrypted.
+ * The records of a session wait for its secrets, and for the hello that the other direction sees, without blocking
+ * the capture. When the connection cannot be decrypted, the dissector sees the end of the stream, and the connection
+ * is recorded as encrypted once both directions end.
+ */
+type tlsReader struct {
+	b                  *bufio.Reader
+	reader             *TcpReader
+	connection         *tlsConnection
+	isHelloSeen        bool
+	isHelloRetried     bool
+	handshake          []byte // handshake messages that are not complete yet, which may span records
+	pending            []*tlsRecord
+	pendingLen         int
+	keys               *tlsSessionKeys
+	decrypter          *tlsDecrypter
+	isApplicationPhase bool // TLS 1.3, after the Finished message of this direction
+	plaintext          []tlsPlaintext
+	isFailed           bool
+	isEnded            bool
+	length             int
+	firstTime          time.Time
+	lastTime           time.Time
+}
+
+/* isTLSRecord tells whether a stream starts with a TLS record: the hello of a session, or, when isMidSession is set,
+ * a record of a session that started before the capture. The header of a record that is not a hello is too short to tell it apart
+ * from the start of a binary message, so that is left to the connections that no other dissector claims.
+ */
+func isTLSRecord(b *bufio.Reader, isMidSession bool) bool {
+	header, err := b.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return false
+	}
+	contentType, length := header[0], binary.BigEndian.Uint16(header[3:])
+	if header[1] != 3 || header[2] > 4 || length == 0 || length > maxTLSCiphertextLen {
+		return false
+	}
+	switch contentType {
+	case tlsRecordHandshake:
+		message, err := b.Peek(tlsRecordHeaderLen + 1)
+		return err == nil && (message[tlsRecordHeaderLen] == tlsHandshakeClientHello || message[tlsRecordHeaderLen] == tlsHandshakeServerHello)
+	case tlsRecordApplicationData, tlsRecordAlert, tlsRecordChangeCipherSpec:
+		return isMidSession
+	}
+	return false
+}
+
+func newTLSReader(b *bufio.Reader, reader *TcpReader) *tlsReader {
+	return &tlsReader{
+		b:          b,
+		reader:     reader,
+		connection: reader.tlsConnection(),
+	}
+}
+
+func (t *tlsReader) Read(p []byte) (int, error) {
+	for len(t.plaintext) == 0 {
+		if t.isFailed || t.isEnded {
+			return 0, io.EOF
+		}
+		record, err := t.readRecord()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			t.end()
+			continue
+		} else if err != nil {
+			SilentError("TLS-record", "stream %s %s (%v,%+v)", t.reader.ident, err, err, err)
+			t.fail(tlsInvalidRecord)
+			continue
+		}
+		t.handleRecord(record)
+	}
+
+	chunk := &t.plaintext[0]
+	n := copy(p, chunk.data)
+	chunk.data = chunk.data[n:]
+	t.reader.captureTime = chunk.captureTime
+	if len(chunk.data) == 0 {
+		t.plaintext = t.plaintext[1:]
+	}
+	return n, nil
+}
+
+func (t *tlsReader) readRecord() (*tlsRecord, error) {
+	record := &tlsRecord{header: make([]byte, tlsRecordHeaderLen)}
+	if _, err := io.ReadFull(t.b, record.header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(record.header[3:])
+	if length > maxTLSCiphertextLen {
+		return nil, fmt.Errorf("TLS record of %d bytes", length)
+	}
+	record.payload = make([]byte, length)
+	if _, err := io.ReadFull(t.b, record.payload); err != nil {
+		return nil, err
+	}
+	record.captureTime = t.reader.CaptureTime()
+	t.length += tlsRecordHeaderLen + int(length)
+	t.recordTime(record.captureTime)
+	return record, nil
+}
+
+func (t *tlsReader) handleRecord(record *tlsRecord) {
+	if !t.isHelloSeen {
+		t.handleHello(record)
+		return
+	}
+
+	t.pending = append(t.pending, record)
+	t.pendingLen += len(record.payload)
+	t.processPending(false)
+	if !t.isFailed && t.pendingLen > maxPendingTLSLen {
+		t.fail(t.missingKeysReason())
+	}
+}
+
+// handleHello parses the hello that starts each direction of a session.
+func (t *tlsReader) handleHello(record *tlsRecord) {
+	if record.header[0] == tlsRecordChangeCipherSpec && t.isHelloRetried {
+		// Sent after a HelloRetryRequest for compatibility with middleboxes
+		return
+	}
+	if record.header[0] != tlsRecordHandshake {
+		t.fail(tlsHandshakeNotCaptured)
+		return
+	}
+	t.handshake = append(t.handshake, record.payload...)
+	msgType, body, ok := t.nextHandshakeMessage()
+	if !ok {
+		if len(t.handshake) > maxTLSHandshakeLen {
+			t.fail(tlsInvalidRecord)
+		}
+		return
+	}
+	// The other handshake messages of TLS 1.2 that follow the hello in plaintext are of no use
+	t.handshake = nil
+
+	c := t.connection
+	if t.reader.isClient {
+		if msgType != tlsHandshakeClientHello {
+			t.fail(tlsHandshakeNotCaptured)
+			return
+		}
+		hello, ok := parseClientHello(body)
+		if !ok {
+			t.fail(tlsInvalidRecord)
+			return
+		}
+		c.Lock()
+		c.clientRandom, c.serverName, c.alpn = hello.random, hello.serverName, hello.alpn
+		c.Unlock()
+	} else {
+		if msgType != tlsHandshakeServerHello {
+			t.fail(tlsHandshakeNotCaptured)
+			return
+		}
+		hello, ok := parseServerHello(body)
+		if !ok {
+			t.fail(tlsInvalidRecord)
+			return
+		}
+		if bytes.Equal(hello.random, helloRetryRequestRandom) {
+			// The client sends another ClientHello, with the same random, and the server answers it with the actual ServerHello
+			t.isHelloRetried = true
+			return
+		}
+		c.Lock()
+		c.serverRandom, c.version, c.cipherSuite = hello.random, hello.version, hello.cipherSuite
+		c.Unlock()
+	}
+	t.isHelloSeen = true
+}
+
+func (t *tlsReader) nextHandshakeMessage() (byte, []byte, bool) {
+	if len(t.handshake) < tlsHandshakeHeaderLen {
+		return 0, nil, false
+	}
+	length := int(t.handshake[1])<<16 | int(t.handshake[2])<<8 | int(t.handshake[3])
+	if len(t.handshake) < tlsHandshakeHeaderLen+length {
+		return 0, nil, false
+	}
+	msgType, body := t.handshake[0], t.handshake[tlsHandshakeHeaderLen:tlsHandshakeHeaderLen+length]
+	t.handshake = t.handshake[tlsHandshakeHeaderLen+length:]
+	return msgType, body, true
+}
+
+// processPending decrypts the records that wait for the secrets of the session, once they are known.
+func (t *tlsReader) processPending(isEnd bool) {
+	if len(t.pending) == 0 {
+		return
+	}
+	if t.keys == nil {
+		keys, failure := t.sessionKeys()
+		if failure != "" {
+			t.fail(failure)
+			return
+		}
+		if keys == nil {
+			if isEnd {
+				t.fail(t.missingKeysReason())
+			}
+			return
+		}
+		t.keys = keys
+	}
+
+	for _, record := range t.pending {
+		var err error
+		if t.keys.version == tls.VersionTLS13 {
+			err = t.processRecordTLS13(record)
+		} else {
+			err = t.processRecordTLS12(record)
+		}
+		if err != nil {
+			SilentError("TLS-decrypt", "stream %s Failed to decrypt record: %s (%v,%+v)", t.reader.ident, err, err, err)
+			t.fail(tlsWrongSecrets)
+			return
+		}
+	}
+	t.pending = nil
+	t.pendingLen = 0
+}
+
+// sessionKeys returns the secrets of this direction, or a reason why the session cannot be decrypted.
+// It returns neither until the session is negotiated and its secrets are logged.
+func (t *tlsReader) sessionKeys() (*tlsSessionKeys, string) {
+	c := t.connection
+	c.Lock()
+	clientRandom, serverRandom, version, cipherSuite, failure := c.clientRandom, c.serverRandom, c.version, c.cipherSuite, c.failure
+	c.Unlock()
+
+	if failure != "" {
+		return nil, failure
+	}
+	if clientRandom == nil || serverRandom == nil {
+		return nil, ""
+	}
+	if version != tls.VersionTLS12 && version != tls.VersionTLS13 {
+		return nil, fmt.Sprintf("%s is not supported", tlsVersionName(version))
+	}
+	suite, ok := tlsCipherSuites[cipherSuite]
+	if !ok {
+		return nil, fmt.Sprintf("the cipher suite %s is not supported", tls.CipherSuiteName(cipherSuite))
+	}
+	keys := &tlsSessionKeys{version: version, suite: suite}
+
+	if version == tls.VersionTLS13 {
+		handshakeLabel, trafficLabel := keyLogLabelServerHandshake, keyLogLabelServerTraffic
+		if t.reader.isClient {
+			handshakeLabel, trafficLabel = keyLogLabelClientHandshake, keyLogLabelClientTraffic
+		}
+		keys.handshakeSecret = tlsKeyLog.secret(clientRandom, handshakeLabel)
+		keys.trafficSecret = tlsKeyLog.secret(clientRandom, trafficLabel)
+		if keys.handshakeSecret == nil || keys.trafficSecret == nil {
+			return nil, ""
+		}
+		return keys, ""
+	}
+
+	masterSecret := tlsKeyLog.secret(clientRandom, keyLogLabelTLS12)
+	if masterSecret == nil {
+		return nil, ""
+	}
+	// RFC 5246, section 6.3, without MAC keys, which AEAD suites have none of
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	keyBlock := prf12(suite.hash, masterSecret, []byte("key expansion"), seed, 2*suite.keyLen+2*suite.fixedIVLen)
+	clientKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	serverKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	clientIV, serverIV := keyBlock[:suite.fixedIVLen], keyBlock[suite.fixedIVLen:]
+	if t.reader.isClient {
+		keys.key, keys.iv = clientKey, clientIV
+	} else {
+		keys.key, keys.iv = serverKey, serverIV
+	}
+	return keys, ""
+}
+
+func (t *tlsReader) missingKeysReason() string {
+	c := t.connection
+	c.Lock()
+	defer c.Unlock()
+	if c.clientRandom == nil || c.serverRandom == nil {
+		return tlsHandshakeNotCaptured
+	}
+	return tlsNoSecrets
+}
+
+func (t *tlsReader) processRecordTLS12(record *tlsRecord) error {
+	switch record.header[0] {
+	case tlsRecordChangeCipherSpec:
+		decrypter, err := newTLSDecrypter(t.keys.version, t.keys.suite, t.keys.key, t.keys.iv)
+		if err != nil {
+			return err
+		}
+		t.decrypter = decrypter
+	case tlsRecordHandshake, tlsRecordAlert, tlsRecordApplicationData:
+		if t.decrypter == nil {
+			// The handshake messages before ChangeCipherSpec are sent in plaintext
+			return nil
+		}
+		plaintext, err := t.decrypter.decrypt(record)
+		if err != nil {
+			return err
+		}
+		if record.header[0] == tlsRecordApplicationData {
+			t.emitPlaintext(plaintext, record.captureTime)
+		}
+	}
+	return nil
+}
+
+func (t *tlsReader) processRecordTLS13(record *tlsRecord) error {
+	// Records other than application data are only sent in plaintext, before the handshake is encrypted
+	if record.header[0] != tlsRecordApplicationData {
+		return nil
+	}
+	if t.decrypter == nil {
+		decrypter, err := newTLS13Decrypter(t.keys.suite, t.keys.handshakeSecret)
+		if err != nil {
+			return err
+		}
+		t.decrypter = decrypter
+	}
+
+	plaintext, err := t.decrypter.decrypt(record)
+	if err != nil {
+		if t.reader.isClient && !t.isApplicationPhase {
+			// 0-RTT data, encrypted with early secrets, which servers may reject anyway
+			return nil
+		}
+		return err
+	}
+
+	// The content type of the record follows its content and precedes its padding
+	end := len(plaintext) - 1
+	for end >= 0 && plaintext[end] == 0 {
+		end--
+	}
+	if end < 0 {
+		return errors.New("TLS 1.3 record without content type")
+	}
+	contentType, content := plaintext[end], plaintext[:end]
+	switch contentType {
+	case tlsRecordApplicationData:
+		t.emitPlaintext(content, record.captureTime)
+	case tlsRecordHandshake:
+		return t.handleEncryptedHandshake(content)
+	}
+	return nil
+}
+
+// handleEncryptedHandshake switches to the traffic secrets of TLS 1.3 after the Finished message of this direction,
+// and to the next ones on every KeyUpdate.
+func (t *tlsReader) handleEncryptedHandshake(content []byte) error {
+	t.handshake = append(t.handshake, content...)
+	for {
+		msgType, _, ok := t.nextHandshakeMessage()
+		if !ok {
+			break
+		}
+		switch {
+		case msgType == tlsHandshakeFinished && !t.isApplicationPhase:
+			decrypter, err := newTLS13Decrypter(t.keys.suite, t.keys.trafficSecret)
+			if err != nil {
+				return err
+			}
+			t.decrypter = decrypter
+			t.isApplicationPhase = true
+		case msgType == tlsHandshakeKeyUpdate && t.isApplicationPhase:
+			if err := t.decrypter.update(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(t.handshake) > maxTLSHandshakeLen {
+		return errors.New("TLS handshake message too long")
+	}
+	return nil
+}
+
+func (t *tlsReader) emitPlaintext(data []byte, captureTime time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	t.plaintext = append(t.plaintext, tlsPlaintext{data: data, captureTime: captureTime})
+
+	c := t.connection
+	c.Lock()
+	c.isDecrypted = true
+	c.Unlock()
+}
+
+/* end decrypts what it can of the records left when the stream ends, after waiting for the secrets of the session.
+ * It waits on the goroutine of the reader, for up to tlsKeyWaitTimeout in each direction, which delays the end of this connection only,
+ * since its stream ended and no more payload is queued for it.
+ */
+func (t *tlsReader) end() {
+	t.isEnded = true
+	deadline := time.Now().Add(tlsKeyWaitTimeout)
+	for len(t.pending) > 0 && !t.isFailed {
+		t.processPending(time.Now().After(deadline))
+		if len(t.pending) > 0 && !t.isFailed {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// fail gives up decrypting the stream, and skips the rest of it.
+func (t *tlsReader) fail(reason string) {
+	t.isFailed = true
+	t.pending = nil
+	t.pendingLen = 0
+
+	c := t.connection
+	c.Lock()
+	if c.failure == "" {
+		c.failure = reason
+	}
+	c.Unlock()
+	t.drain()
+}
+
+func (t *tlsReader) drain() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.b.Read(buf)
+		if n > 0 {
+			t.length += n
+			t.recordTime(t.reader.CaptureTime())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *tlsReader) recordTime(captureTime time.Time) {
+	if t.firstTime.IsZero() {
+		t.firstTime = captureTime
+	}
+	t.lastTime = captureTime
+}
+
+// close records the connection as encrypted once both of its directions ended, unless either was decrypted.
+func (t *tlsReader) close() {
+	t.drain()
+
+	c := t.connection
+	c.Lock()
+	c.closedCount++
+	if t.reader.isClient {
+		c.clientBytes = t.length
+	} else {
+		c.serverBytes = t.length
+	}
+	if !t.firstTime.IsZero() && (c.startTime.IsZero() || t.firstTime.Before(c.startTime)) {
+		c.startTime = t.firstTime
+	}
+	if t.lastTime.After(c.endTime) {
+		c.endTime = t.lastTime
+	}
+	isClosed := c.closedCount == 2
+	failure := c.failure
+	if failure == "" {
+		failure = tlsNoSecrets
+	}
+	connection := &TLSConnection{
+		CipherSuite: tls.CipherSuiteName(c.cipherSuite),
+		ServerName:  c.serverName,
+		ALPN:        c.alpn,
+		Reason:      failure,
+		ClientBytes: c.clientBytes,
+		ServerBytes: c.serverBytes,
+	}
+	if c.version != 0 {
+		connection.Version = tlsVersionName(c.version)
+	}
+	if c.cipherSuite == 0 {
+		connection.CipherSuite = ""
+	}
+	isDecrypted, startTime, endTime := c.isDecrypted, c.startTime, c.endTime
+	c.Unlock()
+
+	if !isClosed || isDecrypted {
+		return
+	}
+	entry := newEntry(tlsProtocol, startTime, endTime)
+	entry.Method = connection.Version
+	entry.Path = connection.ServerName
+	entry.StatusText = connection.Reason
+	entry.Request = connection
+
+	statsTracker.incMatchedMessages()
+	t.reader.Emit(&OutputChannelItem{
+		Protocol: tlsProtocol.Name,
+		Entry:    entry,
+	})
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+type tlsHello struct {
+	random      []byte
+	version     uint16
+	cipherSuite uint16
+	serverName  string
+	alpn        []string
+}
+
+func parseClientHello(body []byte) (*tlsHello, bool) {
+	s := cryptobyte.String(body)
+	hello := &tlsHello{}
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.Skip(2) || !s.ReadBytes(&hello.random, 32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) || !s.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, false
+	}
+	if s.Empty() {
+		return hello, true
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, false
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		var list cryptobyte.String
+		switch extension {
+		case tlsExtensionServerName:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, false
+			}
+			for !list.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+					return nil, false
+				}
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case tlsExtensionALPN:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, false
+			}
+			for !list.Empty() {
+				var protocol cryptobyte.String
+				if !list.ReadUint8LengthPrefixed(&protocol) {
+					return nil, false
+				}
+				hello.alpn = append(hello.alpn, string(protocol))
+			}
+		}
+	}
+	return hello, true
+}
+
+func parseServerHello(body []byte) (*tlsHello, bool) {
+	s := cryptobyte.String(body)
+	hello := &tlsHello{}
+	var sessionID, extensions cryptobyte.String
+	var compressionMethod uint8
+	if !s.ReadUint16(&hello.version) || !s.ReadBytes(&hello.random, 32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16(&hello.cipherSuite) || !s.ReadUint8(&compressionMethod) {
+		return nil, false
+	}
+	if s.Empty() {
+		return hello, true
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, false
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		// TLS 1.3 servers keep 1.2 as the legacy version, and select the actual one with an extension
+		if extension == tlsExtensionSupportedVersions && !data.ReadUint16(&hello.version) {
+			return nil, false
+		}
+	}
+	return hello, true
+}
+
+// tlsDecrypter decrypts the records of one direction with the current keys of the direction.
+type tlsDecrypter struct {
+	version uint16
+	suite   *tlsCipherSuite
+	aead    cipher.AEAD
+	iv      []byte
+	seq     uint64
+	secret  []byte // the traffic secret of TLS 1.3, which key updates derive the next one from
+}
+
+func newTLSDecrypter(version uint16, suite *tlsCipherSuite, key []byte, iv []byte) (*tlsDecrypter, error) {
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsDecrypter{version: version, suite: suite, aead: aead, iv: iv}, nil
+}
+
+func newTLS13Decrypter(suite *tlsCipherSuite, secret []byte) (*tlsDecrypter, error) {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", suite.fixedIVLen)
+	decrypter, err := newTLSDecrypter(tls.VersionTLS13, suite, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	decrypter.secret = secret
+	return decrypter, nil
+}
+
+// update switches to the next traffic secret after a KeyUpdate (RFC 8446, section 7.2).
+func (d *tlsDecrypter) update() error {
+	next, err := newTLS13Decrypter(d.suite, hkdfExpandLabel(d.suite.hash, d.secret, "traffic upd", d.suite.hash.Size()))
+	if err != nil {
+		return err
+	}
+	*d = *next
+	return nil
+}
+
+func (d *tlsDecrypter) decrypt(record *tlsRecord) ([]byte, error) {
+	payload := record.payload
+	var nonce, additionalData []byte
+	if d.version == tls.VersionTLS13 {
+		nonce = d.sequenceNonce()
+		additionalData = record.header
+	} else {
+		if d.suite.explicitNonceLen > 0 {
+			if len(payload) < d.suite.explicitNonceLen {
+				return nil, errors.New("TLS record shorter than its nonce")
+			}
+			nonce = append(append([]byte(nil), d.iv...), payload[:d.suite.explicitNonceLen]...)
+			payload = payload[d.suite.explicitNonceLen:]
+		} else {
+			nonce = d.sequenceNonce()
+		}
+		if len(payload) < d.aead.Overhead() {
+			return nil, errors.New("TLS record shorter than its tag")
+		}
+		additionalData = make([]byte, 13)
+		binary.BigEndian.PutUint64(additionalData, d.seq)
+		copy(additionalData[8:11], record.header[:3])
+		binary.BigEndian.PutUint16(additionalData[11:], uint16(len(payload)-d.aead.Overhead()))
+	}
+
+	plaintext, err := d.aead.Open(nil, nonce, payload, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	d.seq++
+	return plaintext, nil
+}
+
+// sequenceNonce returns the IV XORed with the sequence number of the record.
+func (d *tlsDecrypter) sequenceNonce() []byte {
+	nonce := append([]byte(nil), d.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// prf12 is the pseudorandom function of TLS 1.2 (RFC 5246, section 5).
+func prf12(hash crypto.Hash, secret []byte, label []byte, seed []byte, length int) []byte {
+	labelAndSeed := append(append([]byte(nil), label...), seed...)
+	mac := hmac.New(hash.New, secret)
+	mac.Write(labelAndSeed)
+	a := mac.Sum(nil)
+
+	result := make([]byte, 0, length+hash.Size())
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		result = mac.Sum(result)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return result[:length]
+}
+
+// hkdfExpandLabel derives the keys of TLS 1.3 (RFC 8446, section 7.1).
+func hkdfExpandLabel(hash crypto.Hash, secret []byte, label string, length int) []byte {
+	var hkdfLabel cryptobyte.Builder
+	hkdfLabel.AddUint16(uint16(length))
+	hkdfLabel.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	hkdfLabel.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(hash.New, secret, hkdfLabel.BytesOrPanic()), out); err != nil {
+		panic(fmt.Sprintf("hkdf: %v", err))
+	}
+	return out
+}
@@ -0,0 +1,345 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tlsTestServerName = "mizu.test"
+
+var (
+	tlsTestRequest  = []byte("GET / HTTP/1.1\r\nHost: mizu.test\r\n\r\n")
+	tlsTestResponse = []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+)
+
+// recordingConn records what is written to a connection, which is what a capture of its direction sees.
+type recordingConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mutex.Lock()
+	c.written.Write(p[:n])
+	c.mutex.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// tlsTestSession is a session between a crypto/tls client and server, with what each of them sent and received.
+type tlsTestSession struct {
+	clientStream   []byte
+	serverStream   []byte
+	keyLog         []byte
+	serverReceived []byte
+	clientReceived []byte
+}
+
+type tlsTestEmitter struct {
+	mutex sync.Mutex
+	items []*OutputChannelItem
+}
+
+func (e *tlsTestEmitter) Emit(item *OutputChannelItem) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.items = append(e.items, item)
+}
+
+func tlsTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: tlsTestServerName},
+		DNSNames:     []string{tlsTestServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}
+}
+
+/* runTLSSession runs a session over net.Pipe, in which the client sends what clientWrite writes and then the server answers.
+ * clientWrite ends the writes of the client, with a close_notify alert.
+ */
+func runTLSSession(t *testing.T, version uint16, cipherSuite uint16, clientWrite func(client *tls.Conn, conn net.Conn, keyLog []byte)) *tlsTestSession {
+	clientPipe, serverPipe := net.Pipe()
+	// Writes wait for the other end to read, so a peer that fails while the other one writes would block both without a deadline
+	deadline := time.Now().Add(10 * time.Second)
+	_ = clientPipe.SetDeadline(deadline)
+	_ = serverPipe.SetDeadline(deadline)
+	clientConn, serverConn := &recordingConn{Conn: clientPipe}, &recordingConn{Conn: serverPipe}
+
+	var keyLog bytes.Buffer
+	clientConfig := &tls.Config{
+		ServerName:         tlsTestServerName,
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		KeyLogWriter:       &keyLog,
+	}
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsTestCertificate(t)},
+		MinVersion:   version,
+		MaxVersion:   version,
+		// Tickets would be written while the client does not read, which blocks net.Pipe
+		SessionTicketsDisabled: true,
+	}
+	if cipherSuite != 0 {
+		clientConfig.CipherSuites = []uint16{cipherSuite}
+		serverConfig.CipherSuites = []uint16{cipherSuite}
+	}
+	client, server := tls.Client(clientConn, clientConfig), tls.Server(serverConn, serverConfig)
+
+	session := &tlsTestSession{}
+	serverDone := make(chan error, 1)
+	go func() {
+		received, err := ioutil.ReadAll(server)
+		session.serverReceived = received
+		if err == nil {
+			_, err = server.Write(tlsTestResponse)
+		}
+		_ = server.Close()
+		serverDone <- err
+	}()
+
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	clientWrite(client, clientConn, keyLog.Bytes())
+	received, readErr := ioutil.ReadAll(client)
+	_ = client.Close()
+	if err := <-serverDone; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if readErr != nil {
+		t.Fatalf("client read: %v", readErr)
+	}
+	session.clientReceived = received
+
+	session.clientStream, session.serverStream = clientConn.bytes(), serverConn.bytes()
+	session.keyLog = keyLog.Bytes()
+	return session
+}
+
+func writeTLSTestRequest(client *tls.Conn, conn net.Conn, keyLog []byte) {
+	_, _ = client.Write(tlsTestRequest)
+	_ = client.CloseWrite()
+}
+
+// decryptTLSSession feeds both directions of a session through tlsReader, as the readers of a connection do, and returns their plaintext.
+func decryptTLSSession(t *testing.T, session *tlsTestSession) ([]byte, []byte, []*OutputChannelItem) {
+	errorsMapMutex.Lock()
+	if errorsMap == nil {
+		errorsMap = make(map[string]uint)
+	}
+	errorsMapMutex.Unlock()
+
+	emitter := &tlsTestEmitter{}
+	stream := &tcpStream{}
+	tcpID := &TcpID{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: "40000", DstPort: "443"}
+	readers := []*TcpReader{
+		{ident: "client", tcpID: tcpID, isClient: true, parent: stream, emitter: emitter},
+		{ident: "server", tcpID: tcpID.Reverse(), parent: stream, emitter: emitter},
+	}
+	streams := [][]byte{session.clientStream, session.serverStream}
+	plaintexts := make([][]byte, 2)
+
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := bufio.NewReader(bytes.NewReader(streams[i]))
+			if !isTLSRecord(b, false) {
+				t.Errorf("the %s stream does not start with a TLS hello", readers[i].ident)
+				return
+			}
+			reader := newTLSReader(b, readers[i])
+			plaintext, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Errorf("reading the %s stream: %v", readers[i].ident, err)
+			}
+			plaintexts[i] = plaintext
+			reader.close()
+		}(i)
+	}
+	wg.Wait()
+	return plaintexts[0], plaintexts[1], emitter.items
+}
+
+func testDecryptTLSSession(t *testing.T, version uint16, cipherSuite uint16) {
+	session := runTLSSession(t, version, cipherSuite, writeTLSTestRequest)
+	if _, err := AddTLSKeyLog(session.keyLog); err != nil {
+		t.Fatal(err)
+	}
+	clientPlaintext, serverPlaintext, items := decryptTLSSession(t, session)
+	if !bytes.Equal(clientPlaintext, tlsTestRequest) {
+		t.Errorf("client plaintext %q, want %q", clientPlaintext, tlsTestRequest)
+	}
+	if !bytes.Equal(serverPlaintext, tlsTestResponse) {
+		t.Errorf("server plaintext %q, want %q", serverPlaintext, tlsTestResponse)
+	}
+	if len(items) != 0 {
+		t.Errorf("a decrypted connection was recorded as encrypted: %+v", items[0].Entry.Request)
+	}
+}
+
+func TestDecryptTLS12GCM(t *testing.T) {
+	testDecryptTLSSession(t, tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+}
+
+func TestDecryptTLS12ChaCha20Poly1305(t *testing.T) {
+	testDecryptTLSSession(t, tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256)
+}
+
+func TestDecryptTLS13(t *testing.T) {
+	testDecryptTLSSession(t, tls.VersionTLS13, 0)
+}
+
+// keyLogSecret returns the first secret of a label in a key log.
+func keyLogSecret(t *testing.T, keyLog []byte, label string) []byte {
+	for _, line := range strings.Split(string(keyLog), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == label {
+			secret, err := hex.DecodeString(fields[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return secret
+		}
+	}
+	t.Fatalf("no %s in the key log", label)
+	return nil
+}
+
+// sealTLS13Record encrypts a record of TLS 1.3 with the next sequence number of an encrypter, which is a tlsDecrypter used the other way.
+func sealTLS13Record(encrypter *tlsDecrypter, contentType byte, content []byte) []byte {
+	plaintext := append(append([]byte(nil), content...), contentType)
+	length := len(plaintext) + encrypter.aead.Overhead()
+	header := []byte{tlsRecordApplicationData, 3, 3, byte(length >> 8), byte(length)}
+	record := encrypter.aead.Seal(header, encrypter.sequenceNonce(), plaintext, header)
+	encrypter.seq++
+	return record
+}
+
+func TestDecryptTLS13KeyUpdate(t *testing.T) {
+	afterUpdate := []byte("sent after a key update")
+	session := runTLSSession(t, tls.VersionTLS13, 0, func(client *tls.Conn, conn net.Conn, keyLog []byte) {
+		_, _ = client.Write(tlsTestRequest)
+
+		// crypto/tls never sends a KeyUpdate, so the rest of the writes of the client are encrypted here
+		suite := tlsCipherSuites[client.ConnectionState().CipherSuite]
+		secret := keyLogSecret(t, keyLog, keyLogLabelClientTraffic)
+		encrypter, err := newTLS13Decrypter(suite, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypter.seq = 1 // the request
+		keyUpdate := []byte{tlsHandshakeKeyUpdate, 0, 0, 1, 0}
+		if _, err := conn.Write(sealTLS13Record(encrypter, tlsRecordHandshake, keyUpdate)); err != nil {
+			t.Fatal(err)
+		}
+		if err := encrypter.update(); err != nil {
+			t.Fatal(err)
+		}
+		closeNotify := []byte{1, 0}
+		for _, record := range [][]byte{sealTLS13Record(encrypter, tlsRecordApplicationData, afterUpdate), sealTLS13Record(encrypter, tlsRecordAlert, closeNotify)} {
+			if _, err := conn.Write(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	want := append(append([]byte(nil), tlsTestRequest...), afterUpdate...)
+	if !bytes.Equal(session.serverReceived, want) {
+		t.Fatalf("the server received %q, want %q", session.serverReceived, want)
+	}
+	if _, err := AddTLSKeyLog(session.keyLog); err != nil {
+		t.Fatal(err)
+	}
+
+	clientPlaintext, serverPlaintext, _ := decryptTLSSession(t, session)
+	if !bytes.Equal(clientPlaintext, want) {
+		t.Errorf("client plaintext %q, want %q", clientPlaintext, want)
+	}
+	if !bytes.Equal(serverPlaintext, tlsTestResponse) {
+		t.Errorf("server plaintext %q, want %q", serverPlaintext, tlsTestResponse)
+	}
+}
+
+func TestDecryptTLSMissingKeys(t *testing.T) {
+	defer func(timeout time.Duration) { tlsKeyWaitTimeout = timeout }(tlsKeyWaitTimeout)
+	tlsKeyWaitTimeout = 100 * time.Millisecond
+
+	session := runTLSSession(t, tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, writeTLSTestRequest)
+	clientPlaintext, serverPlaintext, items := decryptTLSSession(t, session)
+	if len(clientPlaintext) != 0 || len(serverPlaintext) != 0 {
+		t.Errorf("decrypted %q and %q without secrets", clientPlaintext, serverPlaintext)
+	}
+	if len(items) != 1 || items[0].Protocol != TLSProtocolName {
+		t.Fatalf("got %d items, want a TLS connection", len(items))
+	}
+	connection := items[0].Entry.Request.(*TLSConnection)
+	want := TLSConnection{
+		Version:     "TLS 1.2",
+		CipherSuite: tls.CipherSuiteName(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256),
+		ServerName:  tlsTestServerName,
+		Reason:      tlsNoSecrets,
+		ClientBytes: len(session.clientStream),
+		ServerBytes: len(session.serverStream),
+	}
+	if connection.Version != want.Version || connection.CipherSuite != want.CipherSuite || connection.ServerName != want.ServerName ||
+		connection.Reason != want.Reason || connection.ClientBytes != want.ClientBytes || connection.ServerBytes != want.ServerBytes {
+		t.Errorf("got %+v, want %+v", connection, want)
+	}
+}
+
+func TestIsTLSRecord(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		isMidSession bool
+		want         bool
+	}{
+		{"client hello", []byte{tlsRecordHandshake, 3, 1, 0, 200, tlsHandshakeClientHello}, false, true},
+		{"server hello", []byte{tlsRecordHandshake, 3, 3, 0, 90, tlsHandshakeServerHello}, false, true},
+		{"application data", []byte{tlsRecordApplicationData, 3, 3, 0, 40, 0}, true, true},
+		// A MongoDB message of 788 bytes, whose length is little endian
+		{"binary message", []byte{0x14, 3, 0, 0, 1, 0}, false, false},
+		{"application data of another dissector", []byte{tlsRecordApplicationData, 3, 3, 0, 40, 0}, false, false},
+		{"empty record", []byte{tlsRecordApplicationData, 3, 3, 0, 0, 0}, true, false},
+		{"HTTP request", []byte("GET / HTTP/1.1\r\n"), true, false},
+	}
+	for _, test := range tests {
+		if got := isTLSRecord(bufio.NewReader(bytes.NewReader(test.data)), test.isMidSession); got != test.want {
+			t.Errorf("%s: isTLSRecord = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const WebSocketProtocolName = "websocket"
+
+var webSocketProtocol = &Protocol{
+	Name:         WebSocketProtocolName,
+	Abbreviation: "WS",
+}
+
+const (
+	WebSocketClientMessage = "client"
+	WebSocketServerMessage = "server"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2)
+const (
+	webSocketContinuation = 0x0
+	webSocketText         = 0x1
+	webSocketBinary       = 0x2
+	webSocketClose        = 0x8
+	webSocketPing         = 0x9
+	webSocketPong         = 0xa
+)
+
+var webSocketOpcodeNames = map[byte]string{
+	webSocketText:   "text",
+	webSocketBinary: "binary",
+	webSocketClose:  "close",
+	webSocketPing:   "ping",
+	webSocketPong:   "pong",
+}
+
+// Never save more than maxWebSocketMessageLen bytes of a message, before or after it is decompressed
+const maxWebSocketMessageLen = 1024 * 1024
+
+// permessage-deflate keeps the LZ77 window between the messages of a direction, unless no_context_takeover was negotiated
+const deflateWindowLen = 32 * 1024
+
+// WebSocketMessage is a message of a WebSocket session, linked to the HTTP upgrade of the session by its stream ID.
+type WebSocketMessage struct {
+	Direction  string `json:"direction"`
+	Opcode     string `json:"opcode"`
+	Compressed bool   `json:"compressed,omitempty"`
+	Size       int    `json:"size"` // decompressed, unless the message is truncated and only its size on the wire is known
+	Truncated  bool   `json:"truncated,omitempty"`
+	Text       string `json:"text,omitempty"` // text messages, and the reason of close messages
+	Data       string `json:"data,omitempty"` // base64 encoded binary messages
+	CloseCode  int    `json:"closeCode,omitempty"`
+	Fragments  int    `json:"fragments,omitempty"`
+}
+
+// webSocketSession is the WebSocket session of a connection, shared by both of its directions.
+type webSocketSession struct {
+	sync.Mutex
+	id   string
+	path string
+}
+
+func (h *httpReader) webSocketSession() *webSocketSession {
+	return h.httpConnection().webSocket
+}
+
+// webSocketSessionID returns the ID that links the entries of the session, which are the upgrade and every message.
+func (h *httpReader) webSocketSessionID(request *http.Request) string {
+	session := h.webSocketSession()
+	session.Lock()
+	defer session.Unlock()
+
+	if session.id == "" {
+		session.id = newStreamID()
+	}
+	if request != nil {
+		session.path = request.URL.Path
+	}
+	return session.id
+}
+
+// isWebSocketFrame tells whether the next bytes of a client stream that requested an upgrade are a frame rather than
+// another HTTP request, which is sent when the upgrade was refused. Frames of clients are always masked.
+func isWebSocketFrame(b *bufio.Reader) bool {
+	header, err := b.Peek(2)
+	if err != nil {
+		return false
+	}
+	_, isKnownOpcode := webSocketOpcodeNames[header[0]&0x0f]
+	isReservedSet := header[0]&0x30 != 0 // RSV2 and RSV3, that no extension in use defines
+	return (isKnownOpcode || header[0]&0x0f == webSocketContinuation) && !isReservedSet && header[1]&0x80 != 0
+}
+
+// webSocketReader parses the frames of one direction of a WebSocket session into messages.
+type webSocketReader struct {
+	message       *webSocketMessageBuffer // the fragmented message whose frames are still being received
+	deflateWindow []byte
+}
+
+type webSocketMessageBuffer struct {
+	opcode       byte
+	isCompressed bool
+	data         []byte
+	length       int
+	isTruncated  bool // set when data is only part of the decompressed message
+	fragments    int
+	startTime    time.Time
+}
+
+type webSocketFrame struct {
+	fin          bool
+	isCompressed bool
+	opcode       byte
+	payload      []byte
+	length       int
+}
+
+func (h *httpReader) startWebSocket() {
+	h.webSocket = &webSocketReader{}
+}
+
+func (h *httpReader) handleWebSocketFrame(b *bufio.Reader) error {
+	frame, err := readWebSocketFrame(b)
+	if err != nil {
+		return err
+	}
+	ws := h.webSocket
+
+	// Control frames may come between the fragments of a message
+	if frame.opcode >= webSocketClose {
+		if frame.opcode == webSocketClose {
+			h.emitWebSocketMessage(&webSocketMessageBuffer{
+				opcode:    frame.opcode,
+				data:      frame.payload,
+				length:    frame.length,
+				fragments: 1,
+				startTime: h.captureTime(),
+			})
+		}
+		return nil
+	}
+
+	if frame.opcode == webSocketContinuation {
+		if ws.message == nil {
+			// The first fragment was not seen
+			return nil
+		}
+	} else {
+		ws.message = &webSocketMessageBuffer{opcode: frame.opcode, isCompressed: frame.isCompressed, startTime: h.captureTime()}
+	}
+	message := ws.message
+	numBytesToAppend := len(frame.payload)
+	if numBytesToAppend > maxWebSocketMessageLen-len(message.data) {
+		numBytesToAppend = maxWebSocketMessageLen - len(message.data)
+	}
+	message.data = append(message.data, frame.payload[:numBytesToAppend]...)
+	message.length += frame.length
+	message.fragments++
+
+	if !frame.fin {
+		return nil
+	}
+	ws.message = nil
+	if message.isCompressed {
+		ws.inflate(message)
+	}
+	h.emitWebSocketMessage(message)
+	return nil
+}
+
+func readWebSocketFrame(b *bufio.Reader) (*webSocketFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(b, header[:]); err != nil {
+		return nil, err
+	}
+	frame := &webSocketFrame{
+		fin:          header[0]&0x80 != 0,
+		isCompressed: header[0]&0x40 != 0,
+		opcode:       header[0] & 0x0f,
+	}
+	isMasked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(b, extended[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(b, extended[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+		if length > 1<<62 {
+			return nil, errors.New("invalid WebSocket frame length")
+		}
+	}
+
+	var maskKey [4]byte
+	if isMasked {
+		if _, err := io.ReadFull(b, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Never save more than maxWebSocketMessageLen bytes
+	savedLen := length
+	if savedLen > maxWebSocketMessageLen {
+		savedLen = maxWebSocketMessageLen
+	}
+	frame.payload = make([]byte, savedLen)
+	if _, err := io.ReadFull(b, frame.payload); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, b, int64(length-savedLen)); err != nil {
+		return nil, err
+	}
+	frame.length = int(length)
+
+	if isMasked {
+		for i := range frame.payload {
+			frame.payload[i] ^= maskKey[i%4]
+		}
+	}
+	return frame, nil
+}
+
+// inflate decompresses a message compressed by permessage-deflate (RFC 7692), which strips the end of the last deflate block.
+func (ws *webSocketReader) inflate(message *webSocketMessageBuffer) {
+	compressed := append(message.data, 0x00, 0x00, 0xff, 0xff)
+	reader := flate.NewReaderDict(bytes.NewReader(compressed), ws.deflateWindow)
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxWebSocketMessageLen+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		SilentError("WebSocket-inflate", "Failed to decompress message: %s (%v,%+v)", err, err, err)
+		return
+	}
+	// The message is only partly decompressed when it was saved in part, or when it decompresses to more than can be saved
+	isTruncated := len(message.data) < message.length
+	if len(data) > maxWebSocketMessageLen {
+		data = data[:maxWebSocketMessageLen]
+		isTruncated = true
+	}
+	message.data = data
+	message.isTruncated = isTruncated
+	if !isTruncated {
+		message.length = len(data)
+	}
+
+	ws.deflateWindow = append(ws.deflateWindow, data...)
+	if len(ws.deflateWindow) > deflateWindowLen {
+		ws.deflateWindow = append([]byte(nil), ws.deflateWindow[len(ws.deflateWindow)-deflateWindowLen:]...)
+	}
+}
+
+func (h *httpReader) emitWebSocketMessage(message *webSocketMessageBuffer) {
+	session := h.webSocketSession()
+	session.Lock()
+	path := session.path
+	session.Unlock()
+	sessionID := h.webSocketSessionID(nil)
+
+	direction := WebSocketServerMessage
+	if h.isClient {
+		direction = WebSocketClientMessage
+	}
+	webSocketMessage := &WebSocketMessage{
+		Direction:  direction,
+		Opcode:     webSocketOpcodeNames[message.opcode],
+		Compressed: message.isCompressed,
+		Size:       message.length,
+		Truncated:  message.isTruncated || len(message.data) < message.length,
+		Fragments:  message.fragments,
+	}
+
+	entry := newEntry(webSocketProtocol, message.startTime, h.captureTime())
+	entry.Method = webSocketMessage.Opcode
+	entry.Path = path
+	switch message.opcode {
+	case webSocketText:
+		webSocketMessage.Text = string(message.data)
+	case webSocketClose:
+		if len(message.data) >= 2 {
+			webSocketMessage.CloseCode = int(binary.BigEndian.Uint16(message.data))
+			webSocketMessage.Text = string(message.data[2:])
+			entry.Status = webSocketMessage.CloseCode
+			entry.StatusText = webSocketMessage.Text
+		}
+	case webSocketBinary:
+		webSocketMessage.Data = base64.StdEncoding.EncodeToString(message.data)
+	}
+	entry.Request = webSocketMessage
+
+	statsTracker.incMatchedMessages()
+	h.reader.Emit(&OutputChannelItem{
+		Protocol: webSocketProtocol.Name,
+		Entry:    entry,
+		StreamID: sessionID,
+	})
+}
@@ -45,8 +45,9 @@ export const HarEntriesList: React.FC<HarEntriesListProps> = ({entries, setEntri
     const filterEntries = useCallback((entry) => {
         if(methodsFilter.length > 0 && !methodsFilter.includes(entry.method.toLowerCase())) return;
         if(pathFilter && entry.path?.toLowerCase()?.indexOf(pathFilter) === -1) return;
-        if(statusFilter.includes(StatusType.SUCCESS) && entry.statusCode >= 400) return;
-        if(statusFilter.includes(StatusType.ERROR) && entry.statusCode < 400) return;
+        const isError = entry.grpcStatus !== undefined && entry.grpcStatus !== null ? entry.grpcStatus !== 0 : entry.statusCode >= 400;
+        if(statusFilter.includes(StatusType.SUCCESS) && isError) return;
+        if(statusFilter.includes(StatusType.ERROR) && !isError) return;
         return entry;
     },[methodsFilter, pathFilter, statusFilter])
 
@@ -1,6 +1,6 @@
 import React from "react";
 import styles from './style/HarEntry.module.sass';
-import StatusCode, {getClassification, StatusCodeClassification} from "./StatusCode";
+import StatusCode, {getClassification, getGrpcClassification, GrpcStatusCode, StatusCodeClassification} from "./StatusCode";
 import {EndpointPath} from "./EndpointPath";
 import ingoingIconSuccess from "./assets/ingoing-traffic-success.svg"
 import ingoingIconFailure from "./assets/ingoing-traffic-failure.svg"
@@ -10,11 +10,13 @@ import outgoingIconFailure from "./assets/outgoing-traffic-failure.svg"
 import outgoingIconNeutral from "./assets/outgoing-traffic-neutral.svg"
 
 interface HAREntry {
+    protocol?: string,
     method?: string,
     path: string,
     service: string,
     id: string,
     statusCode?: number;
+    grpcStatus?: number;
     url?: string;
     isCurrentRevision?: boolean;
     timestamp: Date;
@@ -28,7 +30,9 @@ interface HAREntryProps {
 }
 
 export const HarEntry: React.FC<HAREntryProps> = ({entry, setFocusedEntryId, isSelected}) => {
-    const classification = getClassification(entry.statusCode)
+    // gRPC calls fail with an HTTP status of 200, their gRPC status tells whether they succeeded
+    const isGrpc = entry.grpcStatus !== undefined && entry.grpcStatus !== null;
+    const classification = isGrpc ? getGrpcClassification(entry.grpcStatus) : getClassification(entry.statusCode)
     let ingoingIcon;
     let outgoingIcon;
     switch(classification) {
@@ -51,9 +55,14 @@ export const HarEntry: React.FC<HAREntryProps> = ({entry, setFocusedEntryId, isS
 
     return <>
         <div id={entry.id} className={`${styles.row} ${isSelected ? styles.rowSelected : ''}`} onClick={() => setFocusedEntryId(entry.id)}>
-            {entry.statusCode && <div>
+            {isGrpc ? <div>
+                <GrpcStatusCode grpcStatus={entry.grpcStatus}/>
+            </div> : entry.statusCode && <div>
                 <StatusCode statusCode={entry.statusCode}/>
             </div>}
+            {entry.protocol && entry.protocol !== "http" && <div className={styles.protocol}>
+                {entry.protocol.toUpperCase()}
+            </div>}
             <div className={styles.endpointServiceContainer}>
                 <EndpointPath method={entry.method} path={entry.path}/>
                 <div className={styles.service}>
@@ -2,6 +2,7 @@ import React from "react";
 import {singleEntryToHAR} from "./utils";
 import styles from './style/HarEntryDetailed.module.sass';
 import HAREntryViewer from "./HarEntryViewer/HAREntryViewer";
+import GenericEntryViewer from "./HarEntryViewer/GenericEntryViewer";
 import {makeStyles} from "@material-ui/core";
 import StatusCode from "./StatusCode";
 import {EndpointPath} from "./EndpointPath";
@@ -46,7 +47,28 @@ const HarEntryTitle: React.FC<any> = ({har}) => {
     </div>;
 };
 
+const GenericEntryTitle: React.FC<any> = ({entry}) => {
+    const classes = useStyles();
+
+    return <div className={classes.entryTitle}>
+        <div style={{flexGrow: 1, overflow: 'hidden'}}>
+            <EndpointPath method={entry.method} path={entry.path}/>
+        </div>
+        <div style={{margin: "0 24px", opacity: 0.5}}>{entry.protocol?.toUpperCase()}</div>
+        <div style={{marginRight: 24, opacity: 0.5}}>{entry.status} {entry.statusText}</div>
+        <div style={{opacity: 0.5}}>{Math.round(entry.time)}ms</div>
+    </div>;
+};
+
 export const HAREntryDetailed: React.FC<HarEntryDetailedProps> = ({classes, harEntry}) => {
+    // Only the protocol-neutral entries of non-HTTP protocols carry a protocol field
+    if (harEntry?.protocol) {
+        return <>
+            <GenericEntryTitle entry={harEntry}/>
+            <GenericEntryViewer entry={harEntry} className={classes?.root ?? styles.har}/>
+        </>
+    }
+
     const har = singleEntryToHAR(harEntry);
 
     return <>
@@ -0,0 +1,36 @@
+import React, {useState} from 'react';
+import styles from './HAREntryViewer.module.sass';
+import Tabs from "../Tabs";
+import {HAREntrySectionContainer} from "./HAREntrySections";
+import {SyntaxHighlighter} from "../SyntaxHighlighter/index";
+
+interface Props {
+    entry: any;
+    className?: string;
+}
+
+// Displays the protocol-neutral entries of non-HTTP protocols (Kafka, Redis, ...)
+const GenericEntryViewer: React.FC<Props> = ({entry, className}) => {
+    const TABS = [
+        {tab: 'request'},
+        {tab: 'response', disabled: !entry.response, disabledMessage: 'No response'},
+    ];
+
+    const [currentTab, setCurrentTab] = useState(TABS[0].tab);
+    const content = currentTab === TABS[0].tab ? entry.request : entry.response;
+
+    return <div className={`${className ? className : ''}`}>
+        <div className={styles.harEntry}>
+            <div className={styles.body}>
+                <div className={styles.bodyHeader}>
+                    <Tabs tabs={TABS} currentTab={currentTab} onChange={setCurrentTab} leftAligned/>
+                </div>
+                <HAREntrySectionContainer title={entry.protocol?.toUpperCase()}>
+                    <SyntaxHighlighter isWrapped={true} code={JSON.stringify(content, null, 2)} language="json"/>
+                </HAREntrySectionContainer>
+            </div>
+        </div>
+    </div>;
+};
+
+export default GenericEntryViewer;
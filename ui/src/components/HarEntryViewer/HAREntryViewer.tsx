@@ -31,7 +31,7 @@ const HAREntryDisplay: React.FC<any> = ({entry, isCollapsed: initialIsCollapsed,
 
                     <HAREntryTableSection title={'Cookies'} arrayToIterate={request.cookies}/>
 
-                    {request?.postData && <HAREntryBodySection content={request.postData} encoding={request.postData.comment} contentType={request.postData[MIME_TYPE_KEY]}/>}
+                    {request?.postData && <HAREntryBodySection content={request.postData} encoding={request.postData.encoding ?? request.postData.comment} contentType={request.postData[MIME_TYPE_KEY]}/>}
 
                     <HAREntryTableSection title={'Query'} arrayToIterate={request.queryString}/>
                 </React.Fragment>
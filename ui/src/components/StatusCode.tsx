@@ -31,4 +31,24 @@ export function getClassification(statusCode: number): string {
     return classification
 }
 
+// The names of the gRPC status codes, indexed by code
+const grpcStatusNames = ["OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+    "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL",
+    "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"];
+
+interface GrpcStatusCodeProps {
+    grpcStatus: number
+}
+
+export const GrpcStatusCode: React.FC<GrpcStatusCodeProps> = ({grpcStatus}) => {
+
+    const classification = getGrpcClassification(grpcStatus)
+
+    return <span className={`${styles[classification]} ${styles.base}`} title={grpcStatusNames[grpcStatus]}>{grpcStatus}</span>
+};
+
+export function getGrpcClassification(grpcStatus: number): string {
+    return grpcStatus === 0 ? StatusCodeClassification.SUCCESS : StatusCodeClassification.FAILURE;
+}
+
 export default StatusCode;